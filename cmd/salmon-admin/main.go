@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	salmonWeb "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/salmon"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/salmon"
+)
+
+const usage = `Usage: salmon-admin [flags] command [secret-id]
+
+Commands:
+  users             List users by trust level and suspicion.
+  subtree secret-id Show the invitation tree of the given user.
+  ban secret-id     Ban the given user.
+  unban secret-id   Unban the given user and forget their blocking events.
+  revoke secret-id  Ban the given user and everyone they invited.
+  invite            Issue an invite that turns its redeemer into an admin user.
+
+Flags:
+`
+
+// client talks to Salmon's admin API.
+type client struct {
+	apiUrl string
+	token  string
+}
+
+// request sends a request to the given endpoint of the admin API, and decodes
+// the JSON response into the given object.
+func (c *client) request(method, endpoint string, form url.Values, v interface{}) error {
+
+	var req *http.Request
+	var err error
+	if method == http.MethodGet {
+		req, err = http.NewRequest(method, c.apiUrl+endpoint+"?"+form.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, c.apiUrl+endpoint, strings.NewReader(form.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// printUsers prints the given users as a table.
+func printUsers(users []*salmon.UserInfo) {
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SECRET ID\tTRUST\tSUSPICION\tBANNED\tLOCATION\tINVITED\tPROXIES\tLIMIT HITS")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%.3f\t%s\t%s\t%d\t%d\t%d\n",
+			u.SecretId, trustString(u.Trust), u.Suspicion, banString(u), u.Location, u.NumInvited, u.NumProxies, u.LimitHits)
+	}
+	w.Flush()
+}
+
+// printTree prints the given invitation tree, indenting invitees by their
+// depth.
+func printTree(tree *salmon.UserTree, depth int) {
+
+	fmt.Printf("%s%s (trust %s, suspicion %.3f, %s)\n", strings.Repeat("  ", depth),
+		tree.SecretId, trustString(tree.Trust), tree.Suspicion, banString(tree.UserInfo))
+	for _, invitee := range tree.Invited {
+		printTree(invitee, depth+1)
+	}
+}
+
+// trustString returns a string representation of the given trust level.
+func trustString(trust salmon.Trust) string {
+	if trust == salmon.UntouchableTrustLevel {
+		return "admin"
+	}
+	return fmt.Sprintf("%d", trust)
+}
+
+// banString returns a string representation of the given user's ban state.
+func banString(u *salmon.UserInfo) string {
+	switch {
+	case u.BannedByAdmin:
+		return "banned by admin"
+	case u.Banned:
+		return "banned"
+	default:
+		return "not banned"
+	}
+}
+
+func main() {
+	var apiUrl, tokenFile string
+	flag.StringVar(&apiUrl, "api", "http://127.0.0.1:7500", "URL of Salmon's admin API.")
+	flag.StringVar(&tokenFile, "token-file", "", "File that contains your API token.  "+
+		"If empty, we take the token from the SALMON_ADMIN_TOKEN environment variable.")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	token := os.Getenv("SALMON_ADMIN_TOKEN")
+	if tokenFile != "" {
+		content, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token == "" {
+		log.Fatal("No API token provided.  Use -token-file or set SALMON_ADMIN_TOKEN.")
+	}
+	c := &client{apiUrl: strings.TrimSuffix(apiUrl, "/"), token: token}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	command := args[0]
+	var secretId string
+	switch command {
+	case "subtree", "ban", "unban", "revoke":
+		if len(args) != 2 {
+			log.Fatalf("Command %q takes exactly one secret ID.", command)
+		}
+		secretId = args[1]
+	case "users", "invite":
+		if len(args) != 1 {
+			log.Fatalf("Command %q takes no arguments.", command)
+		}
+	default:
+		log.Fatalf("Unknown command %q.", command)
+	}
+	form := url.Values{}
+	if secretId != "" {
+		form.Set("secret-id", secretId)
+	}
+
+	var err error
+	switch command {
+	case "users":
+		var users []*salmon.UserInfo
+		if err = c.request(http.MethodGet, "/admin/users", form, &users); err == nil {
+			printUsers(users)
+		}
+	case "subtree":
+		var tree salmon.UserTree
+		if err = c.request(http.MethodGet, "/admin/subtree", form, &tree); err == nil {
+			printTree(&tree, 0)
+		}
+	case "ban", "unban":
+		var result salmonWeb.BanResult
+		if err = c.request(http.MethodPost, "/admin/"+command, form, &result); err == nil {
+			fmt.Printf("User %s is now banned: %t\n", result.SecretId, result.Banned)
+		}
+	case "revoke":
+		var result salmonWeb.RevokeResult
+		if err = c.request(http.MethodPost, "/admin/revoke", form, &result); err == nil {
+			fmt.Printf("Revoked invitation tree with %d users.\n", result.NumRevoked)
+		}
+	case "invite":
+		var result salmonWeb.InviteResult
+		if err = c.request(http.MethodPost, "/admin/invite", form, &result); err == nil {
+			fmt.Printf("Give the following admin invite to a trusted party:\n%s\n", result.Token)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -5,4 +5,6 @@ go 1.14
 require (
 	github.com/prometheus/client_golang v1.8.0
 	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.27.1
 )
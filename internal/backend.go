@@ -2,34 +2,49 @@ package internal
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc64"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 )
 
 // BackendContext contains the state that our backend requires.
 type BackendContext struct {
 	Config    *Config
 	Resources core.BackendResources
-	rTestPool *ResourceTestPool
-	metrics   *Metrics
+	// rTestPools maps tester names to the pools that feed them.
+	rTestPools map[string]*ResourceTestPool
+	metrics    *Metrics
+	// statusLimiter rate-limits lookups on our status page.  If nil, lookups
+	// aren't rate-limited.
+	statusLimiter *rateLimiter
+	// trustedProxies contains the addresses of the reverse proxies whose
+	// X-Forwarded-For header our status page believes.
+	trustedProxies []net.IP
 }
 
+// errSubscriberOverflow is returned when a distributor fails to keep up with
+// our resource updates.
+var errSubscriberOverflow = errors.New("distributor is too slow")
+
 // metricsWrapper keeps track of the number of times each of our API endpoints
 // is called.
 func metricsWrapper(f http.HandlerFunc, endpoint string, metrics *Metrics) http.HandlerFunc {
@@ -39,9 +54,8 @@ func metricsWrapper(f http.HandlerFunc, endpoint string, metrics *Metrics) http.
 	}
 }
 
-// startWebApi starts our Web server.
-func (b *BackendContext) startWebApi(cfg *Config, srv *http.Server) {
-	log.Printf("Starting Web API at %s.", cfg.Backend.WebApi.ApiAddress)
+// newApiHandler returns the HTTP handler that serves our API endpoints.
+func (b *BackendContext) newApiHandler(cfg *Config) http.Handler {
 
 	mux := http.NewServeMux()
 	endpoints := map[string]http.HandlerFunc{
@@ -54,18 +68,39 @@ func (b *BackendContext) startWebApi(cfg *Config, srv *http.Server) {
 	for endpoint, handler := range endpoints {
 		mux.Handle(endpoint, metricsWrapper(handler, endpoint, b.metrics))
 	}
-	srv.Handler = mux
+	return mux
+}
+
+// startWebApi starts our Web server.
+func (b *BackendContext) startWebApi(cfg *Config, srv *http.Server) {
+	log.Printf("Starting Web API at %s.", cfg.Backend.WebApi.ApiAddress)
+
+	srv.Handler = b.newApiHandler(cfg)
 	srv.Addr = cfg.Backend.WebApi.ApiAddress
 
 	var err error
 	if cfg.Backend.WebApi.CertFile != "" && cfg.Backend.WebApi.KeyFile != "" {
-		err = srv.ListenAndServeTLS(cfg.Backend.WebApi.CertFile, cfg.Backend.WebApi.KeyFile)
+		if srv.TLSConfig, err = cfg.Backend.WebApi.tlsConfig(); err != nil {
+			log.Fatalf("Failed to load TLS configuration of Web API: %s", err)
+		}
+		// Our TLS configuration already contains our certificate.
+		err = srv.ListenAndServeTLS("", "")
 	} else {
 		err = srv.ListenAndServe()
 	}
 	log.Printf("Web API shut down: %s", err)
 }
 
+// startUnixApi makes our API available over the given Unix domain socket
+// listener.
+func (b *BackendContext) startUnixApi(cfg *Config, srv *http.Server, l net.Listener) {
+	log.Printf("Starting Unix domain socket API at %s.", cfg.Backend.UnixSocket.Path)
+
+	srv.Handler = b.newApiHandler(cfg)
+	err := srv.Serve(l)
+	log.Printf("Unix domain socket API shut down: %s", err)
+}
+
 // stopWebApi stops our Web server.
 func (b *BackendContext) stopWebApi(srv *http.Server) {
 	// Give our Web server five seconds to shut down.
@@ -93,30 +128,78 @@ func (b *BackendContext) InitBackend(cfg *Config) {
 	}
 	b.Resources = *core.NewBackendResources(rTypes, BuildStencil(cfg.Backend.DistProportions))
 	b.metrics = InitMetrics()
+	b.statusLimiter = newStatusLimiter(cfg.Backend.StatusPage)
+	prometheus.MustRegister(NewQueueCollector(b.Resources.QueueStats))
 
-	b.rTestPool = NewResourceTestPool(cfg.Backend.BridgestrapEndpoint)
-	defer b.rTestPool.Stop()
+	var err error
+	if b.trustedProxies, err = ParseTrustedProxies(cfg.Backend.StatusPage.TrustedProxies); err != nil {
+		log.Fatalf("Invalid status page configuration: %s", err)
+	}
+	if b.rTestPools, err = newTestPools(&cfg.Backend, rTypes, b.metrics); err != nil {
+		log.Fatalf("Failed to set up resource testers: %s", err)
+	}
+	for _, p := range b.rTestPools {
+		defer p.Stop()
+	}
 	for _, rType := range rTypes {
-		b.Resources.Collection[rType].TestFunc = b.rTestPool.GetTestFunc()
+		name := cfg.Backend.testerName(rType)
+		log.Printf("Testing %q resources with %q tester.", rType, name)
+		b.Resources.Collection[rType].TestFunc = b.rTestPools[name].GetTestFunc()
+	}
+	retester, err := NewRetestScheduler(&b.Resources, cfg.Backend.Retest)
+	if err != nil {
+		log.Fatalf("Failed to set up re-testing scheduler: %s", err)
 	}
+	prometheus.MustRegister(NewRetestCollector(retester.Stats))
+	retester.Start()
+	defer retester.Stop()
 
 	quit := make(chan bool)
 
 	var wg sync.WaitGroup
 	ready := make(chan bool, 1)
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 		InitKraken(cfg, quit, ready, b)
 	}()
 
 	var srv http.Server
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 		b.startWebApi(cfg, &srv)
 	}()
 
+	var unixSrv http.Server
+	if cfg.Backend.UnixSocket.Path != "" {
+		l, err := listenUnix(cfg.Backend.UnixSocket)
+		if err != nil {
+			log.Fatalf("Failed to listen on Unix domain socket: %s", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.startUnixApi(cfg, &unixSrv, l)
+		}()
+	}
+
+	var grpcSrv *grpc.Server
+	if cfg.Backend.Grpc.ApiAddress != "" {
+		if grpcSrv, err = b.newGrpcServer(cfg); err != nil {
+			log.Fatalf("Failed to create gRPC API: %s", err)
+		}
+		l, err := net.Listen("tcp", cfg.Backend.Grpc.ApiAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC API: %s", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.startGrpcApi(grpcSrv, l)
+		}()
+	}
+
 	// Wait until our data kraken parsed our bridge descriptors.
 	<-ready
 	log.Println("Kraken finished parsing bridge descriptors.")
@@ -128,6 +211,12 @@ func (b *BackendContext) InitBackend(cfg *Config) {
 	log.Println("Received SIGINT.")
 	close(quit)
 	b.stopWebApi(&srv)
+	b.stopWebApi(&unixSrv)
+	if grpcSrv != nil {
+		// Our resource streams never end, so there's no point in stopping
+		// gracefully.
+		grpcSrv.Stop()
+	}
 
 	// Wait for goroutines to finish.
 	wg.Wait()
@@ -162,42 +251,90 @@ func extractResourceRequest(w http.ResponseWriter, r *http.Request) (*core.Resou
 // writes an error to the given ResponseWriter and returns false.
 func (b *BackendContext) isAuthenticated(w http.ResponseWriter, r *http.Request) bool {
 
+	_, ok := b.authenticate(w, r)
+	return ok
+}
+
+// authenticate determines the name of the distributor that sent the given
+// HTTP request.  If our Web API verifies client certificates, distributors
+// that talk to it are identified by their certificate; otherwise by their
+// bearer token.  Requests that arrive over our Unix domain socket don't use
+// TLS and are therefore always identified by their bearer token.  If
+// authentication fails, the function writes an error to the given
+// ResponseWriter and returns false.
+func (b *BackendContext) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+
+	if b.Config.Backend.WebApi.ClientCAFile != "" && r.TLS != nil {
+		distName, err := b.certIdentity(r.TLS)
+		if err != nil {
+			log.Printf("Failed to authenticate %s by its certificate: %s", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return "", false
+		}
+		return distName, true
+	}
+
 	// First, we take the bearer token from the 'Authorization' HTTP header.
 	tokenLine := r.Header.Get("Authorization")
 	if tokenLine == "" {
 		log.Printf("Request carries no 'Authorization' HTTP header.")
 		http.Error(w, "request carries no 'Authorization' HTTP header", http.StatusBadRequest)
-		return false
+		return "", false
 	}
 	if !strings.HasPrefix(tokenLine, "Bearer ") {
 		log.Printf("Authorization header contains no bearer token.")
 		http.Error(w, "authorization header contains no bearer token", http.StatusBadRequest)
-		return false
+		return "", false
 	}
 	fields := strings.Split(tokenLine, " ")
 	givenToken := fields[1]
 
-	// Do we have the given token on record?
-	for _, savedToken := range b.Config.Backend.ApiTokens {
-		if givenToken == savedToken {
-			return true
-		}
+	if distName, ok := b.tokenIdentity(givenToken); ok {
+		return distName, true
 	}
 	log.Printf("Invalid authentication token.")
 	http.Error(w, "invalid authentication token", http.StatusUnauthorized)
 
-	return false
+	return "", false
+}
+
+// isAuthorized returns true if the given distributor is allowed to make the
+// given resource request, i.e. if it doesn't ask for another distributor's
+// resources.  If not, it writes an error to the given ResponseWriter.
+func isAuthorized(w http.ResponseWriter, distName string, req *core.ResourceRequest) bool {
+
+	if req.RequestOrigin != distName {
+		log.Printf("Distributor %q asked for resources of distributor %q.", distName, req.RequestOrigin)
+		http.Error(w, "request origin doesn't match authenticated distributor", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// tokenIdentity returns the name of the distributor that the given bearer token
+// belongs to, and false if we don't have the token on record.
+func (b *BackendContext) tokenIdentity(givenToken string) (string, bool) {
+
+	for distName, savedToken := range b.Config.Backend.ApiTokens {
+		if subtle.ConstantTimeCompare([]byte(givenToken), []byte(savedToken)) == 1 {
+			return distName, true
+		}
+	}
+	return "", false
 }
 
 func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !b.isAuthenticated(w, r) {
+	distName, ok := b.authenticate(w, r)
+	if !ok {
 		return
 	}
 
 	req, err := extractResourceRequest(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isAuthorized(w, distName, req) {
 		return
 	}
 
@@ -207,139 +344,83 @@ func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	// Distributors that don't ask for a specific stream format get our
+	// legacy format.
+	sw := mechanisms.NewStreamWriter(w, mechanisms.NegotiateStreamFormat(r.Header.Get("Accept")))
+
+	// Clients of Server-Sent Events resume a stream by setting the
+	// Last-Event-ID header, which carries the last sequence number.
+	if lastEventID := r.Header.Get("Last-Event-ID"); req.LastSequence == 0 && lastEventID != "" {
+		if seq, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+			req.LastSequence = seq
+		} else {
+			log.Printf("Ignoring invalid Last-Event-ID header %q.", lastEventID)
+		}
+	}
+
 	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", sw.ContentType())
+	if sw.ContentType() == mechanisms.ContentTypeSSE {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
 	w.WriteHeader(http.StatusOK)
 
-	diffs := make(chan *core.ResourceDiff)
-	b.Resources.RegisterChan(req, diffs)
-	defer b.Resources.UnregisterChan(req.RequestOrigin, diffs)
-	defer close(diffs)
-
 	sendDiff := func(diff *core.ResourceDiff) error {
-		jsonBlurb, err := json.MarshalIndent(diff, "", "    ")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return err
-		}
-
-		if _, err := fmt.Fprintf(w, string(jsonBlurb)); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := sw.WriteDiff(diff); err != nil {
 			return err
 		}
-		fmt.Fprintf(w, "\r") // delimiter
 		flusher.Flush()
 		return nil
 	}
 
-	resourceMap := b.processResourceRequest(req)
-	log.Printf("Sending distributor initial batch: %s", resourceMap)
-	if err := sendDiff(&core.ResourceDiff{New: resourceMap}); err != nil {
-		log.Printf("Error sending initial diff to distributor: %s.", err)
-	}
-
 	log.Printf("Entering streaming loop for %s.", r.RemoteAddr)
-	for {
-		select {
-		// Is our HTTP connection done?
-		case <-r.Context().Done():
-			log.Printf("Exiting streaming loop for %s.", r.RemoteAddr)
-			// Consume remaining hashring differences.
-			for {
-				select {
-				case diff := <-diffs:
-					log.Printf("Sending remaining hashring diff.")
-					sendDiff(diff)
-				default:
-					return
-				}
-			}
-		case diff := <-diffs:
-			if err := sendDiff(diff); err != nil {
-				log.Printf("Error sending diff to distributor: %s.", err)
-				break
-			}
-		}
-	}
+	b.streamDiffs(r.Context(), req, sendDiff)
+	log.Printf("Exiting streaming loop for %s.", r.RemoteAddr)
 }
 
-func (b *BackendContext) statusHandler(w http.ResponseWriter, r *http.Request) {
+// streamDiffs subscribes to the resource updates that the given request asks
+// for and passes them to the given send function, until either the given
+// context is done, sending fails, or the distributor fails to keep up.  The
+// function returns the reason why it stopped.
+func (b *BackendContext) streamDiffs(ctx context.Context, req *core.ResourceRequest, send func(*core.ResourceDiff) error) error {
 
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "failed to parse parameters", http.StatusBadRequest)
-		return
-	}
+	// Our subscriber's queue starts out with either the diffs that the
+	// distributor missed, or a snapshot of all of its resources, depending
+	// on the distributor's last sequence number.
+	subscriber := b.Resources.Subscribe(req)
+	defer b.Resources.Unsubscribe(req.RequestOrigin, subscriber)
 
-	id := r.FormValue("id")
-	if id == "" {
-		http.Error(w, "no 'id' parameter given", http.StatusBadRequest)
-		return
-	}
-	id = strings.TrimSpace(id)
-	id = strings.ToUpper(id)
-
-	var result []string
-	result = append(result, fmt.Sprintf("Bridge %s advertises:\n\n", id))
-
-	// Iterate over each resource type that contains the given UID and add it
-	// to the final result.
-	foundResource := false
-	table := crc64.MakeTable(resources.Crc64Polynomial)
-	statuses := []string{"not yet tested", "functional", "dysfunctional"}
-	for rType, _ := range resources.ResourceMap {
-		sHashring, exists := b.Resources.Collection[rType]
-		if !exists {
-			continue
-		}
-
-		key := core.Hashkey(crc64.Checksum([]byte(rType+id), table))
-		resource, err := sHashring.GetExact(key)
-		if err != nil {
-			// We may have been given a non-hashed fingerprint.  Let's try to
-			// hash it, and see if we get a result.
-			hId, err := resources.HashFingerprint(id)
-			if err != nil {
-				continue
+	for {
+		for diff := subscriber.Pop(); diff != nil; diff = subscriber.Pop() {
+			if diff.FullUpdate {
+				log.Printf("Sending distributor snapshot: %s", diff.New)
 			}
-			key := core.Hashkey(crc64.Checksum([]byte(rType+hId), table))
-			resource, err = sHashring.GetExact(key)
-			if err != nil {
-				continue
+			if err := send(diff); err != nil {
+				log.Printf("Error sending diff to distributor: %s.", err)
+				return err
 			}
 		}
-		foundResource = true
 
-		rResult := fmt.Sprintf("* %s: %s\n", rType, statuses[resource.Test().State])
-		if resource.Test().Error != "" {
-			rResult += fmt.Sprintf("  Error: %s\n", resource.Test().Error)
-		}
-		if resource.Test().State != core.StateUntested {
-			lastTested := resource.Test().LastTested
-			tDiff := time.Now().UTC().Sub(lastTested)
-			rResult += fmt.Sprintf("  Last tested: %s (%s ago)\n", lastTested, tDiff)
+		select {
+		// Is our connection done?  There's no need to send the remaining
+		// diffs because the distributor will ask for them when reconnecting.
+		case <-ctx.Done():
+			return ctx.Err()
+		// Did the distributor fail to keep up with our diffs?  If so, we
+		// close the connection.  The distributor will get a snapshot once it
+		// reconnects.
+		case <-subscriber.Done():
+			log.Printf("Distributor %q is too slow.  Closing connection.", req.RequestOrigin)
+			return errSubscriberOverflow
+		case <-subscriber.Ready():
 		}
-		result = append(result, rResult+"\n")
-	}
-	if !foundResource {
-		http.Error(w, "no resources for the given id", http.StatusNotFound)
-	} else {
-		fmt.Fprintf(w, strings.Join(result, ""))
 	}
 }
 
-func (b *BackendContext) processResourceRequest(req *core.ResourceRequest) core.ResourceMap {
-
-	resources := make(core.ResourceMap)
-	for _, rType := range req.ResourceTypes {
-		resources[rType] = b.Resources.Get(req.RequestOrigin, rType)
-	}
-
-	return resources
-}
-
 func (b *BackendContext) getResourcesHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !b.isAuthenticated(w, r) {
+	distName, ok := b.authenticate(w, r)
+	if !ok {
 		return
 	}
 
@@ -347,12 +428,16 @@ func (b *BackendContext) getResourcesHandler(w http.ResponseWriter, r *http.Requ
 	if err != nil {
 		return
 	}
+	if !isAuthorized(w, distName, req) {
+		return
+	}
 	log.Printf("Distributor %q is asking for %q.", req.RequestOrigin, req.ResourceTypes)
 
 	var resources []core.Resource
 	for _, rType := range req.ResourceTypes {
 		resources = append(resources, b.Resources.Get(req.RequestOrigin, rType)...)
 	}
+	resources = req.FilterByScore(resources)
 	log.Printf("Returning %d resources of type %s to distributor %q.",
 		len(resources), req.ResourceTypes, req.RequestOrigin)
 
@@ -2,12 +2,15 @@ package internal
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 func TestAuthentication(t *testing.T) {
@@ -15,7 +18,7 @@ func TestAuthentication(t *testing.T) {
 	b := BackendContext{}
 	tokens := make(map[string]string)
 	tokens["https"] = "8M4WSTrhwatWYGDWJw1OtS2cDXYfJtAetCcaFP94lYo="
-	b.Config = &Config{BackendConfig{ApiTokens: tokens}, Distributors{}}
+	b.Config = &Config{Backend: BackendConfig{ApiTokens: tokens}}
 
 	rr := httptest.NewRecorder()
 	r := &http.Request{}
@@ -86,3 +89,52 @@ func TestPostResourcesHandler(t *testing.T) {
 		t.Errorf("expected HTTP return code 400 but got %d", rr.Code)
 	}
 }
+
+// newScoredBridge returns a test bridge whose test history contains the given
+// number of functional and dysfunctional results.
+func newScoredBridge(num, functional, dysfunctional int) *resources.Bridge {
+
+	b := newTestBridge(num, "1.2.3.4")
+	// Each test needs its own time, or it doesn't make it into the history.
+	when := time.Now().UTC().Add(-time.Duration(functional+dysfunctional) * time.Minute)
+	for i := 0; i < dysfunctional; i++ {
+		b.Test().Record(core.StateDysfunctional, when, "timeout")
+		when = when.Add(time.Minute)
+	}
+	for i := 0; i < functional; i++ {
+		b.Test().Record(core.StateFunctional, when, "")
+		when = when.Add(time.Minute)
+	}
+	return b
+}
+
+func TestGetResourcesMinScore(t *testing.T) {
+
+	b := newTestBackend([]string{"vanilla"})
+	b.Resources.Add(newScoredBridge(1, 4, 0))
+	b.Resources.Add(newScoredBridge(2, 1, 3))
+
+	getResources := func(minScore float64) []json.RawMessage {
+		body := fmt.Sprintf(`{"request_origin": %q, "resource_types": ["vanilla"], "min_score": %f}`,
+			testDistName, minScore)
+		req := httptest.NewRequest("GET", testGetPath, strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer "+testToken)
+		rr := httptest.NewRecorder()
+		b.getResourcesHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+		}
+		var rs []json.RawMessage
+		if err := json.Unmarshal(rr.Body.Bytes(), &rs); err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}
+
+	if rs := getResources(0); len(rs) != 2 {
+		t.Errorf("expected 2 resources without minimum score but got %d", len(rs))
+	}
+	if rs := getResources(0.5); len(rs) != 1 {
+		t.Errorf("expected 1 resource with minimum score 0.5 but got %d", len(rs))
+	}
+}
@@ -15,6 +15,9 @@ import (
 type Config struct {
 	Backend      BackendConfig `json:"backend"`
 	Distributors Distributors  `json:"distributors"`
+	// Filename is the file that LoadConfig loaded the configuration from, so
+	// we can reload it.
+	Filename string `json:"-"`
 }
 
 type BackendConfig struct {
@@ -26,6 +29,19 @@ type BackendConfig struct {
 	StatusEndpoint         string            `json:"web_endpoint_status"`
 	MetricsEndpoint        string            `json:"web_endpoint_metrics"`
 	BridgestrapEndpoint    string            `json:"bridgestrap_endpoint"`
+	// ResourceTesters maps resource types to the name of the tester that
+	// tests them, e.g. "tcp".  Resource types that aren't listed are tested
+	// by DefaultTester.
+	ResourceTesters map[string]string `json:"resource_testers"`
+	// Testers maps tester names to their parameters.  The bridgestrap
+	// tester's endpoint defaults to BridgestrapEndpoint.
+	Testers map[string]json.RawMessage `json:"testers"`
+	// Retest determines how often we re-test resources that we already
+	// tested.
+	Retest RetestConfig `json:"retest"`
+	// StatusPage configures the page that tells bridge operators about
+	// their bridge's status.
+	StatusPage StatusPageConfig `json:"status_page"`
 	// DistProportions contains the proportion of resources that each
 	// distributor should get.  E.g. if the HTTPS distributor is set to x and
 	// the Salmon distributor is set to y, then HTTPS gets x/(x+y) of all
@@ -33,6 +49,87 @@ type BackendConfig struct {
 	DistProportions    map[string]int `json:"distribution_proportions"`
 	SupportedResources []string       `json:"supported_resources"`
 	WebApi             WebApiConfig   `json:"web_api"`
+	// UnixSocket makes the backend's API available over a Unix domain socket,
+	// in addition to WebApi.
+	UnixSocket UnixSocketConfig `json:"unix_socket"`
+	// Grpc makes the backend's API available over gRPC, in addition to
+	// WebApi.
+	Grpc GrpcConfig `json:"grpc"`
+}
+
+// GrpcConfig configures the backend's gRPC API.  The API requires mutual TLS,
+// i.e. distributors must present a client certificate that was signed by one
+// of the CAs in ClientCAFile.
+type GrpcConfig struct {
+	// ApiAddress is the address that the gRPC API listens on, e.g.
+	// "127.0.0.1:7101".  If empty, the backend doesn't offer a gRPC API.
+	ApiAddress   string `json:"api_address"`
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// TLSClientConfig configures how a distributor authenticates itself to the
+// backend, and how it authenticates the backend.
+type TLSClientConfig struct {
+	// CAFile contains the CA certificates that the backend's certificate
+	// must be signed by.
+	CAFile   string `json:"ca_file"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// PinnedCerts contains the SHA-256 fingerprints of the backend
+	// certificates that we accept, e.g. "AB:CD:...".  If set, the backend's
+	// certificate must be one of them.
+	PinnedCerts []string `json:"pinned_certs"`
+}
+
+// RetestConfig configures our re-testing scheduler.  Durations are strings
+// like "6h"; empty values and a zero budget fall back to our defaults.
+type RetestConfig struct {
+	// FunctionalInterval determines how often we re-test functional
+	// resources.
+	FunctionalInterval string `json:"functional_interval"`
+	// DysfunctionalMinInterval determines how long we wait before re-testing
+	// a resource that failed its test.  The wait time doubles with each
+	// consecutive failure, up to DysfunctionalMaxInterval.
+	DysfunctionalMinInterval string `json:"dysfunctional_min_interval"`
+	DysfunctionalMaxInterval string `json:"dysfunctional_max_interval"`
+	// TestsPerMinute caps the number of re-tests across all resource types,
+	// so we don't overload our testers.
+	TestsPerMinute int `json:"tests_per_minute"`
+}
+
+// StatusPageConfig configures our bridge status page.  Lookups are rate-limited
+// per client and globally, so the page cannot be used to enumerate bridges.
+// Zero values fall back to our defaults.
+type StatusPageConfig struct {
+	// LookupsPerMinute is the number of lookups that a single client IP
+	// address may make per minute.
+	LookupsPerMinute int `json:"lookups_per_minute"`
+	// GlobalLookupsPerMinute is the number of lookups that all clients
+	// together may make per minute.
+	GlobalLookupsPerMinute int `json:"global_lookups_per_minute"`
+	// TrustedProxies contains the IP addresses of the reverse proxies in
+	// front of our status page.  We only believe the X-Forwarded-For header
+	// of requests that come from these proxies, which must append the
+	// client's address to the header.
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// UnixSocketConfig configures the Unix domain socket that distributors can use
+// to talk to the backend.  Access to the socket is restricted by its file
+// permissions and by the user IDs of connecting processes.
+type UnixSocketConfig struct {
+	// Path is the file system path of the socket.  If empty, the backend
+	// doesn't listen on a Unix domain socket.
+	Path string `json:"path"`
+	// Mode contains the socket's file permissions in octal notation, e.g.
+	// "0660".  If empty, it defaults to DefaultUnixSocketMode.
+	Mode string `json:"mode"`
+	// AllowedUids contains the user IDs of processes that may connect to the
+	// socket.  If empty, only processes that run as the same user as the
+	// backend may connect.
+	AllowedUids []int `json:"allowed_uids"`
 }
 
 type Distributors struct {
@@ -42,25 +139,149 @@ type Distributors struct {
 }
 
 type StubDistConfig struct {
-	Resources []string     `json:"resources"`
-	WebApi    WebApiConfig `json:"web_api"`
+	Resources []string        `json:"resources"`
+	WebApi    WebApiConfig    `json:"web_api"`
+	Ipc       string          `json:"ipc"`
+	Tls       TLSClientConfig `json:"tls"`
 }
 
 type HttpsDistConfig struct {
-	Resources []string     `json:"resources"`
-	WebApi    WebApiConfig `json:"web_api"`
+	Resources []string        `json:"resources"`
+	WebApi    WebApiConfig    `json:"web_api"`
+	Ipc       string          `json:"ipc"`
+	Tls       TLSClientConfig `json:"tls"`
 }
 
 type SalmonDistConfig struct {
-	Resources  []string     `json:"resources"`
-	WebApi     WebApiConfig `json:"web_api"`
-	WorkingDir string       `json:"working_dir"` // This is where Salmon stores its state.
+	Resources  []string        `json:"resources"`
+	WebApi     WebApiConfig    `json:"web_api"`
+	Ipc        string          `json:"ipc"`
+	Tls        TLSClientConfig `json:"tls"`
+	WorkingDir string          `json:"working_dir"` // This is where Salmon stores its state.
+	// Registration lets users sign up without an invite.
+	Registration SalmonRegistrationConfig `json:"registration"`
+	// Redemption rate-limits the redemption of invites.
+	Redemption SalmonRedemptionConfig `json:"redemption"`
+	// Params tunes Salmon's trust and suspicion mechanisms.
+	Params SalmonParamsConfig `json:"params"`
+	// GeoipFile and Geoip6File point to Tor's geoip databases, which let us
+	// infer the location of users who don't tell us where they are.
+	GeoipFile  string `json:"geoip_file"`
+	Geoip6File string `json:"geoip6_file"`
+	// TrustedProxies contains the IP addresses of the reverse proxies in
+	// front of Salmon.  We only believe the X-Forwarded-For header of
+	// requests that come from these proxies, which must append the client's
+	// address to the header.  Otherwise, a client's address is the address
+	// that its connection comes from.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Admin lets operators inspect and change Salmon's state.
+	Admin SalmonAdminConfig `json:"admin"`
+}
+
+// SalmonAdminConfig configures Salmon's admin API.  The API has its own Web
+// server, so operators can keep it off the Internet, e.g. by having it listen
+// on a loopback address.
+type SalmonAdminConfig struct {
+	// WebApi configures the admin API's Web server.  If its address is empty,
+	// Salmon doesn't offer an admin API.
+	WebApi WebApiConfig `json:"web_api"`
+	// ApiTokens maps operator names to the bearer tokens that they
+	// authenticate with.
+	ApiTokens map[string]string `json:"api_tokens"`
+	// AuditLog is the file that we write all admin actions to.
+	AuditLog string `json:"audit_log"`
+}
+
+// SalmonParamsConfig tunes Salmon's trust and suspicion mechanisms.  Zero
+// values fall back to the defaults that the Salmon paper suggests.
+type SalmonParamsConfig struct {
+	// MaxSuspicion is the suspicion at which we ban users.  The paper calls
+	// this threshold "T".
+	MaxSuspicion float64 `json:"max_suspicion"`
+	// MaxTrustLevel is the highest trust level that users can get promoted
+	// to, and the level that users need to issue invites.  The paper calls
+	// this level "L".
+	MaxTrustLevel int `json:"max_trust_level"`
+	// PromotionDays contains, for each trust level n below MaxTrustLevel, the
+	// number of days after which we promote a user from level n to n+1.  By
+	// default, this takes 2^{n+1} days.
+	PromotionDays []int `json:"promotion_days"`
+	// InvitationTokenExpiry is a duration like "168h".
+	InvitationTokenExpiry string `json:"invitation_token_expiry"`
+	// MaxClients is the number of users that may share a proxy.
+	MaxClients int `json:"max_clients"`
+	// ProxiesPerUser is the number of proxies that we hand out to each user.
+	ProxiesPerUser int `json:"proxies_per_user"`
+	// MaxReplacements is the number of blocked proxies that we replace per
+	// user within ReplacementWindow, a duration like "720h".  Unlike our
+	// other parameters, zero is a valid setting, which turns off
+	// replacements, so we tell it apart from a missing setting by using a
+	// pointer.
+	MaxReplacements   *int   `json:"max_replacements"`
+	ReplacementWindow string `json:"replacement_window"`
+	// InviteQuotas contains, for each trust level n from 0 to MaxTrustLevel,
+	// the number of invites that a user at level n may issue within
+	// InviteWindow, a duration like "720h".  By default, only users at
+	// MaxTrustLevel may issue invites.
+	InviteQuotas []int  `json:"invite_quotas"`
+	InviteWindow string `json:"invite_window"`
+	// MaxInviteDepth is the maximum length of an invitation chain, i.e. the
+	// number of invites between a user and the root of the user's
+	// invitation tree.
+	MaxInviteDepth int `json:"max_invite_depth"`
+	// LimitHitInnocence is the probability of innocence that we assign to a
+	// user who exceeds one of our limits.
+	LimitHitInnocence float64 `json:"limit_hit_innocence"`
+	// ResourceParams overrides MaxClients and ProxiesPerUser per resource
+	// type.
+	ResourceParams map[string]SalmonResourceParams `json:"resource_params"`
+}
+
+// SalmonResourceParams contains Salmon's parameters for a resource type.
+type SalmonResourceParams struct {
+	MaxClients     int `json:"max_clients"`
+	ProxiesPerUser int `json:"proxies_per_user"`
+}
+
+const (
+	// These constants represent the admission controls that gate Salmon's
+	// open registration.
+	AdmissionPow     = "pow"
+	AdmissionCaptcha = "captcha"
+)
+
+// SalmonRegistrationConfig configures Salmon's open registration.  Users who
+// register have to pass our admission control first, i.e. solve a
+// proof-of-work puzzle or a CAPTCHA.  Registration is disabled if Admission is
+// empty.
+type SalmonRegistrationConfig struct {
+	Admission string `json:"admission"`
+	// PowDifficulty is the number of leading zero bits that a proof of work
+	// must have.
+	PowDifficulty int `json:"pow_difficulty"`
+	// PerDay is the number of users that may register per (UTC) day.
+	PerDay int `json:"registrations_per_day"`
+	// PoolShare is the percentage of new proxies that we set aside for
+	// registered users.  Registered users never get proxies from elsewhere.
+	PoolShare int `json:"pool_share"`
+}
+
+// SalmonRedemptionConfig rate-limits the redemption of invites per client IP
+// address and across all clients.  Zero values fall back to our defaults.
+type SalmonRedemptionConfig struct {
+	AttemptsPerMinute       int `json:"attempts_per_minute"`
+	GlobalAttemptsPerMinute int `json:"global_attempts_per_minute"`
 }
 
 type WebApiConfig struct {
 	ApiAddress string `json:"api_address"`
 	CertFile   string `json:"cert_file"`
 	KeyFile    string `json:"key_file"`
+	// ClientCAFile is only used by the backend.  If set, distributors must
+	// present a client certificate that was signed by one of the CAs in the
+	// file, and whose common name is the distributor's name.  Client
+	// certificates then replace bearer tokens.
+	ClientCAFile string `json:"client_ca_file"`
 }
 
 // LoadConfig loads the given JSON configuration file and returns the resulting
@@ -86,10 +307,155 @@ func LoadConfig(filename string) (*Config, error) {
 	if err = json.Unmarshal(content, &config); err != nil {
 		return nil, err
 	}
+	if err = config.validate(); err != nil {
+		return nil, err
+	}
+	config.Filename = filename
 
 	return &config, nil
 }
 
+// validate returns an error if the configuration contains values that we
+// cannot work with.
+func (cfg *Config) validate() error {
+
+	grpcCfg := cfg.Backend.Grpc
+	if grpcCfg.ApiAddress != "" && (grpcCfg.CertFile == "" || grpcCfg.KeyFile == "" || grpcCfg.ClientCAFile == "") {
+		return fmt.Errorf("backend's gRPC API requires certificate, key, and client CA file")
+	}
+
+	ipcs := map[string]string{
+		"https":  cfg.Distributors.Https.Ipc,
+		"salmon": cfg.Distributors.Salmon.Ipc,
+		"stub":   cfg.Distributors.Stub.Ipc,
+	}
+	tlsCfgs := map[string]TLSClientConfig{
+		"https":  cfg.Distributors.Https.Tls,
+		"salmon": cfg.Distributors.Salmon.Tls,
+		"stub":   cfg.Distributors.Stub.Tls,
+	}
+	for distName, ipc := range ipcs {
+		switch ipc {
+		case "", IpcHttps:
+		case IpcUnix:
+			if cfg.Backend.UnixSocket.Path == "" {
+				return fmt.Errorf("distributor %q uses Unix domain socket but backend has no socket path", distName)
+			}
+		case IpcGrpc:
+			if grpcCfg.ApiAddress == "" {
+				return fmt.Errorf("distributor %q uses gRPC but backend has no gRPC address", distName)
+			}
+			tlsCfg := tlsCfgs[distName]
+			if tlsCfg.CertFile == "" || tlsCfg.KeyFile == "" {
+				return fmt.Errorf("distributor %q uses gRPC but lacks certificate or key file", distName)
+			}
+			if tlsCfg.CAFile == "" && len(tlsCfg.PinnedCerts) == 0 {
+				return fmt.Errorf("distributor %q uses gRPC but has neither CA file nor pinned certificates", distName)
+			}
+		default:
+			return fmt.Errorf("distributor %q uses unsupported IPC mechanism %q", distName, ipc)
+		}
+	}
+
+	if _, err := cfg.Backend.UnixSocket.fileMode(); err != nil {
+		return err
+	}
+
+	if _, err := cfg.Backend.Retest.policy(); err != nil {
+		return err
+	}
+
+	statusPage := cfg.Backend.StatusPage
+	if statusPage.LookupsPerMinute < 0 || statusPage.GlobalLookupsPerMinute < 0 {
+		return fmt.Errorf("status page lookups per minute must not be negative")
+	}
+	if _, err := ParseTrustedProxies(statusPage.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid status page configuration: %s", err)
+	}
+
+	if err := cfg.Distributors.Salmon.Registration.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Distributors.Salmon.Admin.validate(); err != nil {
+		return err
+	}
+	if _, err := ParseTrustedProxies(cfg.Distributors.Salmon.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid salmon configuration: %s", err)
+	}
+
+	known := make(map[string]bool)
+	for _, name := range core.TesterNames() {
+		known[name] = true
+	}
+	for rType, name := range cfg.Backend.ResourceTesters {
+		if !known[name] {
+			return fmt.Errorf("resource type %q uses unknown tester %q", rType, name)
+		}
+	}
+	for name := range cfg.Backend.Testers {
+		if !known[name] {
+			return fmt.Errorf("configuration contains parameters for unknown tester %q", name)
+		}
+	}
+
+	webApi := cfg.Backend.WebApi
+	if webApi.ClientCAFile != "" && (webApi.CertFile == "" || webApi.KeyFile == "") {
+		return fmt.Errorf("backend can only verify client certificates if it serves TLS")
+	}
+	for distName, tlsCfg := range tlsCfgs {
+		for _, pin := range tlsCfg.PinnedCerts {
+			if _, err := parsePin(pin); err != nil {
+				return fmt.Errorf("distributor %q: %s", distName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if Salmon's registration configuration is invalid.
+func (cfg *SalmonRegistrationConfig) validate() error {
+
+	switch cfg.Admission {
+	case "":
+		return nil
+	case AdmissionPow:
+		if cfg.PowDifficulty <= 0 || cfg.PowDifficulty > 256 {
+			return fmt.Errorf("salmon's proof-of-work difficulty must be between 1 and 256 bits")
+		}
+	case AdmissionCaptcha:
+	default:
+		return fmt.Errorf("salmon uses unsupported admission control %q", cfg.Admission)
+	}
+	if cfg.PerDay <= 0 {
+		return fmt.Errorf("salmon's registration quota must be positive")
+	}
+	if cfg.PoolShare <= 0 || cfg.PoolShare > 100 {
+		return fmt.Errorf("salmon's registration pool share must be between 1 and 100 percent")
+	}
+	return nil
+}
+
+// validate returns an error if Salmon's admin API configuration is invalid.
+func (cfg *SalmonAdminConfig) validate() error {
+
+	if cfg.WebApi.ApiAddress == "" {
+		return nil
+	}
+	if len(cfg.ApiTokens) == 0 {
+		return fmt.Errorf("salmon's admin API needs at least one API token")
+	}
+	for operator, token := range cfg.ApiTokens {
+		if token == "" {
+			return fmt.Errorf("operator %q of salmon's admin API has an empty API token", operator)
+		}
+	}
+	if cfg.AuditLog == "" {
+		return fmt.Errorf("salmon's admin API needs an audit log")
+	}
+	return nil
+}
+
 // TODO: This function may belong somewhere else.
 // BuildIntervalChain turns the distributor proportions into an interval chain,
 // which helps us determine what distributor a given resource should map to.
@@ -104,7 +470,7 @@ func BuildStencil(proportions map[string]int) *core.Stencil {
 	stencil := &core.Stencil{}
 	i := 0
 	for _, k := range keys {
-		stencil.AddInterval(&core.Interval{i, i + proportions[k] - 1, k})
+		stencil.AddInterval(&core.Interval{Begin: i, End: i + proportions[k] - 1, Name: k})
 		i += proportions[k]
 	}
 	return stencil
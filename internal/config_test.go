@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+
+	cfg := &Config{}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("empty configuration is invalid: %s", err)
+	}
+
+	cfg.Distributors.Salmon.Ipc = IpcUnix
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted Unix domain socket without socket path")
+	}
+	cfg.Backend.UnixSocket.Path = "/run/rdsys/backend.sock"
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid Unix domain socket configuration: %s", err)
+	}
+
+	cfg.Backend.UnixSocket.Mode = "rw-rw----"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted invalid socket mode")
+	}
+	cfg.Backend.UnixSocket.Mode = "0660"
+
+	cfg.Distributors.Https.Ipc = "carrier-pigeon"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted unsupported IPC mechanism")
+	}
+	cfg.Distributors.Https.Ipc = ""
+
+	cfg.Distributors.Stub.Ipc = IpcGrpc
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted gRPC without backend address")
+	}
+	cfg.Backend.Grpc.ApiAddress = "127.0.0.1:7101"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted gRPC API without TLS configuration")
+	}
+	cfg.Backend.Grpc = GrpcConfig{
+		ApiAddress:   "127.0.0.1:7101",
+		CertFile:     "backend-cert.pem",
+		KeyFile:      "backend-key.pem",
+		ClientCAFile: "ca.pem",
+	}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted gRPC distributor without TLS configuration")
+	}
+	cfg.Distributors.Stub.Tls = TLSClientConfig{CAFile: "ca.pem", CertFile: "stub-cert.pem", KeyFile: "stub-key.pem"}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid gRPC configuration: %s", err)
+	}
+}
+
+func TestValidateTLSConfig(t *testing.T) {
+
+	cfg := &Config{}
+	cfg.Backend.WebApi.ClientCAFile = "ca.pem"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted client CA without Web API certificate")
+	}
+	cfg.Backend.WebApi.CertFile = "backend-cert.pem"
+	cfg.Backend.WebApi.KeyFile = "backend-key.pem"
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid Web API configuration: %s", err)
+	}
+
+	cfg.Distributors.Https.Tls.PinnedCerts = []string{"foo"}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted invalid certificate pin")
+	}
+	cfg.Distributors.Https.Tls.PinnedCerts = []string{strings.Repeat("AB:", 31) + "AB"}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid certificate pin: %s", err)
+	}
+}
+
+func TestValidateTesters(t *testing.T) {
+
+	cfg := &Config{}
+	cfg.Backend.ResourceTesters = map[string]string{"obfs4": "tcp", "vanilla": DefaultTester}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid tester configuration: %s", err)
+	}
+	cfg.Backend.ResourceTesters["meek"] = "carrier-pigeon"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted unknown tester")
+	}
+	delete(cfg.Backend.ResourceTesters, "meek")
+	cfg.Backend.Testers = map[string]json.RawMessage{"carrier-pigeon": nil}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted parameters for unknown tester")
+	}
+}
+
+func TestValidateRetest(t *testing.T) {
+
+	cfg := &Config{}
+	cfg.Backend.Retest = RetestConfig{FunctionalInterval: "6h", TestsPerMinute: 30}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid re-test configuration: %s", err)
+	}
+	cfg.Backend.Retest.DysfunctionalMaxInterval = "sometimes"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted invalid re-test interval")
+	}
+}
+
+func TestValidateStatusPage(t *testing.T) {
+
+	cfg := &Config{}
+	cfg.Backend.StatusPage = StatusPageConfig{LookupsPerMinute: 5}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid status page configuration: %s", err)
+	}
+	cfg.Backend.StatusPage.GlobalLookupsPerMinute = -1
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted negative number of lookups")
+	}
+}
+
+func TestValidateSalmonRegistration(t *testing.T) {
+
+	cfg := &Config{}
+	reg := &cfg.Distributors.Salmon.Registration
+	reg.Admission = AdmissionPow
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted proof of work without difficulty")
+	}
+	reg.PowDifficulty = 20
+	reg.PerDay = 100
+	reg.PoolShare = 20
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid registration configuration: %s", err)
+	}
+	reg.Admission = AdmissionCaptcha
+	reg.PoolShare = 101
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted pool share above 100 percent")
+	}
+	reg.Admission = "handshake"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted unknown admission control")
+	}
+}
+
+func TestValidateSalmonAdmin(t *testing.T) {
+
+	cfg := &Config{}
+	admin := &cfg.Distributors.Salmon.Admin
+	admin.WebApi.ApiAddress = "127.0.0.1:7500"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted admin API without API tokens")
+	}
+	admin.ApiTokens = map[string]string{"alice": ""}
+	admin.AuditLog = "/var/log/salmon-audit.log"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted empty API token")
+	}
+	admin.ApiTokens["alice"] = "secret"
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid admin API configuration: %s", err)
+	}
+	admin.AuditLog = ""
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted admin API without audit log")
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+
+	cfg := &Config{}
+	cfg.Backend.StatusPage.TrustedProxies = []string{"127.0.0.1"}
+	cfg.Distributors.Salmon.TrustedProxies = []string{"127.0.0.1", "::1"}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("rejected valid trusted proxies: %s", err)
+	}
+	cfg.Distributors.Salmon.TrustedProxies = []string{"localhost"}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted salmon trusted proxy that isn't an IP address")
+	}
+	cfg.Distributors.Salmon.TrustedProxies = nil
+	cfg.Backend.StatusPage.TrustedProxies = []string{"localhost"}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("accepted status page trusted proxy that isn't an IP address")
+	}
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// geoipRange maps a range of IP addresses to a country code.  Addresses are in
+// their 16-byte form, so IPv4 and IPv6 ranges can share one sorted slice.
+type geoipRange struct {
+	low, high   net.IP
+	countryCode string
+}
+
+// Geoip maps IP addresses to countries, using the geoip and geoip6 files that
+// ship with Tor.
+type Geoip struct {
+	ranges []geoipRange
+}
+
+// LoadGeoip loads the given geoip files.  Each line of a file contains a range
+// of addresses and its country code, e.g. "16777216,16777471,AU" for IPv4 and
+// "2001:200::,2001:200:ffff:ffff:ffff:ffff:ffff:ffff,JP" for IPv6.  Lines that
+// start with '#' are comments.
+func LoadGeoip(filenames ...string) (*Geoip, error) {
+
+	g := &Geoip{}
+	for _, filename := range filenames {
+		if err := g.load(filename); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(g.ranges, func(i, j int) bool {
+		return bytes.Compare(g.ranges[i].low, g.ranges[j].low) < 0
+	})
+	return g, nil
+}
+
+// load adds the ranges of the given geoip file to our database.
+func (g *Geoip) load(filename string) error {
+
+	fd, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected three fields but got %d", filename, lineNum, len(fields))
+		}
+		low, lowErr := parseGeoipAddr(fields[0])
+		high, highErr := parseGeoipAddr(fields[1])
+		if lowErr != nil || highErr != nil || bytes.Compare(low, high) > 0 {
+			return fmt.Errorf("%s:%d: invalid address range", filename, lineNum)
+		}
+		g.ranges = append(g.ranges, geoipRange{low, high, strings.ToUpper(fields[2])})
+	}
+	return scanner.Err()
+}
+
+// parseGeoipAddr parses the given address, which is either an IPv6 address
+// or an IPv4 address in its integer representation.
+func parseGeoipAddr(addr string) (net.IP, error) {
+
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.To16(), nil
+	}
+	n, err := strconv.ParseUint(addr, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(n))
+	return ip.To16(), nil
+}
+
+// CountryCode returns the country code of the given IP address, e.g. "RU", or
+// an empty string if the address isn't in our database.
+func (g *Geoip) CountryCode(ip net.IP) string {
+
+	ip = ip.To16()
+	if g == nil || ip == nil {
+		return ""
+	}
+	// Find the first range that starts after our address.  The range before
+	// it is the only one that may contain the address.
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].low, ip) > 0
+	})
+	if i == 0 {
+		return ""
+	}
+	if r := g.ranges[i-1]; bytes.Compare(ip, r.high) <= 0 {
+		return r.countryCode
+	}
+	return ""
+}
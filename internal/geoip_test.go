@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// writeGeoipFile writes the given content to a temporary file and returns its
+// name.
+func writeGeoipFile(t *testing.T, content string) string {
+
+	file, err := ioutil.TempFile("", "geoip")
+	if err != nil {
+		t.Fatalf("could not create temporary file: %s", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatalf("could not write temporary file: %s", err)
+	}
+	return file.Name()
+}
+
+func TestGeoip(t *testing.T) {
+
+	// 1.0.0.0-1.0.0.255 and 1.0.1.0-1.0.3.255.
+	geoip := writeGeoipFile(t, "# Comment\n16777216,16777471,AU\n16777472,16778239,cn\n")
+	defer os.Remove(geoip)
+	geoip6 := writeGeoipFile(t, "2001:200::,2001:200:ffff:ffff:ffff:ffff:ffff:ffff,JP\n")
+	defer os.Remove(geoip6)
+
+	g, err := LoadGeoip(geoip, geoip6)
+	if err != nil {
+		t.Fatalf("failed to load geoip files: %s", err)
+	}
+	expected := map[string]string{
+		"1.0.0.0":     "AU",
+		"1.0.0.255":   "AU",
+		"1.0.2.3":     "CN",
+		"1.0.4.0":     "",
+		"0.255.255.1": "",
+		"2001:200::1": "JP",
+		"2001:201::1": "",
+	}
+	for addr, cc := range expected {
+		if got := g.CountryCode(net.ParseIP(addr)); got != cc {
+			t.Errorf("expected country code %q for %s but got %q", cc, addr, got)
+		}
+	}
+
+	var empty *Geoip
+	if cc := empty.CountryCode(net.ParseIP("1.0.0.0")); cc != "" {
+		t.Errorf("expected no country code without database but got %q", cc)
+	}
+
+	invalid := writeGeoipFile(t, "16777472,16777216,AU\n")
+	defer os.Remove(invalid)
+	if _, err := LoadGeoip(invalid); err == nil {
+		t.Errorf("accepted invalid address range")
+	}
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms/rdsyspb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcBackend implements the gRPC service that's defined in rdsys.proto.
+type grpcBackend struct {
+	rdsyspb.UnimplementedBackendServer
+	b *BackendContext
+}
+
+// newGrpcServer returns a gRPC server that requires mutual TLS and serves our
+// API.
+func (b *BackendContext) newGrpcServer(cfg *Config) (*grpc.Server, error) {
+
+	tlsConfig, err := cfg.Backend.Grpc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	rdsyspb.RegisterBackendServer(srv, &grpcBackend{b: b})
+
+	return srv, nil
+}
+
+// startGrpcApi makes our gRPC API available over the given listener.
+func (b *BackendContext) startGrpcApi(srv *grpc.Server, l net.Listener) {
+	log.Printf("Starting gRPC API at %s.", l.Addr())
+
+	err := srv.Serve(l)
+	log.Printf("gRPC API shut down: %v", err)
+}
+
+// authenticate returns the name of the distributor that made the request with
+// the given context, and makes sure that the distributor only asks for its own
+// resources.  Distributors are identified by their client certificate if its
+// common name is the name of a distributor that we know; otherwise by their
+// bearer token.
+func (g *grpcBackend) authenticate(ctx context.Context, req *core.ResourceRequest) error {
+
+	distName := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			distName, _ = g.b.certIdentity(&tlsInfo.State)
+		}
+	}
+
+	if distName == "" {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok || len(md.Get("authorization")) == 0 {
+			return status.Error(codes.Unauthenticated, "request carries no authorization metadata")
+		}
+		tokenLine := md.Get("authorization")[0]
+		if !strings.HasPrefix(tokenLine, "Bearer ") {
+			return status.Error(codes.Unauthenticated, "authorization metadata contains no bearer token")
+		}
+		if distName, ok = g.b.tokenIdentity(strings.TrimPrefix(tokenLine, "Bearer ")); !ok {
+			log.Printf("Invalid authentication token.")
+			return status.Error(codes.Unauthenticated, "invalid authentication token")
+		}
+	}
+
+	if req.RequestOrigin != distName {
+		log.Printf("Distributor %q asked for resources of distributor %q.", distName, req.RequestOrigin)
+		return status.Error(codes.PermissionDenied, "request origin doesn't match authenticated distributor")
+	}
+	return nil
+}
+
+// StreamResources sends the requesting distributor its resources, followed by
+// resource updates.
+func (g *grpcBackend) StreamResources(pbReq *rdsyspb.ResourceRequest, stream rdsyspb.Backend_StreamResourcesServer) error {
+
+	req := mechanisms.RequestFromProto(pbReq)
+	if err := g.authenticate(stream.Context(), req); err != nil {
+		return err
+	}
+
+	sendDiff := func(diff *core.ResourceDiff) error {
+		pbDiff, err := mechanisms.DiffToProto(diff)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return stream.Send(pbDiff)
+	}
+
+	log.Printf("Entering gRPC streaming loop for distributor %q.", req.RequestOrigin)
+	err := g.b.streamDiffs(stream.Context(), req, sendDiff)
+	log.Printf("Exiting gRPC streaming loop for distributor %q.", req.RequestOrigin)
+
+	switch err {
+	case errSubscriberOverflow:
+		// The distributor will get a snapshot once it reconnects.
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	default:
+		return err
+	}
+}
+
+// GetResources returns the requesting distributor's resources.
+func (g *grpcBackend) GetResources(ctx context.Context, pbReq *rdsyspb.ResourceRequest) (*rdsyspb.ResourceList, error) {
+
+	req := mechanisms.RequestFromProto(pbReq)
+	if err := g.authenticate(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var rs []core.Resource
+	for _, rType := range req.ResourceTypes {
+		rs = append(rs, g.b.Resources.Get(req.RequestOrigin, rType)...)
+	}
+	rs = req.FilterByScore(rs)
+	log.Printf("Returning %d resources of type %s to distributor %q over gRPC.",
+		len(rs), req.ResourceTypes, req.RequestOrigin)
+
+	l, err := mechanisms.ResourcesToProto(rs)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return l, nil
+}
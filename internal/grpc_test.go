@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms/rdsyspb"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newTestGrpcBackend returns a backend whose gRPC API listens on a random
+// port, and the TLS configuration that our test distributor should use.  The
+// returned function stops the gRPC API.
+func newTestGrpcBackend(t *testing.T, pki *testPKI, rTypes []string) (*BackendContext, TLSClientConfig, func()) {
+
+	b := newTestBackend(rTypes)
+	certFile, keyFile := pki.IssueServer("backend")
+	b.Config.Backend.Grpc = GrpcConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: pki.CAFile,
+	}
+	srv, err := b.newGrpcServer(b.Config)
+	if err != nil {
+		t.Fatalf("failed to create gRPC server: %s", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Config.Backend.Grpc.ApiAddress = l.Addr().String()
+	go b.startGrpcApi(srv, l)
+
+	certFile, keyFile = pki.IssueClient(testDistName)
+	tlsCfg := TLSClientConfig{CAFile: pki.CAFile, CertFile: certFile, KeyFile: keyFile}
+
+	return b, tlsCfg, srv.Stop
+}
+
+func TestGrpcStream(t *testing.T) {
+
+	pki := newTestPKI(t)
+	defer pki.Remove()
+	rType := resources.ResourceTypeObfs4
+	b, tlsCfg, stop := newTestGrpcBackend(t, pki, []string{rType})
+	defer stop()
+
+	t1 := resources.NewTransport()
+	t1.SetType(rType)
+	t1.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.1.1.1")}}
+	t1.Port = 1111
+	t1.Parameters["cert"] = "foo"
+	b.Resources.Add(t1)
+
+	ipc, err := NewBackendIpc(b.Config, IpcGrpc, tlsCfg)
+	if err != nil {
+		t.Fatalf("failed to create gRPC IPC mechanism: %s", err)
+	}
+	rStream := make(chan *core.ResourceDiff)
+	req := &core.ResourceRequest{
+		RequestOrigin: testDistName,
+		ResourceTypes: []string{rType},
+		BearerToken:   testToken,
+		Receiver:      rStream,
+	}
+	ipc.StartStream(req)
+	defer ipc.StopStream()
+
+	diff := recvDiff(t, rStream)
+	if len(diff.New[rType]) != 1 {
+		t.Fatalf("expected 1 resource in initial batch but got: %s", diff)
+	}
+	if r := diff.New[rType][0]; r.Uid() != t1.Uid() || r.Oid() != t1.Oid() {
+		t.Errorf("resource got mangled over gRPC: %s", r)
+	}
+
+	t2 := resources.NewTransport()
+	t2.SetType(rType)
+	t2.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("2.2.2.2")}}
+	t2.Port = 2222
+	b.Resources.Add(t2)
+	if diff := recvDiff(t, rStream); len(diff.New[rType]) != 1 || diff.New[rType][0].Uid() != t2.Uid() {
+		t.Fatalf("expected diff with one new resource but got: %s", diff)
+	}
+
+	// One-shot requests go through the same connection.
+	var rs []core.Resource
+	if err := ipc.MakeJsonRequest(req, &rs); err != nil {
+		t.Fatalf("failed to get resources: %s", err)
+	}
+	if len(rs) != 2 {
+		t.Errorf("expected 2 resources but got %d", len(rs))
+	}
+}
+
+func TestGrpcAuthentication(t *testing.T) {
+
+	pki := newTestPKI(t)
+	defer pki.Remove()
+	rType := resources.ResourceTypeObfs4
+	b, tlsCfg, stop := newTestGrpcBackend(t, pki, []string{rType})
+	defer stop()
+
+	getResources := func(tlsConfig *tls.Config, token, origin string) error {
+		conn, err := grpc.Dial(b.Config.Backend.Grpc.ApiAddress,
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		_, err = rdsyspb.NewBackendClient(conn).GetResources(ctx, &rdsyspb.ResourceRequest{
+			RequestOrigin: origin,
+			ResourceTypes: []string{rType},
+		})
+		return err
+	}
+
+	// Our distributor's certificate is all it takes to identify it.
+	tlsConfig, err := tlsCfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getResources(tlsConfig, "", testDistName); err != nil {
+		t.Fatalf("valid request failed: %s", err)
+	}
+	if err := getResources(tlsConfig, "", "https"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected request for other distributor's resources to be rejected but got: %v", err)
+	}
+
+	// A certificate whose common name isn't a distributor's name requires a
+	// bearer token.
+	certFile, keyFile := pki.IssueClient("unknown")
+	unknownCfg := TLSClientConfig{CAFile: pki.CAFile, CertFile: certFile, KeyFile: keyFile}
+	if tlsConfig, err = unknownCfg.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := getResources(tlsConfig, testToken, testDistName); err != nil {
+		t.Fatalf("valid request with bearer token failed: %s", err)
+	}
+	if err := getResources(tlsConfig, "invalid", testDistName); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected invalid token to be rejected but got: %v", err)
+	}
+	if err := getResources(tlsConfig, "", testDistName); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected missing token to be rejected but got: %v", err)
+	}
+
+	// Without a client certificate, we must not get past the TLS handshake.
+	tlsConfig.Certificates = nil
+	if err := getResources(tlsConfig, testToken, testDistName); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected request without client certificate to fail but got: %v", err)
+	}
+
+	// Neither with a client certificate that's signed by a different CA.
+	otherPKI := newTestPKI(t)
+	defer otherPKI.Remove()
+	certFile, keyFile = otherPKI.IssueClient(testDistName)
+	otherCfg := TLSClientConfig{CAFile: pki.CAFile, CertFile: certFile, KeyFile: keyFile}
+	if tlsConfig, err = otherCfg.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := getResources(tlsConfig, testToken, testDistName); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected request with untrusted client certificate to fail but got: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/testers/bridgestraptest"
+)
+
+const testExtrainfo = `extra-info bridge1 0000000000000000000000000000000000000001
+transport obfs4 1.1.1.1:1111 cert=foo,iat-mode=0
+extra-info bridge2 0000000000000000000000000000000000000002
+transport obfs4 2.2.2.2:2222 cert=bar,iat-mode=0
+extra-info bridge3 0000000000000000000000000000000000000003
+transport obfs4 3.3.3.3:3333 cert=baz,iat-mode=0
+`
+
+// writeExtrainfo writes our test extra-info document to a temporary file and
+// returns the file's name.
+func writeExtrainfo(t *testing.T) string {
+
+	file, err := ioutil.TempFile("", "cached-extrainfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(testExtrainfo); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// waitFor polls the given condition until it's true, or fails the test.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// getScoredResources asks the given server for its obfs4 resources whose
+// score is at least the given minimum.
+func getScoredResources(t *testing.T, srv *httptest.Server, minScore float64) []json.RawMessage {
+
+	body := fmt.Sprintf(`{"request_origin": %q, "resource_types": ["obfs4"], "min_score": %f}`,
+		testDistName, minScore)
+	req, err := http.NewRequest(http.MethodGet, srv.URL+testGetPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var rs []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&rs); err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+// TestBackendIntegration runs the kraken, a test pool that talks to a fake
+// bridgestrap, and a distributor's resource stream, and checks that the
+// distributor learns about our resources and their test results.
+func TestBackendIntegration(t *testing.T) {
+
+	extrainfo := writeExtrainfo(t)
+	defer os.Remove(extrainfo)
+	bridges, err := loadBridgesFromExtrainfo(extrainfo)
+	if err != nil {
+		t.Fatalf("failed to parse extra-info document: %s", err)
+	}
+
+	fake := bridgestraptest.NewServer()
+	defer fake.Close()
+	// The first test request fails, so our test pool has to re-try.
+	fake.SetStatusCode(http.StatusServiceUnavailable)
+	broken := bridges[2].String()
+	fake.SetVerdict(broken, false, "timed out waiting for bootstrap")
+
+	b := newTestBackend([]string{"obfs4"})
+	b.Config.Backend.ExtrainfoFile = extrainfo
+	b.Config.Backend.BridgestrapEndpoint = fake.Endpoint()
+	b.rTestPools, err = newTestPools(&b.Config.Backend, []string{"obfs4"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test pools: %s", err)
+	}
+	pool := b.rTestPools[DefaultTester]
+	pool.flushTimeout = 10 * time.Millisecond
+	pool.retryDelay = 10 * time.Millisecond
+	defer pool.Stop()
+	b.Resources.Collection["obfs4"].TestFunc = pool.GetTestFunc()
+
+	srv := httptest.NewServer(http.HandlerFunc(b.resourcesHandler))
+	defer srv.Close()
+	rStream, ipc := startTestStream(srv, "obfs4")
+	defer ipc.StopStream()
+	recvDiff(t, rStream)
+
+	quit := make(chan bool)
+	ready := make(chan bool, 1)
+	go InitKraken(b.Config, quit, ready, b)
+	defer close(quit)
+	<-ready
+
+	// The distributor learns about all resources as soon as the kraken adds
+	// them, regardless of their test state.
+	streamed := make(map[string]bool)
+	for len(streamed) < len(bridges) {
+		diff := recvDiff(t, rStream)
+		for _, r := range diff.New["obfs4"] {
+			streamed[r.String()] = true
+		}
+	}
+
+	waitFor(t, "failed test request", func() bool { return len(fake.Requests()) >= 1 })
+	fake.SetStatusCode(http.StatusOK)
+	waitFor(t, "resource tests", func() bool {
+		for _, r := range bridges {
+			if fake.NumTested(r.String()) < 2 {
+				return false
+			}
+		}
+		return len(fake.Requests()) >= 2
+	})
+
+	// Once the test results are in, the distributor can ask for resources
+	// that passed their tests.
+	waitFor(t, "test results", func() bool {
+		return len(getScoredResources(t, srv, 1)) == len(bridges)-1
+	})
+	for _, raw := range getScoredResources(t, srv, 1) {
+		rs, err := UnmarshalResources([]json.RawMessage{raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs[0].String() == broken {
+			t.Errorf("distributor received dysfunctional resource %q", broken)
+		}
+	}
+	if rs := getScoredResources(t, srv, 0); len(rs) != len(bridges) {
+		t.Errorf("expected %d resources without minimum score but got %d", len(bridges), len(rs))
+	}
+
+	for _, r := range b.Resources.Get(testDistName, "obfs4") {
+		want := core.StateFunctional
+		if r.String() == broken {
+			want = core.StateDysfunctional
+		}
+		if r.Test().State != want {
+			t.Errorf("expected %q to be in state %d but got %d", r, want, r.Test().State)
+		}
+	}
+}
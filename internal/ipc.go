@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+const (
+	// These constants represent the IPC mechanisms that distributors can use
+	// to talk to the backend.
+	IpcHttps = "https"
+	IpcUnix  = "unix"
+	IpcGrpc  = "grpc"
+
+	// DefaultUnixSocketMode represents the file permissions of our Unix
+	// domain socket, unless configured otherwise.
+	DefaultUnixSocketMode os.FileMode = 0660
+)
+
+// NewBackendIpc returns the IPC mechanism that a distributor should use to
+// talk to the backend.  The given IPC mechanism and TLS configuration are taken
+// from the distributor's configuration.  The IPC mechanism is either IpcHttps
+// (the default), IpcUnix, or IpcGrpc.  IpcHttps uses TLS if the backend's Web
+// API is configured to serve TLS.
+func NewBackendIpc(cfg *Config, ipc string, tlsCfg TLSClientConfig) (delivery.Mechanism, error) {
+
+	switch ipc {
+	case IpcUnix:
+		log.Printf("Talking to backend over Unix domain socket at %s.", cfg.Backend.UnixSocket.Path)
+		return mechanisms.NewUnixIpc(cfg.Backend.UnixSocket.Path, cfg.Backend.ResourceStreamEndpoint), nil
+	case IpcGrpc:
+		log.Printf("Talking to backend over gRPC at %s.", cfg.Backend.Grpc.ApiAddress)
+		tlsConfig, err := tlsCfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		ipc, err := mechanisms.NewGrpcIpc(cfg.Backend.Grpc.ApiAddress, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return ipc, nil
+	default:
+		webApi := cfg.Backend.WebApi
+		if webApi.CertFile == "" || webApi.KeyFile == "" {
+			return mechanisms.NewHttpsIpc("http://" + webApi.ApiAddress + cfg.Backend.ResourceStreamEndpoint), nil
+		}
+		if webApi.ClientCAFile != "" && (tlsCfg.CertFile == "" || tlsCfg.KeyFile == "") {
+			return nil, errors.New("backend requires client certificate but we have none")
+		}
+		tlsConfig, err := tlsCfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		return mechanisms.NewHttpsIpcWithTLS("https://"+webApi.ApiAddress+cfg.Backend.ResourceStreamEndpoint, tlsConfig), nil
+	}
+}
+
+// fileMode returns the file permissions that the socket should have.
+func (cfg UnixSocketConfig) fileMode() (os.FileMode, error) {
+
+	if cfg.Mode == "" {
+		return DefaultUnixSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid Unix domain socket mode %q", cfg.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// peerCredListener wraps a Unix domain socket listener and only accepts
+// connections from processes whose user ID is allowed to talk to us.
+type peerCredListener struct {
+	net.Listener
+	allowedUids map[int]bool
+}
+
+// Accept waits for and returns the next connection from an allowed process.
+// Connections from other processes are closed right away.
+func (l *peerCredListener) Accept() (net.Conn, error) {
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := peerUid(conn)
+		if err != nil {
+			log.Printf("Rejecting Unix domain socket connection: %s", err)
+			conn.Close()
+			continue
+		}
+		if !l.allowedUids[uid] {
+			log.Printf("Rejecting Unix domain socket connection from disallowed user ID %d.", uid)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// listenUnix creates the Unix domain socket that's described by the given
+// configuration and returns a listener that enforces the configuration's
+// access restrictions.
+func listenUnix(cfg UnixSocketConfig) (net.Listener, error) {
+
+	mode, err := cfg.fileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove a stale socket that a previous backend may have left behind.
+	// We leave alone files that aren't sockets, to avoid removing something
+	// that the operator may still need.
+	if info, err := os.Lstat(cfg.Path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists but is not a Unix domain socket", cfg.Path)
+		}
+		if err := os.Remove(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(cfg.Path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	allowedUids := make(map[int]bool)
+	for _, uid := range cfg.AllowedUids {
+		allowedUids[uid] = true
+	}
+	if len(allowedUids) == 0 {
+		allowedUids[os.Getuid()] = true
+	}
+
+	return &peerCredListener{Listener: l, allowedUids: allowedUids}, nil
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// newTestSocket returns a backend whose resource stream is served over a Unix
+// domain socket with the given configuration.  The returned function removes
+// the server and removes the socket's directory.
+func newTestSocket(t *testing.T, rTypes []string, cfg UnixSocketConfig) (*BackendContext, func()) {
+
+	dir, err := ioutil.TempDir("", "rdsys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Path = filepath.Join(dir, "backend.sock")
+
+	b := newTestBackend(rTypes)
+	b.Config.Backend.UnixSocket = cfg
+	l, err := listenUnix(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to listen on Unix domain socket: %s", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(b.resourcesHandler)}
+	go srv.Serve(l)
+
+	return b, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnixSocketStream(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b, cleanup := newTestSocket(t, []string{rType}, UnixSocketConfig{})
+	defer cleanup()
+	b.Resources.Add(newTestBridge(1, "1.1.1.1"))
+
+	info, err := os.Stat(b.Config.Backend.UnixSocket.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != DefaultUnixSocketMode {
+		t.Errorf("expected socket permissions %s but got %s", DefaultUnixSocketMode, info.Mode().Perm())
+	}
+
+	rStream := make(chan *core.ResourceDiff)
+	ipc, err := NewBackendIpc(b.Config, IpcUnix, TLSClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ipc.(*mechanisms.UnixIpcContext); !ok {
+		t.Fatalf("expected Unix domain socket IPC mechanism but got %T", ipc)
+	}
+	ipc.StartStream(&core.ResourceRequest{
+		RequestOrigin: testDistName,
+		ResourceTypes: []string{rType},
+		BearerToken:   testToken,
+		Receiver:      rStream,
+	})
+	defer ipc.StopStream()
+
+	if diff := recvDiff(t, rStream); len(diff.New[rType]) != 1 {
+		t.Fatalf("expected 1 resource in initial batch but got: %s", diff)
+	}
+	b.Resources.Add(newTestBridge(2, "2.2.2.2"))
+	if diff := recvDiff(t, rStream); len(diff.New[rType]) != 1 {
+		t.Fatalf("expected diff with one new resource but got: %s", diff)
+	}
+}
+
+func TestUnixSocketPeerCred(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b, cleanup := newTestSocket(t, []string{rType}, UnixSocketConfig{
+		Mode:        "0600",
+		AllowedUids: []int{os.Getuid() + 1},
+	})
+	defer cleanup()
+
+	info, err := os.Stat(b.Config.Backend.UnixSocket.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected socket permissions 0600 but got %s", info.Mode().Perm())
+	}
+
+	// We're not among the allowed user IDs, so the backend must hang up on
+	// us before we get to make a request.
+	var ret interface{}
+	ipc := mechanisms.NewUnixIpc(b.Config.Backend.UnixSocket.Path, testStreamPath)
+	if err := ipc.MakeJsonRequest(&core.ResourceRequest{}, &ret); err == nil {
+		t.Errorf("backend accepted connection from disallowed user ID")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rdsys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// We must not remove files that aren't sockets.
+	path := filepath.Join(dir, "backend.sock")
+	if err := ioutil.WriteFile(path, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(UnixSocketConfig{Path: path}); err == nil {
+		t.Errorf("listenUnix replaced a file that's not a socket")
+	}
+	os.Remove(path)
+
+	// A stale socket of a previous backend must not get in our way.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenUnix(UnixSocketConfig{Path: path})
+	if err != nil {
+		t.Fatalf("failed to replace stale socket: %s", err)
+	}
+	l.Close()
+
+	if _, err := listenUnix(UnixSocketConfig{Path: path, Mode: "0999"}); err == nil {
+		t.Errorf("listenUnix accepted invalid socket mode")
+	}
+}
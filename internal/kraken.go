@@ -29,7 +29,7 @@ func InitKraken(cfg *Config, shutdown chan bool, ready chan bool, bCtx *BackendC
 	ticker := time.NewTicker(KrakenTickerInterval)
 	defer ticker.Stop()
 
-	rcol := bCtx.Resources
+	rcol := &bCtx.Resources
 	// Immediately parse bridge descriptor when we're called, and let caller
 	// know when we're done.
 	reloadBridgeDescriptors(cfg.Backend.ExtrainfoFile, rcol)
@@ -45,7 +45,7 @@ func InitKraken(cfg *Config, shutdown chan bool, ready chan bool, bCtx *BackendC
 			reloadBridgeDescriptors(cfg.Backend.ExtrainfoFile, rcol)
 			pruneExpiredResources(bCtx.metrics, rcol)
 			calcTestedResources(bCtx.metrics, rcol)
-			log.Printf("Backend resources: %s", &rcol)
+			log.Printf("Backend resources: %s", rcol)
 		}
 	}
 }
@@ -54,7 +54,7 @@ func InitKraken(cfg *Config, shutdown chan bool, ready chan bool, bCtx *BackendC
 // resource type and exposes them via Prometheus.  The function can tell us
 // that e.g. among all obfs4 bridges, 0.2 are untested, 0.7 are functional, and
 // 0.1 are dysfunctional.
-func calcTestedResources(metrics *Metrics, rcol core.BackendResources) {
+func calcTestedResources(metrics *Metrics, rcol *core.BackendResources) {
 
 	// Map our numerical resource states to human-friendly strings.
 	toStr := map[int]string{
@@ -70,7 +70,7 @@ func calcTestedResources(metrics *Metrics, rcol core.BackendResources) {
 			core.StateDysfunctional: 0,
 		}
 		for _, r := range hashring.GetAll() {
-			nums[r.Test().State] += 1
+			nums[r.Test().Snapshot().State] += 1
 		}
 		for state, num := range nums {
 			frac := float64(num) / float64(hashring.Len())
@@ -79,13 +79,14 @@ func calcTestedResources(metrics *Metrics, rcol core.BackendResources) {
 	}
 }
 
-func pruneExpiredResources(metrics *Metrics, rcol core.BackendResources) {
+// pruneExpiredResources removes expired resources from our collection.  The
+// collection takes care of informing distributors about the removal.
+func pruneExpiredResources(metrics *Metrics, rcol *core.BackendResources) {
 
+	pruned := rcol.Prune()
 	for rName, hashring := range rcol.Collection {
-		origLen := hashring.Len()
-		prunedResources := hashring.Prune()
-		if len(prunedResources) > 0 {
-			log.Printf("Pruned %d out of %d resources from %s hashring.", len(prunedResources), origLen, rName)
+		if num := len(pruned[rName]); num > 0 {
+			log.Printf("Pruned %d out of %d resources from %s hashring.", num, num+hashring.Len(), rName)
 		}
 		metrics.Resources.With(prometheus.Labels{"type": rName}).Set(float64(hashring.Len()))
 	}
@@ -93,7 +94,7 @@ func pruneExpiredResources(metrics *Metrics, rcol core.BackendResources) {
 
 // reloadBridgeDescriptors reloads bridge descriptors from the given
 // cached-extrainfo file and its corresponding cached-extrainfo.new.
-func reloadBridgeDescriptors(extrainfoFile string, rcol core.BackendResources) {
+func reloadBridgeDescriptors(extrainfoFile string, rcol *core.BackendResources) {
 
 	var err error
 	var res []core.Resource
@@ -200,7 +201,7 @@ func populateTransportInfo(transport string, t *resources.Transport) error {
 	if err != nil {
 		return err
 	}
-	t.Address = resources.IPAddr{net.IPAddr{addr.IP, addr.Zone}}
+	t.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: addr.IP, Zone: addr.Zone}}
 	p, err := strconv.Atoi(port)
 	if err != nil {
 		return err
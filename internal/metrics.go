@@ -3,6 +3,7 @@ package internal
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 )
 
 const (
@@ -13,6 +14,10 @@ type Metrics struct {
 	TestedResources *prometheus.GaugeVec
 	Resources       *prometheus.GaugeVec
 	Requests        *prometheus.CounterVec
+	TestDuration    *prometheus.HistogramVec
+	TestFailures    *prometheus.CounterVec
+	TestPending     *prometheus.GaugeVec
+	TestBatchSize   *prometheus.GaugeVec
 }
 
 // InitMetrics initialises our Prometheus metrics.
@@ -47,5 +52,136 @@ func InitMetrics() *Metrics {
 		[]string{"target"},
 	)
 
+	metrics.TestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "resource_test_duration_seconds",
+			Help:      "The time it takes a tester to test a batch of resources",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		},
+		[]string{"tester"},
+	)
+
+	metrics.TestFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "resource_test_failures_total",
+			Help:      "The number of failed test batches (reason \"error\"), resources that were missing from test results (reason \"missing\"), and resources that cannot be tested (reason \"untestable\")",
+		},
+		[]string{"tester", "reason"},
+	)
+
+	metrics.TestPending = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "resource_test_pending",
+			Help:      "The number of resources that wait to be tested or re-tried",
+		},
+		[]string{"tester"},
+	)
+
+	metrics.TestBatchSize = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "resource_test_batch_size",
+			Help:      "The number of resources that we currently hand to a tester at once",
+		},
+		[]string{"tester"},
+	)
+
 	return metrics
 }
+
+// QueueCollector exposes the state of each distributor's subscriber queues via
+// Prometheus.  The state is determined when Prometheus scrapes our metrics, so
+// it's up to date even if a distributor's queue is stuck.
+type QueueCollector struct {
+	queueStats func() map[string]core.QueueStats
+	depth      *prometheus.Desc
+	overflows  *prometheus.Desc
+}
+
+// NewQueueCollector returns a new queue collector that obtains its data from
+// the given function.
+func NewQueueCollector(queueStats func() map[string]core.QueueStats) *QueueCollector {
+
+	return &QueueCollector{
+		queueStats: queueStats,
+		depth: prometheus.NewDesc(
+			prometheus.BuildFQName(PrometheusNamespace, "", "distributor_queue_depth"),
+			"The number of resource diffs that are waiting to be sent to a distributor",
+			[]string{"distributor"}, nil,
+		),
+		overflows: prometheus.NewDesc(
+			prometheus.BuildFQName(PrometheusNamespace, "", "distributor_queue_overflows_total"),
+			"The number of times that a distributor was disconnected because it was too slow",
+			[]string{"distributor"}, nil,
+		),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+	ch <- c.overflows
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *QueueCollector) Collect(ch chan<- prometheus.Metric) {
+	for distName, stats := range c.queueStats() {
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(stats.Depth), distName)
+		ch <- prometheus.MustNewConstMetric(c.overflows, prometheus.CounterValue, float64(stats.Overflows), distName)
+	}
+}
+
+// RetestCollector exposes the state of our re-testing scheduler via
+// Prometheus.
+type RetestCollector struct {
+	retestStats func() RetestStats
+	waiting     *prometheus.Desc
+	scheduled   *prometheus.Desc
+	budget      *prometheus.Desc
+}
+
+// NewRetestCollector returns a new re-test collector that obtains its data
+// from the given function.
+func NewRetestCollector(retestStats func() RetestStats) *RetestCollector {
+
+	return &RetestCollector{
+		retestStats: retestStats,
+		waiting: prometheus.NewDesc(
+			prometheus.BuildFQName(PrometheusNamespace, "", "retest_queue_depth"),
+			"The number of resources that are due for a re-test but wait for our test budget",
+			[]string{"type", "status"}, nil,
+		),
+		scheduled: prometheus.NewDesc(
+			prometheus.BuildFQName(PrometheusNamespace, "", "retests_scheduled_total"),
+			"The number of re-tests that we scheduled",
+			[]string{"type"}, nil,
+		),
+		budget: prometheus.NewDesc(
+			prometheus.BuildFQName(PrometheusNamespace, "", "retest_budget"),
+			"The number of re-tests that we can currently schedule",
+			nil, nil,
+		),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *RetestCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.waiting
+	ch <- c.scheduled
+	ch <- c.budget
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *RetestCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.retestStats()
+	for group, num := range stats.Waiting {
+		ch <- prometheus.MustNewConstMetric(c.waiting, prometheus.GaugeValue, float64(num), group.Type, group.Status)
+	}
+	for rType, num := range stats.Scheduled {
+		ch <- prometheus.MustNewConstMetric(c.scheduled, prometheus.CounterValue, float64(num), rType)
+	}
+	ch <- prometheus.MustNewConstMetric(c.budget, prometheus.GaugeValue, stats.Budget)
+}
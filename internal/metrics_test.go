@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestQueueCollector(t *testing.T) {
+
+	stats := map[string]core.QueueStats{
+		"https":  {Depth: 3, Overflows: 1},
+		"salmon": {Depth: 0, Overflows: 0},
+	}
+	c := NewQueueCollector(func() map[string]core.QueueStats { return stats })
+
+	expected := `
+# HELP rdsys_backend_distributor_queue_depth The number of resource diffs that are waiting to be sent to a distributor
+# TYPE rdsys_backend_distributor_queue_depth gauge
+rdsys_backend_distributor_queue_depth{distributor="https"} 3
+rdsys_backend_distributor_queue_depth{distributor="salmon"} 0
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "rdsys_backend_distributor_queue_depth"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(c); n != 4 {
+		t.Errorf("expected 4 metrics but got %d", n)
+	}
+}
+
+func TestRetestCollector(t *testing.T) {
+
+	stats := RetestStats{
+		Waiting:   map[RetestGroup]int{{"obfs4", "dysfunctional"}: 5},
+		Scheduled: map[string]uint64{"obfs4": 10, "vanilla": 2},
+		Budget:    0.5,
+	}
+	c := NewRetestCollector(func() RetestStats { return stats })
+
+	expected := `
+# HELP rdsys_backend_retest_queue_depth The number of resources that are due for a re-test but wait for our test budget
+# TYPE rdsys_backend_retest_queue_depth gauge
+rdsys_backend_retest_queue_depth{status="dysfunctional",type="obfs4"} 5
+# HELP rdsys_backend_retest_budget The number of re-tests that we can currently schedule
+# TYPE rdsys_backend_retest_budget gauge
+rdsys_backend_retest_budget 0.5
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"rdsys_backend_retest_queue_depth", "rdsys_backend_retest_budget"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(c); n != 4 {
+		t.Errorf("expected 4 metrics but got %d", n)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerUid returns the user ID of the process at the other end of the given
+// Unix domain socket connection, as reported by SO_PEERCRED.
+func peerUid(conn net.Conn) (int, error) {
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("connection is not a Unix domain socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, fmt.Errorf("failed to get peer credentials: %s", credErr)
+	}
+
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package internal
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerUid is only implemented on Linux because we rely on SO_PEERCRED.  On
+// other platforms, we reject all Unix domain socket connections rather than
+// letting processes through whose user ID we cannot check.
+func peerUid(conn net.Conn) (int, error) {
+	return 0, fmt.Errorf("peer credentials are not supported on this platform")
+}
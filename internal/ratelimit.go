@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter implements one token bucket per key, e.g. per client IP address,
+// and a global token bucket that all keys share.
+type rateLimiter struct {
+	sync.Mutex
+	perMinute       float64
+	globalPerMinute float64
+	buckets         map[string]*tokenBucket
+	global          *tokenBucket
+	lastSweep       time.Time
+}
+
+// tokenBucket holds up to one minute's worth of tokens.
+type tokenBucket struct {
+	tokens   float64
+	lastFill time.Time
+}
+
+// newRateLimiter returns a new rate limiter that allows each key the given
+// number of events per minute, and all keys together the given global number
+// of events per minute.
+func newRateLimiter(perMinute, globalPerMinute int) *rateLimiter {
+	return &rateLimiter{
+		perMinute:       float64(perMinute),
+		globalPerMinute: float64(globalPerMinute),
+		buckets:         make(map[string]*tokenBucket),
+	}
+}
+
+// refill adds the tokens that the bucket earned since it was last filled.
+func (b *tokenBucket) refill(perMinute float64, now time.Time) {
+	b.tokens += perMinute * now.Sub(b.lastFill).Minutes()
+	if b.tokens > perMinute {
+		b.tokens = perMinute
+	}
+	b.lastFill = now
+}
+
+// wait returns how long it takes until the bucket has a token again.
+func (b *tokenBucket) wait(perMinute float64) time.Duration {
+	minutes := (1 - b.tokens) / perMinute
+	return time.Duration(math.Ceil(minutes * float64(time.Minute)))
+}
+
+// allow returns true if the given key may proceed at the given time.  If not,
+// it also returns how long the caller should wait before trying again.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep(now)
+	if l.global == nil {
+		l.global = &tokenBucket{tokens: l.globalPerMinute, lastFill: now}
+	}
+	l.global.refill(l.globalPerMinute, now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.perMinute, lastFill: now}
+		l.buckets[key] = b
+	}
+	b.refill(l.perMinute, now)
+
+	if b.tokens < 1 {
+		return false, b.wait(l.perMinute)
+	}
+	if l.global.tokens < 1 {
+		return false, l.global.wait(l.globalPerMinute)
+	}
+	b.tokens--
+	l.global.tokens--
+	return true, 0
+}
+
+// sweep forgets about keys whose buckets are full again, so our map doesn't
+// grow without bounds.  We sweep at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+l.perMinute*now.Sub(b.lastFill).Minutes() >= l.perMinute {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	now := time.Now().UTC()
+	l := newRateLimiter(2, 3)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("alice", now); !ok {
+			t.Fatalf("rate limiter rejected lookup %d", i+1)
+		}
+	}
+	ok, wait := l.allow("alice", now)
+	if ok {
+		t.Fatal("rate limiter accepted lookup beyond per-client limit")
+	}
+	if wait <= 0 || wait > 30*time.Second {
+		t.Errorf("expected to wait up to 30s for next token but got %s", wait)
+	}
+
+	// Bob has his own bucket, but there's only one global token left.
+	if ok, _ := l.allow("bob", now); !ok {
+		t.Error("rate limiter rejected first lookup of another client")
+	}
+	if ok, _ := l.allow("bob", now); ok {
+		t.Error("rate limiter accepted lookup beyond global limit")
+	}
+
+	// Half a minute later, alice earned another token.
+	now = now.Add(30 * time.Second)
+	if ok, _ := l.allow("alice", now); !ok {
+		t.Error("rate limiter didn't refill bucket")
+	}
+
+	// Buckets that are full again are forgotten.
+	now = now.Add(2 * time.Minute)
+	l.allow("carol", now)
+	if _, exists := l.buckets["alice"]; exists {
+		t.Error("rate limiter didn't forget about idle client")
+	}
+	if _, exists := l.buckets["carol"]; !exists {
+		t.Error("rate limiter forgot about active client")
+	}
+}
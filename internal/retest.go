@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	DefaultFunctionalRetestInterval       = 6 * time.Hour
+	DefaultDysfunctionalMinRetestInterval = 30 * time.Minute
+	DefaultDysfunctionalMaxRetestInterval = 18 * time.Hour
+	DefaultRetestsPerMinute               = 60
+	// RetestTick determines how often our scheduler looks for resources that
+	// are due for a re-test.
+	RetestTick = 10 * time.Second
+)
+
+// retestPolicy contains the parsed values of a RetestConfig.
+type retestPolicy struct {
+	functional     time.Duration
+	dysfunctional  time.Duration
+	maxBackoff     time.Duration
+	testsPerMinute int
+}
+
+// parseDuration parses the given duration, e.g. "6h", and returns the given
+// default if the duration is empty.
+func parseDuration(name, value string, def time.Duration) (time.Duration, error) {
+
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", name, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s %q must be positive", name, value)
+	}
+	return d, nil
+}
+
+// policy turns the configuration into a retestPolicy, filling in defaults.
+func (c RetestConfig) policy() (*retestPolicy, error) {
+
+	var err error
+	p := &retestPolicy{testsPerMinute: c.TestsPerMinute}
+	if p.functional, err = parseDuration("functional retest interval", c.FunctionalInterval,
+		DefaultFunctionalRetestInterval); err != nil {
+		return nil, err
+	}
+	if p.dysfunctional, err = parseDuration("dysfunctional retest interval", c.DysfunctionalMinInterval,
+		DefaultDysfunctionalMinRetestInterval); err != nil {
+		return nil, err
+	}
+	if p.maxBackoff, err = parseDuration("maximum dysfunctional retest interval", c.DysfunctionalMaxInterval,
+		DefaultDysfunctionalMaxRetestInterval); err != nil {
+		return nil, err
+	}
+	if p.maxBackoff < p.dysfunctional {
+		return nil, fmt.Errorf("maximum dysfunctional retest interval must not be smaller than minimum")
+	}
+	if p.testsPerMinute < 0 {
+		return nil, fmt.Errorf("tests per minute must not be negative")
+	}
+	if p.testsPerMinute == 0 {
+		p.testsPerMinute = DefaultRetestsPerMinute
+	}
+	return p, nil
+}
+
+// backoff returns how long we wait before re-testing a resource that failed
+// the given number of consecutive tests.
+func (p *retestPolicy) backoff(failures int) time.Duration {
+
+	d := p.dysfunctional
+	for i := 1; i < failures && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+// retestState keeps track of a resource's test history, as far as our
+// scheduler is concerned.
+type retestState struct {
+	// lastTested is the resource's LastTested timestamp when we last looked
+	// at it.  Once it changes, we know that the resource was tested again.
+	lastTested time.Time
+	// failures is the number of consecutive tests that the resource failed.
+	failures int
+	// lastScheduled is the time when we last handed the resource to its
+	// tester.  If the test never happens, e.g. because the tester is
+	// unreachable, we try again one interval later.
+	lastScheduled time.Time
+	seen          bool
+}
+
+// RetestGroup identifies a group of resources in our statistics.
+type RetestGroup struct {
+	Type   string
+	Status string
+}
+
+// RetestStats represents the state of our re-testing scheduler.
+type RetestStats struct {
+	// Waiting maps resource types and test states to the number of
+	// resources that are due for a re-test but wait for our budget.
+	Waiting map[RetestGroup]int
+	// Scheduled maps resource types to the number of re-tests that we
+	// scheduled so far.
+	Scheduled map[string]uint64
+	// Budget is the number of re-tests that we can currently schedule.
+	Budget float64
+}
+
+// dueResource represents a resource that's due for a re-test.
+type dueResource struct {
+	r        core.Resource
+	key      RetestGroup
+	testFunc core.TestFunc
+	due      time.Time
+}
+
+// RetestScheduler periodically re-tests resources that we already tested.
+// Functional resources are re-tested at a fixed interval, and dysfunctional
+// resources with exponential backoff.  All re-tests share a global budget of
+// tests per minute.  New resources aren't our business; they are tested when
+// they are added to the backend.
+type RetestScheduler struct {
+	sync.Mutex
+	resources *core.BackendResources
+	policy    *retestPolicy
+	states    map[core.Hashkey]*retestState
+	budget    float64
+	lastTick  time.Time
+	stats     RetestStats
+	shutdown  chan bool
+	wg        sync.WaitGroup
+}
+
+// NewRetestScheduler returns a new scheduler for the given resources.
+func NewRetestScheduler(resources *core.BackendResources, cfg RetestConfig) (*RetestScheduler, error) {
+
+	policy, err := cfg.policy()
+	if err != nil {
+		return nil, err
+	}
+	return &RetestScheduler{
+		resources: resources,
+		policy:    policy,
+		states:    make(map[core.Hashkey]*retestState),
+		stats: RetestStats{
+			Waiting:   make(map[RetestGroup]int),
+			Scheduled: make(map[string]uint64),
+		},
+		shutdown: make(chan bool),
+	}, nil
+}
+
+// Start starts the scheduler in the background.
+func (s *RetestScheduler) Start() {
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(RetestTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.tick(now.UTC())
+			case <-s.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler and waits until it's done.
+func (s *RetestScheduler) Stop() {
+	close(s.shutdown)
+	s.wg.Wait()
+}
+
+// Stats returns a copy of the scheduler's statistics.
+func (s *RetestScheduler) Stats() RetestStats {
+	s.Lock()
+	defer s.Unlock()
+
+	stats := RetestStats{
+		Waiting:   make(map[RetestGroup]int),
+		Scheduled: make(map[string]uint64),
+		Budget:    s.stats.Budget,
+	}
+	for k, v := range s.stats.Waiting {
+		stats.Waiting[k] = v
+	}
+	for k, v := range s.stats.Scheduled {
+		stats.Scheduled[k] = v
+	}
+	return stats
+}
+
+// refill adds the re-tests that we earned since our last tick to our budget.
+// The budget never exceeds one minute's worth of tests, so we don't burst
+// after a quiet period.
+func (s *RetestScheduler) refill(now time.Time) {
+
+	perMinute := float64(s.policy.testsPerMinute)
+	if s.lastTick.IsZero() {
+		s.budget = perMinute
+	} else {
+		s.budget += perMinute * now.Sub(s.lastTick).Minutes()
+	}
+	if s.budget > perMinute {
+		s.budget = perMinute
+	}
+	s.lastTick = now
+}
+
+// tick determines the resources that are due for a re-test and hands as many
+// of them to their tester as our budget allows, most overdue first.  We hand
+// them over one by one, so a slow tester slows us down rather than piling up
+// goroutines, and we never hand over more resources than our budget allows.
+func (s *RetestScheduler) tick(now time.Time) {
+
+	for _, d := range s.schedule(now) {
+		if d.testFunc != nil {
+			d.testFunc(d.r)
+		}
+	}
+}
+
+// schedule returns the resources that are due for a re-test, as many as our
+// budget allows, most overdue first.  We don't hold our lock while the caller
+// hands the resources to their tester, so our statistics remain available.
+func (s *RetestScheduler) schedule(now time.Time) []*dueResource {
+	s.Lock()
+	defer s.Unlock()
+
+	s.refill(now)
+	due := s.findDue(now)
+	sort.Slice(due, func(i, j int) bool { return due[i].due.Before(due[j].due) })
+
+	waiting := make(map[RetestGroup]int)
+	scheduled := []*dueResource{}
+	for _, d := range due {
+		if s.budget < 1 {
+			waiting[d.key]++
+			continue
+		}
+		s.budget--
+		s.states[d.r.Oid()].lastScheduled = now
+		s.stats.Scheduled[d.key.Type]++
+		scheduled = append(scheduled, d)
+	}
+	if len(due) > 0 {
+		log.Printf("Scheduled %d of %d resources that are due for a re-test.",
+			len(scheduled), len(due))
+	}
+	s.stats.Waiting = waiting
+	s.stats.Budget = s.budget
+
+	return scheduled
+}
+
+// findDue updates our view of all resources' test history and returns the
+// resources that are due for a re-test.  We forget about resources that are
+// no longer in the backend.
+func (s *RetestScheduler) findDue(now time.Time) []*dueResource {
+
+	for _, state := range s.states {
+		state.seen = false
+	}
+
+	due := []*dueResource{}
+	s.resources.RLock()
+	for rType, hashring := range s.resources.Collection {
+		hashring.RLock()
+		testFunc := hashring.TestFunc
+		for _, node := range hashring.Hashnodes {
+			if d := s.check(node.Elem, now); d != nil {
+				d.key.Type = rType
+				d.testFunc = testFunc
+				due = append(due, d)
+			}
+		}
+		hashring.RUnlock()
+	}
+	s.resources.RUnlock()
+
+	for oid, state := range s.states {
+		if !state.seen {
+			delete(s.states, oid)
+		}
+	}
+	return due
+}
+
+// check updates the test history of the given resource and returns a
+// dueResource if it's time to re-test the resource, or nil otherwise.
+func (s *RetestScheduler) check(r core.Resource, now time.Time) *dueResource {
+
+	rTest := r.Test().Snapshot()
+	if rTest == nil || rTest.State == core.StateUntested {
+		return nil
+	}
+
+	state, exists := s.states[r.Oid()]
+	if !exists {
+		state = &retestState{}
+		s.states[r.Oid()] = state
+	}
+	state.seen = true
+	if !rTest.LastTested.Equal(state.lastTested) {
+		state.lastTested = rTest.LastTested
+		if rTest.State == core.StateDysfunctional {
+			state.failures++
+		} else {
+			state.failures = 0
+		}
+	}
+
+	last := rTest.LastTested
+	if state.lastScheduled.After(last) {
+		last = state.lastScheduled
+	}
+	d := &dueResource{r: r}
+	if rTest.State == core.StateDysfunctional {
+		d.key.Status = "dysfunctional"
+		d.due = last.Add(s.policy.backoff(state.failures))
+	} else {
+		d.key.Status = "functional"
+		d.due = last.Add(s.policy.functional)
+	}
+	if d.due.After(now) {
+		return nil
+	}
+	return d
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestRetestPolicy(t *testing.T) {
+
+	p, err := RetestConfig{DysfunctionalMinInterval: "10m", DysfunctionalMaxInterval: "1h"}.policy()
+	if err != nil {
+		t.Fatalf("failed to parse valid configuration: %s", err)
+	}
+	if p.functional != DefaultFunctionalRetestInterval || p.testsPerMinute != DefaultRetestsPerMinute {
+		t.Errorf("configuration lacks defaults: %+v", p)
+	}
+	expected := map[int]time.Duration{
+		1:  10 * time.Minute,
+		2:  20 * time.Minute,
+		3:  40 * time.Minute,
+		4:  time.Hour,
+		50: time.Hour,
+	}
+	for failures, d := range expected {
+		if backoff := p.backoff(failures); backoff != d {
+			t.Errorf("expected backoff of %s after %d failures but got %s", d, failures, backoff)
+		}
+	}
+
+	invalid := []RetestConfig{
+		{FunctionalInterval: "often"},
+		{DysfunctionalMinInterval: "-1m"},
+		{DysfunctionalMinInterval: "2h", DysfunctionalMaxInterval: "1h"},
+		{TestsPerMinute: -1},
+	}
+	for _, cfg := range invalid {
+		if _, err := cfg.policy(); err == nil {
+			t.Errorf("accepted invalid configuration %+v", cfg)
+		}
+	}
+}
+
+// expectRetests fails the test unless the given channel yields exactly the
+// given resources.
+func expectRetests(t *testing.T, c chan core.Resource, expected ...core.Resource) {
+	t.Helper()
+
+	for _, r := range expected {
+		select {
+		case got := <-c:
+			if got.Oid() != r.Oid() {
+				t.Errorf("expected re-test of %s but got %s", r, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected re-test of %s", r)
+		}
+	}
+	select {
+	case got := <-c:
+		t.Errorf("unexpected re-test of %s", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRetestScheduler(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b := newTestBackend([]string{rType})
+	stale, fresh := newTestBridge(1, "1.1.1.1"), newTestBridge(2, "2.2.2.2")
+	broken, untested := newTestBridge(3, "3.3.3.3"), newTestBridge(4, "4.4.4.4")
+	for _, r := range []*resources.Bridge{stale, fresh, broken, untested} {
+		b.Resources.Add(r)
+	}
+	retests := make(chan core.Resource, 10)
+	b.Resources.Collection[rType].TestFunc = func(r core.Resource) { retests <- r }
+
+	now := time.Now().UTC()
+	*stale.Test() = core.ResourceTest{State: core.StateFunctional, LastTested: now.Add(-7 * time.Hour)}
+	*fresh.Test() = core.ResourceTest{State: core.StateFunctional, LastTested: now.Add(-time.Hour)}
+	*broken.Test() = core.ResourceTest{State: core.StateDysfunctional, LastTested: now.Add(-31 * time.Minute)}
+
+	// With a budget of one test per minute, only the most overdue resource
+	// gets re-tested right away.
+	s, err := NewRetestScheduler(&b.Resources, RetestConfig{TestsPerMinute: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tick(now)
+	expectRetests(t, retests, stale)
+	stats := s.Stats()
+	if stats.Waiting[RetestGroup{rType, "dysfunctional"}] != 1 || stats.Scheduled[rType] != 1 {
+		t.Errorf("unexpected scheduler stats: %+v", stats)
+	}
+
+	// Half a minute later, we haven't earned another test yet.
+	s.tick(now.Add(30 * time.Second))
+	expectRetests(t, retests)
+	s.tick(now.Add(time.Minute))
+	expectRetests(t, retests, broken)
+	if stats := s.Stats(); len(stats.Waiting) != 0 || stats.Scheduled[rType] != 2 {
+		t.Errorf("unexpected scheduler stats: %+v", stats)
+	}
+
+	// Scheduled resources aren't due again until one interval later, even
+	// if their tests don't happen.
+	s.tick(now.Add(2 * time.Minute))
+	expectRetests(t, retests)
+
+	// The broken resource fails its re-test, so we wait twice as long
+	// before trying again.
+	broken.Test().LastTested = now.Add(2 * time.Minute)
+	s.tick(now.Add(40 * time.Minute))
+	expectRetests(t, retests)
+	s.tick(now.Add(63 * time.Minute))
+	expectRetests(t, retests, broken)
+
+	// Once it works again, it's back to the regular interval.
+	*broken.Test() = core.ResourceTest{State: core.StateFunctional, LastTested: now.Add(64 * time.Minute)}
+	s.tick(now.Add(5 * time.Hour))
+	expectRetests(t, retests, fresh)
+	s.tick(now.Add(6 * time.Hour))
+	expectRetests(t, retests, stale)
+	s.tick(now.Add(7*time.Hour + 5*time.Minute))
+	expectRetests(t, retests, broken)
+}
+
+func TestRetestSchedulerSubmitsInline(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b := newTestBackend([]string{rType})
+	now := time.Now().UTC()
+	for i := 1; i <= 5; i++ {
+		r := newTestBridge(i, fmt.Sprintf("%d.%d.%d.%d", i, i, i, i))
+		b.Resources.Add(r)
+		*r.Test() = core.ResourceTest{State: core.StateFunctional, LastTested: now.Add(-7 * time.Hour)}
+	}
+	s, err := NewRetestScheduler(&b.Resources, RetestConfig{TestsPerMinute: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We hand resources to their tester before tick returns, and without
+	// holding our lock, so a slow tester cannot pile up goroutines or block
+	// our statistics.
+	submitted := 0
+	b.Resources.Collection[rType].TestFunc = func(r core.Resource) {
+		s.Stats()
+		submitted++
+	}
+	s.tick(now)
+	if submitted != 3 {
+		t.Errorf("expected 3 submitted re-tests but got %d", submitted)
+	}
+}
@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// stateNames maps our numerical resource states to the names that our JSON
+// status API uses.
+var stateNames = map[int]string{
+	core.StateUntested:      "untested",
+	core.StateFunctional:    "functional",
+	core.StateDysfunctional: "dysfunctional",
+}
+
+// stateName returns the name of the given resource state, or "unknown" if
+// there's no such state.
+func stateName(state int) string {
+	if name, exists := stateNames[state]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+// describeState turns the given state name into the description that our text
+// status page uses.
+func describeState(name string) string {
+	if name == stateNames[core.StateUntested] {
+		return "not yet tested"
+	}
+	return name
+}
+
+// TestResultStatus represents a single test result in our JSON status API.
+type TestResultStatus struct {
+	State string    `json:"state"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// ResourceStatus represents the status of one of a bridge's resources, e.g.
+// its obfs4 transport.
+type ResourceStatus struct {
+	Type        string             `json:"type"`
+	State       string             `json:"state"`
+	LastTested  *time.Time         `json:"last_tested,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	Score       float64            `json:"score"`
+	History     []TestResultStatus `json:"history"`
+	BlockedIn   []string           `json:"blocked_in"`
+	Distributor string             `json:"distributor,omitempty"`
+	FirstSeen   time.Time          `json:"first_seen"`
+	LastSeen    time.Time          `json:"last_seen"`
+	// Expires is the time when we forget about the resource unless we see
+	// its descriptor again.
+	Expires time.Time `json:"expires"`
+}
+
+// BridgeStatus represents the response of our JSON status API.
+type BridgeStatus struct {
+	Fingerprint string            `json:"fingerprint"`
+	Resources   []*ResourceStatus `json:"resources"`
+}
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatHTML = "html"
+)
+
+// statusFormat returns the format that the given status request asks for,
+// either via its "format" parameter or its Accept header.  Browsers get HTML
+// and everything else gets text by default.
+func statusFormat(r *http.Request) string {
+
+	switch format := r.FormValue("format"); format {
+	case formatText, formatJSON, formatHTML:
+		return format
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") {
+		return formatJSON
+	}
+	if strings.Contains(accept, "text/html") {
+		return formatHTML
+	}
+	return formatText
+}
+
+// findNode returns the hash node of the given resource type whose UID belongs
+// to the given fingerprint, which may be hashed or not.
+func findNode(sHashring *core.SplitHashring, rType, id string) (*core.Hashnode, error) {
+
+	table := crc64.MakeTable(resources.Crc64Polynomial)
+	key := core.Hashkey(crc64.Checksum([]byte(rType+id), table))
+	node, err := sHashring.GetExactNode(key)
+	if err == nil {
+		return node, nil
+	}
+	// We may have been given a non-hashed fingerprint.  Let's try to hash it,
+	// and see if we get a result.
+	hId, err := resources.HashFingerprint(id)
+	if err != nil {
+		return nil, err
+	}
+	key = core.Hashkey(crc64.Checksum([]byte(rType+hId), table))
+	return sHashring.GetExactNode(key)
+}
+
+// newResourceStatus determines the status of the resource in the given hash
+// node.
+func newResourceStatus(sHashring *core.SplitHashring, rType string, node *core.Hashnode) *ResourceStatus {
+
+	r := node.Elem
+	status := &ResourceStatus{
+		Type:      rType,
+		State:     stateName(core.StateUntested),
+		History:   []TestResultStatus{},
+		BlockedIn: []string{},
+		FirstSeen: node.FirstSeen,
+		LastSeen:  node.LastUpdate,
+		Expires:   node.LastUpdate.Add(r.Expiry()),
+	}
+	if distName, err := sHashring.GetDistName(r); err == nil {
+		status.Distributor = distName
+	}
+	for location := range r.BlockedIn() {
+		status.BlockedIn = append(status.BlockedIn, location)
+	}
+	sort.Strings(status.BlockedIn)
+
+	rTest := r.Test().Snapshot()
+	if rTest == nil {
+		return status
+	}
+	status.State = stateName(rTest.State)
+	status.Error = rTest.Error
+	status.Score = rTest.Score()
+	if rTest.State != core.StateUntested {
+		lastTested := rTest.LastTested
+		status.LastTested = &lastTested
+	}
+	for _, result := range rTest.History {
+		status.History = append(status.History, TestResultStatus{
+			State: stateName(result.State),
+			Time:  result.Time,
+			Error: result.Error,
+		})
+	}
+	return status
+}
+
+// bridgeStatus returns the status of each resource that the bridge with the
+// given fingerprint advertises, sorted by resource type.
+func (b *BackendContext) bridgeStatus(id string) *BridgeStatus {
+
+	rTypes := []string{}
+	for rType := range resources.ResourceMap {
+		rTypes = append(rTypes, rType)
+	}
+	sort.Strings(rTypes)
+
+	status := &BridgeStatus{Fingerprint: id, Resources: []*ResourceStatus{}}
+	for _, rType := range rTypes {
+		sHashring, exists := b.Resources.Collection[rType]
+		if !exists {
+			continue
+		}
+		node, err := findNode(sHashring, rType, id)
+		if err != nil {
+			continue
+		}
+		status.Resources = append(status.Resources, newResourceStatus(sHashring, rType, node))
+	}
+	return status
+}
+
+// String turns the given resource status into the human-readable format of our
+// text status page.
+func (s *ResourceStatus) String() string {
+
+	str := fmt.Sprintf("* %s: %s\n", s.Type, describeState(s.State))
+	if s.Error != "" {
+		str += fmt.Sprintf("  Error: %s\n", s.Error)
+	}
+	if s.LastTested != nil {
+		tDiff := time.Now().UTC().Sub(*s.LastTested)
+		str += fmt.Sprintf("  Last tested: %s (%s ago)\n", *s.LastTested, tDiff)
+	}
+	if len(s.History) > 0 {
+		str += fmt.Sprintf("  Score: %.0f%% of the last %d tests succeeded\n", s.Score*100, len(s.History))
+		str += "  Recent tests (newest first):\n"
+		for i := len(s.History) - 1; i >= 0; i-- {
+			result := s.History[i]
+			str += fmt.Sprintf("    %s: %s", result.Time, describeState(result.State))
+			if result.Error != "" {
+				str += fmt.Sprintf(" (%s)", result.Error)
+			}
+			str += "\n"
+		}
+	}
+	return str
+}
+
+// statusHandler tells bridge operators what rdsys knows about their bridge.
+// Depending on statusFormat, the handler returns a human-readable text page,
+// an HTML page, or a BridgeStatus in JSON.  Lookups are rate-limited, so the
+// handler cannot be used to enumerate bridges.
+func (b *BackendContext) statusHandler(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "failed to parse parameters", http.StatusBadRequest)
+		return
+	}
+	format := statusFormat(r)
+
+	id := r.FormValue("id")
+	if id == "" {
+		if format == formatHTML {
+			writeStatusPage(w, http.StatusOK, &statusPage{})
+			return
+		}
+		http.Error(w, "no 'id' parameter given", http.StatusBadRequest)
+		return
+	}
+	id, err := normalizeFingerprint(id)
+	if err != nil {
+		if format == formatHTML {
+			writeStatusPage(w, http.StatusBadRequest, &statusPage{ID: r.FormValue("id"), Error: err.Error()})
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	if b.statusLimiter != nil {
+		if ok, wait := b.statusLimiter.allow(ClientAddr(r, b.trustedProxies), now); !ok {
+			msg := "too many lookups; please try again later"
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+			if format == formatHTML {
+				writeStatusPage(w, http.StatusTooManyRequests, &statusPage{ID: id, Error: msg})
+				return
+			}
+			http.Error(w, msg, http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	status := b.bridgeStatus(id)
+	if len(status.Resources) == 0 {
+		if format == formatHTML {
+			writeStatusPage(w, http.StatusNotFound, &statusPage{ID: id, Hints: notFoundHints()})
+			return
+		}
+		http.Error(w, "no resources for the given id", http.StatusNotFound)
+		return
+	}
+
+	switch format {
+	case formatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			http.Error(w, "error while turning status into JSON", http.StatusInternalServerError)
+		}
+	case formatHTML:
+		writeStatusPage(w, http.StatusOK, newStatusPage(id, status, now))
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Bridge %s advertises:\n\n", id)
+		for _, rStatus := range status.Resources {
+			fmt.Fprint(w, rStatus.String()+"\n")
+		}
+	}
+}
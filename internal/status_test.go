@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestStatusHandlerHistory(t *testing.T) {
+
+	b := newTestBackend([]string{"vanilla"})
+	bridge := newScoredBridge(1, 3, 1)
+	b.Resources.Add(bridge)
+
+	req := httptest.NewRequest("GET", "/status?id="+bridge.Fingerprint, nil)
+	rr := httptest.NewRecorder()
+	b.statusHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	page := rr.Body.String()
+	if !strings.Contains(page, "Score: 75% of the last 4 tests succeeded") {
+		t.Errorf("status page lacks bridge's score:\n%s", page)
+	}
+	if strings.Count(page, "dysfunctional (timeout)") != 1 || strings.Count(page, ": functional\n") != 4 {
+		t.Errorf("status page lacks bridge's test history:\n%s", page)
+	}
+}
+
+func TestStatusHandlerJSON(t *testing.T) {
+
+	b := newTestBackend([]string{"vanilla"})
+	bridge := newScoredBridge(1, 1, 1)
+	bridge.SetBlockedIn(core.LocationSet{"ru": true, "cn": true})
+	b.Resources.Add(bridge)
+
+	getStatus := func(query string, header http.Header) *BridgeStatus {
+		req := httptest.NewRequest("GET", "/status?id="+strings.ToLower(bridge.Fingerprint)+query, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		b.statusHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+		}
+		if rr.Header().Get("Content-Type") != "application/json" {
+			return nil
+		}
+		status := &BridgeStatus{}
+		if err := json.Unmarshal(rr.Body.Bytes(), status); err != nil {
+			t.Fatalf("failed to unmarshal status: %s", err)
+		}
+		return status
+	}
+
+	if getStatus("", nil) != nil {
+		t.Errorf("got JSON although we didn't ask for it")
+	}
+	if getStatus("&format=text", http.Header{"Accept": []string{"application/json"}}) != nil {
+		t.Errorf("format parameter didn't take precedence over Accept header")
+	}
+	if getStatus("", http.Header{"Accept": []string{"application/json"}}) == nil {
+		t.Errorf("didn't get JSON although Accept header asked for it")
+	}
+
+	status := getStatus("&format=json", nil)
+	if status == nil {
+		t.Fatalf("didn't get JSON although format parameter asked for it")
+	}
+	if status.Fingerprint != bridge.Fingerprint || len(status.Resources) != 1 {
+		t.Fatalf("unexpected bridge status: %+v", status)
+	}
+	rStatus := status.Resources[0]
+	if rStatus.Type != "vanilla" || rStatus.State != "functional" || rStatus.Score != 0.5 {
+		t.Errorf("unexpected resource status: %+v", rStatus)
+	}
+	if rStatus.LastTested == nil || len(rStatus.History) != 2 || rStatus.History[0].Error != "timeout" {
+		t.Errorf("unexpected test history: %+v", rStatus)
+	}
+	if strings.Join(rStatus.BlockedIn, ",") != "cn,ru" {
+		t.Errorf("expected bridge to be blocked in cn and ru but got %v", rStatus.BlockedIn)
+	}
+	if rStatus.Distributor != testDistName {
+		t.Errorf("expected distributor %q but got %q", testDistName, rStatus.Distributor)
+	}
+	if rStatus.FirstSeen.IsZero() || rStatus.LastSeen.Before(rStatus.FirstSeen) {
+		t.Errorf("unexpected first-seen and last-seen times: %s, %s", rStatus.FirstSeen, rStatus.LastSeen)
+	}
+}
+
+func TestStatusHandlerErrors(t *testing.T) {
+
+	b := newTestBackend([]string{"vanilla"})
+	for query, code := range map[string]int{
+		"":                               http.StatusBadRequest,
+		"?id=nonexistent":                http.StatusBadRequest,
+		"?id=0&format=json":              http.StatusBadRequest,
+		"?id=" + strings.Repeat("0", 40): http.StatusNotFound,
+		"?id=" + strings.Repeat("0", 40) + "&format=json": http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		b.statusHandler(rr, httptest.NewRequest("GET", "/status"+query, nil))
+		if rr.Code != code {
+			t.Errorf("expected HTTP return code %d for %q but got %d", code, query, rr.Code)
+		}
+	}
+
+	if name := stateName(42); name != "unknown" {
+		t.Errorf("expected unknown state but got %q", name)
+	}
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	DefaultStatusLookupsPerMinute       = 10
+	DefaultStatusGlobalLookupsPerMinute = 300
+	// StaleDescriptorAge is the time after which we consider a bridge's
+	// descriptor stale.  The kraken reloads descriptors every minute, so a
+	// bridge whose descriptor we haven't seen in a while no longer
+	// publishes it.
+	StaleDescriptorAge = 3 * time.Hour
+	// MinFlakyHistory is the number of test results that a resource needs
+	// before we call it flaky.
+	MinFlakyHistory = 4
+)
+
+var fingerprintRegexp = regexp.MustCompile(`^[0-9A-F]{40}$`)
+
+// Hints for errors that can have several causes.
+const (
+	unreachableHint = "Your bridge's address is unreachable.  Make sure that your bridge advertises the right IP address, e.g. by setting the Address option in your torrc."
+	timeoutHint     = "Our connection attempts time out.  A firewall may be dropping connections to your transport's port.  Make sure the port is open, and forwarded if your bridge is behind a NAT."
+)
+
+// errorHints maps substrings of the errors that our testers report to hints
+// that tell bridge operators what they can do about them.  The first matching
+// substring wins, so specific substrings come first.
+var errorHints = []struct {
+	substr string
+	hint   string
+}{
+	{"bootstrap", "We can reach your bridge, but Tor fails to bootstrap over it.  Make sure that your bridge can reach the Tor network, and check its log for warnings."},
+	{"handshake", "We can reach your bridge, but the pluggable transport handshake fails.  This happens if your transport's keys changed, e.g. after its state directory was deleted.  Restart tor, so it publishes a fresh descriptor."},
+	{"connection refused", "Nothing accepts connections on your transport's port.  Make sure that tor and your pluggable transport are running, and that ServerTransportListenAddr matches the port that your bridge advertises."},
+	{"no route to host", unreachableHint},
+	{"network is unreachable", unreachableHint},
+	{"timeout", timeoutHint},
+	{"timed out", timeoutHint},
+}
+
+// transportView contains what our HTML status page shows about a resource.
+type transportView struct {
+	*ResourceStatus
+	Stale bool
+	Hints []string
+}
+
+// statusPage contains what our HTML status page shows.
+type statusPage struct {
+	ID         string
+	Error      string
+	Now        time.Time
+	Transports []*transportView
+	Hints      []string
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"describe": describeState,
+	"ago": func(now, t time.Time) string {
+		return now.Sub(t).Round(time.Second).String()
+	},
+	"date": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02 15:04:05 MST")
+	},
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.0f%%", f*100)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Bridge status{{if .ID}} of {{.ID}}{{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; }
+.functional { color: #1a7f37; }
+.dysfunctional, .error { color: #cf222e; }
+.hint { background: #fff8c5; padding: 0.5em; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; }
+</style>
+</head>
+<body>
+<h1>Bridge status</h1>
+<form method="get">
+<label for="id">Bridge fingerprint:</label>
+<input type="text" id="id" name="id" size="50" value="{{.ID}}">
+<input type="submit" value="Look up">
+</form>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{range .Hints}}<p class="hint">{{.}}</p>{{end}}
+{{$now := .Now}}
+{{range .Transports}}
+<h2>{{.Type}}: <span class="{{.State}}">{{describe .State}}</span></h2>
+<table>
+<tr><th>Distributor</th><td>{{if .Distributor}}{{.Distributor}}{{else}}none{{end}}</td></tr>
+<tr><th>Blocked in</th><td>{{range $i, $l := .BlockedIn}}{{if $i}}, {{end}}{{$l}}{{else}}nowhere that we know of{{end}}</td></tr>
+<tr><th>First seen</th><td>{{date .FirstSeen}}</td></tr>
+<tr><th>Descriptor last seen</th><td>{{date .LastSeen}} ({{ago $now .LastSeen}} ago){{if .Stale}} &ndash; <span class="error">stale</span>{{end}}</td></tr>
+<tr><th>Expires</th><td>{{date .Expires}}</td></tr>
+{{if .LastTested}}<tr><th>Last tested</th><td>{{date .LastTested}} ({{ago $now .LastTested}} ago)</td></tr>{{end}}
+{{if .Error}}<tr><th>Error</th><td class="error">{{.Error}}</td></tr>{{end}}
+{{if .History}}<tr><th>Score</th><td>{{percent .Score}} of the last {{len .History}} tests succeeded</td></tr>{{end}}
+</table>
+{{range .Hints}}<p class="hint">{{.}}</p>{{end}}
+{{if .History}}
+<h3>Recent tests</h3>
+<table>
+<tr><th>Time</th><th>Result</th><th>Error</th></tr>
+{{range .HistoryNewestFirst}}<tr><td>{{date .Time}}</td><td class="{{.State}}">{{describe .State}}</td><td>{{.Error}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// normalizeFingerprint turns the given user input into a fingerprint, or a
+// hashed fingerprint.  Tor logs fingerprints in groups of four characters, and
+// sometimes prefixes them with a '$', so we tolerate both.
+func normalizeFingerprint(id string) (string, error) {
+
+	id = strings.Join(strings.Fields(id), "")
+	id = strings.TrimPrefix(id, "$")
+	id = strings.ToUpper(id)
+	if !fingerprintRegexp.MatchString(id) {
+		return "", errors.New("a fingerprint consists of 40 hexadecimal characters")
+	}
+	return id, nil
+}
+
+// newStatusLimiter returns the rate limiter for our status page.
+func newStatusLimiter(cfg StatusPageConfig) *rateLimiter {
+
+	perMinute, globalPerMinute := cfg.LookupsPerMinute, cfg.GlobalLookupsPerMinute
+	if perMinute == 0 {
+		perMinute = DefaultStatusLookupsPerMinute
+	}
+	if globalPerMinute == 0 {
+		globalPerMinute = DefaultStatusGlobalLookupsPerMinute
+	}
+	return newRateLimiter(perMinute, globalPerMinute)
+}
+
+// ParseTrustedProxies parses the given IP addresses of trusted reverse
+// proxies, and returns an error if one of them isn't an IP address.
+func ParseTrustedProxies(addrs []string) ([]net.IP, error) {
+
+	var proxies []net.IP
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address", addr)
+		}
+		proxies = append(proxies, ip)
+	}
+	return proxies, nil
+}
+
+// ClientAddr returns the IP address of the client that sent the given request.
+// If the request comes from one of the given reverse proxies, we trust the
+// last address that the proxy added to X-Forwarded-For.  Otherwise, the
+// client's address is the address that the request's connection comes from,
+// so clients cannot spoof their address.
+func ClientAddr(r *http.Request, trustedProxies []net.IP) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	trusted := false
+	for _, proxy := range trustedProxies {
+		trusted = trusted || proxy.Equal(ip)
+	}
+	if !trusted {
+		return host
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	if last := strings.TrimSpace(forwarded[len(forwarded)-1]); last != "" {
+		return last
+	}
+	return host
+}
+
+// HistoryNewestFirst returns the resource's test history, newest first.
+func (s *ResourceStatus) HistoryNewestFirst() []TestResultStatus {
+
+	history := make([]TestResultStatus, len(s.History))
+	for i, result := range s.History {
+		history[len(s.History)-1-i] = result
+	}
+	return history
+}
+
+// transportHints returns hints that explain the given resource's status to
+// its operator.
+func transportHints(s *ResourceStatus, now time.Time) []string {
+
+	hints := []string{}
+	if s.State == stateNames[core.StateUntested] {
+		hints = append(hints, "We haven't tested your bridge yet.  New bridges are usually tested within minutes after we learn about them.")
+	}
+	if s.Error != "" {
+		lowerErr := strings.ToLower(s.Error)
+		for _, h := range errorHints {
+			if strings.Contains(lowerErr, h.substr) {
+				hints = append(hints, h.hint)
+				break
+			}
+		}
+	}
+	failed := 0
+	for _, result := range s.History {
+		if result.State != stateNames[core.StateFunctional] {
+			failed++
+		}
+	}
+	if len(s.History) >= MinFlakyHistory && failed > 0 && failed < len(s.History) {
+		hints = append(hints, fmt.Sprintf("Your bridge failed %d of its last %d tests, so it seems to be flaky.  "+
+			"Distributors may prefer bridges that pass their tests more reliably.", failed, len(s.History)))
+	}
+	if len(s.BlockedIn) > 0 {
+		hints = append(hints, fmt.Sprintf("Your bridge is blocked in %s.  We don't hand out bridges to users "+
+			"in places where they are blocked.  Consider moving your bridge to a new IP address.", strings.Join(s.BlockedIn, ", ")))
+	}
+	if s.Distributor == "" {
+		hints = append(hints, "Your bridge isn't assigned to any distributor, so we don't hand it out.")
+	}
+	if now.Sub(s.LastSeen) > StaleDescriptorAge {
+		hints = append(hints, fmt.Sprintf("We haven't seen a descriptor of your bridge since %s.  "+
+			"Make sure that your bridge is running and publishes its descriptor.  Otherwise, we will "+
+			"forget about it on %s.", s.LastSeen.UTC().Format(time.RFC1123), s.Expires.UTC().Format(time.RFC1123)))
+	}
+	return hints
+}
+
+// notFoundHints returns hints for operators whose bridge we don't know.
+func notFoundHints() []string {
+	return []string{
+		"We don't know a bridge with this fingerprint.  It can take a few hours until we learn about new bridges.",
+		"Make sure that your torrc sets BridgeRelay to 1, and that your bridge publishes its descriptor.",
+		"Bridges whose BridgeDistribution option is set to \"none\" are never handed out, and we don't know about them.",
+	}
+}
+
+// newStatusPage returns the HTML status page for the given bridge status.
+func newStatusPage(id string, status *BridgeStatus, now time.Time) *statusPage {
+
+	page := &statusPage{ID: id, Now: now}
+	for _, rStatus := range status.Resources {
+		page.Transports = append(page.Transports, &transportView{
+			ResourceStatus: rStatus,
+			Stale:          now.Sub(rStatus.LastSeen) > StaleDescriptorAge,
+			Hints:          transportHints(rStatus, now),
+		})
+	}
+	return page
+}
+
+// writeStatusPage renders the given status page with the given HTTP status
+// code.
+func writeStatusPage(w http.ResponseWriter, code int, page *statusPage) {
+
+	if page.Now.IsZero() {
+		page.Now = time.Now().UTC()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := statusTemplate.Execute(w, page); err != nil {
+		// We already sent our status code, so all we can do is log.
+		log.Printf("Failed to render status page: %s", err)
+	}
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeFingerprint(t *testing.T) {
+
+	fpr := "0123456789ABCDEF0123456789ABCDEF01234567"
+	for _, input := range []string{
+		fpr,
+		strings.ToLower(fpr),
+		"$" + fpr,
+		" 0123 4567 89AB CDEF 0123 4567 89AB CDEF 0123 4567 ",
+	} {
+		id, err := normalizeFingerprint(input)
+		if err != nil {
+			t.Errorf("rejected fingerprint %q: %s", input, err)
+		}
+		if id != fpr {
+			t.Errorf("expected %q but got %q", fpr, id)
+		}
+	}
+	for _, input := range []string{"", fpr[:39], fpr + "0", "<script>" + fpr[8:]} {
+		if _, err := normalizeFingerprint(input); err == nil {
+			t.Errorf("accepted invalid fingerprint %q", input)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+
+	proxies := []net.IP{net.ParseIP("10.0.0.1")}
+	r := httptest.NewRequest("GET", "/status", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+	if addr := ClientAddr(r, proxies); addr != "1.2.3.4" {
+		t.Errorf("trusted X-Forwarded-For of non-proxy: %s", addr)
+	}
+
+	// Without a trusted proxy, even loopback peers cannot spoof their
+	// address.
+	r.RemoteAddr = "127.0.0.1:1234"
+	if addr := ClientAddr(r, proxies); addr != "127.0.0.1" {
+		t.Errorf("trusted X-Forwarded-For of untrusted loopback peer: %s", addr)
+	}
+	if addr := ClientAddr(r, nil); addr != "127.0.0.1" {
+		t.Errorf("trusted X-Forwarded-For without trusted proxies: %s", addr)
+	}
+
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "9.9.9.9, 5.6.7.8")
+	if addr := ClientAddr(r, proxies); addr != "5.6.7.8" {
+		t.Errorf("expected address that our proxy added but got %s", addr)
+	}
+
+	r.Header.Del("X-Forwarded-For")
+	if addr := ClientAddr(r, proxies); addr != "10.0.0.1" {
+		t.Errorf("expected proxy's address but got %s", addr)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+
+	proxies, err := ParseTrustedProxies([]string{"127.0.0.1", "::1"})
+	if err != nil {
+		t.Errorf("rejected valid trusted proxies: %s", err)
+	}
+	if len(proxies) != 2 || !proxies[1].Equal(net.IPv6loopback) {
+		t.Errorf("expected two trusted proxies but got %v", proxies)
+	}
+	if _, err := ParseTrustedProxies([]string{"localhost"}); err == nil {
+		t.Errorf("accepted trusted proxy that isn't an IP address")
+	}
+}
+
+func TestTransportHints(t *testing.T) {
+
+	now := time.Now().UTC()
+	status := &ResourceStatus{
+		State:       "dysfunctional",
+		Error:       "timed out waiting for bootstrap",
+		Distributor: testDistName,
+		LastSeen:    now,
+	}
+	hints := transportHints(status, now)
+	if len(hints) != 1 || !strings.Contains(hints[0], "fails to bootstrap") {
+		t.Errorf("expected bootstrap hint but got %q", hints)
+	}
+
+	status.Error = "dial tcp 1.2.3.4:1234: connect: connection refused"
+	status.BlockedIn = []string{"ir"}
+	status.Distributor = ""
+	status.LastSeen = now.Add(-2 * StaleDescriptorAge)
+	status.History = []TestResultStatus{{State: "functional"}, {State: "dysfunctional"},
+		{State: "functional"}, {State: "dysfunctional"}}
+	hints = transportHints(status, now)
+	for _, want := range []string{"Nothing accepts connections", "flaky", "blocked in ir", "any distributor", "descriptor"} {
+		found := false
+		for _, hint := range hints {
+			found = found || strings.Contains(hint, want)
+		}
+		if !found {
+			t.Errorf("expected hint containing %q but got %q", want, hints)
+		}
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+
+	b := newTestBackend([]string{"vanilla"})
+	b.statusLimiter = newRateLimiter(1, 100)
+	bridge := newScoredBridge(1, 3, 1)
+	bridge.Test().Error = "<b>connection refused</b>"
+	b.Resources.Add(bridge)
+
+	lookup := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/status"+query, nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		rr := httptest.NewRecorder()
+		b.statusHandler(rr, req)
+		return rr
+	}
+
+	// Browsers that don't give us a fingerprint get our form.
+	rr := lookup("")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<form") {
+		t.Errorf("expected form but got %d: %s", rr.Code, rr.Body)
+	}
+	rr = lookup("?id=foo")
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "40 hexadecimal characters") {
+		t.Errorf("expected error message but got %d: %s", rr.Code, rr.Body)
+	}
+
+	rr = lookup("?id=" + strings.ToLower(bridge.Fingerprint))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected HTML but got %q", ct)
+	}
+	page := rr.Body.String()
+	for _, want := range []string{"vanilla", "75%", testDistName, "Recent tests",
+		"Nothing accepts connections", "&lt;b&gt;connection refused&lt;/b&gt;"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("status page lacks %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "<b>connection refused") {
+		t.Error("status page doesn't escape test errors")
+	}
+
+	// We already used up our only lookup.  Invalid fingerprints don't count.
+	rr = lookup("?id=" + strings.Repeat("0", 40))
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected rate-limited lookup but got %d", rr.Code)
+	}
+
+	b.statusLimiter = nil
+	rr = lookup("?id=" + strings.Repeat("0", 40))
+	if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), "BridgeRelay") {
+		t.Errorf("expected hints for unknown bridge but got %d: %s", rr.Code, rr.Body)
+	}
+}
@@ -0,0 +1,495 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	testDistName    = "stub"
+	testToken       = "StubApiToken"
+	testStreamPath  = "/resource-stream"
+	testGetPath     = "/resources"
+	testStreamDelay = 5 * time.Second
+	// testRetryInterval is the minimum time that our test distributors wait
+	// before reconnecting to the backend.
+	testRetryInterval = 10 * time.Millisecond
+)
+
+// newTestBackend returns a backend that owns the given resource types and
+// maps all of its resources to our test distributor.
+func newTestBackend(rTypes []string) *BackendContext {
+
+	b := &BackendContext{}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = map[string]string{testDistName: testToken}
+	b.Config.Backend.ResourceStreamEndpoint = testStreamPath
+	b.Config.Backend.ResourcesEndpoint = testGetPath
+	b.Resources = *core.NewBackendResources(rTypes, BuildStencil(map[string]int{testDistName: 1}))
+
+	return b
+}
+
+// gatedBackend serves the resource stream of a backend, which can be swapped
+// at runtime, but only lets requests through after they were admitted.  This
+// allows tests to control when a distributor gets to reconnect.
+type gatedBackend struct {
+	sync.Mutex
+	backend *BackendContext
+	gate    chan bool
+}
+
+func newGatedBackend(b *BackendContext) (*gatedBackend, *httptest.Server) {
+	g := &gatedBackend{backend: b, gate: make(chan bool, 1)}
+	return g, httptest.NewServer(g)
+}
+
+func (g *gatedBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	<-g.gate
+	g.Lock()
+	b := g.backend
+	g.Unlock()
+	b.resourcesHandler(w, r)
+}
+
+// admit lets the next request through.
+func (g *gatedBackend) admit() {
+	g.gate <- true
+}
+
+// swap replaces the backend, which simulates a backend restart.
+func (g *gatedBackend) swap(b *BackendContext) {
+	g.Lock()
+	defer g.Unlock()
+	g.backend = b
+}
+
+// waitForSubscribers waits until the given backend has the given number of
+// registered subscribers for our test distributor.
+func waitForSubscribers(t *testing.T, b *BackendContext, num int) {
+
+	for i := 0; i < 500; i++ {
+		b.Resources.RLock()
+		er, exists := b.Resources.EventRecipients[testDistName]
+		n := 0
+		if exists {
+			n = len(er.Subscribers)
+		}
+		b.Resources.RUnlock()
+		if n == num {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("backend never reached %d registered subscriber(s)", num)
+}
+
+// newTestBridge returns a vanilla bridge whose fingerprint is derived from the
+// given number.
+func newTestBridge(num int, addr string) *resources.Bridge {
+
+	b := resources.NewBridge()
+	b.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP(addr)}}
+	b.Port = uint16(1000 + num)
+	b.Fingerprint = fmt.Sprintf("%040X", num)
+	return b
+}
+
+// recvDiff returns the next resource diff from the given channel, or fails the
+// test if none arrives in time.
+func recvDiff(t *testing.T, c chan *core.ResourceDiff) *core.ResourceDiff {
+
+	select {
+	case diff := <-c:
+		return diff
+	case <-time.After(testStreamDelay):
+		t.Fatal("timed out waiting for resource diff")
+	}
+	return nil
+}
+
+// startTestStream starts a resource stream from the given server's backend and
+// returns the stream's channel and IPC mechanism.
+func startTestStream(srv *httptest.Server, rType string) (chan *core.ResourceDiff, *mechanisms.HttpsIpcContext) {
+
+	rStream := make(chan *core.ResourceDiff)
+	ipc := mechanisms.NewHttpsIpc(srv.URL + testStreamPath)
+	ipc.SetRetryInterval(testRetryInterval, 10*testRetryInterval)
+	ipc.StartStream(&core.ResourceRequest{
+		RequestOrigin: testDistName,
+		ResourceTypes: []string{rType},
+		BearerToken:   testToken,
+		Receiver:      rStream,
+	})
+	return rStream, ipc
+}
+
+func TestResourceStream(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b := newTestBackend([]string{rType})
+	srv := httptest.NewServer(http.HandlerFunc(b.resourcesHandler))
+	defer srv.Close()
+
+	b1, b2 := newTestBridge(1, "1.1.1.1"), newTestBridge(2, "2.2.2.2")
+	b.Resources.Add(b1)
+	b.Resources.Add(b2)
+
+	// Our distributor is a hashring that's fed by the resource stream, just
+	// like the ones that our actual distributors maintain.
+	ring := core.NewHashring()
+	rStream, ipc := startTestStream(srv, rType)
+	defer ipc.StopStream()
+
+	// The first diff contains the initial batch of resources.
+	ring.ApplyDiff(recvDiff(t, rStream))
+	if ring.Len() != 2 {
+		t.Fatalf("expected 2 resources in initial batch but got %d", ring.Len())
+	}
+
+	// A new resource must show up as new.
+	b3 := newTestBridge(3, "3.3.3.3")
+	b.Resources.Add(b3)
+	diff := recvDiff(t, rStream)
+	if len(diff.New[rType]) != 1 || len(diff.Changed) != 0 || len(diff.Gone) != 0 {
+		t.Fatalf("expected diff with one new resource but got: %s", diff)
+	}
+	ring.ApplyDiff(diff)
+	if ring.Len() != 3 {
+		t.Fatalf("expected 3 resources but got %d", ring.Len())
+	}
+
+	// A bridge that changed its address must show up as changed.
+	b3Changed := newTestBridge(3, "4.4.4.4")
+	b.Resources.Add(b3Changed)
+	diff = recvDiff(t, rStream)
+	if len(diff.Changed[rType]) != 1 || len(diff.New) != 0 || len(diff.Gone) != 0 {
+		t.Fatalf("expected diff with one changed resource but got: %s", diff)
+	}
+	ring.ApplyDiff(diff)
+	r, err := ring.GetExact(b3.Uid())
+	if err != nil {
+		t.Fatalf("changed resource is missing from hashring: %s", err)
+	}
+	if r.Oid() != b3Changed.Oid() {
+		t.Errorf("changed resource was not updated in hashring")
+	}
+
+	// Expire b1, prune our backend, and make sure that b1 disappears from our
+	// distributor's hashring.
+	hashring := b.Resources.Collection[rType]
+	for _, node := range hashring.Hashnodes {
+		if node.Hashkey == b1.Uid() {
+			node.LastUpdate = time.Now().UTC().Add(-b1.Expiry() - time.Minute)
+		}
+	}
+	pruned := b.Resources.Prune()
+	if len(pruned[rType]) != 1 {
+		t.Fatalf("expected 1 pruned resource but got %d", len(pruned[rType]))
+	}
+	diff = recvDiff(t, rStream)
+	if len(diff.Gone[rType]) != 1 || len(diff.New) != 0 || len(diff.Changed) != 0 {
+		t.Fatalf("expected diff with one gone resource but got: %s", diff)
+	}
+	ring.ApplyDiff(diff)
+	if ring.Len() != 2 {
+		t.Fatalf("expected 2 resources but got %d", ring.Len())
+	}
+	if _, err := ring.GetExact(b1.Uid()); err == nil {
+		t.Errorf("gone resource is still in hashring")
+	}
+}
+
+func TestResourceStreamResume(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b := newTestBackend([]string{rType})
+	g, srv := newGatedBackend(b)
+	defer srv.Close()
+	b.Resources.Add(newTestBridge(1, "1.1.1.1"))
+
+	g.admit()
+	rStream, ipc := startTestStream(srv, rType)
+	defer ipc.StopStream()
+
+	ring := core.NewHashring()
+	ring.ApplyDiff(recvDiff(t, rStream))
+	if ring.Len() != 1 {
+		t.Fatalf("expected 1 resource in initial batch but got %d", ring.Len())
+	}
+
+	// Cut the distributor's connection and add resources while it's gone.
+	srv.CloseClientConnections()
+	waitForSubscribers(t, b, 0)
+	b.Resources.Add(newTestBridge(2, "2.2.2.2"))
+	b.Resources.Add(newTestBridge(3, "3.3.3.3"))
+
+	// Once the distributor is back, the backend should replay the two diffs
+	// that the distributor missed, one by one.
+	g.admit()
+	for i := 0; i < 2; i++ {
+		diff := recvDiff(t, rStream)
+		if len(diff.New[rType]) != 1 || len(diff.Changed) != 0 || len(diff.Gone) != 0 {
+			t.Fatalf("expected replayed diff with one new resource but got: %s", diff)
+		}
+		ring.ApplyDiff(diff)
+	}
+	if ring.Len() != 3 {
+		t.Fatalf("expected 3 resources after replay but got %d", ring.Len())
+	}
+}
+
+func TestResourceStreamReset(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b1 := newTestBackend([]string{rType})
+	g, srv := newGatedBackend(b1)
+	defer srv.Close()
+	b1.Resources.Add(newTestBridge(1, "1.1.1.1"))
+	b1.Resources.Add(newTestBridge(2, "2.2.2.2"))
+
+	g.admit()
+	rStream, ipc := startTestStream(srv, rType)
+	defer ipc.StopStream()
+
+	ring := core.NewHashring()
+	ring.ApplyDiff(recvDiff(t, rStream))
+	if ring.Len() != 2 {
+		t.Fatalf("expected 2 resources in initial batch but got %d", ring.Len())
+	}
+
+	// Simulate a backend restart.  The new backend knows nothing about our
+	// distributor's sequence numbers, so it has to send a snapshot, which
+	// the distributor should receive as a diff against its current state.
+	srv.CloseClientConnections()
+	waitForSubscribers(t, b1, 0)
+	b2 := newTestBackend([]string{rType})
+	b2.Resources.Add(newTestBridge(2, "2.2.2.2"))
+	b2.Resources.Add(newTestBridge(3, "3.3.3.3"))
+	g.swap(b2)
+	g.admit()
+
+	diff := recvDiff(t, rStream)
+	if diff.FullUpdate {
+		t.Errorf("snapshot was relayed to distributor as is")
+	}
+	if len(diff.New[rType]) != 1 || len(diff.Gone[rType]) != 1 || len(diff.Changed[rType]) != 0 {
+		t.Fatalf("expected diff with one new and one gone resource but got: %s", diff)
+	}
+	ring.ApplyDiff(diff)
+	if ring.Len() != 2 {
+		t.Fatalf("expected 2 resources after reset but got %d", ring.Len())
+	}
+	if _, err := ring.GetExact(newTestBridge(1, "1.1.1.1").Uid()); err == nil {
+		t.Errorf("resource that's gone after reset is still in hashring")
+	}
+}
+
+// startBackendAt starts serving the given backend's Web API at the given
+// address, e.g. "127.0.0.1:0".
+func startBackendAt(t *testing.T, b *BackendContext, addr string) *httptest.Server {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", addr, err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(b.resourcesHandler))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	return srv
+}
+
+// killBackend stops the given server and cuts all of its connections,
+// including the ones that are busy streaming resources.
+func killBackend(srv *httptest.Server) {
+
+	// Close the listener first, so distributors can't reconnect before we
+	// get to cut their connections.
+	srv.Listener.Close()
+	srv.CloseClientConnections()
+	srv.Close()
+}
+
+func TestResourceStreamRestart(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b1 := newTestBackend([]string{rType})
+	b1.Resources.Add(newTestBridge(1, "1.1.1.1"))
+	srv := startBackendAt(t, b1, "127.0.0.1:0")
+	defer func() { srv.Close() }()
+	addr := srv.Listener.Addr().String()
+
+	rStream, ipc := startTestStream(srv, rType)
+	defer ipc.StopStream()
+	ring := core.NewHashring()
+	ring.ApplyDiff(recvDiff(t, rStream))
+	if ring.Len() != 1 {
+		t.Fatalf("expected 1 resource in initial batch but got %d", ring.Len())
+	}
+
+	// Kill the backend and give our distributor time to fail a few
+	// reconnection attempts.
+	killBackend(srv)
+	time.Sleep(10 * testRetryInterval)
+
+	// Bring up a new backend at the same address.  Our distributor must find
+	// it on its own.
+	b2 := newTestBackend([]string{rType})
+	b2.Resources.Add(newTestBridge(1, "1.1.1.1"))
+	b2.Resources.Add(newTestBridge(2, "2.2.2.2"))
+	srv = startBackendAt(t, b2, addr)
+
+	diff := recvDiff(t, rStream)
+	if len(diff.New[rType]) != 1 || len(diff.Changed) != 0 || len(diff.Gone) != 0 {
+		t.Fatalf("expected diff with one new resource after restart but got: %s", diff)
+	}
+	ring.ApplyDiff(diff)
+	if ring.Len() != 2 {
+		t.Fatalf("expected 2 resources after restart but got %d", ring.Len())
+	}
+
+	// The new connection must carry subsequent diffs as usual.
+	b2.Resources.Add(newTestBridge(3, "3.3.3.3"))
+	if diff := recvDiff(t, rStream); len(diff.New[rType]) != 1 {
+		t.Fatalf("expected diff with one new resource but got: %s", diff)
+	}
+}
+
+func TestResourceStreamStop(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b := newTestBackend([]string{rType})
+	b.Resources.Add(newTestBridge(1, "1.1.1.1"))
+	srv := startBackendAt(t, b, "127.0.0.1:0")
+	defer srv.Close()
+
+	// Stop a stream whose receiver never reads.  It must neither hang nor
+	// keep the backend's subscriber around.
+	_, ipc := startTestStream(srv, rType)
+	waitForSubscribers(t, b, 1)
+	ipc.StopStream()
+	waitForSubscribers(t, b, 0)
+
+	// Stop a stream while the backend is gone and the distributor keeps
+	// trying to reconnect.
+	rStream, ipc := startTestStream(srv, rType)
+	recvDiff(t, rStream)
+	killBackend(srv)
+	time.Sleep(10 * testRetryInterval)
+	ipc.StopStream()
+}
+
+// openRawStream requests a resource stream from the given server with the
+// given HTTP headers and returns the response.
+func openRawStream(t *testing.T, srv *httptest.Server, rType string, header http.Header) *http.Response {
+
+	body, err := json.Marshal(&core.ResourceRequest{
+		RequestOrigin: testDistName,
+		ResourceTypes: []string{rType},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, srv.URL+testStreamPath, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestResourceStreamFormats(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b := newTestBackend([]string{rType})
+	srv := httptest.NewServer(http.HandlerFunc(b.resourcesHandler))
+	defer srv.Close()
+	b.Resources.Add(newTestBridge(1, "1.1.1.1"))
+
+	tests := map[string]string{
+		"":                     mechanisms.ContentTypeLegacy,
+		"text/html":            mechanisms.ContentTypeLegacy,
+		"application/x-ndjson": mechanisms.ContentTypeNDJSON,
+		"text/event-stream":    mechanisms.ContentTypeSSE,
+	}
+	for accept, contentType := range tests {
+		header := http.Header{}
+		if accept != "" {
+			header.Set("Accept", accept)
+		}
+		resp := openRawStream(t, srv, rType, header)
+		if ct := resp.Header.Get("Content-Type"); ct != contentType {
+			t.Errorf("expected content type %q for %q but got %q", contentType, accept, ct)
+		}
+		msg, err := mechanisms.NewStreamReader(resp.Body, resp.Header.Get("Content-Type")).ReadMessage()
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read %s message: %s", contentType, err)
+		}
+		tmp := resources.TmpResourceDiff{}
+		if err := json.Unmarshal(msg, &tmp); err != nil {
+			t.Fatalf("failed to unmarshal %s message: %s", contentType, err)
+		}
+		if !tmp.FullUpdate || len(tmp.New[rType]) != 1 {
+			t.Errorf("expected snapshot with one resource in %s stream but got %q", contentType, msg)
+		}
+	}
+}
+
+func TestResourceStreamLastEventID(t *testing.T) {
+
+	rType := resources.ResourceTypeVanilla
+	b := newTestBackend([]string{rType})
+	srv := httptest.NewServer(http.HandlerFunc(b.resourcesHandler))
+	defer srv.Close()
+	b.Resources.Add(newTestBridge(1, "1.1.1.1"))
+
+	header := http.Header{}
+	header.Set("Accept", mechanisms.ContentTypeSSE)
+	resp := openRawStream(t, srv, rType, header)
+	msg, err := mechanisms.NewStreamReader(resp.Body, resp.Header.Get("Content-Type")).ReadMessage()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := resources.TmpResourceDiff{}
+	if err := json.Unmarshal(msg, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscribers(t, b, 0)
+	b.Resources.Add(newTestBridge(2, "2.2.2.2"))
+
+	// An SSE client that reconnects with the Last-Event-ID header must get
+	// the diff that it missed rather than another snapshot.
+	header.Set("Last-Event-ID", fmt.Sprintf("%d", snapshot.Sequence))
+	resp = openRawStream(t, srv, rType, header)
+	defer resp.Body.Close()
+	msg, err = mechanisms.NewStreamReader(resp.Body, resp.Header.Get("Content-Type")).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := resources.TmpResourceDiff{}
+	if err := json.Unmarshal(msg, &diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.FullUpdate || diff.Sequence != snapshot.Sequence+1 || len(diff.New[rType]) != 1 {
+		t.Errorf("expected replayed diff with sequence number %d but got %q", snapshot.Sequence+1, msg)
+	}
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/testers"
+)
+
+// DefaultTester is the tester for resource types that our configuration
+// doesn't assign a tester to.
+const DefaultTester = testers.TesterBridgestrap
+
+// testerName returns the name of the tester that's responsible for the given
+// resource type.
+func (cfg *BackendConfig) testerName(rType string) string {
+
+	if name, exists := cfg.ResourceTesters[rType]; exists {
+		return name
+	}
+	return DefaultTester
+}
+
+// testerParams returns the JSON parameters of the tester with the given name.
+func (cfg *BackendConfig) testerParams(name string) (json.RawMessage, error) {
+
+	if params, exists := cfg.Testers[name]; exists || name != testers.TesterBridgestrap {
+		return params, nil
+	}
+	// Older configuration files only have a bridgestrap endpoint.
+	return json.Marshal(&testers.BridgestrapConfig{Endpoint: cfg.BridgestrapEndpoint})
+}
+
+// newTestPools creates a resource test pool for each tester that's responsible
+// for at least one of the given resource types, and returns the pools keyed by
+// tester name.
+func newTestPools(cfg *BackendConfig, rTypes []string, metrics *Metrics) (map[string]*ResourceTestPool, error) {
+
+	pools := make(map[string]*ResourceTestPool)
+	for _, rType := range rTypes {
+		name := cfg.testerName(rType)
+		if _, exists := pools[name]; exists {
+			continue
+		}
+		params, err := cfg.testerParams(name)
+		if err != nil {
+			return nil, err
+		}
+		tester, err := core.NewTester(name, params)
+		if err != nil {
+			// Stop the pools that we already started.
+			for _, p := range pools {
+				p.Stop()
+			}
+			return nil, fmt.Errorf("failed to create tester %q: %s", name, err)
+		}
+		pools[name] = NewResourceTestPool(name, tester, metrics)
+	}
+	return pools, nil
+}
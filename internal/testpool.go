@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	// FarInTheFuture determines a time span that's far enough in the future to
+	// practically count as infinity.
+	FarInTheFuture = time.Hour * 24 * 365 * 100
+	// MaxResources determines the number of resources that we're initially
+	// willing to buffer before handing them to our tester.
+	MaxResources = 25
+	// MinBatchSize and MaxBatchSize bound the number of resources that we
+	// hand to our tester at once.  Within these bounds, we tune the batch
+	// size to our tester's latency.
+	MinBatchSize = 5
+	MaxBatchSize = 100
+	// TargetTestLatency is the time that we would like a batch test to
+	// take.  If tests take longer, we shrink our batches; if they're much
+	// faster, we grow them.
+	TargetTestLatency = 30 * time.Second
+	// MaxTestAttempts determines how often we try to test a batch of
+	// resources before giving up.
+	MaxTestAttempts = 5
+	// TestRetryDelay is the time that we wait before re-trying a failed
+	// test.  The delay doubles with each attempt, up to MaxTestRetryDelay.
+	TestRetryDelay    = 30 * time.Second
+	MaxTestRetryDelay = 10 * time.Minute
+)
+
+// ResourceTestPool implements a pool to which we add resources until it's time
+// to hand them to our tester, e.g. bridgestrap.
+type ResourceTestPool struct {
+	sync.Mutex
+	name         string
+	flushTimeout time.Duration
+	retryDelay   time.Duration
+	maxAttempts  int
+	batchSize    int
+	numPending   int
+	shutdown     chan bool
+	pending      chan core.Resource
+	tester       core.Tester
+	inProgress   map[string]bool
+	metrics      *Metrics
+}
+
+// NewResourceTestPool returns a new resource test pool that tests resources
+// with the given tester, whose name we use in log messages and metrics.  The
+// metrics may be nil.
+func NewResourceTestPool(name string, tester core.Tester, metrics *Metrics) *ResourceTestPool {
+	p := &ResourceTestPool{}
+	p.name = name
+	p.flushTimeout = time.Minute
+	p.retryDelay = TestRetryDelay
+	p.maxAttempts = MaxTestAttempts
+	p.batchSize = MaxResources
+	p.shutdown = make(chan bool)
+	p.pending = make(chan core.Resource)
+	p.tester = tester
+	p.inProgress = make(map[string]bool)
+	p.metrics = metrics
+	if metrics != nil {
+		metrics.TestBatchSize.WithLabelValues(name).Set(float64(p.batchSize))
+	}
+	go p.dispatch()
+
+	return p
+}
+
+// GetTestFunc returns a function that's executed when a new resource is added
+// to rdsys's backend.  The function takes as input a resource and submits it
+// to our testing pool.
+func (p *ResourceTestPool) GetTestFunc() core.TestFunc {
+	return func(r core.Resource) {
+		p.pending <- r
+	}
+}
+
+// Stop stops the test pool by signalling to the dispatcher that it's time to
+// shut down.
+func (p *ResourceTestPool) Stop() {
+	close(p.shutdown)
+}
+
+// alreadyInProgress returns 'true' if the given bridge line is being tested
+// right now.
+func (p *ResourceTestPool) alreadyInProgress(bridgeLine string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, exists := p.inProgress[bridgeLine]; exists {
+		return true
+	}
+	p.inProgress[bridgeLine] = true
+	return false
+}
+
+// getBatchSize returns the number of resources that we currently hand to our
+// tester at once.
+func (p *ResourceTestPool) getBatchSize() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.batchSize
+}
+
+// tuneBatchSize adjusts our batch size to the time it took our tester to test
+// a batch of the given size.  Failed or slow tests halve the batch size and
+// fast tests of full batches grow it.
+func (p *ResourceTestPool) tuneBatchSize(size int, latency time.Duration, failed bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	oldSize := p.batchSize
+	if failed || latency > TargetTestLatency {
+		p.batchSize /= 2
+	} else if latency < TargetTestLatency/2 && size >= p.batchSize {
+		p.batchSize += MinBatchSize
+	}
+	if p.batchSize < MinBatchSize {
+		p.batchSize = MinBatchSize
+	}
+	if p.batchSize > MaxBatchSize {
+		p.batchSize = MaxBatchSize
+	}
+	if p.batchSize != oldSize {
+		log.Printf("Changed %s test batch size from %d to %d.", p.name, oldSize, p.batchSize)
+	}
+	if p.metrics != nil {
+		p.metrics.TestBatchSize.WithLabelValues(p.name).Set(float64(p.batchSize))
+	}
+}
+
+// addPending adds the given number, which may be negative, to the number of
+// resources that wait for a test.
+func (p *ResourceTestPool) addPending(num int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.numPending += num
+	if p.metrics != nil {
+		p.metrics.TestPending.WithLabelValues(p.name).Set(float64(p.numPending))
+	}
+}
+
+// countFailure increments our failure metric for the given reason.
+func (p *ResourceTestPool) countFailure(reason string, num int) {
+	if p.metrics != nil {
+		p.metrics.TestFailures.WithLabelValues(p.name, reason).Add(float64(num))
+	}
+}
+
+// dispatch handles the following requests:
+// 1) Incoming resources to be tested
+// 2) A timer whose expiry signals that it's time to test bridges
+// 3) A shutdown signal, indicating that the function should return
+func (p *ResourceTestPool) dispatch() {
+	defer log.Printf("Shutting down resource pool ticker.")
+	log.Printf("Starting resource pool ticker.")
+
+	ticker := time.NewTicker(FarInTheFuture)
+	rMap := make(map[string]core.Resource)
+	for {
+		select {
+		case <-ticker.C:
+			// The timer is re-started once the next resource arrives.
+			ticker.Reset(FarInTheFuture)
+			if len(rMap) == 0 {
+				break
+			}
+			log.Println("Test pool timer expired.  Testing resources.")
+			go p.testResources(rMap)
+			rMap = make(map[string]core.Resource)
+		case r := <-p.pending:
+			if p.alreadyInProgress(r.String()) {
+				break
+			}
+
+			// We got a new resource to test.  Start timer if our pool was
+			// empty.
+			if len(rMap) == 0 {
+				log.Println("Starting test pool timer.")
+				ticker.Reset(p.flushTimeout)
+			}
+			rMap[r.String()] = r
+			p.addPending(1)
+
+			// Test resources if our pool is full.
+			if len(rMap) >= p.getBatchSize() {
+				log.Println("Test pool reached capacity.  Resetting timer and testing resources.")
+				ticker.Reset(FarInTheFuture)
+				go p.testResources(rMap)
+				rMap = make(map[string]core.Resource)
+			}
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// testResources hands all resources that are currently in our pool to our
+// tester.  The tester adds the testing results to each resource's state.  If
+// the test fails, or the tester's results lack some of the resources, we try
+// again with exponential backoff, until we give up after maxAttempts.
+func (p *ResourceTestPool) testResources(rMap map[string]core.Resource) {
+	defer func() {
+		p.Lock()
+		for bridgeLine, _ := range rMap {
+			delete(p.inProgress, bridgeLine)
+		}
+		p.Unlock()
+	}()
+
+	rs := []core.Resource{}
+	for _, r := range rMap {
+		rs = append(rs, r)
+	}
+	defer func() { p.addPending(-len(rs)) }()
+
+	delay := p.retryDelay
+	for attempt := 1; len(rs) > 0; attempt++ {
+		untested := p.testBatch(rs)
+		p.addPending(len(untested) - len(rs))
+		rs = untested
+		if len(rs) == 0 {
+			return
+		}
+		if attempt >= p.maxAttempts {
+			log.Printf("Giving up on testing %d resources after %d attempts.", len(rs), attempt)
+			return
+		}
+
+		log.Printf("Re-trying test of %d resources in %s.", len(rs), delay)
+		select {
+		case <-time.After(delay):
+		case <-p.shutdown:
+			return
+		}
+		delay *= 2
+		if delay > MaxTestRetryDelay {
+			delay = MaxTestRetryDelay
+		}
+	}
+}
+
+// testBatch hands the given resources to our tester and returns the resources
+// that remain untested.
+func (p *ResourceTestPool) testBatch(rs []core.Resource) []core.Resource {
+
+	start := time.Now()
+	err := p.tester.Test(rs)
+	latency := time.Since(start)
+	if p.metrics != nil {
+		p.metrics.TestDuration.WithLabelValues(p.name).Observe(latency.Seconds())
+	}
+
+	untested, untestable := []core.Resource{}, []core.Resource{}
+	if partial, ok := err.(*core.PartialTestError); ok {
+		log.Printf("Resource test was incomplete: %s", err)
+		p.countFailure("missing", len(partial.Untested))
+		p.countFailure("untestable", len(partial.Untestable))
+		untested, untestable = partial.Untested, partial.Untestable
+	} else if err != nil {
+		log.Printf("Resource test failed: %s", err)
+		p.countFailure("error", 1)
+		p.tuneBatchSize(len(rs), latency, true)
+		return rs
+	}
+	p.tuneBatchSize(len(rs), latency, false)
+
+	// We don't retry untestable resources, so we only return the untested
+	// ones.
+	isUntested := make(map[core.Resource]bool)
+	for _, r := range append(untested, untestable...) {
+		isUntested[r] = true
+	}
+	numFunctional, numDysfunctional := 0, 0
+	for _, r := range rs {
+		if isUntested[r] {
+			continue
+		}
+		switch r.Test().Snapshot().State {
+		case core.StateFunctional:
+			numFunctional++
+		case core.StateDysfunctional:
+			numDysfunctional++
+		}
+	}
+	log.Printf("Tested %d resources in %s: %d functional and %d dysfunctional.",
+		len(rs)-len(isUntested), latency, numFunctional, numDysfunctional)
+
+	return untested
+}
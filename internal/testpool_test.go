@@ -0,0 +1,284 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// DummyTester is a drop-in replacement for bridgestrap and facilitates
+// testing.  It considers all resources functional.
+type DummyTester struct{}
+
+func (d *DummyTester) Test(rs []core.Resource) error {
+	for _, r := range rs {
+		r.Test().Record(core.StateFunctional, time.Now().UTC(), "")
+	}
+	return nil
+}
+
+// flakyTester fails the first given number of tests, and then leaves the first
+// resource of the given number of tests untested.
+type flakyTester struct {
+	sync.Mutex
+	failures int
+	partials int
+	calls    int
+}
+
+func (f *flakyTester) Test(rs []core.Resource) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("tester unreachable")
+	}
+	if f.partials > 0 {
+		f.partials--
+		for _, r := range rs[1:] {
+			r.Test().Record(core.StateFunctional, time.Now().UTC(), "")
+		}
+		return &core.PartialTestError{Untested: rs[:1]}
+	}
+	for _, r := range rs {
+		r.Test().Record(core.StateFunctional, time.Now().UTC(), "")
+	}
+	return nil
+}
+
+func (f *flakyTester) numCalls() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls
+}
+
+func TestInProgress(t *testing.T) {
+
+	bridgeLine := "dummy"
+	p := NewResourceTestPool("dummy", &DummyTester{}, nil)
+
+	if p.alreadyInProgress(bridgeLine) == true {
+		t.Fatal("bridge line isn't currently being tested")
+	}
+
+	p.inProgress[bridgeLine] = true
+
+	if p.alreadyInProgress(bridgeLine) != true {
+		t.Fatal("bridge line is currently being tested")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+
+	d := core.NewDummy(0, 0)
+	p := NewResourceTestPool("dummy", &DummyTester{}, nil)
+	// Set flush timeout to a nanosecond, so it triggers practically instantly.
+	p.flushTimeout = time.Nanosecond
+	defer p.Stop()
+
+	p.pending <- d
+	d.Test().Record(core.StateUntested, time.Now().UTC(), "")
+	p.pending <- d
+	time.Sleep(time.Millisecond)
+
+	if d.Test().Snapshot().State == core.StateUntested {
+		t.Fatal("resource should not be untested")
+	}
+}
+
+func TestTestFunc(t *testing.T) {
+
+	p := NewResourceTestPool("dummy", &DummyTester{}, nil)
+	defer p.Stop()
+
+	f := p.GetTestFunc()
+	dummies := [25]*core.Dummy{}
+	for i := 0; i < len(dummies); i++ {
+		k := core.Hashkey(i)
+		dummies[i] = core.NewDummy(k, k)
+		f(dummies[i])
+	}
+
+	// Were all states set correctly?
+	for i := 0; i < len(dummies); i++ {
+		if state := dummies[i].Test().Snapshot().State; state != core.StateFunctional {
+			t.Fatal("resource state was set incorrectly", state)
+		}
+	}
+}
+
+func TestNewTestPools(t *testing.T) {
+
+	cfg := &BackendConfig{
+		BridgestrapEndpoint: "http://127.0.0.1:5001/bridge-state",
+		ResourceTesters:     map[string]string{"snowflake": "tcp"},
+	}
+	pools, err := newTestPools(cfg, []string{"vanilla", "obfs4", "snowflake"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test pools: %s", err)
+	}
+	for _, p := range pools {
+		defer p.Stop()
+	}
+	if len(pools) != 2 || pools[DefaultTester] == nil || pools["tcp"] == nil {
+		t.Errorf("expected bridgestrap and tcp test pools but got %v", pools)
+	}
+	if name := cfg.testerName("obfs4"); name != DefaultTester {
+		t.Errorf("expected obfs4 to be tested by %q but got %q", DefaultTester, name)
+	}
+
+	cfg.Testers = map[string]json.RawMessage{"tcp": json.RawMessage(`{"timeout": "forever"}`)}
+	if _, err := newTestPools(cfg, []string{"vanilla", "snowflake"}, nil); err == nil {
+		t.Errorf("accepted invalid tester parameters")
+	}
+}
+
+// newTestPoolMetrics returns unregistered test pool metrics, so tests don't
+// clash with the metrics in Prometheus's default registry.
+func newTestPoolMetrics() *Metrics {
+	return &Metrics{
+		TestDuration:  prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration"}, []string{"tester"}),
+		TestFailures:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "failures"}, []string{"tester", "reason"}),
+		TestPending:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "pending"}, []string{"tester"}),
+		TestBatchSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "batch_size"}, []string{"tester"}),
+	}
+}
+
+func TestTestResourcesRetry(t *testing.T) {
+
+	tester := &flakyTester{failures: 2, partials: 1}
+	metrics := newTestPoolMetrics()
+	p := NewResourceTestPool("flaky", tester, metrics)
+	defer p.Stop()
+	p.retryDelay = time.Millisecond
+
+	d1, d2 := core.NewDummy(1, 1), core.NewDummy(2, 2)
+	d1.Test().State, d2.Test().State = core.StateUntested, core.StateUntested
+	p.addPending(2)
+	p.testResources(map[string]core.Resource{"1": d1, "2": d2})
+
+	// Two failed attempts, one partial attempt, and one attempt for the
+	// resource that was missing.
+	if calls := tester.numCalls(); calls != 4 {
+		t.Errorf("expected 4 test attempts but got %d", calls)
+	}
+	if d1.Test().State != core.StateFunctional || d2.Test().State != core.StateFunctional {
+		t.Errorf("expected resources to be tested eventually")
+	}
+	if n := testutil.ToFloat64(metrics.TestFailures.WithLabelValues("flaky", "error")); n != 2 {
+		t.Errorf("expected 2 failed tests but got %f", n)
+	}
+	if n := testutil.ToFloat64(metrics.TestFailures.WithLabelValues("flaky", "missing")); n != 1 {
+		t.Errorf("expected 1 missing resource but got %f", n)
+	}
+	if n := testutil.ToFloat64(metrics.TestPending.WithLabelValues("flaky")); n != 0 {
+		t.Errorf("expected no pending resources but got %f", n)
+	}
+	if len(p.inProgress) != 0 {
+		t.Errorf("resources are still in progress after test")
+	}
+}
+
+func TestTestResourcesGiveUp(t *testing.T) {
+
+	tester := &flakyTester{failures: 100}
+	p := NewResourceTestPool("flaky", tester, nil)
+	defer p.Stop()
+	p.retryDelay = time.Millisecond
+	p.maxAttempts = 3
+
+	d := core.NewDummy(1, 1)
+	d.Test().State = core.StateUntested
+	p.testResources(map[string]core.Resource{"1": d})
+	if calls := tester.numCalls(); calls != 3 {
+		t.Errorf("expected 3 test attempts but got %d", calls)
+	}
+	if d.Test().State != core.StateUntested {
+		t.Errorf("failed tests changed resource state to %d", d.Test().State)
+	}
+}
+
+// untestableTester cannot test any of the resources that it's given.
+type untestableTester struct {
+	sync.Mutex
+	calls int
+}
+
+func (u *untestableTester) Test(rs []core.Resource) error {
+	u.Lock()
+	defer u.Unlock()
+
+	u.calls++
+	for _, r := range rs {
+		r.Test().Record(core.StateUntested, time.Now().UTC(), "resource has no address")
+	}
+	return &core.PartialTestError{Untestable: rs}
+}
+
+func TestTestResourcesUntestable(t *testing.T) {
+
+	tester := &untestableTester{}
+	metrics := newTestPoolMetrics()
+	p := NewResourceTestPool("untestable", tester, metrics)
+	defer p.Stop()
+	p.retryDelay = time.Millisecond
+
+	d := core.NewDummy(1, 1)
+	p.addPending(1)
+	p.testResources(map[string]core.Resource{"1": d})
+
+	// Trying again would be pointless.
+	if tester.calls != 1 {
+		t.Errorf("expected 1 test attempt but got %d", tester.calls)
+	}
+	if d.Test().State != core.StateUntested {
+		t.Errorf("expected untestable resource to remain untested")
+	}
+	if n := testutil.ToFloat64(metrics.TestFailures.WithLabelValues("untestable", "untestable")); n != 1 {
+		t.Errorf("expected 1 untestable resource but got %f", n)
+	}
+	if n := testutil.ToFloat64(metrics.TestPending.WithLabelValues("untestable")); n != 0 {
+		t.Errorf("expected no pending resources but got %f", n)
+	}
+}
+
+func TestTuneBatchSize(t *testing.T) {
+
+	p := NewResourceTestPool("dummy", &DummyTester{}, nil)
+	defer p.Stop()
+
+	p.tuneBatchSize(MaxResources, time.Second, false)
+	if size := p.getBatchSize(); size != MaxResources+MinBatchSize {
+		t.Errorf("expected fast test to grow batch size but got %d", size)
+	}
+	// Fast tests of small batches don't tell us anything about our tester's
+	// capacity.
+	p.tuneBatchSize(1, time.Second, false)
+	if size := p.getBatchSize(); size != MaxResources+MinBatchSize {
+		t.Errorf("expected small batch to leave batch size alone but got %d", size)
+	}
+	p.tuneBatchSize(MaxResources, 2*TargetTestLatency, false)
+	if size := p.getBatchSize(); size != (MaxResources+MinBatchSize)/2 {
+		t.Errorf("expected slow test to shrink batch size but got %d", size)
+	}
+	for i := 0; i < 10; i++ {
+		p.tuneBatchSize(1, time.Second, true)
+	}
+	if size := p.getBatchSize(); size != MinBatchSize {
+		t.Errorf("expected batch size to bottom out at %d but got %d", MinBatchSize, size)
+	}
+	for i := 0; i < 100; i++ {
+		p.tuneBatchSize(MaxBatchSize, time.Second, false)
+	}
+	if size := p.getBatchSize(); size != MaxBatchSize {
+		t.Errorf("expected batch size to top out at %d but got %d", MaxBatchSize, size)
+	}
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// loadCertPool returns a certificate pool that contains the PEM-encoded
+// certificates in the given file.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("found no certificates in %s", filename)
+	}
+	return pool, nil
+}
+
+// parsePin turns the given certificate fingerprint into bytes.  We accept the
+// output of "openssl x509 -noout -fingerprint -sha256", i.e. hex-encoded bytes
+// that may be separated by colons.
+func parsePin(pin string) ([]byte, error) {
+
+	fingerprint, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %q", pin)
+	}
+	return fingerprint, nil
+}
+
+// verifyPins returns a function that makes sure that the peer's certificate
+// has one of the given SHA-256 fingerprints.
+func verifyPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+		fingerprint := sha256.Sum256(rawCerts[0])
+		for _, pin := range pins {
+			if bytes.Equal(fingerprint[:], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("peer certificate %x is not pinned", fingerprint)
+	}
+}
+
+// tlsConfig returns the TLS configuration that a distributor uses to talk to
+// the backend.  The distributor presents its client certificate (if any), and
+// only accepts backend certificates that were signed by one of the configured
+// CAs (or, if none are configured, by one of the system's CAs).  If
+// certificates are pinned, the backend's certificate must also be one of
+// them.  Pinned certificates without CAs allow for self-signed backend
+// certificates.
+func (cfg TLSClientConfig) tlsConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(cfg.PinnedCerts) > 0 {
+		pins := [][]byte{}
+		for _, pin := range cfg.PinnedCerts {
+			fingerprint, err := parsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, fingerprint)
+		}
+		// Without CAs, the pins are all that we verify.  Note that
+		// VerifyPeerCertificate is called regardless of InsecureSkipVerify.
+		if cfg.CAFile == "" {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPins(pins)
+	}
+
+	return tlsConfig, nil
+}
+
+// serverTLSConfig returns a TLS configuration that serves the given
+// certificate and verifies client certificates against the CAs in the given
+// file.  If required is false, clients may connect without a certificate.
+func serverTLSConfig(certFile, keyFile, clientCAFile string, required bool) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	if tlsConfig.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if required {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// tlsConfig returns the TLS configuration of the backend's gRPC API, which
+// requires and verifies client certificates.
+func (cfg GrpcConfig) tlsConfig() (*tls.Config, error) {
+	return serverTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile, true)
+}
+
+// tlsConfig returns the TLS configuration of the backend's Web API.  The Web
+// API also serves our status page and metrics, so client certificates are
+// verified if given, but not required on the TLS layer.  Instead, the
+// distributor endpoints require them.
+func (cfg WebApiConfig) tlsConfig() (*tls.Config, error) {
+	return serverTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile, false)
+}
+
+// certIdentity returns the name of the distributor that presented the client
+// certificate in the given connection state.  The name is the common name of
+// the certificate, which must be signed by one of our client CAs, and must be
+// the name of a distributor that we know.
+func (b *BackendContext) certIdentity(state *tls.ConnectionState) (string, error) {
+
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", errors.New("request carries no verified client certificate")
+	}
+	distName := state.VerifiedChains[0][0].Subject.CommonName
+	if !b.isKnownDistributor(distName) {
+		return "", fmt.Errorf("client certificate belongs to unknown distributor %q", distName)
+	}
+	return distName, nil
+}
+
+// isKnownDistributor returns true if the given distributor name is part of our
+// configuration.
+func (b *BackendContext) isKnownDistributor(distName string) bool {
+
+	if _, exists := b.Config.Backend.ApiTokens[distName]; exists {
+		return true
+	}
+	_, exists := b.Config.Backend.DistProportions[distName]
+	return exists
+}
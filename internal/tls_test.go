@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// testPKI represents a certificate authority whose certificates and keys are
+// stored in a temporary directory.
+type testPKI struct {
+	t      *testing.T
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+	// CAFile contains the CA's PEM-encoded certificate.
+	CAFile string
+}
+
+// newTestPKI creates a new certificate authority.  The caller must call
+// Remove when done.
+func newTestPKI(t *testing.T) *testPKI {
+
+	dir, err := ioutil.TempDir("", "rdsys-pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{t: t, dir: dir}
+	p.cert, p.key = p.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "rdsys test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	p.CAFile = p.write("ca.pem", "CERTIFICATE", p.cert.Raw)
+
+	return p
+}
+
+// Remove removes the CA's directory.
+func (p *testPKI) Remove() {
+	os.RemoveAll(p.dir)
+}
+
+// issue creates a key and a certificate from the given template.  The
+// certificate is signed by our CA, or self-signed if we don't have a CA yet.
+func (p *testPKI) issue(tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.serial++
+	tmpl.SerialNumber = big.NewInt(p.serial)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	parent, parentKey := tmpl, key
+	if p.cert != nil {
+		parent, parentKey = p.cert, p.key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return cert, key
+}
+
+// write PEM-encodes the given bytes into the given file in our directory and
+// returns the file's path.
+func (p *testPKI) write(filename, blockType string, b []byte) string {
+
+	path := filepath.Join(p.dir, filename)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b}), 0600); err != nil {
+		p.t.Fatal(err)
+	}
+	return path
+}
+
+// IssueServer issues a server certificate for 127.0.0.1 and returns the
+// paths of the certificate and key files.
+func (p *testPKI) IssueServer(name string) (string, string) {
+	return p.issueFiles(name, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// IssueClient issues a client certificate with the given common name and
+// returns the paths of the certificate and key files.
+func (p *testPKI) IssueClient(name string) (string, string) {
+	return p.issueFiles(name, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func (p *testPKI) issueFiles(name string, tmpl *x509.Certificate) (string, string) {
+
+	cert, key := p.issue(tmpl)
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return p.write(name+"-cert.pem", "CERTIFICATE", cert.Raw), p.write(name+"-key.pem", "EC PRIVATE KEY", rawKey)
+}
+
+func TestTLSConfig(t *testing.T) {
+
+	pki := newTestPKI(t)
+	defer pki.Remove()
+	certFile, keyFile := pki.IssueClient(testDistName)
+
+	cfg := TLSClientConfig{CAFile: pki.CAFile, CertFile: certFile, KeyFile: keyFile}
+	if _, err := cfg.tlsConfig(); err != nil {
+		t.Fatalf("failed to load valid TLS configuration: %s", err)
+	}
+
+	cfg.CAFile = keyFile
+	if _, err := cfg.tlsConfig(); err == nil {
+		t.Errorf("accepted CA file without certificates")
+	}
+	cfg.CAFile = pki.CAFile
+	cfg.KeyFile = pki.CAFile
+	if _, err := cfg.tlsConfig(); err == nil {
+		t.Errorf("accepted certificate without key")
+	}
+}
+
+// newTestTLSBackend returns a backend whose Web API serves TLS and requires
+// client certificates that were issued by the given PKI.
+func newTestTLSBackend(t *testing.T, pki *testPKI, rTypes []string) (*BackendContext, *httptest.Server) {
+
+	b := newTestBackend(rTypes)
+	certFile, keyFile := pki.IssueServer("backend")
+	b.Config.Backend.WebApi = WebApiConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: pki.CAFile}
+	tlsConfig, err := b.Config.Backend.WebApi.tlsConfig()
+	if err != nil {
+		t.Fatalf("failed to load TLS configuration: %s", err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(b.resourcesHandler))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	b.Config.Backend.WebApi.ApiAddress = srv.Listener.Addr().String()
+
+	return b, srv
+}
+
+func TestWebApiClientCerts(t *testing.T) {
+
+	pki := newTestPKI(t)
+	defer pki.Remove()
+	rType := resources.ResourceTypeVanilla
+	b, srv := newTestTLSBackend(t, pki, []string{rType})
+	defer srv.Close()
+	b.Resources.Add(newTestBridge(1, "1.1.1.1"))
+
+	certFile, keyFile := pki.IssueClient(testDistName)
+	tlsCfg := TLSClientConfig{CAFile: pki.CAFile, CertFile: certFile, KeyFile: keyFile}
+
+	if _, err := NewBackendIpc(b.Config, IpcHttps, TLSClientConfig{CAFile: pki.CAFile}); err == nil {
+		t.Errorf("created HTTPS IPC mechanism without client certificate")
+	}
+
+	// Our distributor must be able to stream resources without a bearer
+	// token because its certificate identifies it.
+	ipc, err := NewBackendIpc(b.Config, IpcHttps, tlsCfg)
+	if err != nil {
+		t.Fatalf("failed to create HTTPS IPC mechanism: %s", err)
+	}
+	rStream := make(chan *core.ResourceDiff)
+	ipc.StartStream(&core.ResourceRequest{
+		RequestOrigin: testDistName,
+		ResourceTypes: []string{rType},
+		Receiver:      rStream,
+	})
+	defer ipc.StopStream()
+	if diff := recvDiff(t, rStream); len(diff.New[rType]) != 1 {
+		t.Fatalf("expected 1 resource in initial batch but got: %s", diff)
+	}
+
+	getResources := func(tlsCfg TLSClientConfig, origin string) int {
+		tlsConfig, err := tlsCfg.tlsConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		body := strings.NewReader(fmt.Sprintf(`{"request_origin": %q, "resource_types": [%q]}`, origin, rType))
+		req, err := http.NewRequest(http.MethodGet, "https://"+b.Config.Backend.WebApi.ApiAddress+testGetPath, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := getResources(tlsCfg, testDistName); code != http.StatusOK {
+		t.Errorf("expected HTTP status code 200 but got %d", code)
+	}
+	// A certificate doesn't entitle a distributor to another distributor's
+	// resources.
+	if code := getResources(tlsCfg, "https"); code != http.StatusForbidden {
+		t.Errorf("expected HTTP status code 403 but got %d", code)
+	}
+	// Once the backend requires certificates, bearer tokens are no longer
+	// enough.
+	if code := getResources(TLSClientConfig{CAFile: pki.CAFile}, testDistName); code != http.StatusUnauthorized {
+		t.Errorf("expected HTTP status code 401 but got %d", code)
+	}
+	certFile, keyFile = pki.IssueClient("unknown")
+	unknownCfg := TLSClientConfig{CAFile: pki.CAFile, CertFile: certFile, KeyFile: keyFile}
+	if code := getResources(unknownCfg, testDistName); code != http.StatusUnauthorized {
+		t.Errorf("expected HTTP status code 401 but got %d", code)
+	}
+}
+
+func TestTLSConfigPinning(t *testing.T) {
+
+	// httptest's server uses a self-signed certificate.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	fingerprint := sha256.Sum256(srv.Certificate().Raw)
+	pin := strings.ToUpper(hex.EncodeToString(fingerprint[:]))
+
+	get := func(cfg TLSClientConfig) error {
+		tlsConfig, err := cfg.tlsConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(TLSClientConfig{}); err == nil {
+		t.Errorf("accepted self-signed certificate without pin")
+	}
+	if err := get(TLSClientConfig{PinnedCerts: []string{pin}}); err != nil {
+		t.Errorf("rejected pinned certificate: %s", err)
+	}
+	// Colon-separated fingerprints are fine, too.
+	colonPin := []string{}
+	for i := 0; i < len(pin); i += 2 {
+		colonPin = append(colonPin, pin[i:i+2])
+	}
+	if err := get(TLSClientConfig{PinnedCerts: []string{strings.Join(colonPin, ":")}}); err != nil {
+		t.Errorf("rejected pinned certificate with colon-separated fingerprint: %s", err)
+	}
+	otherPin := strings.Repeat("00", sha256.Size)
+	if err := get(TLSClientConfig{PinnedCerts: []string{otherPin}}); err == nil {
+		t.Errorf("accepted certificate that's not pinned")
+	}
+
+	// A pinned certificate must still be signed by our CA, if we have one.
+	pki := newTestPKI(t)
+	defer pki.Remove()
+	if err := get(TLSClientConfig{CAFile: pki.CAFile, PinnedCerts: []string{pin}}); err == nil {
+		t.Errorf("accepted pinned certificate that's not signed by our CA")
+	}
+
+	if _, err := (TLSClientConfig{PinnedCerts: []string{"foo"}}).tlsConfig(); err == nil {
+		t.Errorf("accepted invalid pin")
+	}
+}
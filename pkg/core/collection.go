@@ -6,6 +6,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -16,6 +17,16 @@ const (
 	ResourceIsGone
 )
 
+const (
+	// ReplayLogMaxLen determines the maximum number of diffs that we keep
+	// around per distributor, so we can replay them to a distributor that
+	// reconnects.
+	ReplayLogMaxLen = 10000
+	// ReplayLogMaxAge determines how long we keep diffs around for replaying.
+	// Distributors that were gone for longer than that get a full snapshot.
+	ReplayLogMaxAge = time.Hour
+)
+
 // BackendResources implements a collection of resources for our backend.  The
 // backend uses this data structure to keep track of all of its resource types.
 type BackendResources struct {
@@ -32,8 +43,99 @@ type BackendResources struct {
 // EventRecipient represents the recipient of a resource event, i.e. a
 // distributor; or rather, what we need to send updates to said distributor.
 type EventRecipient struct {
-	EventChans []chan *ResourceDiff
-	Request    *ResourceRequest
+	Subscribers []*Subscriber
+	Request     *ResourceRequest
+	// sequence is the sequence number of the last diff that we created for
+	// the distributor.
+	sequence uint64
+	// replayLog contains the distributor's most recent diffs, sorted by
+	// sequence number.
+	replayLog []*replayEntry
+	// needsSnapshot is set after one of the distributor's subscribers
+	// overflowed.  The next subscriber then gets a snapshot instead of a
+	// replay of what could be a large number of diffs.
+	needsSnapshot bool
+	// overflows is the number of times that the distributor's subscribers
+	// overflowed.
+	overflows int
+}
+
+// QueueStats represents the state of a distributor's subscriber queues.
+type QueueStats struct {
+	// Depth is the number of diffs that are waiting to be sent to the
+	// distributor's subscribers.
+	Depth int
+	// Overflows is the number of times that the distributor's subscribers
+	// overflowed and had to be disconnected.
+	Overflows int
+}
+
+// replayEntry represents a diff in an EventRecipient's replay log.
+type replayEntry struct {
+	diff  *ResourceDiff
+	added time.Time
+}
+
+// NewEventRecipient returns a new event recipient for the given request.  The
+// recipient's sequence numbers start at the current Unix time in nanoseconds,
+// which keeps sequence numbers monotonically increasing across backend
+// restarts.
+func NewEventRecipient(req *ResourceRequest) *EventRecipient {
+	return &EventRecipient{
+		Request:  req,
+		sequence: uint64(time.Now().UnixNano()),
+	}
+}
+
+// logDiff assigns the next sequence number to the given diff and adds the diff
+// to the recipient's replay log.
+func (er *EventRecipient) logDiff(diff *ResourceDiff) {
+
+	er.sequence++
+	diff.Sequence = er.sequence
+	er.replayLog = append(er.replayLog, &replayEntry{diff: diff, added: time.Now().UTC()})
+	if len(er.replayLog) > ReplayLogMaxLen {
+		er.replayLog = er.replayLog[len(er.replayLog)-ReplayLogMaxLen:]
+	}
+}
+
+// pruneReplayLog removes diffs from the replay log that are older than
+// ReplayLogMaxAge.
+func (er *EventRecipient) pruneReplayLog() {
+
+	now := time.Now().UTC()
+	i := 0
+	for ; i < len(er.replayLog); i++ {
+		if now.Sub(er.replayLog[i].added) <= ReplayLogMaxAge {
+			break
+		}
+	}
+	er.replayLog = er.replayLog[i:]
+}
+
+// diffsSince returns all diffs whose sequence number is larger than the given
+// sequence number.  If our replay log no longer covers all of these diffs,
+// the function returns an error.
+func (er *EventRecipient) diffsSince(sequence uint64) ([]*ResourceDiff, error) {
+
+	er.pruneReplayLog()
+	if sequence > er.sequence {
+		return nil, fmt.Errorf("sequence number %d is from the future", sequence)
+	}
+	if sequence == er.sequence {
+		return []*ResourceDiff{}, nil
+	}
+	if len(er.replayLog) == 0 || er.replayLog[0].diff.Sequence > sequence+1 {
+		return nil, fmt.Errorf("replay log no longer contains sequence number %d", sequence+1)
+	}
+
+	diffs := []*ResourceDiff{}
+	for _, entry := range er.replayLog {
+		if entry.diff.Sequence > sequence {
+			diffs = append(diffs, entry.diff)
+		}
+	}
+	return diffs, nil
 }
 
 // NewBackendResources creates and returns a new resource collection.
@@ -77,18 +179,24 @@ func (ctx *BackendResources) Add(r1 Resource) {
 	if !exists {
 		return
 	}
+	event := -1
 	if i, err := hashring.getIndex(r1.Uid()); err == nil {
 		// The resource's unique ID already exists.  That means, the resource
 		// either remains the same, or it changed (i.e. its object ID differs).
 		r2 := hashring.Hashnodes[i].Elem
 		if r1.Oid() != r2.Oid() {
-			ctx.propagateUpdate(r1, ResourceChanged)
+			event = ResourceChanged
 		}
 	} else {
 		// The unique ID doesn't exist, so we're dealing with a new resource.
-		ctx.propagateUpdate(r1, ResourceIsNew)
+		event = ResourceIsNew
 	}
+	// We update our hashring before propagating the update, so that a
+	// snapshot never lacks a resource whose diff was already sent.
 	hashring.AddOrUpdate(r1)
+	if event != -1 {
+		ctx.propagateUpdate(r1, event)
+	}
 }
 
 // Get returns a slice of resources of the requested type for the given
@@ -108,20 +216,27 @@ func (ctx *BackendResources) Get(distName string, rType string) []Resource {
 	return resources
 }
 
-// Prune removes expired resources.
-func (ctx *BackendResources) Prune() {
+// Prune removes expired resources, informs distributors about the removal,
+// and returns the resources that were pruned.
+func (ctx *BackendResources) Prune() ResourceMap {
 
-	for _, hashring := range ctx.Collection {
+	pruned := make(ResourceMap)
+	for rType, hashring := range ctx.Collection {
 		prunedResources := hashring.Prune()
 		for _, resource := range prunedResources {
 			ctx.propagateUpdate(resource, ResourceIsGone)
 		}
+		if len(prunedResources) > 0 {
+			pruned[rType] = prunedResources
+		}
 	}
+	return pruned
 }
 
 // propagateUpdate sends updates about new, changed, and gone resources to
-// channels, allowing the backend to immediately inform a distributor of the
-// update.
+// subscribers, allowing the backend to immediately inform a distributor of the
+// update.  The function never blocks: diffs are queued in each subscriber, and
+// subscribers that cannot keep up are disconnected.
 func (ctx *BackendResources) propagateUpdate(r Resource, event int) {
 	ctx.Lock()
 	defer ctx.Unlock()
@@ -130,18 +245,7 @@ func (ctx *BackendResources) propagateUpdate(r Resource, event int) {
 		return
 	}
 
-	// Prepare the hashring difference that we're about to send.
-	diff := &ResourceDiff{}
 	rm := ResourceMap{r.Type(): []Resource{r}}
-	switch event {
-	case ResourceIsNew:
-		diff.New = rm
-	case ResourceChanged:
-		diff.Changed = rm
-	case ResourceIsGone:
-		diff.Gone = rm
-	}
-
 	for distName, eventRecipient := range ctx.EventRecipients {
 
 		// A distributor should only receive a diff if the resource in the diff
@@ -153,47 +257,117 @@ func (ctx *BackendResources) propagateUpdate(r Resource, event int) {
 			continue
 		}
 
-		for _, c := range eventRecipient.EventChans {
-			c <- diff
+		// Prepare the hashring difference that we're about to send.  Each
+		// distributor gets its own diff because sequence numbers are
+		// distributor-specific.
+		diff := &ResourceDiff{}
+		switch event {
+		case ResourceIsNew:
+			diff.New = rm
+		case ResourceChanged:
+			diff.Changed = rm
+		case ResourceIsGone:
+			diff.Gone = rm
 		}
+		// We log the diff even if the distributor is currently not connected,
+		// so we can replay the diff once it reconnects.
+		eventRecipient.logDiff(diff)
+
+		subscribers := eventRecipient.Subscribers[:0]
+		for _, s := range eventRecipient.Subscribers {
+			if s.push(diff) {
+				subscribers = append(subscribers, s)
+				continue
+			}
+			log.Printf("Subscriber of distributor %q overflowed.  Disconnecting it.", distName)
+			eventRecipient.needsSnapshot = true
+			eventRecipient.overflows++
+		}
+		eventRecipient.Subscribers = subscribers
 	}
 }
 
-// RegisterChan registers a channel to be informed about resource updates.
-func (ctx *BackendResources) RegisterChan(req *ResourceRequest, recipient chan *ResourceDiff) {
+// snapshot returns a diff that contains all of the resources that the given
+// request asks for.  The diff is marked as a full update.
+func (ctx *BackendResources) snapshot(req *ResourceRequest, sequence uint64) *ResourceDiff {
+
+	rm := make(ResourceMap)
+	for _, rType := range req.ResourceTypes {
+		rm[rType] = ctx.Get(req.RequestOrigin, rType)
+	}
+	return &ResourceDiff{New: rm, Sequence: sequence, FullUpdate: true}
+}
+
+// Subscribe returns a new subscriber that's informed about resource updates
+// for the given request.  The subscriber's queue starts out with the diffs
+// that the distributor needs to catch up: If the request's LastSequence is
+// covered by our replay log, these are the diffs that the distributor missed.
+// Otherwise, it's a single diff that contains a full snapshot of the
+// distributor's resources.
+func (ctx *BackendResources) Subscribe(req *ResourceRequest) *Subscriber {
 	ctx.Lock()
 	defer ctx.Unlock()
 
 	distName := req.RequestOrigin
-	log.Printf("Registered new channel for distributor %q to receive updates.", distName)
-	_, exists := ctx.EventRecipients[distName]
+	log.Printf("Registered new subscriber for distributor %q to receive updates.", distName)
+	er, exists := ctx.EventRecipients[distName]
 	if !exists {
-		er := &EventRecipient{Request: req, EventChans: []chan *ResourceDiff{recipient}}
+		er = NewEventRecipient(req)
 		ctx.EventRecipients[distName] = er
-	} else {
-		ctx.EventRecipients[distName].EventChans = append(ctx.EventRecipients[distName].EventChans, recipient)
 	}
+
+	s := NewSubscriber()
+	er.Subscribers = append(er.Subscribers, s)
+
+	if req.LastSequence != 0 && !er.needsSnapshot {
+		diffs, err := er.diffsSince(req.LastSequence)
+		if err == nil {
+			log.Printf("Replaying %d diff(s) to distributor %q.", len(diffs), distName)
+			s.queue = diffs
+			return s
+		}
+		log.Printf("Cannot replay diffs to distributor %q: %s", distName, err)
+	}
+	er.needsSnapshot = false
+	s.queue = []*ResourceDiff{ctx.snapshot(req, er.sequence)}
+
+	return s
 }
 
-// UnregisterChan unregisters a channel to be informed about resource updates.
-func (ctx *BackendResources) UnregisterChan(distName string, recipient chan *ResourceDiff) {
+// Unsubscribe removes the given subscriber, so it's no longer informed about
+// resource updates.
+func (ctx *BackendResources) Unsubscribe(distName string, s *Subscriber) {
 	ctx.Lock()
 	defer ctx.Unlock()
 
-	chanSlice := ctx.EventRecipients[distName].EventChans
-	newSlice := []chan *ResourceDiff{}
-
-	for i, c := range chanSlice {
-		if c == recipient {
-			log.Printf("Unregistering channel from recipients.")
-			// Are we dealing with the last element in the slice?
-			if i == len(chanSlice)-1 {
-				newSlice = chanSlice[:i]
-			} else {
-				newSlice = append(chanSlice[:i], chanSlice[i+1:]...)
-			}
-			break
+	er, exists := ctx.EventRecipients[distName]
+	if !exists {
+		return
+	}
+
+	subscribers := []*Subscriber{}
+	for _, subscriber := range er.Subscribers {
+		if subscriber == s {
+			log.Printf("Unregistering subscriber of distributor %q.", distName)
+			continue
+		}
+		subscribers = append(subscribers, subscriber)
+	}
+	er.Subscribers = subscribers
+}
+
+// QueueStats returns the state of each distributor's subscriber queues.
+func (ctx *BackendResources) QueueStats() map[string]QueueStats {
+	ctx.RLock()
+	defer ctx.RUnlock()
+
+	stats := make(map[string]QueueStats)
+	for distName, er := range ctx.EventRecipients {
+		depth := 0
+		for _, s := range er.Subscribers {
+			depth += s.Len()
 		}
+		stats[distName] = QueueStats{Depth: depth, Overflows: er.overflows}
 	}
-	ctx.EventRecipients[distName].EventChans = newSlice
+	return stats
 }
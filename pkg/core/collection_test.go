@@ -74,3 +74,162 @@ func TestPruneCollection(t *testing.T) {
 		t.Fatalf("expectec hashring of length 0 but got %d", hLength())
 	}
 }
+
+// drain returns all diffs that are queued in the given subscriber.
+func drain(s *Subscriber) []*ResourceDiff {
+	diffs := []*ResourceDiff{}
+	for diff := s.Pop(); diff != nil; diff = s.Pop() {
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+func TestReplayLog(t *testing.T) {
+	stencil := &Stencil{}
+	stencil.AddInterval(&Interval{Begin: 0, End: 0, Name: "foo"})
+	d1, d2, d3 := NewDummy(1, 1), NewDummy(2, 2), NewDummy(3, 3)
+	c := NewBackendResources([]string{d1.Type()}, stencil)
+	req := &ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{d1.Type()}}
+
+	// A distributor that connects for the first time gets a snapshot.
+	s := c.Subscribe(req)
+	initial := drain(s)
+	if len(initial) != 1 || !initial[0].FullUpdate {
+		t.Fatalf("expected full snapshot for new distributor")
+	}
+	firstSeq := initial[0].Sequence
+
+	c.Add(d1)
+	diff := s.Pop()
+	if diff == nil || diff.Sequence != firstSeq+1 {
+		t.Fatalf("expected diff with sequence number %d", firstSeq+1)
+	}
+
+	// The distributor disconnects and misses two diffs.
+	c.Unsubscribe(req.RequestOrigin, s)
+	c.Add(d2)
+	c.Add(d3)
+	if s.Len() != 0 {
+		t.Errorf("unsubscribed subscriber still received diffs")
+	}
+
+	// When reconnecting, the distributor should get exactly the two diffs
+	// that it missed.
+	resumeReq := *req
+	resumeReq.LastSequence = firstSeq + 1
+	s = c.Subscribe(&resumeReq)
+	initial = drain(s)
+	if len(initial) != 2 {
+		t.Fatalf("expected 2 replayed diffs but got %d", len(initial))
+	}
+	for i, diff := range initial {
+		if diff.FullUpdate {
+			t.Errorf("replayed diff must not be a full update")
+		}
+		if diff.Sequence != firstSeq+2+uint64(i) {
+			t.Errorf("expected sequence number %d but got %d", firstSeq+2+uint64(i), diff.Sequence)
+		}
+	}
+	c.Unsubscribe(req.RequestOrigin, s)
+
+	// A distributor that's up to date gets nothing.
+	resumeReq.LastSequence = firstSeq + 3
+	s = c.Subscribe(&resumeReq)
+	if initial = drain(s); len(initial) != 0 {
+		t.Errorf("expected no diffs but got %d", len(initial))
+	}
+	c.Unsubscribe(req.RequestOrigin, s)
+
+	// Sequence numbers from the future result in a snapshot.
+	resumeReq.LastSequence = firstSeq + 100
+	s = c.Subscribe(&resumeReq)
+	initial = drain(s)
+	if len(initial) != 1 || !initial[0].FullUpdate {
+		t.Fatalf("expected full snapshot for unknown sequence number")
+	}
+	if len(initial[0].New[d1.Type()]) != 3 {
+		t.Errorf("expected 3 resources in snapshot but got %d", len(initial[0].New[d1.Type()]))
+	}
+	if initial[0].Sequence != firstSeq+3 {
+		t.Errorf("expected snapshot sequence number %d but got %d", firstSeq+3, initial[0].Sequence)
+	}
+	c.Unsubscribe(req.RequestOrigin, s)
+
+	// Diffs that are too old are no longer replayed.
+	er := c.EventRecipients[req.RequestOrigin]
+	er.replayLog[0].added = time.Now().UTC().Add(-ReplayLogMaxAge - time.Minute)
+	resumeReq.LastSequence = firstSeq
+	initial = drain(c.Subscribe(&resumeReq))
+	if len(initial) != 1 || !initial[0].FullUpdate {
+		t.Fatalf("expected full snapshot after replay log expired")
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	stencil := &Stencil{}
+	stencil.AddInterval(&Interval{Begin: 0, End: 0, Name: "foo"})
+	c := NewBackendResources([]string{"dummy"}, stencil)
+	req := &ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{"dummy"}}
+
+	// Both subscribers consume their initial snapshot but only one of them
+	// keeps up afterwards.
+	slow := c.Subscribe(req)
+	fast := c.Subscribe(req)
+	drain(slow)
+	drain(fast)
+
+	// Fill the slow subscriber's queue.  Adding resources must never block,
+	// even though nobody consumes the slow subscriber's queue.
+	var lastSeq uint64
+	for i := 1; i <= SubscriberQueueLen+10; i++ {
+		c.Add(NewDummy(Hashkey(i), Hashkey(i)))
+		diff := fast.Pop()
+		if diff == nil {
+			t.Fatalf("fast subscriber missed diff %d", i)
+		}
+		lastSeq = diff.Sequence
+	}
+
+	// The last few diffs should have been coalesced into the last diff in the
+	// queue.
+	if slow.Len() != SubscriberQueueLen {
+		t.Fatalf("expected queue length %d but got %d", SubscriberQueueLen, slow.Len())
+	}
+	diffs := drain(slow)
+	last := diffs[len(diffs)-1]
+	if n := len(last.New["dummy"]); n != 11 {
+		t.Errorf("expected 11 resources in coalesced diff but got %d", n)
+	}
+	if last.Sequence != lastSeq {
+		t.Errorf("expected sequence number %d but got %d", lastSeq, last.Sequence)
+	}
+	if stats := c.QueueStats()["foo"]; stats.Depth != 0 || stats.Overflows != 0 {
+		t.Errorf("unexpected queue stats: %+v", stats)
+	}
+
+	// Now let the slow subscriber overflow.
+	for i := 0; i < SubscriberQueueLen+SubscriberMaxCoalesced+1; i++ {
+		c.Add(NewDummy(Hashkey(i+2), 1))
+		fast.Pop()
+	}
+	select {
+	case <-slow.Done():
+	default:
+		t.Fatalf("slow subscriber did not overflow")
+	}
+	if stats := c.QueueStats()["foo"]; stats.Overflows != 1 {
+		t.Errorf("expected 1 overflow but got %d", stats.Overflows)
+	}
+	if len(c.EventRecipients["foo"].Subscribers) != 1 {
+		t.Errorf("overflowed subscriber was not removed")
+	}
+
+	// The overflowed distributor must get a snapshot when it resumes, even
+	// though its sequence number is still covered by our replay log.
+	resumeReq := *req
+	resumeReq.LastSequence = last.Sequence
+	initial := drain(c.Subscribe(&resumeReq))
+	if len(initial) != 1 || !initial[0].FullUpdate {
+		t.Fatalf("expected full snapshot after overflow")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +17,10 @@ const (
 	StateDysfunctional
 )
 
+// MaxTestHistory is the number of test results that we keep per resource.  A
+// resource's score is computed over this sliding window.
+const MaxTestHistory = 20
+
 // Resource specifies the resources that rdsys hands out to users.  This could
 // be a vanilla Tor bridge, and obfs4 bridge, a Snowflake proxy, and even Tor
 // Browser links.  Your imagination is the limit.
@@ -45,10 +50,96 @@ type Resource interface {
 // ResourceTest represents the result of a test of a resource.  We use the tool
 // bridgestrap for testing:
 // https://gitlab.torproject.org/tpo/anti-censorship/bridgestrap
+// Testers record their results while others read them, so testers must use
+// Record, and readers must use Snapshot or Score.
 type ResourceTest struct {
 	State      int
 	LastTested time.Time
 	Error      string
+	// History contains the resource's most recent test results, oldest
+	// first.  It never contains more than MaxTestHistory results.
+	History []TestResult
+	// lock protects the above fields.
+	lock sync.Mutex
+}
+
+// TestResult represents the outcome of a single test of a resource.
+type TestResult struct {
+	State int
+	Time  time.Time
+	Error string
+}
+
+// Record sets the resource test's current state to the given test result and
+// adds the result to the test's history.  If the history is full, we drop the
+// oldest result.  Testers like bridgestrap answer from their cache, so we
+// don't add a result to the history if it's as old as the newest result that
+// we already have.
+func (t *ResourceTest) Record(state int, when time.Time, errStr string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.State = state
+	t.LastTested = when
+	t.Error = errStr
+
+	if n := len(t.History); n > 0 && t.History[n-1].Time.Equal(when) {
+		return
+	}
+	t.History = append(t.History, TestResult{State: state, Time: when, Error: errStr})
+	if len(t.History) > MaxTestHistory {
+		t.History = t.History[len(t.History)-MaxTestHistory:]
+	}
+}
+
+// Score returns the fraction of tests in the resource's history that found the
+// resource functional, i.e. a number in [0, 1].  A resource without history
+// has a score of 0.
+func (t *ResourceTest) Score() float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.History) == 0 {
+		return 0
+	}
+	functional := 0
+	for _, result := range t.History {
+		if result.State == StateFunctional {
+			functional++
+		}
+	}
+	return float64(functional) / float64(len(t.History))
+}
+
+// Snapshot returns a copy of the resource test, which the caller can read
+// while testers keep recording results.  If the test is nil, so is its
+// snapshot.
+func (t *ResourceTest) Snapshot() *ResourceTest {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return &ResourceTest{
+		State:      t.State,
+		LastTested: t.LastTested,
+		Error:      t.Error,
+		History:    append([]TestResult{}, t.History...),
+	}
+}
+
+// inheritHistory copies the history of the given old test if we have no
+// history of our own yet.
+func (t *ResourceTest) inheritHistory(old *ResourceTest) {
+
+	history := old.Snapshot().History
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.History) == 0 {
+		t.History = history
+	}
 }
 
 // ResourceMap maps a resource type to a slice of respective resources.
@@ -182,6 +273,41 @@ func (m ResourceMap) ApplyDiff(d *ResourceDiff) {
 	}
 }
 
+// Diff determines the resources that are 1) in m1 but not m2 (new), 2) in both
+// m1 and m2 but changed, and 3) in m2 but not m1 (gone).
+func (m1 ResourceMap) Diff(m2 ResourceMap) *ResourceDiff {
+
+	diff := NewResourceDiff()
+
+	for rType, q1 := range m1 {
+		q2 := m2[rType]
+		for _, r1 := range q1 {
+			r2, err := q2.Search(r1.Uid())
+			// The given resource is not present in m2, so it must be new.
+			if err != nil {
+				diff.New[rType] = append(diff.New[rType], r1)
+				continue
+			}
+			// The given resource is present.  Did it change, though?
+			if r1.Oid() != r2.Oid() {
+				diff.Changed[rType] = append(diff.Changed[rType], r1)
+			}
+		}
+	}
+
+	// Finally, find resources that are gone.
+	for rType, q2 := range m2 {
+		q1 := m1[rType]
+		for _, r2 := range q2 {
+			if _, err := q1.Search(r2.Uid()); err != nil {
+				diff.Gone[rType] = append(diff.Gone[rType], r2)
+			}
+		}
+	}
+
+	return diff
+}
+
 // Location represents the physical and topological location of a resource or
 // requester.
 type Location struct {
@@ -224,6 +350,17 @@ func (s1 LocationSet) HasLocationsNotIn(s2 LocationSet) bool {
 	return false
 }
 
+// HasCountry returns true if the location set contains a location in the
+// given country, e.g. "RU" or "RU (1234)" for the country code "RU".
+func (l LocationSet) HasCountry(countryCode string) bool {
+	for key, _ := range l {
+		if strings.EqualFold(strings.SplitN(key, " ", 2)[0], countryCode) {
+			return true
+		}
+	}
+	return false
+}
+
 // ResourceBase provides a data structure plus associated methods that are
 // shared across all of our resources.
 type ResourceBase struct {
@@ -280,6 +417,14 @@ type ResourceRequest struct {
 	ResourceTypes []string           `json:"resource_types"`
 	BearerToken   string             `json:"-"`
 	Receiver      chan *ResourceDiff `json:"-"`
+	// LastSequence is the sequence number of the last diff that the
+	// distributor received.  The backend uses it to replay diffs that the
+	// distributor missed while it was disconnected.
+	LastSequence uint64 `json:"last_sequence,omitempty"`
+	// MinScore is the minimum score that a resource's test history must
+	// have for the backend to hand it out.  It only applies to one-shot
+	// requests; resource streams are not filtered.
+	MinScore float64 `json:"min_score,omitempty"`
 }
 
 // HasResourceType returns true if the resource request contains the given
@@ -293,3 +438,20 @@ func (r *ResourceRequest) HasResourceType(rType1 string) bool {
 	}
 	return false
 }
+
+// FilterByScore returns the given resources whose test score is at least the
+// request's minimum score.  If the request has no minimum score, we return all
+// resources.
+func (r *ResourceRequest) FilterByScore(rs []Resource) []Resource {
+
+	if r.MinScore <= 0 {
+		return rs
+	}
+	filtered := []Resource{}
+	for _, resource := range rs {
+		if rTest := resource.Test(); rTest != nil && rTest.Score() >= r.MinScore {
+			filtered = append(filtered, resource)
+		}
+	}
+	return filtered
+}
@@ -1,7 +1,9 @@
 package core
 
 import (
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestQueue(t *testing.T) {
@@ -130,6 +132,18 @@ func TestHasLocationNotIn(t *testing.T) {
 	}
 }
 
+func TestHasCountry(t *testing.T) {
+
+	s := LocationSet{"BY (1234)": true, "be": true}
+
+	if !s.HasCountry("BY") || !s.HasCountry("BE") {
+		t.Errorf("failed to find country in location set")
+	}
+	if s.HasCountry("B") || s.HasCountry("") {
+		t.Errorf("found country that isn't in location set")
+	}
+}
+
 func TestResourceBase(t *testing.T) {
 
 	b := NewResourceBase()
@@ -228,3 +242,145 @@ func TestResourceTests(t *testing.T) {
 		t.Fatal("unexpected resource state")
 	}
 }
+
+func TestResourceTestHistory(t *testing.T) {
+
+	rTest := &ResourceTest{}
+	if rTest.Score() != 0 {
+		t.Errorf("expected score 0 for resource without history but got %f", rTest.Score())
+	}
+
+	now := time.Now().UTC()
+	rTest.Record(StateFunctional, now, "")
+	rTest.Record(StateDysfunctional, now.Add(time.Minute), "timeout")
+	if rTest.State != StateDysfunctional || rTest.Error != "timeout" || !rTest.LastTested.Equal(now.Add(time.Minute)) {
+		t.Errorf("resource test doesn't reflect latest result: %+v", rTest)
+	}
+	if rTest.Score() != 0.5 {
+		t.Errorf("expected score 0.5 but got %f", rTest.Score())
+	}
+
+	// Fill the history with functional results, which pushes out the
+	// dysfunctional ones.
+	for i := 0; i < MaxTestHistory; i++ {
+		rTest.Record(StateFunctional, now.Add(time.Duration(i+2)*time.Minute), "")
+	}
+	if len(rTest.History) != MaxTestHistory {
+		t.Errorf("expected %d results in history but got %d", MaxTestHistory, len(rTest.History))
+	}
+	if rTest.Score() != 1 {
+		t.Errorf("expected score 1 but got %f", rTest.Score())
+	}
+	if !rTest.History[0].Time.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("oldest result wasn't dropped from history")
+	}
+
+	// Results that a tester answered from its cache carry the time of the
+	// original test and don't count twice.
+	last := now.Add(time.Duration(MaxTestHistory+2) * time.Minute)
+	rTest.Record(StateDysfunctional, last, "timeout")
+	rTest.Record(StateDysfunctional, last, "timeout")
+	if n := len(rTest.History); n != MaxTestHistory || rTest.History[n-2].State != StateFunctional {
+		t.Errorf("cached result was added to history twice")
+	}
+	if rTest.Score() != float64(MaxTestHistory-1)/MaxTestHistory {
+		t.Errorf("expected cached result to count once but got score %f", rTest.Score())
+	}
+}
+
+// TestConcurrentResourceTests is meant to be run with Go's race detector.
+// Testers record results while others read and copy them.
+func TestConcurrentResourceTests(t *testing.T) {
+
+	const numRounds = 100
+	now := time.Now().UTC()
+	h := NewHashring()
+	h.TestFunc = func(r Resource) {
+		r.Test().Record(StateFunctional, time.Now().UTC(), "")
+	}
+	d := NewDummy(1, 1)
+	h.AddOrUpdate(d)
+	req := &ResourceRequest{MinScore: 0.5}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numRounds; i++ {
+			d.Test().Record(StateDysfunctional, now.Add(time.Duration(i)*time.Minute), "timeout")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numRounds; i++ {
+			if rTest := d.Test().Snapshot(); len(rTest.History) > MaxTestHistory {
+				t.Errorf("history exceeds %d results", MaxTestHistory)
+			}
+			req.FilterByScore([]Resource{d})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// Changed resources inherit the history of the resource that
+		// they replace, which testers keep recording results for.
+		for i := 0; i < numRounds; i++ {
+			h.AddOrUpdate(NewDummy(Hashkey(i+2), 1))
+		}
+	}()
+	wg.Wait()
+}
+
+func TestFilterByScore(t *testing.T) {
+
+	now := time.Now().UTC()
+	good, flaky, untested := NewDummy(1, 1), NewDummy(2, 2), NewDummy(3, 3)
+	good.Test().Record(StateFunctional, now, "")
+	flaky.Test().Record(StateFunctional, now, "")
+	flaky.Test().Record(StateDysfunctional, now.Add(time.Minute), "")
+	flaky.Test().Record(StateDysfunctional, now.Add(2*time.Minute), "")
+	rs := []Resource{good, flaky, untested}
+
+	req := &ResourceRequest{}
+	if len(req.FilterByScore(rs)) != 3 {
+		t.Errorf("request without minimum score filtered resources")
+	}
+	req.MinScore = 0.3
+	filtered := req.FilterByScore(rs)
+	if len(filtered) != 2 || filtered[0] != good || filtered[1] != flaky {
+		t.Errorf("unexpected filtered resources: %v", filtered)
+	}
+	req.MinScore = 0.9
+	filtered = req.FilterByScore(rs)
+	if len(filtered) != 1 || filtered[0] != good {
+		t.Errorf("unexpected filtered resources: %v", filtered)
+	}
+}
+
+func TestResourceMapDiff(t *testing.T) {
+
+	d1 := NewDummy(1, 1)
+	d2 := NewDummy(2, 2)
+	d2Changed := NewDummy(3, 2)
+	d4 := NewDummy(4, 4)
+
+	oldMap := ResourceMap{d1.Type(): ResourceQueue{d1, d2}}
+	newMap := ResourceMap{d1.Type(): ResourceQueue{d2Changed, d4}}
+
+	diff := newMap.Diff(oldMap)
+	if len(diff.New[d1.Type()]) != 1 || diff.New[d1.Type()][0] != d4 {
+		t.Errorf("failed to determine new resources")
+	}
+	if len(diff.Changed[d1.Type()]) != 1 || diff.Changed[d1.Type()][0] != d2Changed {
+		t.Errorf("failed to determine changed resources")
+	}
+	if len(diff.Gone[d1.Type()]) != 1 || diff.Gone[d1.Type()][0] != d1 {
+		t.Errorf("failed to determine gone resources")
+	}
+
+	// Applying the diff to the old map must result in the new map.
+	oldMap.ApplyDiff(diff)
+	diff = newMap.Diff(oldMap)
+	if len(diff.New) != 0 || len(diff.Changed) != 0 || len(diff.Gone) != 0 {
+		t.Errorf("applying diff did not result in identical resource maps: %s", diff)
+	}
+}
@@ -17,6 +17,14 @@ type ResourceDiff struct {
 	New     ResourceMap `json:"new"`
 	Changed ResourceMap `json:"changed"`
 	Gone    ResourceMap `json:"gone"`
+	// Sequence is a monotonically increasing number that the backend assigns
+	// to each diff that it sends to a distributor.
+	Sequence uint64 `json:"sequence"`
+	// FullUpdate is set if the diff contains a full snapshot of a
+	// distributor's resources rather than an incremental update.  In that
+	// case, all resources are in New, and the receiver should discard
+	// resources that the snapshot doesn't contain.
+	FullUpdate bool `json:"full_update"`
 }
 
 // Hashkey represents an index in a hashring.
@@ -27,6 +35,10 @@ type Hashnode struct {
 	Hashkey    Hashkey
 	Elem       Resource
 	LastUpdate time.Time
+	// FirstSeen is the time when the resource was first added to the
+	// hashring.  Unlike LastUpdate, it doesn't change when the resource is
+	// updated.
+	FirstSeen time.Time
 }
 
 // Hashring represents a hashring consisting of resources.
@@ -52,10 +64,11 @@ func NewResourceDiff() *ResourceDiff {
 	}
 }
 
-// NewHashnode returns a new hash node and sets its LastUpdate field to the
-// current UTC time.
+// NewHashnode returns a new hash node and sets its LastUpdate and FirstSeen
+// fields to the current UTC time.
 func NewHashnode(k Hashkey, r Resource) *Hashnode {
-	return &Hashnode{Hashkey: k, Elem: r, LastUpdate: time.Now().UTC()}
+	now := time.Now().UTC()
+	return &Hashnode{Hashkey: k, Elem: r, LastUpdate: now, FirstSeen: now}
 }
 
 // NewHashring returns a new hashring.
@@ -82,6 +95,113 @@ func (m *ResourceDiff) String() string {
 	return "Resource diff: " + strings.Join(s, ", ")
 }
 
+// Len returns the number of resources in the resource diff.
+func (m *ResourceDiff) Len() int {
+
+	num := 0
+	for _, rMap := range []ResourceMap{m.New, m.Changed, m.Gone} {
+		for _, rQueue := range rMap {
+			num += len(rQueue)
+		}
+	}
+	return num
+}
+
+// copyResourceMap returns a copy of the given resource map that can be
+// modified without affecting the original.
+func copyResourceMap(m ResourceMap) ResourceMap {
+
+	c := make(ResourceMap)
+	for rType, rQueue := range m {
+		c[rType] = append(ResourceQueue{}, rQueue...)
+	}
+	return c
+}
+
+// Merge returns a new diff that has the same effect as applying m and then
+// d.  Neither m nor d are modified.  A resource that's new in m and gone in d
+// disappears from the merged diff, and a resource that's gone in m and new in
+// d shows up as changed.  The merged diff carries d's sequence number.
+func (m *ResourceDiff) Merge(d *ResourceDiff) *ResourceDiff {
+
+	merged := &ResourceDiff{
+		New:        copyResourceMap(m.New),
+		Changed:    copyResourceMap(m.Changed),
+		Gone:       copyResourceMap(m.Gone),
+		Sequence:   d.Sequence,
+		FullUpdate: m.FullUpdate,
+	}
+
+	// contains returns true if the given resource map contains a resource
+	// with the same unique ID as the given resource.
+	contains := func(rm ResourceMap, rType string, r Resource) bool {
+		q := rm[rType]
+		_, err := q.Search(r.Uid())
+		return err == nil
+	}
+	remove := func(rm ResourceMap, rType string, r Resource) {
+		q := rm[rType]
+		q.Delete(r)
+		rm[rType] = q
+	}
+	replace := func(rm ResourceMap, rType string, r Resource) {
+		q := rm[rType]
+		q.Update(r)
+		rm[rType] = q
+	}
+	add := func(rm ResourceMap, rType string, r Resource) {
+		q := rm[rType]
+		q.Enqueue(r)
+		rm[rType] = q
+	}
+
+	for rType, rQueue := range d.New {
+		for _, r := range rQueue {
+			switch {
+			case contains(merged.Gone, rType, r):
+				remove(merged.Gone, rType, r)
+				add(merged.Changed, rType, r)
+			case contains(merged.New, rType, r):
+				replace(merged.New, rType, r)
+			case contains(merged.Changed, rType, r):
+				replace(merged.Changed, rType, r)
+			default:
+				add(merged.New, rType, r)
+			}
+		}
+	}
+	for rType, rQueue := range d.Changed {
+		for _, r := range rQueue {
+			switch {
+			case contains(merged.New, rType, r):
+				replace(merged.New, rType, r)
+			case contains(merged.Changed, rType, r):
+				replace(merged.Changed, rType, r)
+			default:
+				remove(merged.Gone, rType, r)
+				add(merged.Changed, rType, r)
+			}
+		}
+	}
+	for rType, rQueue := range d.Gone {
+		for _, r := range rQueue {
+			switch {
+			case contains(merged.New, rType, r):
+				// The receiver never learned about the resource, so there's
+				// no need to tell it that the resource is gone.
+				remove(merged.New, rType, r)
+			case contains(merged.Changed, rType, r):
+				remove(merged.Changed, rType, r)
+				add(merged.Gone, rType, r)
+			default:
+				add(merged.Gone, rType, r)
+			}
+		}
+	}
+
+	return merged
+}
+
 // Len implements the sort interface.
 func (h *Hashring) Len() int {
 	return len(h.Hashnodes)
@@ -190,7 +310,7 @@ func (h *Hashring) maybeTestResource(r Resource) {
 		oldR = h.Hashnodes[i].Elem
 		// And is it exactly the same as the one we're dealing with?
 		if oldR.Oid() == r.Oid() {
-			rTest := oldR.Test()
+			rTest := oldR.Test().Snapshot()
 			r = oldR
 			// Is the resource already tested?
 			if rTest != nil && rTest.State != StateUntested {
@@ -213,6 +333,11 @@ func (h *Hashring) AddOrUpdate(r Resource) {
 	h.Lock()
 	defer h.Unlock()
 
+	// We carry over the test history before testing the resource, so the
+	// test cannot race with us.
+	if i, err := h.getIndex(r.Uid()); err == nil {
+		carryTestHistory(h.Hashnodes[i].Elem, r)
+	}
 	h.maybeTestResource(r)
 	// Does the hashring already have the resource?
 	if i, err := h.getIndex(r.Uid()); err == nil {
@@ -228,6 +353,22 @@ func (h *Hashring) AddOrUpdate(r Resource) {
 	}
 }
 
+// carryTestHistory copies the test history of the given old resource to the
+// given new resource, which is about to replace the old one because its object
+// ID changed, e.g. because its bridge line did.  It's still the same resource,
+// so its score shouldn't start from scratch.
+func carryTestHistory(oldR, newR Resource) {
+
+	if oldR.Oid() == newR.Oid() {
+		return
+	}
+	oldTest, newTest := oldR.Test(), newR.Test()
+	if oldTest == nil || newTest == nil || oldTest == newTest {
+		return
+	}
+	newTest.inheritHistory(oldTest)
+}
+
 // Remove removes the given resource from the hashring.  If the hashring is
 // empty or we cannot find the key, an error is returned.
 func (h *Hashring) Remove(r Resource) error {
@@ -296,6 +437,19 @@ func (h *Hashring) GetExact(k Hashkey) (Resource, error) {
 	return h.Hashnodes[i].Elem, nil
 }
 
+// GetExactNode is like GetExact but returns the resource's hash node, which
+// tells us when the resource was first and last seen.
+func (h *Hashring) GetExactNode(k Hashkey) (*Hashnode, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	i, err := h.getIndex(k)
+	if err != nil {
+		return nil, err
+	}
+	return h.Hashnodes[i], nil
+}
+
 // GetMany behaves like Get with the exception that it attempts to return the
 // given number of elements.  If the number of desired elements exceeds the
 // number of elements in the hashring, an error is returned.
@@ -313,8 +467,8 @@ func (h *Hashring) GetMany(k Hashkey, num int) ([]Resource, error) {
 
 	for j := i; j < num+i; j++ {
 		r := h.Hashnodes[j%h.Len()].Elem
-		if r.Test().State != StateFunctional {
-			log.Printf("Skipping %q because its state is %d.", r.String(), r.Test().State)
+		if state := r.Test().Snapshot().State; state != StateFunctional {
+			log.Printf("Skipping %q because its state is %d.", r.String(), state)
 			continue
 		}
 		resources = append(resources, h.Hashnodes[j%h.Len()].Elem)
@@ -352,12 +506,16 @@ func (h *Hashring) Prune() []Resource {
 	now := time.Now().UTC()
 	pruned := []Resource{}
 
+	// Determine expired resources first because Remove modifies the slice
+	// that we would otherwise be iterating over.
 	for _, node := range h.Hashnodes {
 		if now.Sub(node.LastUpdate) > node.Elem.Expiry() {
 			pruned = append(pruned, node.Elem)
-			h.Remove(node.Elem)
 		}
 	}
+	for _, r := range pruned {
+		h.Remove(r)
+	}
 
 	return pruned
 }
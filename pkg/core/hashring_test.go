@@ -206,6 +206,27 @@ func TestRemove(t *testing.T) {
 	}
 }
 
+func TestAddOrUpdateKeepsHistory(t *testing.T) {
+
+	now := time.Now().UTC()
+	d := NewDummy(1, 1)
+	d.Test().Record(StateFunctional, now, "")
+	d.Test().Record(StateDysfunctional, now.Add(time.Minute), "")
+	h := NewHashring()
+	h.AddOrUpdate(d)
+
+	// A changed resource keeps its test history.
+	newD := NewDummy(2, 1)
+	h.AddOrUpdate(newD)
+	r, _ := h.GetExact(1)
+	if r.Oid() != newD.Oid() {
+		t.Fatal("resource's object ID was not updated")
+	}
+	if len(r.Test().History) != 2 || r.Test().Score() != 0.5 {
+		t.Errorf("changed resource lost its test history: %+v", r.Test().History)
+	}
+}
+
 func TestAddOrUpdate(t *testing.T) {
 	d := NewDummy(1, 1)
 	newD := NewDummy(2, 1)
@@ -239,6 +260,18 @@ func TestAddOrUpdate(t *testing.T) {
 	if newTimestamp != sameTimestamp {
 		t.Fatal("timestamp should be identical")
 	}
+
+	// Updates must not change when we first saw the resource.
+	node, err := h.GetExactNode(d.Uid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.FirstSeen.Before(node.LastUpdate) {
+		t.Fatal("first-seen timestamp changed when resource was updated")
+	}
+	if _, err := h.GetExactNode(42); err == nil {
+		t.Fatal("got hash node for non-existing resource")
+	}
 }
 
 func TestDiff(t *testing.T) {
@@ -371,3 +404,56 @@ func TestMaybeTestResource(t *testing.T) {
 		t.Fatal("resource state was not set corrected by testing")
 	}
 }
+
+func TestMergeDiff(t *testing.T) {
+	d1 := NewDummy(1, 1)
+	d2 := NewDummy(2, 2)
+	d2Changed := NewDummy(20, 2)
+	d3 := NewDummy(3, 3)
+	d3Changed := NewDummy(30, 3)
+	d4 := NewDummy(4, 4)
+	rType := d1.Type()
+
+	// d1 is new and then gone, d2 is gone and then back, d3 changes twice,
+	// and d4 is new.
+	older := &ResourceDiff{
+		New:      ResourceMap{rType: ResourceQueue{d1}},
+		Changed:  ResourceMap{rType: ResourceQueue{d3}},
+		Gone:     ResourceMap{rType: ResourceQueue{d2}},
+		Sequence: 1,
+	}
+	newer := &ResourceDiff{
+		New:      ResourceMap{rType: ResourceQueue{d2Changed, d4}},
+		Changed:  ResourceMap{rType: ResourceQueue{d3Changed}},
+		Gone:     ResourceMap{rType: ResourceQueue{d1}},
+		Sequence: 2,
+	}
+	merged := older.Merge(newer)
+
+	if merged.Sequence != 2 {
+		t.Errorf("expected sequence number 2 but got %d", merged.Sequence)
+	}
+	if q := merged.New[rType]; len(q) != 1 || q[0] != d4 {
+		t.Errorf("got incorrect new resources: %s", merged)
+	}
+	if q := merged.Gone[rType]; len(q) != 0 {
+		t.Errorf("got incorrect gone resources: %s", merged)
+	}
+	changed := merged.Changed[rType]
+	if len(changed) != 2 {
+		t.Fatalf("got incorrect changed resources: %s", merged)
+	}
+	for _, r := range changed {
+		if r != d2Changed && r != d3Changed {
+			t.Errorf("got unexpected changed resource %s", r)
+		}
+	}
+
+	// Merging must not modify the original diffs.
+	if len(older.New[rType]) != 1 || len(older.Gone[rType]) != 1 || older.Changed[rType][0] != d3 {
+		t.Errorf("merging modified original diff")
+	}
+	if merged.Len() != 3 {
+		t.Errorf("expected merged diff of length 3 but got %d", merged.Len())
+	}
+}
@@ -100,16 +100,10 @@ func (s *Stencil) GetFilterFunc(distName string) (FilterFunc, error) {
 	}
 
 	// This function returns 'true' if the given resource should be assigned to
-	// the given distributor name.  The function uses a deterministic random
-	// number generator to that end.
+	// the given distributor name.
 	f := func(r Resource) bool {
 
-		// What interval does the resource's hash fall into?
-		seed := r.Uid()
-		rand.Seed(int64(seed))
-		n := rand.Intn(upperEnd + 1)
-
-		i, err := s.FindByValue(n)
+		i, err := s.findInterval(r, upperEnd)
 		if err != nil {
 			log.Printf("Bug: resource %q does not fall in any interval.", r.String())
 			return false
@@ -119,6 +113,32 @@ func (s *Stencil) GetFilterFunc(distName string) (FilterFunc, error) {
 	return f, nil
 }
 
+// GetDistName returns the name of the distributor that the given resource is
+// assigned to.
+func (s *Stencil) GetDistName(r Resource) (string, error) {
+
+	upperEnd, err := s.GetUpperEnd()
+	if err != nil {
+		return "", err
+	}
+	i, err := s.findInterval(r, upperEnd)
+	if err != nil {
+		return "", err
+	}
+	return i.Name, nil
+}
+
+// findInterval returns the interval that the given resource's hash falls into.
+// The function uses a deterministic random number generator to that end.
+func (s *Stencil) findInterval(r Resource, upperEnd int) (*Interval, error) {
+
+	seed := r.Uid()
+	rand.Seed(int64(seed))
+	n := rand.Intn(upperEnd + 1)
+
+	return s.FindByValue(n)
+}
+
 // GetForDist takes as input a distributor's name (e.g. "moat") and returns the
 // resources that are allocated for the given distributor.
 func (h *SplitHashring) GetForDist(distName string) ([]Resource, error) {
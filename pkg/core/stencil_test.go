@@ -85,3 +85,24 @@ func TestGetFilterFunc(t *testing.T) {
 		t.Errorf("got unexpectedly large number of hits")
 	}
 }
+
+func TestGetDistName(t *testing.T) {
+	s := Stencil{}
+	if _, err := s.GetDistName(NewDummy(1, 1)); err == nil {
+		t.Errorf("empty stencil assigned resource to distributor")
+	}
+
+	s.AddInterval(&Interval{0, 4, "foo"})
+	s.AddInterval(&Interval{5, 14, "bar"})
+	fooFunc, _ := s.GetFilterFunc("foo")
+	for i := 0; i < 100; i++ {
+		d := NewDummy(Hashkey(i), Hashkey(i))
+		distName, err := s.GetDistName(d)
+		if err != nil {
+			t.Fatalf("failed to get distributor name: %s", err)
+		}
+		if (distName == "foo") != fooFunc(d) {
+			t.Errorf("distributor name %q disagrees with filter function", distName)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"sync"
+)
+
+const (
+	// SubscriberQueueLen determines the number of diffs that we queue for a
+	// subscriber.  Once the queue is full, we coalesce new diffs into the
+	// last diff in the queue.
+	SubscriberQueueLen = 1000
+	// SubscriberMaxCoalesced determines the number of diffs that we coalesce
+	// for a subscriber that doesn't consume its queue.  Once a subscriber
+	// exceeds this number, it overflows and we disconnect it.
+	SubscriberMaxCoalesced = 10000
+)
+
+// Subscriber represents a single connection of a distributor that's
+// interested in resource updates.  Resource updates are queued in the
+// subscriber, so that a slow subscriber never blocks the backend.
+type Subscriber struct {
+	sync.Mutex
+	queue []*ResourceDiff
+	// coalesced is the number of diffs that we coalesced since the
+	// subscriber last consumed a diff.
+	coalesced  int
+	overflowed bool
+	ready      chan bool
+	done       chan bool
+}
+
+// NewSubscriber returns a new subscriber.
+func NewSubscriber() *Subscriber {
+	return &Subscriber{
+		ready: make(chan bool, 1),
+		done:  make(chan bool),
+	}
+}
+
+// Ready returns a channel that receives a value whenever new diffs are queued.
+func (s *Subscriber) Ready() <-chan bool {
+	return s.ready
+}
+
+// Done returns a channel that's closed when the subscriber overflowed.  The
+// subscriber won't receive diffs after that.
+func (s *Subscriber) Done() <-chan bool {
+	return s.done
+}
+
+// Len returns the number of diffs that are waiting in the subscriber's queue.
+func (s *Subscriber) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.queue)
+}
+
+// Pop removes and returns the oldest diff in the subscriber's queue.  If the
+// queue is empty, the function returns nil.
+func (s *Subscriber) Pop() *ResourceDiff {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil
+	}
+	diff := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.coalesced = 0
+	return diff
+}
+
+// push adds the given diff to the subscriber's queue without ever blocking.
+// If the queue is full, the diff is coalesced into the last diff in the queue.
+// The function returns false if the subscriber overflowed.
+func (s *Subscriber) push(diff *ResourceDiff) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.overflowed {
+		return false
+	}
+
+	if len(s.queue) < SubscriberQueueLen {
+		s.queue = append(s.queue, diff)
+	} else {
+		last := len(s.queue) - 1
+		s.queue[last] = s.queue[last].Merge(diff)
+		s.coalesced++
+		if s.coalesced > SubscriberMaxCoalesced {
+			s.overflowed = true
+			s.queue = nil
+			close(s.done)
+			return false
+		}
+	}
+
+	// Wake up the subscriber unless it already has a pending wake-up call.
+	select {
+	case s.ready <- true:
+	default:
+	}
+	return true
+}
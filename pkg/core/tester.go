@@ -0,0 +1,85 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Tester tests whether resources work.  Bridgestrap is one such tester; see
+// the package usecases/testers for others.
+type Tester interface {
+	// Test tests the given resources and records the outcome in each
+	// resource's ResourceTest.  If the tester fails altogether, e.g.
+	// because it cannot reach an external service, the function returns an
+	// error and leaves the resources' test results untouched.  If the
+	// tester only tested some of the resources, it returns a
+	// *PartialTestError that contains the remaining resources.  Testers
+	// record resources that they can never test as untested.
+	Test(rs []Resource) error
+}
+
+// PartialTestError is returned by testers whose results lack some of the
+// resources that they were asked to test.
+type PartialTestError struct {
+	// Untested contains the resources that the tester may be able to test
+	// if we try again.
+	Untested []Resource
+	// Untestable contains the resources that the tester can never test,
+	// e.g. because they lack an address, so there's no point in trying
+	// again.
+	Untestable []Resource
+}
+
+func (e *PartialTestError) Error() string {
+	return fmt.Sprintf("%d resource(s) missing from test results and %d untestable",
+		len(e.Untested), len(e.Untestable))
+}
+
+// TesterFactory returns a new Tester that is configured by the given JSON
+// parameters.  The parameters may be nil if the tester isn't configured.
+type TesterFactory func(params json.RawMessage) (Tester, error)
+
+var (
+	testersMutex sync.RWMutex
+	testers      = make(map[string]TesterFactory)
+)
+
+// RegisterTester makes the tester with the given name available to NewTester.
+// The function panics if a tester with the same name was already registered.
+func RegisterTester(name string, factory TesterFactory) {
+	testersMutex.Lock()
+	defer testersMutex.Unlock()
+
+	if _, exists := testers[name]; exists {
+		panic(fmt.Sprintf("tester %q registered twice", name))
+	}
+	testers[name] = factory
+}
+
+// NewTester returns a new instance of the tester with the given name, which is
+// configured by the given JSON parameters.
+func NewTester(name string, params json.RawMessage) (Tester, error) {
+	testersMutex.RLock()
+	factory, exists := testers[name]
+	testersMutex.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown tester %q", name)
+	}
+	return factory(params)
+}
+
+// TesterNames returns the sorted names of all registered testers.
+func TesterNames() []string {
+	testersMutex.RLock()
+	defer testersMutex.RUnlock()
+
+	names := []string{}
+	for name := range testers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type nopTester struct {
+	params json.RawMessage
+}
+
+func (t *nopTester) Test(rs []Resource) error {
+	return nil
+}
+
+func TestTesterRegistry(t *testing.T) {
+
+	RegisterTester("nop", func(params json.RawMessage) (Tester, error) {
+		return &nopTester{params: params}, nil
+	})
+
+	tester, err := NewTester("nop", json.RawMessage(`{"foo": "bar"}`))
+	if err != nil {
+		t.Fatalf("failed to create registered tester: %s", err)
+	}
+	if string(tester.(*nopTester).params) != `{"foo": "bar"}` {
+		t.Errorf("tester didn't get its parameters")
+	}
+	if _, err := NewTester("unknown", nil); err == nil {
+		t.Errorf("created unregistered tester")
+	}
+
+	found := false
+	for _, name := range TesterNames() {
+		if name == "nop" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("registered tester is missing from %v", TesterNames())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a tester twice didn't panic")
+		}
+	}()
+	RegisterTester("nop", nil)
+}
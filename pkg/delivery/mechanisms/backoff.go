@@ -0,0 +1,64 @@
+package mechanisms
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// backoff implements exponential backoff with jitter.  Without jitter, all
+// distributors would reconnect in lockstep after a backend restart.
+type backoff struct {
+	min  time.Duration
+	max  time.Duration
+	cur  time.Duration
+	rand *rand.Rand
+}
+
+// newBackoff returns a new backoff whose delays start at the given minimum and
+// max out at the given maximum.
+func newBackoff(min, max time.Duration) *backoff {
+
+	// Each backoff gets its own source because the global source always
+	// starts with the same seed, which would defeat the point of jitter.
+	return &backoff{
+		min:  min,
+		max:  max,
+		cur:  min,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the time to wait before the next attempt and doubles the
+// delay for subsequent calls.  The returned duration is picked uniformly at
+// random from the second half of the current delay.
+func (b *backoff) next() time.Duration {
+
+	half := b.cur / 2
+	ret := half + time.Duration(b.rand.Int63n(int64(b.cur-half)+1))
+	b.cur *= 2
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	return ret
+}
+
+// reset makes the next delay start at the minimum again.
+func (b *backoff) reset() {
+	b.cur = b.min
+}
+
+// sleepContext sleeps for the given duration or until the given context is
+// done, whichever comes first.  The function returns the context's error if
+// the context is done.
+func sleepContext(c context.Context, delay time.Duration) error {
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
@@ -0,0 +1,53 @@
+package mechanisms
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+
+	min, max := 10*time.Second, 60*time.Second
+	b := newBackoff(min, max)
+
+	expected := []time.Duration{10, 20, 40, 60, 60}
+	for _, cur := range expected {
+		cur *= time.Second
+		d := b.next()
+		if d < cur/2 || d > cur {
+			t.Errorf("expected delay in [%s, %s] but got %s", cur/2, cur, d)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d < min/2 || d > min {
+		t.Errorf("expected delay in [%s, %s] after reset but got %s", min/2, min, d)
+	}
+
+	// Two backoffs shouldn't produce the same delays, or else distributors
+	// would reconnect in lockstep.
+	b1, b2 := newBackoff(time.Hour, time.Hour), newBackoff(time.Hour, time.Hour)
+	same := true
+	for i := 0; i < 10; i++ {
+		if b1.next() != b2.next() {
+			same = false
+		}
+	}
+	if same {
+		t.Errorf("backoffs aren't jittered")
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+
+	if err := sleepContext(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("expected sleep to finish but got: %s", err)
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleepContext(c, time.Hour); err != context.Canceled {
+		t.Errorf("expected sleep to be cancelled but got: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package mechanisms
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms/rdsyspb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// GrpcIpcContext implements the delivery.Mechanism interface.  It talks to the
+// backend's gRPC API over mutually-authenticated TLS.
+type GrpcIpcContext struct {
+	conn     *grpc.ClientConn
+	client   rdsyspb.BackendClient
+	messages chan *core.ResourceDiff
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	view     *streamView
+}
+
+// NewGrpcIpc returns a new gRPC IPC mechanism that talks to the backend at the
+// given address, e.g. "127.0.0.1:7101".  The given TLS configuration must
+// contain our client certificate and the CA that signed the backend's
+// certificate.  We don't connect to the backend until the first request.
+func NewGrpcIpc(address string, tlsConfig *tls.Config) (*GrpcIpcContext, error) {
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, err
+	}
+	return &GrpcIpcContext{conn: conn, client: rdsyspb.NewBackendClient(conn)}, nil
+}
+
+// withToken returns a context that carries the given bearer token.
+func withToken(ctx context.Context, bearerToken string) context.Context {
+	if bearerToken == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+bearerToken)
+}
+
+// StartStream initiates the start of the gRPC resource stream.
+func (ctx *GrpcIpcContext) StartStream(req *core.ResourceRequest) {
+
+	var c context.Context
+	c, ctx.cancel = context.WithCancel(context.Background())
+	ctx.messages = req.Receiver
+	ctx.view = newStreamView()
+	ctx.wg.Add(1)
+	go ctx.handleStream(c, req)
+}
+
+// StopStream stops the gRPC resource stream, waits until it's done, and closes
+// our connection to the backend.
+func (ctx *GrpcIpcContext) StopStream() {
+	ctx.cancel()
+	ctx.wg.Wait()
+	ctx.conn.Close()
+}
+
+// MakeJsonRequest satisfies the delivery.Mechanism interface.  Despite its
+// name, it doesn't speak JSON: the given request must be a
+// *core.ResourceRequest and the given return value must be a
+// *[]core.Resource, which is filled with the resources that the backend
+// returns.
+func (ctx *GrpcIpcContext) MakeJsonRequest(req interface{}, ret interface{}) error {
+
+	rReq, ok := req.(*core.ResourceRequest)
+	if !ok {
+		return fmt.Errorf("unsupported request type %T", req)
+	}
+	rs, ok := ret.(*[]core.Resource)
+	if !ok {
+		return fmt.Errorf("unsupported return type %T", ret)
+	}
+
+	l, err := ctx.client.GetResources(withToken(context.Background(), rReq.BearerToken), RequestToProto(rReq))
+	if err != nil {
+		return err
+	}
+	*rs, err = ResourcesFromProto(l)
+	return err
+}
+
+// handleStream keeps our resource stream alive until the given context is
+// cancelled.  If our stream to the backend breaks, we establish a new one and
+// tell the backend the sequence number of the last diff that we received.
+func (ctx *GrpcIpcContext) handleStream(c context.Context, req *core.ResourceRequest) {
+
+	defer ctx.wg.Done()
+	retry := newBackoff(DefaultTimeBeforeRetry, MaxTimeBeforeRetry)
+	for {
+		received, err := ctx.stream(c, req)
+		if c.Err() != nil {
+			log.Printf("Stopping gRPC resource stream.")
+			return
+		}
+		if received {
+			retry.reset()
+		}
+		delay := retry.next()
+		log.Printf("Lost gRPC resource stream (%s).  Retrying in %s.", err, delay)
+		if sleepContext(c, delay) != nil {
+			log.Printf("Stopping gRPC resource stream.")
+			return
+		}
+	}
+}
+
+// stream relays diffs from a single gRPC stream to the caller until the stream
+// breaks or the given context is cancelled.  The function returns true if it
+// received at least one diff.
+func (ctx *GrpcIpcContext) stream(c context.Context, req *core.ResourceRequest) (bool, error) {
+
+	pbReq := RequestToProto(req)
+	pbReq.LastSequence = ctx.view.lastSequence
+	stream, err := ctx.client.StreamResources(withToken(c, req.BearerToken), pbReq)
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		pbDiff, err := stream.Recv()
+		if err == io.EOF {
+			return received, fmt.Errorf("backend closed stream")
+		} else if err != nil {
+			return received, err
+		}
+		received = true
+
+		diff, err := DiffFromProto(pbDiff)
+		if err != nil {
+			log.Printf("Error converting diff from backend: %s", err)
+			continue
+		}
+		if diff = ctx.view.process(diff); diff == nil {
+			continue
+		}
+		select {
+		case ctx.messages <- diff:
+		case <-c.Done():
+			return received, c.Err()
+		}
+	}
+}
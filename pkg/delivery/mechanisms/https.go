@@ -1,8 +1,9 @@
 package mechanisms
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -16,6 +17,7 @@ import (
 )
 
 const (
+	// InterMessageDelimiter separates messages in our legacy stream format.
 	InterMessageDelimiter  = '\r'
 	DefaultTimeBeforeRetry = time.Second * 1
 	MaxTimeBeforeRetry     = time.Hour
@@ -23,31 +25,64 @@ const (
 
 // HttpsIpcContext implements the delivery.Mechanism interface.
 type HttpsIpcContext struct {
-	apiEndpoint     string
-	messages        chan *core.ResourceDiff
-	done            chan bool
-	wg              sync.WaitGroup
-	timeBeforeRetry time.Duration
+	apiEndpoint string
+	client      *http.Client
+	messages    chan *core.ResourceDiff
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	minRetry    time.Duration
+	maxRetry    time.Duration
+	view        *streamView
 }
 
 func NewHttpsIpc(apiEndpoint string) *HttpsIpcContext {
 
-	return &HttpsIpcContext{apiEndpoint: apiEndpoint}
+	return &HttpsIpcContext{
+		apiEndpoint: apiEndpoint,
+		client:      &http.Client{},
+		minRetry:    DefaultTimeBeforeRetry,
+		maxRetry:    MaxTimeBeforeRetry,
+	}
+}
+
+// NewHttpsIpcWithTLS returns a new HTTPS IPC mechanism that uses the given TLS
+// configuration, e.g. to present a client certificate or to only trust a
+// specific CA.
+func NewHttpsIpcWithTLS(apiEndpoint string, tlsConfig *tls.Config) *HttpsIpcContext {
+
+	ctx := NewHttpsIpc(apiEndpoint)
+	ctx.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return ctx
+}
+
+// SetRetryInterval determines how long we wait before trying to reconnect to
+// the backend.  The first retry happens after roughly the given minimum, and
+// the delay doubles with each failed attempt until it reaches the given
+// maximum.  The function must be called before StartStream.
+func (ctx *HttpsIpcContext) SetRetryInterval(min, max time.Duration) {
+	ctx.minRetry = min
+	ctx.maxRetry = max
 }
 
 // StartStream initates the start of the HTTP resource stream.
 func (ctx *HttpsIpcContext) StartStream(req *core.ResourceRequest) {
+
+	var c context.Context
+	c, ctx.cancel = context.WithCancel(context.Background())
 	ctx.messages = req.Receiver
-	ctx.done = make(chan bool)
+	ctx.view = newStreamView()
 	ctx.wg.Add(1)
-	ctx.timeBeforeRetry = DefaultTimeBeforeRetry
-	go ctx.handleStream(req)
+	go ctx.handleStream(c, req)
 }
 
-// StopStream signals the HTTP resource stream to stop and waits until it's
-// done.
+// StopStream stops the HTTP resource stream and waits until it's done.  Once
+// StopStream returns, we no longer write to the stream's receiver channel.
 func (ctx *HttpsIpcContext) StopStream() {
-	close(ctx.done)
+
+	if ctx.cancel == nil {
+		return
+	}
+	ctx.cancel()
 	ctx.wg.Wait()
 }
 
@@ -57,7 +92,14 @@ func (ctx *HttpsIpcContext) StopStream() {
 // returns an error.
 func (ctx *HttpsIpcContext) MakeJsonRequest(req interface{}, ret interface{}) error {
 
-	resp, err := ctx.sendRequest(req, "")
+	return ctx.MakeJsonRequestContext(context.Background(), req, ret)
+}
+
+// MakeJsonRequestContext is like MakeJsonRequest but gives up once the given
+// context is done.
+func (ctx *HttpsIpcContext) MakeJsonRequestContext(c context.Context, req interface{}, ret interface{}) error {
+
+	resp, err := ctx.sendRequest(c, req, "", "")
 	if err != nil {
 		return err
 	}
@@ -79,102 +121,101 @@ func (ctx *HttpsIpcContext) MakeJsonRequest(req interface{}, ret interface{}) er
 	return nil
 }
 
-// expBackoff returns an exponentially increasing time duration with each
-// subsequent call; starting at DefaultTimeBeforeRetry and maxing out at
-// MaxTimeBeforeRetry.
-func (ctx *HttpsIpcContext) expBackoff() time.Duration {
-
-	ret := ctx.timeBeforeRetry
-	ctx.timeBeforeRetry *= 2
-	if ctx.timeBeforeRetry > MaxTimeBeforeRetry {
-		ctx.timeBeforeRetry = MaxTimeBeforeRetry
-	}
-	return ret
-}
-
 // handleStream initiates our resource stream and relays information from the
-// backend to the caller.  If our connection to the backend unexpectedly
-// terminates, the function tries to establish a new connection, which is
-// transparent to the caller.
-func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
+// backend to the caller until the given context is cancelled.  If our
+// connection to the backend unexpectedly terminates, the function tries to
+// establish a new connection, which is transparent to the caller: When
+// reconnecting, we tell the backend the sequence number of the last diff that
+// we received, and the backend either replays the diffs that we missed, or
+// sends us a full snapshot.
+func (ctx *HttpsIpcContext) handleStream(c context.Context, req *core.ResourceRequest) {
 
 	defer ctx.wg.Done()
-	retChan := make(chan error)
-	defer close(retChan)
-	incoming := make(chan []byte)
-	defer close(incoming)
-
-	// setupConn tries to create a persistent HTTP connection to our backend.
-	// If that fails, the function continues to try again, indefinitely.  Once
-	// a connection was established, the function relays all data from the
-	// backend to the channel 'incoming'.  If the backend closes the connection
-	// on us, the function writes the error to the channel 'retChan' and
-	// returns.
-	setupConn := func() {
-		var err error
-		var resp *http.Response
-		for success := false; !success; success = (err == nil) {
-			log.Printf("Making HTTP request to initiate resource stream.")
-			resp, err = ctx.sendRequest(req, req.BearerToken)
-			if err != nil {
-				log.Printf("Error making HTTP request: %s", err.Error())
-				log.Printf("Trying again in %s.", ctx.timeBeforeRetry)
-				time.Sleep(ctx.expBackoff())
-			}
+	retry := newBackoff(ctx.minRetry, ctx.maxRetry)
+	for {
+		delivered, err := ctx.stream(c, req)
+		if c.Err() != nil {
+			log.Printf("Stopping HTTP resource stream.")
+			return
 		}
-		defer resp.Body.Close()
-		ctx.timeBeforeRetry = DefaultTimeBeforeRetry
-
-		reader := bufio.NewReader(resp.Body)
-		for {
-			line, err := reader.ReadBytes(InterMessageDelimiter)
-			if err != nil {
-				retChan <- err
-				return
-			}
-			incoming <- bytes.TrimSpace(line)
+		// A backend that accepts our request but drops the stream right
+		// away must not make us reconnect in a tight loop, so we only start
+		// over with our minimum delay if the stream was of any use.
+		if delivered {
+			retry.reset()
+		}
+		delay := retry.next()
+		log.Printf("Lost HTTP resource stream (%s).  Retrying in %s.", err, delay)
+		if sleepContext(c, delay) != nil {
+			log.Printf("Stopping HTTP resource stream.")
+			return
 		}
 	}
+}
+
+// stream relays diffs from a single HTTP resource stream to the caller until
+// the stream breaks or the given context is cancelled.  The function returns
+// true if the stream delivered at least one diff.
+func (ctx *HttpsIpcContext) stream(c context.Context, req *core.ResourceRequest) (bool, error) {
 
-	go setupConn()
+	streamReq := *req
+	streamReq.LastSequence = ctx.view.lastSequence
+	log.Printf("Making HTTP request to initiate resource stream.")
+	resp, err := ctx.sendRequest(c, &streamReq, req.BearerToken, ContentTypeNDJSON)
+	if err != nil {
+		return false, err
+	}
+	// Cancelling the request's context also unblocks our reads from the
+	// response body.
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("got HTTP status code %d", resp.StatusCode)
+	}
+
+	// We ask for NDJSON but older backends may respond with our legacy
+	// format, so we read whatever the backend says it's sending.
+	reader := NewStreamReader(resp.Body, resp.Header.Get("Content-Type"))
+	delivered := false
 	for {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			return delivered, err
+		}
+
+		helper := resources.TmpResourceDiff{}
+		if err := json.Unmarshal(msg, &helper); err != nil {
+			log.Printf("Error unmarshalling preliminary JSON from backend: %s", err)
+			continue
+		}
+		diff, err := resources.UnmarshalTmpResourceDiff(&helper)
+		if err != nil {
+			log.Printf("Error unmarshalling remaining JSON from backend: %s", err)
+			continue
+		}
+		delivered = true
+		if diff = ctx.view.process(diff); diff == nil {
+			continue
+		}
 		select {
-		// We got a new JSON chunk from our backend.
-		case chunk := <-incoming:
-			helper := resources.TmpResourceDiff{}
-			if err := json.Unmarshal(chunk, &helper); err != nil {
-				log.Printf("Error unmarshalling preliminary JSON from backend: %s", err)
-				break
-			}
-			diff, err := resources.UnmarshalTmpResourceDiff(&helper)
-			if err != nil {
-				log.Printf("Error unmarshalling remaining JSON from backend: %s", err)
-				break
-			}
-			ctx.messages <- diff
-		// We lost our connection to the backend.  Let's try again.
-		case err := <-retChan:
-			log.Printf("Lost connection to backend (%s).  Retrying.", err.Error())
-			go setupConn()
-		// We're told to terminate.
-		case <-ctx.done:
-			log.Printf("Stopping HTTP resource stream.")
-			return
+		case ctx.messages <- diff:
+		case <-c.Done():
+			return delivered, c.Err()
 		}
 	}
 }
 
 // sendRequest marshalls the given request into JSON and sends it to the API
 // endpoint that's part of the given context.  If not "", the function sets the
-// given bearer token in the HTTP request.
-func (ctx *HttpsIpcContext) sendRequest(req interface{}, bearerToken string) (*http.Response, error) {
+// given bearer token and the given accepted content type in the HTTP request.
+// The request is aborted once the given context is done.
+func (ctx *HttpsIpcContext) sendRequest(c context.Context, req interface{}, bearerToken, accept string) (*http.Response, error) {
 
 	encoded, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
 
-	httpReq, err := http.NewRequest(http.MethodGet, ctx.apiEndpoint, bytes.NewBuffer(encoded))
+	httpReq, err := http.NewRequestWithContext(c, http.MethodGet, ctx.apiEndpoint, bytes.NewBuffer(encoded))
 	if err != nil {
 		return nil, err
 	}
@@ -182,9 +223,11 @@ func (ctx *HttpsIpcContext) sendRequest(req interface{}, bearerToken string) (*h
 	if bearerToken != "" {
 		httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", bearerToken))
 	}
+	if accept != "" {
+		httpReq.Header.Set("Accept", accept)
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := ctx.client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
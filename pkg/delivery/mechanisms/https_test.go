@@ -0,0 +1,151 @@
+package mechanisms
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// stopWithin fails the test if the given IPC mechanism's StopStream doesn't
+// return within a second.
+func stopWithin(t *testing.T, ipc *HttpsIpcContext) {
+
+	done := make(chan bool)
+	go func() {
+		ipc.StopStream()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("StopStream didn't return")
+	}
+}
+
+// startTestStream starts a resource stream from the given URL.
+func startTestStream(url string) (chan *core.ResourceDiff, *HttpsIpcContext) {
+
+	rStream := make(chan *core.ResourceDiff)
+	ipc := NewHttpsIpc(url)
+	ipc.SetRetryInterval(10*time.Millisecond, 50*time.Millisecond)
+	ipc.StartStream(&core.ResourceRequest{Receiver: rStream})
+	return rStream, ipc
+}
+
+func TestStopStreamWhileRetrying(t *testing.T) {
+
+	// Nobody is listening on the server's address once it's closed, so our
+	// stream keeps retrying.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	_, ipc := startTestStream(srv.URL)
+	time.Sleep(100 * time.Millisecond)
+	stopWithin(t, ipc)
+}
+
+func TestStopStreamWhileConnected(t *testing.T) {
+
+	requests := make(chan bool, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- true
+		w.Header().Set("Content-Type", ContentTypeNDJSON)
+		sw := NewStreamWriter(w, ContentTypeNDJSON)
+		if err := sw.WriteDiff(newTestDiff(1)); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	// We never read from the stream's channel, so the stream is stuck trying
+	// to hand us the first diff.
+	_, ipc := startTestStream(srv.URL)
+	<-requests
+	stopWithin(t, ipc)
+
+	// Now the stream is waiting for the backend's next diff.
+	rStream, ipc := startTestStream(srv.URL)
+	<-requests
+	<-rStream
+	stopWithin(t, ipc)
+
+	// Stopping twice, or stopping a stream that was never started, is
+	// harmless.
+	ipc.StopStream()
+	NewHttpsIpc(srv.URL).StopStream()
+}
+
+func TestStreamRejected(t *testing.T) {
+
+	requests := make(chan bool, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- true:
+		default:
+		}
+		http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	// A backend that rejects our request must not be mistaken for a stream
+	// that ended, so we keep retrying.
+	_, ipc := startTestStream(srv.URL)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-requests:
+		case <-time.After(time.Second):
+			t.Fatalf("stream didn't retry after rejected request")
+		}
+	}
+	stopWithin(t, ipc)
+}
+
+func TestStreamDroppedRightAway(t *testing.T) {
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", ContentTypeNDJSON)
+	}))
+	defer srv.Close()
+
+	// The backend accepts our request but ends the stream before sending a
+	// diff.  If we reset our backoff, we would reconnect every 5-10 ms, and
+	// make dozens of requests.
+	rStream := make(chan *core.ResourceDiff)
+	ipc := NewHttpsIpc(srv.URL)
+	ipc.SetRetryInterval(10*time.Millisecond, time.Second)
+	ipc.StartStream(&core.ResourceRequest{Receiver: rStream})
+	time.Sleep(300 * time.Millisecond)
+	stopWithin(t, ipc)
+
+	if n := atomic.LoadInt32(&requests); n > 12 {
+		t.Errorf("expected backoff between requests but got %d requests", n)
+	}
+}
+
+func TestMakeJsonRequestContext(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices that the client went away once it has
+		// consumed the request body.
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var ret []core.Resource
+	err := NewHttpsIpc(srv.URL).MakeJsonRequestContext(c, &core.ResourceRequest{}, &ret)
+	if err == nil {
+		t.Errorf("expected request to be cancelled")
+	}
+}
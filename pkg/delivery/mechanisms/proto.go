@@ -0,0 +1,248 @@
+package mechanisms
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms/rdsyspb"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// This file converts our resources, diffs, and requests into the protocol
+// buffer messages that our gRPC API uses, and back.
+
+// RequestToProto turns the given resource request into its protocol buffer
+// message.  The request's bearer token is not part of the message.
+func RequestToProto(req *core.ResourceRequest) *rdsyspb.ResourceRequest {
+	return &rdsyspb.ResourceRequest{
+		RequestOrigin: req.RequestOrigin,
+		ResourceTypes: req.ResourceTypes,
+		LastSequence:  req.LastSequence,
+		MinScore:      req.MinScore,
+	}
+}
+
+// RequestFromProto turns the given protocol buffer message into a resource
+// request.
+func RequestFromProto(pbReq *rdsyspb.ResourceRequest) *core.ResourceRequest {
+	return &core.ResourceRequest{
+		RequestOrigin: pbReq.GetRequestOrigin(),
+		ResourceTypes: pbReq.GetResourceTypes(),
+		LastSequence:  pbReq.GetLastSequence(),
+		MinScore:      pbReq.GetMinScore(),
+	}
+}
+
+func locationToProto(l *core.Location) *rdsyspb.Location {
+	if l == nil {
+		return nil
+	}
+	return &rdsyspb.Location{CountryCode: l.CountryCode, Asn: l.ASN}
+}
+
+func locationFromProto(l *rdsyspb.Location) *core.Location {
+	if l == nil {
+		return nil
+	}
+	return &core.Location{CountryCode: l.GetCountryCode(), ASN: l.GetAsn()}
+}
+
+func blockedInToProto(s core.LocationSet) []string {
+	locations := []string{}
+	for location := range s {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	return locations
+}
+
+func blockedInFromProto(locations []string) core.LocationSet {
+	s := make(core.LocationSet)
+	for _, location := range locations {
+		s[location] = true
+	}
+	return s
+}
+
+// parseAddr parses the given IP address and returns an error if the address
+// is invalid.
+func parseAddr(addr string) (resources.IPAddr, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return resources.IPAddr{}, fmt.Errorf("invalid IP address %q", addr)
+	}
+	return resources.IPAddr{IPAddr: net.IPAddr{IP: ip}}, nil
+}
+
+// ResourceToProto turns the given resource into its protocol buffer message.
+// The function returns an error if we don't know how to represent the
+// resource.
+func ResourceToProto(r core.Resource) (*rdsyspb.Resource, error) {
+
+	switch r := r.(type) {
+	case *resources.Bridge:
+		return &rdsyspb.Resource{Resource: &rdsyspb.Resource_Bridge{Bridge: &rdsyspb.Bridge{
+			Type:        r.Type(),
+			Protocol:    r.Protocol,
+			Address:     r.Address.String(),
+			Port:        uint32(r.Port),
+			Fingerprint: r.Fingerprint,
+			BlockedIn:   blockedInToProto(r.BlockedIn()),
+			Location:    locationToProto(r.Location),
+		}}}, nil
+	case *resources.Transport:
+		return &rdsyspb.Resource{Resource: &rdsyspb.Resource_Transport{Transport: &rdsyspb.Transport{
+			Type:        r.Type(),
+			Protocol:    r.Protocol,
+			Address:     r.Address.String(),
+			Port:        uint32(r.Port),
+			Fingerprint: r.Fingerprint,
+			BlockedIn:   blockedInToProto(r.BlockedIn()),
+			Location:    locationToProto(r.Location),
+			Params:      r.Parameters,
+		}}}, nil
+	default:
+		return nil, fmt.Errorf("cannot represent resource of type %q", r.Type())
+	}
+}
+
+// ResourceFromProto turns the given protocol buffer message into a resource.
+// The function returns an error if the message doesn't contain a valid
+// resource.
+func ResourceFromProto(pbResource *rdsyspb.Resource) (core.Resource, error) {
+
+	var r core.Resource
+	switch pbR := pbResource.GetResource().(type) {
+	case *rdsyspb.Resource_Bridge:
+		addr, err := parseAddr(pbR.Bridge.GetAddress())
+		if err != nil {
+			return nil, err
+		}
+		b := resources.NewBridge()
+		b.SetType(pbR.Bridge.GetType())
+		b.Protocol = pbR.Bridge.GetProtocol()
+		b.Address = addr
+		b.Port = uint16(pbR.Bridge.GetPort())
+		b.Fingerprint = pbR.Bridge.GetFingerprint()
+		b.SetBlockedIn(blockedInFromProto(pbR.Bridge.GetBlockedIn()))
+		b.Location = locationFromProto(pbR.Bridge.GetLocation())
+		r = b
+	case *rdsyspb.Resource_Transport:
+		addr, err := parseAddr(pbR.Transport.GetAddress())
+		if err != nil {
+			return nil, err
+		}
+		t := resources.NewTransport()
+		t.SetType(pbR.Transport.GetType())
+		t.Protocol = pbR.Transport.GetProtocol()
+		t.Address = addr
+		t.Port = uint16(pbR.Transport.GetPort())
+		t.Fingerprint = pbR.Transport.GetFingerprint()
+		t.SetBlockedIn(blockedInFromProto(pbR.Transport.GetBlockedIn()))
+		t.Location = locationFromProto(pbR.Transport.GetLocation())
+		for key, value := range pbR.Transport.GetParams() {
+			t.Parameters[key] = value
+		}
+		r = t
+	default:
+		return nil, fmt.Errorf("message contains no resource")
+	}
+
+	if !r.IsValid() {
+		return nil, fmt.Errorf("resource %q is not valid", r.Type())
+	}
+	return r, nil
+}
+
+// ResourcesToProto turns the given resources into a protocol buffer message.
+func ResourcesToProto(rs []core.Resource) (*rdsyspb.ResourceList, error) {
+
+	l := &rdsyspb.ResourceList{}
+	for _, r := range rs {
+		pbR, err := ResourceToProto(r)
+		if err != nil {
+			return nil, err
+		}
+		l.Resources = append(l.Resources, pbR)
+	}
+	return l, nil
+}
+
+// ResourcesFromProto turns the given protocol buffer message into resources.
+func ResourcesFromProto(l *rdsyspb.ResourceList) ([]core.Resource, error) {
+
+	rs := []core.Resource{}
+	for _, pbR := range l.GetResources() {
+		r, err := ResourceFromProto(pbR)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func resourceMapToProto(m core.ResourceMap) (map[string]*rdsyspb.ResourceList, error) {
+
+	if len(m) == 0 {
+		return nil, nil
+	}
+	pbM := make(map[string]*rdsyspb.ResourceList)
+	for rType, queue := range m {
+		l, err := ResourcesToProto(queue)
+		if err != nil {
+			return nil, err
+		}
+		pbM[rType] = l
+	}
+	return pbM, nil
+}
+
+func resourceMapFromProto(pbM map[string]*rdsyspb.ResourceList) (core.ResourceMap, error) {
+
+	m := make(core.ResourceMap)
+	for rType, l := range pbM {
+		rs, err := ResourcesFromProto(l)
+		if err != nil {
+			return nil, err
+		}
+		m[rType] = rs
+	}
+	return m, nil
+}
+
+// DiffToProto turns the given resource diff into its protocol buffer message.
+func DiffToProto(diff *core.ResourceDiff) (*rdsyspb.ResourceDiff, error) {
+
+	var err error
+	pbDiff := &rdsyspb.ResourceDiff{Sequence: diff.Sequence, FullUpdate: diff.FullUpdate}
+	if pbDiff.New, err = resourceMapToProto(diff.New); err != nil {
+		return nil, err
+	}
+	if pbDiff.Changed, err = resourceMapToProto(diff.Changed); err != nil {
+		return nil, err
+	}
+	if pbDiff.Gone, err = resourceMapToProto(diff.Gone); err != nil {
+		return nil, err
+	}
+	return pbDiff, nil
+}
+
+// DiffFromProto turns the given protocol buffer message into a resource diff.
+func DiffFromProto(pbDiff *rdsyspb.ResourceDiff) (*core.ResourceDiff, error) {
+
+	var err error
+	diff := &core.ResourceDiff{Sequence: pbDiff.GetSequence(), FullUpdate: pbDiff.GetFullUpdate()}
+	if diff.New, err = resourceMapFromProto(pbDiff.GetNew()); err != nil {
+		return nil, err
+	}
+	if diff.Changed, err = resourceMapFromProto(pbDiff.GetChanged()); err != nil {
+		return nil, err
+	}
+	if diff.Gone, err = resourceMapFromProto(pbDiff.GetGone()); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
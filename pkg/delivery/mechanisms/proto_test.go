@@ -0,0 +1,105 @@
+package mechanisms
+
+import (
+	"net"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms/rdsyspb"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDiffProtoRoundTrip(t *testing.T) {
+
+	b := resources.NewBridge()
+	b.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.1.1.1")}}
+	b.Port = 1111
+	b.Fingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+	b.SetBlockedIn(core.LocationSet{"ru": true, "cn": true})
+	b.Location = &core.Location{CountryCode: "de", ASN: 1234}
+
+	tr := newTestDiff(0).New[resources.ResourceTypeObfs4][0].(*resources.Transport)
+	tr.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("2001:db8::1")}}
+
+	diff := &core.ResourceDiff{
+		New:        core.ResourceMap{resources.ResourceTypeVanilla: []core.Resource{b}},
+		Changed:    core.ResourceMap{resources.ResourceTypeObfs4: []core.Resource{tr}},
+		Sequence:   42,
+		FullUpdate: true,
+	}
+	pbDiff, err := DiffToProto(diff)
+	if err != nil {
+		t.Fatalf("failed to convert diff: %s", err)
+	}
+
+	// Make sure that the message survives the wire.
+	raw, err := proto.Marshal(pbDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbDiff = &rdsyspb.ResourceDiff{}
+	if err := proto.Unmarshal(raw, pbDiff); err != nil {
+		t.Fatal(err)
+	}
+
+	diff2, err := DiffFromProto(pbDiff)
+	if err != nil {
+		t.Fatalf("failed to convert diff back: %s", err)
+	}
+	if diff2.Sequence != 42 || !diff2.FullUpdate {
+		t.Errorf("diff metadata got lost: %d, %v", diff2.Sequence, diff2.FullUpdate)
+	}
+	if len(diff2.Gone) != 0 {
+		t.Errorf("expected no gone resources but got %d", len(diff2.Gone))
+	}
+
+	b2, ok := diff2.New[resources.ResourceTypeVanilla][0].(*resources.Bridge)
+	if !ok {
+		t.Fatalf("expected bridge but got %T", diff2.New[resources.ResourceTypeVanilla][0])
+	}
+	if b2.Uid() != b.Uid() || b2.Oid() != b.Oid() {
+		t.Errorf("bridge got mangled: %s", b2)
+	}
+	if !b2.BlockedIn()["ru"] || !b2.BlockedIn()["cn"] || len(b2.BlockedIn()) != 2 {
+		t.Errorf("bridge's blocked locations got mangled: %s", b2.BlockedIn())
+	}
+	if b2.Location == nil || *b2.Location != *b.Location {
+		t.Errorf("bridge's location got mangled: %v", b2.Location)
+	}
+
+	tr2, ok := diff2.Changed[resources.ResourceTypeObfs4][0].(*resources.Transport)
+	if !ok {
+		t.Fatalf("expected transport but got %T", diff2.Changed[resources.ResourceTypeObfs4][0])
+	}
+	if tr2.Uid() != tr.Uid() || tr2.Oid() != tr.Oid() {
+		t.Errorf("transport got mangled: %s", tr2)
+	}
+	if tr2.Location != nil {
+		t.Errorf("transport without location gained location %v", tr2.Location)
+	}
+}
+
+func TestResourceFromProto(t *testing.T) {
+
+	if _, err := ResourceFromProto(&rdsyspb.Resource{}); err == nil {
+		t.Errorf("accepted empty resource")
+	}
+
+	invalid := []*rdsyspb.Resource{
+		{Resource: &rdsyspb.Resource_Bridge{Bridge: &rdsyspb.Bridge{Type: "vanilla", Address: "foo", Port: 1}}},
+		{Resource: &rdsyspb.Resource_Transport{Transport: &rdsyspb.Transport{Type: "obfs4", Address: "1.1.1.1"}}},
+	}
+	for _, pbR := range invalid {
+		if _, err := ResourceFromProto(pbR); err == nil {
+			t.Errorf("accepted invalid resource %v", pbR)
+		}
+	}
+
+	req := &core.ResourceRequest{RequestOrigin: "stub", ResourceTypes: []string{"obfs4"}, LastSequence: 7, BearerToken: "secret"}
+	pbReq := RequestToProto(req)
+	if req2 := RequestFromProto(pbReq); req2.RequestOrigin != "stub" || req2.LastSequence != 7 || req2.BearerToken != "" {
+		t.Errorf("request got mangled: %v", req2)
+	}
+}
@@ -0,0 +1,6 @@
+// Package rdsyspb contains the protocol buffer messages and the gRPC service
+// that the backend offers to distributors.  Distributors that aren't written
+// in Go can generate their own bindings from rdsys.proto.
+package rdsyspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative rdsys.proto
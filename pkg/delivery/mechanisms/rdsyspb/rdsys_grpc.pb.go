@@ -0,0 +1,175 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package rdsyspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// BackendClient is the client API for Backend service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BackendClient interface {
+	// StreamResources returns the requesting distributor's resources, followed
+	// by diffs whenever its resources change.  If the request's last_sequence
+	// is set, the backend first replays the diffs that the distributor missed,
+	// or, if that's no longer possible, sends a full snapshot.
+	StreamResources(ctx context.Context, in *ResourceRequest, opts ...grpc.CallOption) (Backend_StreamResourcesClient, error)
+	// GetResources returns the requesting distributor's current resources.
+	GetResources(ctx context.Context, in *ResourceRequest, opts ...grpc.CallOption) (*ResourceList, error)
+}
+
+type backendClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBackendClient(cc grpc.ClientConnInterface) BackendClient {
+	return &backendClient{cc}
+}
+
+func (c *backendClient) StreamResources(ctx context.Context, in *ResourceRequest, opts ...grpc.CallOption) (Backend_StreamResourcesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Backend_ServiceDesc.Streams[0], "/rdsys.Backend/StreamResources", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &backendStreamResourcesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Backend_StreamResourcesClient interface {
+	Recv() (*ResourceDiff, error)
+	grpc.ClientStream
+}
+
+type backendStreamResourcesClient struct {
+	grpc.ClientStream
+}
+
+func (x *backendStreamResourcesClient) Recv() (*ResourceDiff, error) {
+	m := new(ResourceDiff)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *backendClient) GetResources(ctx context.Context, in *ResourceRequest, opts ...grpc.CallOption) (*ResourceList, error) {
+	out := new(ResourceList)
+	err := c.cc.Invoke(ctx, "/rdsys.Backend/GetResources", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BackendServer is the server API for Backend service.
+// All implementations must embed UnimplementedBackendServer
+// for forward compatibility
+type BackendServer interface {
+	// StreamResources returns the requesting distributor's resources, followed
+	// by diffs whenever its resources change.  If the request's last_sequence
+	// is set, the backend first replays the diffs that the distributor missed,
+	// or, if that's no longer possible, sends a full snapshot.
+	StreamResources(*ResourceRequest, Backend_StreamResourcesServer) error
+	// GetResources returns the requesting distributor's current resources.
+	GetResources(context.Context, *ResourceRequest) (*ResourceList, error)
+	mustEmbedUnimplementedBackendServer()
+}
+
+// UnimplementedBackendServer must be embedded to have forward compatible implementations.
+type UnimplementedBackendServer struct {
+}
+
+func (UnimplementedBackendServer) StreamResources(*ResourceRequest, Backend_StreamResourcesServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamResources not implemented")
+}
+func (UnimplementedBackendServer) GetResources(context.Context, *ResourceRequest) (*ResourceList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetResources not implemented")
+}
+func (UnimplementedBackendServer) mustEmbedUnimplementedBackendServer() {}
+
+// UnsafeBackendServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BackendServer will
+// result in compilation errors.
+type UnsafeBackendServer interface {
+	mustEmbedUnimplementedBackendServer()
+}
+
+func RegisterBackendServer(s grpc.ServiceRegistrar, srv BackendServer) {
+	s.RegisterService(&Backend_ServiceDesc, srv)
+}
+
+func _Backend_StreamResources_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ResourceRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BackendServer).StreamResources(m, &backendStreamResourcesServer{stream})
+}
+
+type Backend_StreamResourcesServer interface {
+	Send(*ResourceDiff) error
+	grpc.ServerStream
+}
+
+type backendStreamResourcesServer struct {
+	grpc.ServerStream
+}
+
+func (x *backendStreamResourcesServer) Send(m *ResourceDiff) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Backend_GetResources_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResourceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackendServer).GetResources(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rdsys.Backend/GetResources",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackendServer).GetResources(ctx, req.(*ResourceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Backend_ServiceDesc is the grpc.ServiceDesc for Backend service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Backend_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rdsys.Backend",
+	HandlerType: (*BackendServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetResources",
+			Handler:    _Backend_GetResources_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamResources",
+			Handler:       _Backend_StreamResources_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rdsys.proto",
+}
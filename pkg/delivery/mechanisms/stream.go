@@ -0,0 +1,276 @@
+package mechanisms
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"strconv"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	// ContentTypeNDJSON represents newline-delimited JSON, i.e. one compact
+	// JSON object per line: http://ndjson.org
+	ContentTypeNDJSON = "application/x-ndjson"
+	// ContentTypeSSE represents Server-Sent Events:
+	// https://html.spec.whatwg.org/multipage/server-sent-events.html
+	ContentTypeSSE = "text/event-stream"
+	// ContentTypeLegacy represents our original stream format: pretty-printed
+	// JSON objects, separated by InterMessageDelimiter.  We keep supporting it
+	// for distributors that don't ask for anything else.
+	ContentTypeLegacy = "application/json"
+
+	// SSEDiffEvent is the event type of Server-Sent Events that carry a
+	// resource diff.
+	SSEDiffEvent = "diff"
+)
+
+// NegotiateStreamFormat takes as input the value of an HTTP Accept header and
+// returns the content type of the stream format that we should use.  We pick
+// the format that the client prefers according to the quality values of its
+// media ranges, as described in RFC 7231, section 5.3.2, and ignore formats
+// with a quality of zero.  If the client likes several formats equally, we pick
+// the one that the client listed first, and if the formats only match the same
+// wildcard, our legacy format.  If the client accepts none of our formats, we
+// fall back to our legacy format.
+func NegotiateStreamFormat(accept string) string {
+
+	best, bestQ, bestPos := ContentTypeLegacy, 0.0, 0
+	for _, format := range []string{ContentTypeLegacy, ContentTypeNDJSON, ContentTypeSSE} {
+		q, pos, ok := acceptQuality(accept, format)
+		if !ok || q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && pos < bestPos) {
+			best, bestQ, bestPos = format, q, pos
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality value that the given Accept header assigns
+// to the given media type, and the position of the media range that the value
+// comes from.  The most specific media range that matches the media type
+// determines its quality.  The function returns false if no media range
+// matches.
+func acceptQuality(accept, mediaType string) (float64, int, bool) {
+
+	q, pos, specificity := 0.0, 0, -1
+	for i, mediaRange := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		s := rangeSpecificity(rangeType, mediaType)
+		if s <= specificity {
+			continue
+		}
+		rangeQ := 1.0
+		if value, exists := params["q"]; exists {
+			rangeQ, err = strconv.ParseFloat(value, 64)
+			if err != nil || rangeQ < 0 || rangeQ > 1 {
+				continue
+			}
+		}
+		q, pos, specificity = rangeQ, i, s
+	}
+	return q, pos, specificity >= 0
+}
+
+// rangeSpecificity returns 2 if the given media range is the given media type,
+// 1 if it's a wildcard for the media type's subtypes, e.g. "text/*", 0 if it's
+// "*/*", and -1 if it doesn't match the media type.
+func rangeSpecificity(mediaRange, mediaType string) int {
+
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") &&
+		strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	default:
+		return -1
+	}
+}
+
+// StreamWriter writes resource diffs to an io.Writer, using one of our stream
+// formats.
+type StreamWriter struct {
+	w           io.Writer
+	contentType string
+}
+
+// NewStreamWriter returns a new stream writer that writes to the given writer
+// in the format that corresponds to the given content type.
+func NewStreamWriter(w io.Writer, contentType string) *StreamWriter {
+	return &StreamWriter{w: w, contentType: contentType}
+}
+
+// ContentType returns the content type of the stream writer's format.
+func (s *StreamWriter) ContentType() string {
+	return s.contentType
+}
+
+// WriteDiff encodes the given resource diff and writes it to the stream.
+func (s *StreamWriter) WriteDiff(diff *core.ResourceDiff) error {
+
+	var msg []byte
+	var err error
+
+	switch s.contentType {
+	case ContentTypeNDJSON:
+		if msg, err = json.Marshal(diff); err != nil {
+			return err
+		}
+		msg = append(msg, '\n')
+	case ContentTypeSSE:
+		jsonBlurb, err := json.Marshal(diff)
+		if err != nil {
+			return err
+		}
+		// The event ID allows clients to resume the stream by setting the
+		// Last-Event-ID header when reconnecting.
+		msg = []byte(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", diff.Sequence, SSEDiffEvent, jsonBlurb))
+	default:
+		if msg, err = json.MarshalIndent(diff, "", "    "); err != nil {
+			return err
+		}
+		msg = append(msg, InterMessageDelimiter)
+	}
+
+	_, err = s.w.Write(msg)
+	return err
+}
+
+// StreamReader reads raw JSON messages from an io.Reader, using one of our
+// stream formats.
+type StreamReader struct {
+	r           *bufio.Reader
+	contentType string
+}
+
+// NewStreamReader returns a new stream reader that reads from the given reader
+// in the format that corresponds to the given content type, which is
+// typically taken from the Content-Type header of an HTTP response.
+func NewStreamReader(r io.Reader, contentType string) *StreamReader {
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ContentTypeLegacy
+	}
+	return &StreamReader{r: bufio.NewReader(r), contentType: mediaType}
+}
+
+// ReadMessage returns the next JSON message from the stream.
+func (s *StreamReader) ReadMessage() ([]byte, error) {
+
+	switch s.contentType {
+	case ContentTypeNDJSON:
+		return s.readDelimited('\n')
+	case ContentTypeSSE:
+		return s.readEvent()
+	default:
+		return s.readDelimited(InterMessageDelimiter)
+	}
+}
+
+// readDelimited returns the next non-empty message that's terminated by the
+// given delimiter.
+func (s *StreamReader) readDelimited(delim byte) ([]byte, error) {
+
+	for {
+		line, err := s.r.ReadBytes(delim)
+		if err != nil {
+			return nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// readEvent returns the data of the next Server-Sent Event that carries a
+// resource diff.
+func (s *StreamReader) readEvent() ([]byte, error) {
+
+	var data [][]byte
+	event := ""
+	for {
+		line, err := s.r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		// An empty line dispatches the event.
+		if len(line) == 0 {
+			if len(data) > 0 && (event == "" || event == SSEDiffEvent) {
+				return bytes.Join(data, []byte("\n")), nil
+			}
+			data, event = nil, ""
+			continue
+		}
+		// Lines that start with a colon are comments.
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value := line, []byte{}
+		if i := bytes.IndexByte(line, ':'); i != -1 {
+			field, value = line[:i], bytes.TrimPrefix(line[i+1:], []byte(" "))
+		}
+		switch string(field) {
+		case "data":
+			data = append(data, value)
+		case "event":
+			event = string(value)
+		}
+	}
+}
+
+// streamView keeps track of the resources that a delivery mechanism relayed to
+// its caller.
+type streamView struct {
+	// lastSequence is the sequence number of the last diff that we relayed
+	// to the caller.  We send it to the backend when reconnecting, so the
+	// backend can replay the diffs that we missed.
+	lastSequence uint64
+	// resources contains the resources that we relayed to the caller.  It
+	// allows us to turn a full snapshot into a diff that the caller can apply.
+	resources core.ResourceMap
+}
+
+func newStreamView() *streamView {
+	return &streamView{resources: make(core.ResourceMap)}
+}
+
+// process updates the view with the given diff and returns the diff that
+// should be relayed to the caller, or nil if there's nothing to relay.  If the
+// given diff is a full snapshot, we turn it into a diff against our current
+// view, so the caller never has to deal with snapshots.  Note that sequence
+// numbers may skip values because the backend coalesces diffs for
+// distributors that are slow to consume them.
+func (v *streamView) process(diff *core.ResourceDiff) *core.ResourceDiff {
+
+	if diff.FullUpdate {
+		log.Printf("Backend sent full snapshot with sequence number %d.", diff.Sequence)
+		sequence := diff.Sequence
+		diff = diff.New.Diff(v.resources)
+		diff.Sequence = sequence
+	} else if diff.Sequence <= v.lastSequence {
+		log.Printf("Ignoring stale diff with sequence number %d.", diff.Sequence)
+		return nil
+	}
+	v.lastSequence = diff.Sequence
+	v.resources.ApplyDiff(diff)
+
+	return diff
+}
@@ -0,0 +1,166 @@
+package mechanisms
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// newTestDiff returns a diff with a single new obfs4 bridge whose parameters
+// contain characters that used to break our stream format.
+func newTestDiff(sequence uint64) *core.ResourceDiff {
+
+	t := resources.NewTransport()
+	t.SetType(resources.ResourceTypeObfs4)
+	t.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	t.Port = 1234
+	t.Parameters = map[string]string{"cert": "100%s%d\r\nfoo", "iat-mode": "0"}
+
+	return &core.ResourceDiff{
+		New:      core.ResourceMap{resources.ResourceTypeObfs4: []core.Resource{t}},
+		Sequence: sequence,
+	}
+}
+
+// decodeDiff turns the given JSON message back into a resource diff.
+func decodeDiff(t *testing.T, msg []byte) *core.ResourceDiff {
+
+	tmp := resources.TmpResourceDiff{}
+	if err := json.Unmarshal(msg, &tmp); err != nil {
+		t.Fatalf("failed to unmarshal message %q: %s", msg, err)
+	}
+	diff, err := resources.UnmarshalTmpResourceDiff(&tmp)
+	if err != nil {
+		t.Fatalf("failed to unmarshal resource diff: %s", err)
+	}
+	return diff
+}
+
+func TestNegotiateStreamFormat(t *testing.T) {
+
+	tests := map[string]string{
+		"":                                      ContentTypeLegacy,
+		"*/*":                                   ContentTypeLegacy,
+		"text/html":                             ContentTypeLegacy,
+		"application/json":                      ContentTypeLegacy,
+		"application/x-ndjson":                  ContentTypeNDJSON,
+		"text/event-stream":                     ContentTypeSSE,
+		"text/html, text/event-stream":          ContentTypeSSE,
+		"application/x-ndjson;q=0.9, text/html": ContentTypeNDJSON,
+		"text/event-stream, application/json":   ContentTypeSSE,
+		"application/json, text/event-stream":   ContentTypeLegacy,
+		"invalid;;, application/x-ndjson":       ContentTypeNDJSON,
+		"text/*":                                ContentTypeSSE,
+		"application/x-ndjson;q=0, text/event-stream":       ContentTypeSSE,
+		"text/event-stream;q=0.5, application/x-ndjson":     ContentTypeNDJSON,
+		"application/json;q=0, */*":                         ContentTypeNDJSON,
+		"text/event-stream;q=0.5, */*;q=0.1":                ContentTypeSSE,
+		"application/x-ndjson;q=0":                          ContentTypeLegacy,
+		"application/x-ndjson;q=invalid, text/event-stream": ContentTypeSSE,
+	}
+	for accept, expected := range tests {
+		if format := NegotiateStreamFormat(accept); format != expected {
+			t.Errorf("expected format %q for %q but got %q", expected, accept, format)
+		}
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+
+	for _, contentType := range []string{ContentTypeNDJSON, ContentTypeSSE, ContentTypeLegacy} {
+		buf := &bytes.Buffer{}
+		w := NewStreamWriter(buf, contentType)
+		for i := uint64(1); i <= 3; i++ {
+			if err := w.WriteDiff(newTestDiff(i)); err != nil {
+				t.Fatalf("failed to write %s diff: %s", contentType, err)
+			}
+		}
+
+		r := NewStreamReader(buf, contentType+"; charset=utf-8")
+		for i := uint64(1); i <= 3; i++ {
+			msg, err := r.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read %s message: %s", contentType, err)
+			}
+			diff := decodeDiff(t, msg)
+			if diff.Sequence != i {
+				t.Errorf("expected sequence number %d but got %d", i, diff.Sequence)
+			}
+			obfs4 := diff.New[resources.ResourceTypeObfs4]
+			if len(obfs4) != 1 {
+				t.Fatalf("expected 1 new resource in %s diff but got %d", contentType, len(obfs4))
+			}
+			if cert := obfs4[0].(*resources.Transport).Parameters["cert"]; cert != "100%s%d\r\nfoo" {
+				t.Errorf("parameter got mangled in %s stream: %q", contentType, cert)
+			}
+		}
+		if _, err := r.ReadMessage(); err != io.EOF {
+			t.Errorf("expected EOF at end of %s stream but got %v", contentType, err)
+		}
+	}
+}
+
+func TestStreamWriterFraming(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	if err := NewStreamWriter(buf, ContentTypeNDJSON).WriteDiff(newTestDiff(1)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(buf.String(), "\n") != 1 || !strings.HasSuffix(buf.String(), "\n") {
+		t.Errorf("NDJSON message is not a single line: %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := NewStreamWriter(buf, ContentTypeSSE).WriteDiff(newTestDiff(42)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "id: 42\nevent: diff\ndata: {") {
+		t.Errorf("unexpected SSE framing: %q", buf.String())
+	}
+}
+
+func TestStreamReaderSSE(t *testing.T) {
+
+	stream := ": keep-alive\n\n" +
+		"event: ping\ndata: ignored\n\n" +
+		"id: 1\r\nevent: diff\r\ndata: {\"sequence\":\r\ndata: 1}\r\n\r\n" +
+		"data:{\"sequence\": 2}\n\n"
+	r := NewStreamReader(strings.NewReader(stream), ContentTypeSSE)
+
+	for i := uint64(1); i <= 2; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read event: %s", err)
+		}
+		if diff := decodeDiff(t, msg); diff.Sequence != i {
+			t.Errorf("expected sequence number %d but got %d", i, diff.Sequence)
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("expected EOF at end of stream but got %v", err)
+	}
+}
+
+func TestStreamReaderFallback(t *testing.T) {
+
+	// Backends that predate content negotiation don't necessarily set a
+	// content type that we understand.
+	for _, contentType := range []string{"", "invalid;;", "text/plain"} {
+		r := NewStreamReader(strings.NewReader("{\"sequence\": 1}\r\r\n{\"sequence\": 2}\r"), contentType)
+		for i := uint64(1); i <= 2; i++ {
+			msg, err := r.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read message for content type %q: %s", contentType, err)
+			}
+			if diff := decodeDiff(t, msg); diff.Sequence != i {
+				t.Errorf("expected sequence number %d but got %d", i, diff.Sequence)
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package mechanisms
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// UnixSocketHost is the host name that we use in HTTP requests that we send
+// over a Unix domain socket.  The name is never resolved; it only exists to
+// make our requests valid.
+const UnixSocketHost = "unix"
+
+// UnixIpcContext implements the delivery.Mechanism interface.  It speaks the
+// same protocol as HttpsIpcContext but talks to the backend over a Unix domain
+// socket instead of a TCP connection, which prevents other hosts -- and, given
+// appropriate file permissions, other local users -- from reaching the
+// backend's API.
+type UnixIpcContext struct {
+	HttpsIpcContext
+	socketPath string
+}
+
+// NewUnixIpc returns a new IPC mechanism that sends requests for the given API
+// endpoint (e.g. "/resource-stream") over the Unix domain socket at the given
+// path.
+func NewUnixIpc(socketPath, apiEndpoint string) *UnixIpcContext {
+
+	ctx := &UnixIpcContext{socketPath: socketPath}
+	ctx.apiEndpoint = "http://" + UnixSocketHost + apiEndpoint
+	ctx.SetRetryInterval(DefaultTimeBeforeRetry, MaxTimeBeforeRetry)
+	ctx.client = &http.Client{
+		Transport: &http.Transport{
+			// We ignore the network and address that the HTTP client wants
+			// to connect to, and connect to our socket instead.
+			DialContext: func(c context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(c, "unix", ctx.socketPath)
+			},
+		},
+	}
+
+	return ctx
+}
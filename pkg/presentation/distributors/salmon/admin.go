@@ -0,0 +1,228 @@
+package salmon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/salmon"
+)
+
+// adminApi lets operators inspect and change Salmon's state.  All requests must
+// carry one of our operators' bearer tokens, and we write every action to our
+// audit log.
+type adminApi struct {
+	dist   *salmon.SalmonDistributor
+	tokens map[string]string
+	audit  *log.Logger
+}
+
+// BanResult is the admin API's response to banning or unbanning a user.
+type BanResult struct {
+	SecretId string `json:"secret_id"`
+	Banned   bool   `json:"banned"`
+}
+
+// RevokeResult is the admin API's response to revoking an invitation tree.
+type RevokeResult struct {
+	NumRevoked int `json:"num_revoked"`
+}
+
+// InviteResult is the admin API's response to issuing an admin invite.
+type InviteResult struct {
+	Token string `json:"token"`
+}
+
+// operator returns the name of the operator that the given bearer token
+// belongs to, and false if we don't have the token on record.
+func (a *adminApi) operator(givenToken string) (string, bool) {
+
+	for operator, savedToken := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(givenToken), []byte(savedToken)) == 1 {
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+// restrict wraps the given handler, so that it only serves requests that use
+// the given method and are authenticated by an operator's bearer token.  The
+// handler learns the operator's name.
+func (a *adminApi) restrict(method string, handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenLine := r.Header.Get("Authorization")
+		if !strings.HasPrefix(tokenLine, "Bearer ") {
+			a.audit.Printf("Rejected %s %s from %s without bearer token.", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "request carries no bearer token", http.StatusUnauthorized)
+			return
+		}
+		operator, ok := a.operator(strings.TrimPrefix(tokenLine, "Bearer "))
+		if !ok {
+			a.audit.Printf("Rejected %s %s from %s with invalid bearer token.", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, fmt.Sprintf("only %s is supported", method), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handler(w, r, operator)
+	}
+}
+
+// logAction writes the given operator's action to our audit log.
+func (a *adminApi) logAction(operator, action, secretId string, err error) {
+
+	outcome := "succeeded"
+	if err != nil {
+		outcome = fmt.Sprintf("failed: %s", err)
+	}
+	if secretId == "" {
+		a.audit.Printf("Operator %q: %s %s.", operator, action, outcome)
+	} else {
+		a.audit.Printf("Operator %q: %s of user %q %s.", operator, action, secretId, outcome)
+	}
+}
+
+// writeJSON writes the given object as JSON to the given ResponseWriter.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %s", err)
+	}
+}
+
+// secretIdField returns the request's 'secret-id' field.  If the request has no
+// such field, the function writes an error to the given ResponseWriter.
+func secretIdField(w http.ResponseWriter, r *http.Request) (string, bool) {
+
+	secretId, ok := r.Form["secret-id"]
+	if !ok || len(secretId) != 1 {
+		http.Error(w, "need excactly one 'secret-id' field", http.StatusBadRequest)
+		return "", false
+	}
+	return secretId[0], true
+}
+
+// usersHandler handles requests for /admin/users.
+func (a *adminApi) usersHandler(w http.ResponseWriter, r *http.Request, operator string) {
+
+	users := a.dist.ListUsers()
+	a.logAction(operator, "listing users", "", nil)
+	writeJSON(w, users)
+}
+
+// subtreeHandler handles requests for /admin/subtree.
+func (a *adminApi) subtreeHandler(w http.ResponseWriter, r *http.Request, operator string) {
+
+	secretId, ok := secretIdField(w, r)
+	if !ok {
+		return
+	}
+	tree, err := a.dist.Subtree(secretId)
+	a.logAction(operator, "showing invitation tree", secretId, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, tree)
+}
+
+// banHandler handles requests for /admin/ban and /admin/unban.
+func (a *adminApi) banHandler(ban bool) func(http.ResponseWriter, *http.Request, string) {
+
+	return func(w http.ResponseWriter, r *http.Request, operator string) {
+		secretId, ok := secretIdField(w, r)
+		if !ok {
+			return
+		}
+		action, f := "ban", a.dist.Ban
+		if !ban {
+			action, f = "unban", a.dist.Unban
+		}
+		err := f(secretId)
+		a.logAction(operator, action, secretId, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, &BanResult{SecretId: secretId, Banned: ban})
+	}
+}
+
+// revokeHandler handles requests for /admin/revoke.
+func (a *adminApi) revokeHandler(w http.ResponseWriter, r *http.Request, operator string) {
+
+	secretId, ok := secretIdField(w, r)
+	if !ok {
+		return
+	}
+	n, err := a.dist.RevokeSubtree(secretId)
+	a.logAction(operator, fmt.Sprintf("revoking invitation tree (%d users)", n), secretId, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, &RevokeResult{NumRevoked: n})
+}
+
+// inviteHandler handles requests for /admin/invite.
+func (a *adminApi) inviteHandler(w http.ResponseWriter, r *http.Request, operator string) {
+
+	token, err := a.dist.CreateAdminInvite()
+	a.logAction(operator, "issuing admin invite", "", err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &InviteResult{Token: token})
+}
+
+// startAdminApi starts the Web server of our admin API, if it's configured.
+// The function doesn't return until the Web server stops.
+func startAdminApi(cfg *internal.SalmonAdminConfig, dist *salmon.SalmonDistributor) {
+
+	apiCfg := cfg.WebApi
+	if apiCfg.ApiAddress == "" {
+		return
+	}
+	fd, err := os.OpenFile(cfg.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Not starting admin API because we cannot open audit log: %s", err)
+		return
+	}
+	defer fd.Close()
+
+	a := &adminApi{
+		dist:   dist,
+		tokens: cfg.ApiTokens,
+		audit:  log.New(fd, "", log.LstdFlags|log.LUTC),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/admin/users", a.restrict(http.MethodGet, a.usersHandler))
+	mux.Handle("/admin/subtree", a.restrict(http.MethodGet, a.subtreeHandler))
+	mux.Handle("/admin/ban", a.restrict(http.MethodPost, a.banHandler(true)))
+	mux.Handle("/admin/unban", a.restrict(http.MethodPost, a.banHandler(false)))
+	mux.Handle("/admin/revoke", a.restrict(http.MethodPost, a.revokeHandler))
+	mux.Handle("/admin/invite", a.restrict(http.MethodPost, a.inviteHandler))
+
+	srv := http.Server{Addr: apiCfg.ApiAddress, Handler: mux}
+	log.Printf("Starting admin API at %s.", srv.Addr)
+	if apiCfg.KeyFile != "" && apiCfg.CertFile != "" {
+		err = srv.ListenAndServeTLS(apiCfg.CertFile, apiCfg.KeyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	log.Printf("Admin API shut down: %s", err)
+}
@@ -1,9 +1,15 @@
 package salmon
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/file"
@@ -13,6 +19,48 @@ import (
 
 var dist *salmon.SalmonDistributor
 
+// geoip lets us infer the location of new users who don't tell us where they
+// are.  It's nil if we have no geoip database.
+var geoip *internal.Geoip
+
+// trustedProxies contains the addresses of the reverse proxies whose
+// X-Forwarded-For header we believe.
+var trustedProxies []net.IP
+
+// clientAddr returns the IP address of the client that sent the given request.
+// Unless the request comes from one of our trusted proxies, that's the address
+// that the request's connection comes from, so clients cannot spoof their
+// address to evade our rate limits or to pick their location.
+func clientAddr(r *http.Request) string {
+	return internal.ClientAddr(r, trustedProxies)
+}
+
+// userLocation returns the location of the user who sent the given request:
+// the country code in the request's 'location' field if the user told us
+// where they are, and the country code of the user's IP address otherwise.
+// The function returns an empty location if we cannot tell.
+func userLocation(r *http.Request) (string, error) {
+
+	location, ok := r.Form["location"]
+	if !ok {
+		return geoip.CountryCode(net.ParseIP(clientAddr(r))), nil
+	}
+	if len(location) != 1 || !salmon.IsCountryCode(location[0]) {
+		return "", errors.New("need exactly one 'location' field with a two-letter country code")
+	}
+	return location[0], nil
+}
+
+// setLocation sets the location of the given new user, if we know it.
+func setLocation(secretId, location string) {
+	if location == "" {
+		return
+	}
+	if err := dist.SetLocation(secretId, location); err != nil {
+		log.Printf("Failed to set location of new user: %s", err)
+	}
+}
+
 // ProxiesHandler handles requests for /proxies.
 func ProxiesHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
@@ -50,16 +98,69 @@ func ProxiesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// AccountHandler handles requests for /account.
+// AccountHandler handles requests for /account.  Without a 'challenge-id'
+// field, the handler returns a new challenge.  With a 'challenge-id' and a
+// 'solution' field, the handler registers a new user.
 func AccountHandler(w http.ResponseWriter, r *http.Request) {
-	secretId, err := dist.Register()
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	challengeId, ok := r.Form["challenge-id"]
+	if !ok {
+		challenge, err := dist.NewChallenge()
+		if err != nil {
+			http.Error(w, err.Error(), registrationErrorCode(err))
+			return
+		}
+		fmt.Fprintf(w, "challenge-id: %s\nadmission: %s\n", challenge.Id, challenge.Admission)
+		switch challenge.Admission {
+		case internal.AdmissionPow:
+			fmt.Fprintf(w, "difficulty: %d\n", challenge.Difficulty)
+		case internal.AdmissionCaptcha:
+			fmt.Fprintf(w, "captcha: data:image/png;base64,%s\n", base64.StdEncoding.EncodeToString(challenge.Image))
+		}
+		return
+	} else if len(challengeId) != 1 {
+		http.Error(w, "need excactly one 'challenge-id' field", http.StatusBadRequest)
+		return
+	}
+	solution, ok := r.Form["solution"]
+	if !ok {
+		http.Error(w, "no field 'solution' given", http.StatusBadRequest)
+		return
+	} else if len(solution) != 1 {
+		http.Error(w, "need excactly one 'solution' field", http.StatusBadRequest)
+		return
+	}
+	location, err := userLocation(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	secretId, err := dist.Register(challengeId[0], solution[0])
+	if err != nil {
+		http.Error(w, err.Error(), registrationErrorCode(err))
+		return
+	}
+	setLocation(secretId, location)
 	fmt.Fprintf(w, "new user secret-id: %s", secretId)
 }
 
+// registrationErrorCode returns the HTTP status code for the given
+// registration error.
+func registrationErrorCode(err error) int {
+	switch err {
+	case salmon.ErrRegistrationDisabled, salmon.ErrWrongSolution:
+		return http.StatusForbidden
+	case salmon.ErrQuotaExhausted:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // InviteHandler handles requests for /invite.
 func InviteHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
@@ -75,12 +176,24 @@ func InviteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	token, err := dist.CreateInvite(secretId[0])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), inviteErrorCode(err))
 		return
 	}
 	fmt.Fprintf(w, "give the following token to your friend:\n%s", token)
 }
 
+// inviteErrorCode returns the HTTP status code for the given invite error.
+func inviteErrorCode(err error) int {
+	switch err {
+	case salmon.ErrInviteQuotaExhausted:
+		return http.StatusTooManyRequests
+	case salmon.ErrInviteDepthExceeded:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // RedeemHandler handles requests for /redeem.
 func RedeemHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
@@ -94,23 +207,72 @@ func RedeemHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "need excactly one 'token' field", http.StatusBadRequest)
 		return
 	}
+	location, err := userLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok, wait := dist.AllowRedemption(clientAddr(r)); !ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+		http.Error(w, "too many redemption attempts; please try again later", http.StatusTooManyRequests)
+		return
+	}
 
 	secretId, err := dist.RedeemInvite(token[0])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), inviteErrorCode(err))
 		return
 	}
+	setLocation(secretId, location)
 	fmt.Fprintf(w, "new user secret-id: %s", secretId)
 }
 
+// reloadParams reloads Salmon's parameters from the given configuration file
+// whenever we receive a SIGHUP.
+func reloadParams(filename string) {
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+	for range signalChan {
+		log.Printf("Caught SIGHUP.  Reloading Salmon's parameters from %s.", filename)
+		cfg, err := internal.LoadConfig(filename)
+		if err != nil {
+			log.Printf("Failed to reload configuration: %s", err)
+			continue
+		}
+		if err := dist.SetParams(cfg.Distributors.Salmon.Params); err != nil {
+			log.Printf("Failed to apply new parameters: %s", err)
+		}
+	}
+}
+
 // InitFrontend is the entry point to Salmon's Web frontend.  It spins up the
 // Web server and then waits until it receives a SIGINT.
 func InitFrontend(cfg *internal.Config) {
 
 	dist = salmon.NewSalmonDistributor()
+	var err error
+	if trustedProxies, err = internal.ParseTrustedProxies(cfg.Distributors.Salmon.TrustedProxies); err != nil {
+		log.Fatalf("Invalid Salmon configuration: %s", err)
+	}
+
+	var geoipFiles []string
+	for _, filename := range []string{cfg.Distributors.Salmon.GeoipFile, cfg.Distributors.Salmon.Geoip6File} {
+		if filename != "" {
+			geoipFiles = append(geoipFiles, filename)
+		}
+	}
+	if len(geoipFiles) > 0 {
+		var err error
+		if geoip, err = internal.LoadGeoip(geoipFiles...); err != nil {
+			log.Printf("Failed to load geoip database, so we cannot infer users' locations: %s", err)
+		}
+	}
 
 	pMech := file.New(salmon.DistName, cfg.Distributors.Salmon.WorkingDir)
-	if err := pMech.Load(dist); err != nil {
+	if err := pMech.Load(dist); os.IsNotExist(err) {
+		log.Printf("Found no persistent data, so we're starting from scratch.")
+	} else if err != nil {
 		// It's best to fail here, and encourage the operator to fix whatever
 		// went wrong with our persistence mechanism.  If we continue despite
 		// the error, we may end up overwriting important data.
@@ -122,6 +284,9 @@ func InitFrontend(cfg *internal.Config) {
 			log.Printf("Failed to save state: %s", err)
 		}
 	}()
+	go reloadParams(cfg.Filename)
+	go startAdminApi(&cfg.Distributors.Salmon.Admin, dist)
+
 	handlers := map[string]http.HandlerFunc{
 		"/proxies": http.HandlerFunc(ProxiesHandler),
 		"/account": http.HandlerFunc(AccountHandler),
@@ -9,7 +9,6 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
 )
 
 const (
@@ -65,7 +64,11 @@ func (d *HttpsDistributor) Init(cfg *internal.Config) {
 	d.ring = core.NewHashring()
 
 	log.Printf("Initialising resource stream.")
-	d.ipc = mechanisms.NewHttpsIpc("http://" + cfg.Backend.WebApi.ApiAddress + cfg.Backend.ResourceStreamEndpoint)
+	ipc, err := internal.NewBackendIpc(cfg, cfg.Distributors.Https.Ipc, cfg.Distributors.Https.Tls)
+	if err != nil {
+		log.Fatalf("Failed to create IPC mechanism: %s", err)
+	}
+	d.ipc = ipc
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
@@ -0,0 +1,182 @@
+package salmon
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// UserInfo summarises a user for our operators.
+type UserInfo struct {
+	SecretId      string  `json:"secret_id"`
+	Trust         Trust   `json:"trust"`
+	Suspicion     float64 `json:"suspicion"`
+	Banned        bool    `json:"banned"`
+	BannedByAdmin bool    `json:"banned_by_admin"`
+	Registered    bool    `json:"registered"`
+	Location      string  `json:"location"`
+	InvitedBy     string  `json:"invited_by"`
+	NumInvited    int     `json:"num_invited"`
+	NumProxies    int     `json:"num_proxies"`
+	LimitHits     int     `json:"limit_hits"`
+}
+
+// UserTree represents a user and the user's invitation tree.
+type UserTree struct {
+	*UserInfo
+	Invited []*UserTree `json:"invited"`
+}
+
+// userInfo returns a summary of the given user.
+func (s *SalmonDistributor) userInfo(u *User) *UserInfo {
+
+	info := &UserInfo{
+		SecretId:      u.SecretId,
+		Trust:         u.Trust,
+		Suspicion:     u.Suspicion(),
+		Banned:        u.Banned,
+		BannedByAdmin: u.BannedByAdmin,
+		Registered:    u.Registered,
+		Location:      u.Location,
+		NumInvited:    len(u.Invited),
+		NumProxies:    len(s.Assignments.GetAllProxies(u)),
+		LimitHits:     u.LimitHits,
+	}
+	if u.InvitedBy != nil {
+		info.InvitedBy = u.InvitedBy.SecretId
+	}
+	return info
+}
+
+// ListUsers returns a summary of all users, sorted by trust level (highest
+// first) and, within a trust level, by suspicion (highest first).
+func (s *SalmonDistributor) ListUsers() []*UserInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	users := []*UserInfo{}
+	for _, u := range s.Users {
+		users = append(users, s.userInfo(u))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Trust != users[j].Trust {
+			return users[i].Trust > users[j].Trust
+		}
+		if users[i].Suspicion != users[j].Suspicion {
+			return users[i].Suspicion > users[j].Suspicion
+		}
+		return users[i].SecretId < users[j].SecretId
+	})
+	return users
+}
+
+// Subtree returns the invitation tree of the given user.
+func (s *SalmonDistributor) Subtree(secretId string) (*UserTree, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, exists := s.Users[secretId]
+	if !exists {
+		return nil, errors.New("user ID does not exists")
+	}
+	return s.subtree(u), nil
+}
+
+// subtree returns the invitation tree of the given user.
+func (s *SalmonDistributor) subtree(u *User) *UserTree {
+
+	tree := &UserTree{UserInfo: s.userInfo(u), Invited: []*UserTree{}}
+	for _, invitee := range u.Invited {
+		tree.Invited = append(tree.Invited, s.subtree(invitee))
+	}
+	return tree
+}
+
+// Ban bans the given user on behalf of an operator.  The ban remains in place
+// until an operator lifts it.
+func (s *SalmonDistributor) Ban(secretId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, exists := s.Users[secretId]
+	if !exists {
+		return errors.New("user ID does not exists")
+	}
+	u.Banned = true
+	u.BannedByAdmin = true
+	log.Printf("Operator banned user %q.", u.SecretId)
+
+	return nil
+}
+
+// Unban lifts the given user's ban, regardless of whether an operator banned
+// the user or the user's suspicion did.  We forget about the user's blocking
+// events, so the user doesn't get banned again as soon as our parameters get
+// reloaded.
+func (s *SalmonDistributor) Unban(secretId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, exists := s.Users[secretId]
+	if !exists {
+		return errors.New("user ID does not exists")
+	}
+	u.Banned = false
+	u.BannedByAdmin = false
+	u.InnocencePs = nil
+	log.Printf("Operator unbanned user %q.", u.SecretId)
+
+	return nil
+}
+
+// RevokeSubtree bans the given user and everyone in the user's invitation
+// tree, e.g. because the tree is compromised, and invalidates the invite
+// tokens that they issued.  The function returns the number of users that it
+// banned.
+func (s *SalmonDistributor) RevokeSubtree(secretId string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, exists := s.Users[secretId]
+	if !exists {
+		return 0, errors.New("user ID does not exists")
+	}
+
+	revoked := make(map[string]bool)
+	var revoke func(*User)
+	revoke = func(u *User) {
+		u.Banned = true
+		u.BannedByAdmin = true
+		revoked[u.SecretId] = true
+		for _, invitee := range u.Invited {
+			revoke(invitee)
+		}
+	}
+	revoke(u)
+
+	for token, metaInfo := range s.TokenCache {
+		if revoked[metaInfo.SecretInviterId] {
+			delete(s.TokenCache, token)
+		}
+	}
+	log.Printf("Operator revoked invitation tree of user %q with %d users.", u.SecretId, len(revoked))
+
+	return len(revoked), nil
+}
+
+// CreateAdminInvite returns an invitation token that an operator can give to,
+// e.g., a trusted partner organisation.  Whoever redeems the token becomes an
+// admin user at UntouchableTrustLevel.
+func (s *SalmonDistributor) CreateAdminInvite() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	token, err := s.addToken(&TokenMetaInfo{IssueTime: time.Now().UTC(), Admin: true})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Operator issued new admin invite token.")
+
+	return token, nil
+}
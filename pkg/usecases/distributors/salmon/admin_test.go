@@ -0,0 +1,132 @@
+package salmon
+
+import (
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func TestListUsers(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	innocent, _ := salmon.addUser(2, admin)
+	suspicious, _ := salmon.addUser(2, admin)
+	suspicious.InnocencePs = []float64{0.9}
+	newbie, _ := salmon.addUser(0, innocent)
+
+	users := salmon.ListUsers()
+	expected := []*User{admin, suspicious, innocent, newbie}
+	if len(users) != len(expected) {
+		t.Fatalf("expected %d users but got %d", len(expected), len(users))
+	}
+	for i, u := range expected {
+		if users[i].SecretId != u.SecretId {
+			t.Errorf("expected user %q at position %d but got %q", u.SecretId, i, users[i].SecretId)
+		}
+	}
+	if users[3].InvitedBy != innocent.SecretId || users[0].NumInvited != 2 {
+		t.Errorf("got incorrect invitation tree in user list")
+	}
+
+	tree, err := salmon.Subtree(innocent.SecretId)
+	if err != nil {
+		t.Fatalf("failed to get subtree: %s", err)
+	}
+	if len(tree.Invited) != 1 || tree.Invited[0].SecretId != newbie.SecretId {
+		t.Errorf("got incorrect subtree")
+	}
+	if _, err := salmon.Subtree("foo"); err == nil {
+		t.Errorf("returned subtree of non-existing user")
+	}
+}
+
+func TestBanUnban(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	u, _ := salmon.addUser(DefaultMaxTrustLevel, admin)
+
+	if err := salmon.Ban(u.SecretId); err != nil {
+		t.Fatalf("failed to ban user: %s", err)
+	}
+	// Reloading our parameters must not lift an operator's ban.
+	if err := salmon.SetParams(internal.SalmonParamsConfig{}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	if !u.Banned {
+		t.Errorf("lifted operator's ban")
+	}
+	if _, err := salmon.CreateInvite(u.SecretId); err == nil {
+		t.Errorf("let banned user issue invite")
+	}
+
+	// Unbanning a suspicious user forgives their blocking events.
+	u.InnocencePs = []float64{0.1}
+	if err := salmon.Unban(u.SecretId); err != nil {
+		t.Fatalf("failed to unban user: %s", err)
+	}
+	if err := salmon.SetParams(internal.SalmonParamsConfig{}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	if u.Banned || u.BannedByAdmin {
+		t.Errorf("user still banned")
+	}
+	if err := salmon.Ban("foo"); err == nil {
+		t.Errorf("banned non-existing user")
+	}
+}
+
+func TestRevokeSubtree(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	compromised, _ := salmon.addUser(DefaultMaxTrustLevel, admin)
+	sibling, _ := salmon.addUser(DefaultMaxTrustLevel, admin)
+	invitee, _ := salmon.addUser(DefaultMaxTrustLevel, compromised)
+	grandInvitee, _ := salmon.addUser(0, invitee)
+	revokedToken, _ := salmon.CreateInvite(invitee.SecretId)
+	siblingToken, _ := salmon.CreateInvite(sibling.SecretId)
+
+	n, err := salmon.RevokeSubtree(compromised.SecretId)
+	if err != nil {
+		t.Fatalf("failed to revoke subtree: %s", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 revoked users but got %d", n)
+	}
+	for _, u := range []*User{compromised, invitee, grandInvitee} {
+		if !u.Banned || !u.BannedByAdmin {
+			t.Errorf("user in revoked subtree isn't banned")
+		}
+	}
+	if admin.Banned || sibling.Banned {
+		t.Errorf("banned user outside of revoked subtree")
+	}
+	if _, err := salmon.RedeemInvite(revokedToken); err == nil {
+		t.Errorf("redeemed token of revoked user")
+	}
+	if _, err := salmon.RedeemInvite(siblingToken); err != nil {
+		t.Errorf("failed to redeem token outside of revoked subtree: %s", err)
+	}
+}
+
+func TestAdminInvite(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	token, err := salmon.CreateAdminInvite()
+	if err != nil {
+		t.Fatalf("failed to create admin invite: %s", err)
+	}
+	secretId, err := salmon.RedeemInvite(token)
+	if err != nil {
+		t.Fatalf("failed to redeem admin invite: %s", err)
+	}
+	u := salmon.Users[secretId]
+	if u.Trust != UntouchableTrustLevel || u.InvitedBy != nil {
+		t.Errorf("expected admin user but got %+v", u)
+	}
+	if _, err := salmon.CreateInvite(secretId); err != nil {
+		t.Errorf("admin user failed to issue invite: %s", err)
+	}
+}
@@ -0,0 +1,285 @@
+package salmon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math/big"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+const (
+	// Number of bytes.
+	ChallengeIdLength = 20
+	// ChallengeExpiry is the time that a user has to solve a challenge.
+	ChallengeExpiry = time.Minute * 10
+	// MaxPendingChallenges limits the number of challenges that we keep in
+	// memory, so clients cannot exhaust our memory by requesting challenges.
+	MaxPendingChallenges = 10000
+	// Number of digits in our CAPTCHAs.
+	CaptchaLength = 6
+	// Each pixel of our font becomes a square of captchaScale pixels.
+	captchaScale = 4
+)
+
+var (
+	ErrRegistrationDisabled = errors.New("registration is disabled")
+	ErrQuotaExhausted       = errors.New("registration quota for today is exhausted")
+	ErrWrongSolution        = errors.New("challenge does not exist, expired, or was solved incorrectly")
+)
+
+// captchaFont is a 5x7 pixel font for the digits 0 to 9.
+var captchaFont = [10][7]string{
+	{"01110", "10001", "10011", "10101", "11001", "10001", "01110"},
+	{"00100", "01100", "00100", "00100", "00100", "00100", "01110"},
+	{"01110", "10001", "00001", "00010", "00100", "01000", "11111"},
+	{"11110", "00001", "00001", "01110", "00001", "00001", "11110"},
+	{"00010", "00110", "01010", "10010", "11111", "00010", "00010"},
+	{"11111", "10000", "11110", "00001", "00001", "10001", "01110"},
+	{"00110", "01000", "10000", "11110", "10001", "10001", "01110"},
+	{"11111", "00001", "00010", "00100", "01000", "01000", "01000"},
+	{"01110", "10001", "10001", "01110", "10001", "10001", "01110"},
+	{"01110", "10001", "10001", "01111", "00001", "00010", "01100"},
+}
+
+// Challenge represents what a user has to solve before we let them register.
+type Challenge struct {
+	Id string
+	// Admission is either internal.AdmissionPow or internal.AdmissionCaptcha.
+	Admission string
+	// Difficulty is the number of leading zero bits that the SHA-256 digest
+	// of "<Id>:<solution>" must have, for proof-of-work challenges.
+	Difficulty int
+	// Image is a PNG-encoded CAPTCHA whose digits are the solution, for
+	// CAPTCHA challenges.
+	Image []byte
+}
+
+// pendingChallenge represents a challenge that we handed out and that wasn't
+// solved yet.
+type pendingChallenge struct {
+	answer  string
+	expires time.Time
+}
+
+// admissionControl gates Salmon's open registration.  Each challenge can be
+// solved only once, and only a limited number of users may register per day.
+// Note that our CAPTCHAs are generated locally and are no match for a
+// determined OCR attack; they merely add cost to automated sign-ups.
+type admissionControl struct {
+	sync.Mutex
+	cfg        internal.SalmonRegistrationConfig
+	pending    map[string]*pendingChallenge
+	day        string
+	registered int
+}
+
+// newAdmissionControl returns a new admission control for the given
+// registration configuration.
+func newAdmissionControl(cfg internal.SalmonRegistrationConfig) *admissionControl {
+	return &admissionControl{
+		cfg:     cfg,
+		pending: make(map[string]*pendingChallenge),
+	}
+}
+
+// quotaLeft returns true if users may still register on the day of the given
+// time.  The caller must hold our lock.
+func (a *admissionControl) quotaLeft(now time.Time) bool {
+
+	if day := now.Format("2006-01-02"); day != a.day {
+		a.day = day
+		a.registered = 0
+	}
+	return a.registered < a.cfg.PerDay
+}
+
+// prune removes expired challenges.  The caller must hold our lock.
+func (a *admissionControl) prune(now time.Time) {
+
+	for id, c := range a.pending {
+		if now.After(c.expires) {
+			delete(a.pending, id)
+		}
+	}
+}
+
+// newChallenge returns a new challenge that expires ChallengeExpiry after the
+// given time.
+func (a *admissionControl) newChallenge(now time.Time) (*Challenge, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.cfg.Admission == "" {
+		return nil, ErrRegistrationDisabled
+	}
+	// There's no point in letting users solve challenges if they cannot
+	// register anyway.
+	if !a.quotaLeft(now) {
+		return nil, ErrQuotaExhausted
+	}
+	a.prune(now)
+	if len(a.pending) >= MaxPendingChallenges {
+		return nil, errors.New("too many pending challenges; try again later")
+	}
+
+	id, err := internal.GetRandBase32(ChallengeIdLength)
+	if err != nil {
+		return nil, err
+	}
+	c := &Challenge{Id: id, Admission: a.cfg.Admission}
+	p := &pendingChallenge{expires: now.Add(ChallengeExpiry)}
+
+	switch a.cfg.Admission {
+	case internal.AdmissionPow:
+		c.Difficulty = a.cfg.PowDifficulty
+	case internal.AdmissionCaptcha:
+		if p.answer, err = randDigits(CaptchaLength); err != nil {
+			return nil, err
+		}
+		if c.Image, err = renderCaptcha(p.answer); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported admission control")
+	}
+	a.pending[id] = p
+
+	return c, nil
+}
+
+// admit returns nil if the given solution solves the given challenge, and if
+// our quota allows for another registration.  A challenge can only be used
+// once, regardless of whether the solution was correct.
+func (a *admissionControl) admit(id, solution string, now time.Time) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.cfg.Admission == "" {
+		return ErrRegistrationDisabled
+	}
+	p, exists := a.pending[id]
+	if !exists {
+		return ErrWrongSolution
+	}
+	delete(a.pending, id)
+	if now.After(p.expires) {
+		return ErrWrongSolution
+	}
+
+	switch a.cfg.Admission {
+	case internal.AdmissionPow:
+		if leadingZeroBits(powDigest(id, solution)) < a.cfg.PowDifficulty {
+			return ErrWrongSolution
+		}
+	case internal.AdmissionCaptcha:
+		if subtle.ConstantTimeCompare([]byte(p.answer), []byte(solution)) != 1 {
+			return ErrWrongSolution
+		}
+	}
+
+	if !a.quotaLeft(now) {
+		return ErrQuotaExhausted
+	}
+	a.registered++
+
+	return nil
+}
+
+// powDigest returns the digest whose leading zero bits determine if the given
+// solution solves the given proof-of-work challenge.
+func powDigest(id, solution string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(id + ":" + solution))
+}
+
+// leadingZeroBits returns the number of leading zero bits in the given digest.
+func leadingZeroBits(digest [sha256.Size]byte) int {
+
+	n := 0
+	for _, b := range digest {
+		if b != 0 {
+			for b&0x80 == 0 {
+				n++
+				b <<= 1
+			}
+			return n
+		}
+		n += 8
+	}
+	return n
+}
+
+// randDigits returns a string of the given number of random digits.
+func randDigits(num int) (string, error) {
+
+	digits := make([]byte, num)
+	for i := range digits {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		digits[i] = byte('0' + d.Int64())
+	}
+	return string(digits), nil
+}
+
+// renderCaptcha returns a PNG image that shows the given digits.  We jitter
+// the digits and add noise, which makes the image harder to read for
+// machines.
+func renderCaptcha(digits string) ([]byte, error) {
+
+	const (
+		glyphWidth  = 5 * captchaScale
+		glyphHeight = 7 * captchaScale
+		margin      = 2 * captchaScale
+	)
+	width := 2*margin + len(digits)*(glyphWidth+captchaScale)
+	height := 2*margin + glyphHeight
+	palette := color.Palette{color.White, color.Black, color.Gray{Y: 0x80}}
+	img := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+
+	// Sprinkle gray noise over the background.
+	for i := 0; i < width*height/10; i++ {
+		img.SetColorIndex(mrand.Intn(width), mrand.Intn(height), 2)
+	}
+	for i, d := range digits {
+		glyph := captchaFont[d-'0']
+		x0 := margin + i*(glyphWidth+captchaScale) + mrand.Intn(captchaScale) - captchaScale/2
+		y0 := margin + mrand.Intn(margin) - margin/2
+		for row, bits := range glyph {
+			for col, bit := range bits {
+				if bit != '1' {
+					continue
+				}
+				for dy := 0; dy < captchaScale; dy++ {
+					for dx := 0; dx < captchaScale; dx++ {
+						img.SetColorIndex(x0+col*captchaScale+dx, y0+row*captchaScale+dy, 1)
+					}
+				}
+			}
+		}
+	}
+
+	// Draw a few lines through the digits.
+	for i := 0; i < 3; i++ {
+		y, slope := mrand.Intn(height), mrand.Float64()-0.5
+		for x := 0; x < width; x++ {
+			img.SetColorIndex(x, y+int(slope*float64(x)), 2)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,139 @@
+package salmon
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+// solvePow returns a solution for the given proof-of-work challenge.
+func solvePow(c *Challenge) string {
+
+	for i := 0; ; i++ {
+		solution := fmt.Sprintf("%d", i)
+		if leadingZeroBits(powDigest(c.Id, solution)) >= c.Difficulty {
+			return solution
+		}
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+
+	var digest [32]byte
+	if n := leadingZeroBits(digest); n != 256 {
+		t.Errorf("expected 256 leading zero bits but got %d", n)
+	}
+	digest[1] = 0x10
+	if n := leadingZeroBits(digest); n != 11 {
+		t.Errorf("expected 11 leading zero bits but got %d", n)
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+
+	now := time.Now().UTC()
+	a := newAdmissionControl(internal.SalmonRegistrationConfig{
+		Admission:     internal.AdmissionPow,
+		PowDifficulty: 8,
+		PerDay:        10,
+	})
+
+	c, err := a.newChallenge(now)
+	if err != nil {
+		t.Fatalf("failed to create challenge: %s", err)
+	}
+	if c.Difficulty != 8 {
+		t.Errorf("expected difficulty 8 but got %d", c.Difficulty)
+	}
+	solution := solvePow(c)
+	if err := a.admit(c.Id, solution, now); err != nil {
+		t.Errorf("rejected valid proof of work: %s", err)
+	}
+	// A challenge can only be solved once.
+	if err := a.admit(c.Id, solution, now); err != ErrWrongSolution {
+		t.Errorf("accepted challenge twice")
+	}
+
+	c, _ = a.newChallenge(now)
+	for leadingZeroBits(powDigest(c.Id, solution)) >= c.Difficulty {
+		solution += "x"
+	}
+	if err := a.admit(c.Id, solution, now); err != ErrWrongSolution {
+		t.Errorf("accepted invalid proof of work")
+	}
+
+	c, _ = a.newChallenge(now)
+	if err := a.admit(c.Id, solvePow(c), now.Add(ChallengeExpiry+time.Second)); err != ErrWrongSolution {
+		t.Errorf("accepted expired challenge")
+	}
+}
+
+func TestCaptcha(t *testing.T) {
+
+	now := time.Now().UTC()
+	a := newAdmissionControl(internal.SalmonRegistrationConfig{
+		Admission: internal.AdmissionCaptcha,
+		PerDay:    10,
+	})
+
+	c, err := a.newChallenge(now)
+	if err != nil {
+		t.Fatalf("failed to create challenge: %s", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(c.Image)); err != nil {
+		t.Fatalf("failed to decode CAPTCHA: %s", err)
+	}
+	answer := a.pending[c.Id].answer
+	if len(answer) != CaptchaLength {
+		t.Errorf("expected %d digits but got %q", CaptchaLength, answer)
+	}
+	if err := a.admit(c.Id, "not a number", now); err != ErrWrongSolution {
+		t.Errorf("accepted wrong CAPTCHA solution")
+	}
+
+	c, _ = a.newChallenge(now)
+	if err := a.admit(c.Id, a.pending[c.Id].answer, now); err != nil {
+		t.Errorf("rejected correct CAPTCHA solution: %s", err)
+	}
+}
+
+func TestRegistrationQuota(t *testing.T) {
+
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	a := newAdmissionControl(internal.SalmonRegistrationConfig{
+		Admission:     internal.AdmissionPow,
+		PowDifficulty: 1,
+		PerDay:        1,
+	})
+
+	c1, _ := a.newChallenge(now)
+	c2, _ := a.newChallenge(now)
+	if err := a.admit(c1.Id, solvePow(c1), now); err != nil {
+		t.Fatalf("rejected registration: %s", err)
+	}
+	if err := a.admit(c2.Id, solvePow(c2), now); err != ErrQuotaExhausted {
+		t.Errorf("expected exhausted quota but got %v", err)
+	}
+	if _, err := a.newChallenge(now); err != ErrQuotaExhausted {
+		t.Errorf("handed out challenge despite exhausted quota")
+	}
+
+	// Our quota refills on the next day.
+	tomorrow := now.Add(24 * time.Hour)
+	c3, err := a.newChallenge(tomorrow)
+	if err != nil {
+		t.Fatalf("failed to create challenge: %s", err)
+	}
+	if err := a.admit(c3.Id, solvePow(c3), tomorrow); err != nil {
+		t.Errorf("rejected registration on the next day: %s", err)
+	}
+
+	a = newAdmissionControl(internal.SalmonRegistrationConfig{})
+	if _, err := a.newChallenge(now); err != ErrRegistrationDisabled {
+		t.Errorf("expected disabled registration but got %v", err)
+	}
+}
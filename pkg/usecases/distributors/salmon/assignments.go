@@ -9,16 +9,18 @@ import (
 )
 
 // ProxyAssignments keeps track of what proxies are assigned to what users.
+// Users have separate assignments for each resource type.
 type ProxyAssignments struct {
-	m           sync.Mutex
-	UserToProxy map[*User]*internal.Set
+	m sync.Mutex
+	// UserToProxy maps a user to the user's proxies, by resource type.
+	UserToProxy map[*User]map[string]*internal.Set
 	ProxyToUser map[*Proxy]*internal.Set
 }
 
 // NewProxyAssignments creates and returns a new ProxyAssignments struct.
 func NewProxyAssignments() *ProxyAssignments {
 	a := &ProxyAssignments{}
-	a.UserToProxy = make(map[*User]*internal.Set)
+	a.UserToProxy = make(map[*User]map[string]*internal.Set)
 	a.ProxyToUser = make(map[*Proxy]*internal.Set)
 	return a
 }
@@ -39,14 +41,14 @@ func (a *ProxyAssignments) GetUsers(p *Proxy) []*User {
 	return users
 }
 
-// GetProxies returns a slice of all resources that were assigned to the given
-// user.
-func (a *ProxyAssignments) GetProxies(u *User) []core.Resource {
+// GetProxies returns a slice of all resources of the given type that were
+// assigned to the given user.
+func (a *ProxyAssignments) GetProxies(u *User, rType string) []core.Resource {
 	a.m.Lock()
 	defer a.m.Unlock()
 
 	proxies := []core.Resource{}
-	s, exists := a.UserToProxy[u]
+	s, exists := a.UserToProxy[u][rType]
 	if !exists {
 		return proxies
 	}
@@ -56,17 +58,37 @@ func (a *ProxyAssignments) GetProxies(u *User) []core.Resource {
 	return proxies
 }
 
+// GetAllProxies returns a slice of all resources, regardless of their type,
+// that were assigned to the given user.
+func (a *ProxyAssignments) GetAllProxies(u *User) []core.Resource {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	proxies := []core.Resource{}
+	for _, s := range a.UserToProxy[u] {
+		for proxy, _ := range s.Set {
+			proxies = append(proxies, proxy.(*Proxy))
+		}
+	}
+	return proxies
+}
+
 // AddAssignment adds a bi-directional assignment from user to/from proxy.
 func (a *ProxyAssignments) Add(u *User, p *Proxy) {
 	a.m.Lock()
 	defer a.m.Unlock()
 
-	set, exists := a.UserToProxy[u]
+	sets, exists := a.UserToProxy[u]
+	if !exists {
+		sets = make(map[string]*internal.Set)
+		a.UserToProxy[u] = sets
+	}
+	set, exists := sets[p.Type()]
 	if !exists {
 		set = internal.NewSet()
 	}
 	set.Add(p)
-	a.UserToProxy[u] = set
+	sets[p.Type()] = set
 
 	set, exists = a.ProxyToUser[p]
 	if !exists {
@@ -76,6 +98,22 @@ func (a *ProxyAssignments) Add(u *User, p *Proxy) {
 	a.ProxyToUser[p] = set
 }
 
+// Remove removes the assignment of the given proxy to the given user.
+func (a *ProxyAssignments) Remove(u *User, p *Proxy) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if set, exists := a.UserToProxy[u][p.Type()]; exists {
+		set.Remove(p)
+	}
+	if set, exists := a.ProxyToUser[p]; exists {
+		set.Remove(u)
+		if set.Length() == 0 {
+			delete(a.ProxyToUser, p)
+		}
+	}
+}
+
 // RemoveProxy removes a proxy from our assignments.
 func (a *ProxyAssignments) RemoveProxy(p *Proxy) {
 	users := a.GetUsers(p)
@@ -91,7 +129,7 @@ func (a *ProxyAssignments) RemoveProxy(p *Proxy) {
 	// Remove the proxy for all users that were ever assigned the proxy.
 	log.Printf("removing proxy for %d users", len(users))
 	for _, user := range users {
-		s, exists := a.UserToProxy[user]
+		s, exists := a.UserToProxy[user][p.Type()]
 		if !exists {
 			log.Printf("Bug: Inconsistent proxy mapping.")
 			continue
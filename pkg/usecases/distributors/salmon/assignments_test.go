@@ -2,15 +2,23 @@ package salmon
 
 import (
 	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
+// newDummyProxy returns a new proxy of the resource type "dummy".
+func newDummyProxy(uid core.Hashkey) *Proxy {
+	return &Proxy{Resource: core.NewDummy(uid, uid)}
+}
+
 func TestGetUsersAndProxies(t *testing.T) {
 	a := NewProxyAssignments()
 	u1, _ := NewUser()
 	u2, _ := NewUser()
 	u3, _ := NewUser()
-	p1 := &Proxy{}
-	p2 := &Proxy{}
+	p1 := newDummyProxy(1)
+	p2 := newDummyProxy(2)
 
 	a.Add(u1, p1)
 	a.Add(u2, p1)
@@ -25,12 +33,12 @@ func TestGetUsersAndProxies(t *testing.T) {
 		t.Fatalf("expected 0 but got %d users", len(users))
 	}
 
-	proxies := a.GetProxies(u1)
+	proxies := a.GetProxies(u1, "dummy")
 	if len(proxies) != 1 {
 		t.Fatalf("expected 1 but got %d proxies", len(proxies))
 	}
 
-	proxies = a.GetProxies(u3)
+	proxies = a.GetProxies(u3, "dummy")
 	if len(proxies) != 0 {
 		t.Fatalf("expected 0 but got %d proxies", len(proxies))
 	}
@@ -40,18 +48,18 @@ func TestRemoveProxies(t *testing.T) {
 	a := NewProxyAssignments()
 	u1, _ := NewUser()
 	u2, _ := NewUser()
-	p1 := &Proxy{}
-	p2 := &Proxy{}
+	p1 := newDummyProxy(1)
+	p2 := newDummyProxy(2)
 
 	a.Add(u1, p1)
 	a.Add(u1, p2)
 	a.Add(u2, p1)
 
-	if len(a.GetProxies(u1)) != 2 {
-		t.Fatalf("expected 2 but got %d proxies", len(a.GetProxies(u1)))
+	if len(a.GetProxies(u1, "dummy")) != 2 {
+		t.Fatalf("expected 2 but got %d proxies", len(a.GetProxies(u1, "dummy")))
 	}
-	if len(a.GetProxies(u2)) != 1 {
-		t.Fatalf("expected 1 but got %d proxies", len(a.GetProxies(u1)))
+	if len(a.GetProxies(u2, "dummy")) != 1 {
+		t.Fatalf("expected 1 but got %d proxies", len(a.GetProxies(u1, "dummy")))
 	}
 
 	a.RemoveProxy(p1)
@@ -62,10 +70,40 @@ func TestRemoveProxies(t *testing.T) {
 	if len(a.GetUsers(p1)) != 0 {
 		t.Fatalf("expected 0 but got %d users", len(a.GetUsers(p1)))
 	}
-	if len(a.GetProxies(u1)) != 1 {
-		t.Fatalf("expected 1 but got %d proxies", len(a.GetProxies(u1)))
+	if len(a.GetProxies(u1, "dummy")) != 1 {
+		t.Fatalf("expected 1 but got %d proxies", len(a.GetProxies(u1, "dummy")))
+	}
+	if len(a.GetProxies(u2, "dummy")) != 0 {
+		t.Fatalf("expected 0 but got %d proxies", len(a.GetProxies(u1, "dummy")))
+	}
+}
+
+func TestProxiesPerType(t *testing.T) {
+	a := NewProxyAssignments()
+	u, _ := NewUser()
+	obfs4 := resources.NewTransport()
+	obfs4.RType = resources.ResourceTypeObfs4
+	vanilla := resources.NewTransport()
+	vanilla.RType = resources.ResourceTypeVanilla
+	p1 := &Proxy{Resource: obfs4}
+	p2 := &Proxy{Resource: vanilla}
+
+	a.Add(u, p1)
+	a.Add(u, p2)
+
+	proxies := a.GetProxies(u, resources.ResourceTypeObfs4)
+	if len(proxies) != 1 || proxies[0] != p1 {
+		t.Fatalf("expected only obfs4 proxy but got %v", proxies)
+	}
+	if len(a.GetAllProxies(u)) != 2 {
+		t.Fatalf("expected 2 but got %d proxies", len(a.GetAllProxies(u)))
+	}
+
+	a.Remove(u, p2)
+	if len(a.GetProxies(u, resources.ResourceTypeVanilla)) != 0 {
+		t.Fatalf("expected no vanilla proxies after removal")
 	}
-	if len(a.GetProxies(u2)) != 0 {
-		t.Fatalf("expected 0 but got %d proxies", len(a.GetProxies(u1)))
+	if len(a.GetProxies(u, resources.ResourceTypeObfs4)) != 1 {
+		t.Fatalf("removal of vanilla proxy affected obfs4 proxy")
 	}
 }
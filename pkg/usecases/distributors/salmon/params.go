@@ -0,0 +1,250 @@
+package salmon
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	// The Salmon paper calls this threshold "T".  Simulation results suggest T
+	// = 1/3: <https://censorbib.nymity.ch/pdf/Douglas2016a.pdf#page=7>
+	DefaultMaxSuspicion = 0.333
+	// DefaultMaxTrustLevel represents the maximum trust level that a user can
+	// get promoted to.  The paper refers to the maximum trust level as "L"
+	// and argues that six is a good compromise:
+	// <https://censorbib.nymity.ch/pdf/Douglas2016a.pdf#page=4>
+	DefaultMaxTrustLevel = Trust(6)
+	// We don't let operators configure absurdly high trust levels.  With our
+	// default promotion schedule, a user would need more than 5,000 years to
+	// reach this level.
+	maxConfigurableTrustLevel = 20
+	// The maximum number of clients per proxy.
+	DefaultMaxClients            = 10
+	DefaultProxiesPerUser        = 3
+	DefaultInvitationTokenExpiry = time.Hour * 24 * 7
+	// By default, we replace up to three blocked proxies per user and month.
+	DefaultMaxReplacements   = 3
+	DefaultReplacementWindow = time.Hour * 24 * 30
+	// By default, users at the maximum trust level may issue three invites
+	// per month.
+	DefaultInviteQuota  = 3
+	DefaultInviteWindow = time.Hour * 24 * 30
+	// Invitees start one trust level below their inviter and need months to
+	// reach the maximum trust level again, so legitimate invitation chains
+	// grow slowly.
+	DefaultMaxInviteDepth = 10
+	// Each limit hit counts like a blocking event that one in ten users is
+	// innocent of.  With our default suspicion threshold, we ban users after
+	// their fourth limit hit.
+	DefaultLimitHitInnocence = 0.9
+)
+
+// Params contains the parameters of Salmon's trust and suspicion mechanisms.
+// Use NewParams to create Params.
+type Params struct {
+	MaxSuspicion          float64
+	MaxTrustLevel         Trust
+	InvitationTokenExpiry time.Duration
+	MaxReplacements       int
+	ReplacementWindow     time.Duration
+	InviteWindow          time.Duration
+	MaxInviteDepth        int
+	LimitHitInnocence     float64
+	promotionDays         []int
+	inviteQuotas          []int
+	maxClients            int
+	proxiesPerUser        int
+	resourceParams        map[string]internal.SalmonResourceParams
+}
+
+// DefaultParams returns the parameters that the Salmon paper suggests.
+func DefaultParams() *Params {
+	// Our zero configuration is valid, so we can ignore the error.
+	params, _ := NewParams(internal.SalmonParamsConfig{})
+	return params
+}
+
+// NewParams turns the given configuration into Params, filling in defaults.
+// The function returns an error if the configuration contains values that we
+// cannot work with.
+func NewParams(cfg internal.SalmonParamsConfig) (*Params, error) {
+
+	p := &Params{
+		MaxSuspicion:          cfg.MaxSuspicion,
+		MaxTrustLevel:         Trust(cfg.MaxTrustLevel),
+		InvitationTokenExpiry: DefaultInvitationTokenExpiry,
+		MaxReplacements:       DefaultMaxReplacements,
+		ReplacementWindow:     DefaultReplacementWindow,
+		InviteWindow:          DefaultInviteWindow,
+		MaxInviteDepth:        cfg.MaxInviteDepth,
+		LimitHitInnocence:     cfg.LimitHitInnocence,
+		promotionDays:         cfg.PromotionDays,
+		inviteQuotas:          cfg.InviteQuotas,
+		maxClients:            cfg.MaxClients,
+		proxiesPerUser:        cfg.ProxiesPerUser,
+		resourceParams:        cfg.ResourceParams,
+	}
+
+	if p.MaxSuspicion == 0 {
+		p.MaxSuspicion = DefaultMaxSuspicion
+	}
+	if p.MaxSuspicion < 0 || p.MaxSuspicion > 1 {
+		return nil, fmt.Errorf("maximum suspicion %.3f is not between 0 and 1", p.MaxSuspicion)
+	}
+
+	if p.MaxTrustLevel == 0 {
+		p.MaxTrustLevel = DefaultMaxTrustLevel
+	}
+	if p.MaxTrustLevel < 1 || p.MaxTrustLevel > maxConfigurableTrustLevel {
+		return nil, fmt.Errorf("maximum trust level %d is not between 1 and %d",
+			p.MaxTrustLevel, maxConfigurableTrustLevel)
+	}
+
+	if len(p.promotionDays) != 0 && len(p.promotionDays) != int(p.MaxTrustLevel) {
+		return nil, fmt.Errorf("promotion schedule must have one entry per trust level below %d",
+			p.MaxTrustLevel)
+	}
+	for n, days := range p.promotionDays {
+		if days <= 0 {
+			return nil, fmt.Errorf("promotion from trust level %d must take at least one day", n)
+		}
+	}
+
+	var err error
+	if p.InvitationTokenExpiry, err = parseDuration("invitation token expiry",
+		cfg.InvitationTokenExpiry, DefaultInvitationTokenExpiry); err != nil {
+		return nil, err
+	}
+	if p.ReplacementWindow, err = parseDuration("replacement window",
+		cfg.ReplacementWindow, DefaultReplacementWindow); err != nil {
+		return nil, err
+	}
+	if cfg.MaxReplacements != nil {
+		p.MaxReplacements = *cfg.MaxReplacements
+	}
+	if p.MaxReplacements < 0 {
+		return nil, fmt.Errorf("maximum replacements must not be negative")
+	}
+
+	if len(p.inviteQuotas) != 0 && len(p.inviteQuotas) != int(p.MaxTrustLevel)+1 {
+		return nil, fmt.Errorf("invite quotas must have one entry per trust level from 0 to %d",
+			p.MaxTrustLevel)
+	}
+	for n, quota := range p.inviteQuotas {
+		if quota < 0 {
+			return nil, fmt.Errorf("invite quota of trust level %d must not be negative", n)
+		}
+	}
+	if p.InviteWindow, err = parseDuration("invite window",
+		cfg.InviteWindow, DefaultInviteWindow); err != nil {
+		return nil, err
+	}
+	if p.MaxInviteDepth == 0 {
+		p.MaxInviteDepth = DefaultMaxInviteDepth
+	}
+	if p.MaxInviteDepth < 0 {
+		return nil, fmt.Errorf("maximum invite depth must not be negative")
+	}
+	if p.LimitHitInnocence == 0 {
+		p.LimitHitInnocence = DefaultLimitHitInnocence
+	}
+	if p.LimitHitInnocence < 0 || p.LimitHitInnocence > 1 {
+		return nil, fmt.Errorf("limit hit innocence %.3f is not between 0 and 1", p.LimitHitInnocence)
+	}
+
+	if p.maxClients == 0 {
+		p.maxClients = DefaultMaxClients
+	}
+	if p.proxiesPerUser == 0 {
+		p.proxiesPerUser = DefaultProxiesPerUser
+	}
+	if p.maxClients < 0 || p.proxiesPerUser < 0 {
+		return nil, fmt.Errorf("maximum clients and proxies per user must not be negative")
+	}
+	for rType, rParams := range p.resourceParams {
+		if _, exists := resources.ResourceMap[rType]; !exists {
+			return nil, fmt.Errorf("parameters for unknown resource type %q", rType)
+		}
+		if rParams.MaxClients < 0 || rParams.ProxiesPerUser < 0 {
+			return nil, fmt.Errorf("maximum clients and proxies per user of %q must not be negative", rType)
+		}
+	}
+
+	return p, nil
+}
+
+// parseDuration parses the given duration, e.g. "168h", and returns the given
+// default if the duration is empty.
+func parseDuration(name, value string, def time.Duration) (time.Duration, error) {
+
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", name, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s %q must be positive", name, value)
+	}
+	return d, nil
+}
+
+// MaxClients returns the maximum number of clients per proxy of the given
+// resource type.
+func (p *Params) MaxClients(rType string) int {
+
+	if rParams, exists := p.resourceParams[rType]; exists && rParams.MaxClients != 0 {
+		return rParams.MaxClients
+	}
+	return p.maxClients
+}
+
+// ProxiesPerUser returns the number of proxies of the given resource type that
+// we hand out to each user.
+func (p *Params) ProxiesPerUser(rType string) int {
+
+	if rParams, exists := p.resourceParams[rType]; exists && rParams.ProxiesPerUser != 0 {
+		return rParams.ProxiesPerUser
+	}
+	return p.proxiesPerUser
+}
+
+// PromotionDays returns the number of days that a user must spend at the given
+// trust level before we promote them.  Unless configured otherwise, a
+// promotion from level n to n+1 takes 2^{n+1} days.
+func (p *Params) PromotionDays(trust Trust) int {
+
+	if trust >= 0 && int(trust) < len(p.promotionDays) {
+		return p.promotionDays[trust]
+	}
+	return int(math.Exp2(math.Abs(float64(trust + 1))))
+}
+
+// InviteQuota returns the number of invites that a user at the given trust
+// level may issue within our invite window.  Unless configured otherwise, only
+// users at the maximum trust level may issue invites.  Admin users, at
+// UntouchableTrustLevel, have no quota.
+func (p *Params) InviteQuota(trust Trust) int {
+
+	if trust == UntouchableTrustLevel {
+		return math.MaxInt32
+	}
+	if trust < 0 {
+		return 0
+	}
+	if trust > p.MaxTrustLevel {
+		trust = p.MaxTrustLevel
+	}
+	if len(p.inviteQuotas) != 0 {
+		return p.inviteQuotas[trust]
+	}
+	if trust == p.MaxTrustLevel {
+		return DefaultInviteQuota
+	}
+	return 0
+}
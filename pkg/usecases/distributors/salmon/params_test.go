@@ -0,0 +1,162 @@
+package salmon
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestNewParams(t *testing.T) {
+
+	params := DefaultParams()
+	if params.MaxSuspicion != DefaultMaxSuspicion || params.MaxTrustLevel != DefaultMaxTrustLevel {
+		t.Errorf("expected default parameters but got %+v", params)
+	}
+	if params.PromotionDays(2) != 8 || params.PromotionDays(-2) != 2 {
+		t.Errorf("expected default promotion schedule")
+	}
+	if params.InviteQuota(DefaultMaxTrustLevel) != DefaultInviteQuota || params.InviteQuota(DefaultMaxTrustLevel-1) != 0 {
+		t.Errorf("expected default invite quotas")
+	}
+	if params.MaxReplacements != DefaultMaxReplacements {
+		t.Errorf("expected %d replacements but got %d", DefaultMaxReplacements, params.MaxReplacements)
+	}
+
+	// Operators can turn off replacements.
+	noReplacements := 0
+	params, err := NewParams(internal.SalmonParamsConfig{MaxReplacements: &noReplacements})
+	if err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	if params.MaxReplacements != 0 {
+		t.Errorf("expected no replacements but got %d", params.MaxReplacements)
+	}
+
+	params, err = NewParams(internal.SalmonParamsConfig{
+		MaxTrustLevel:         2,
+		PromotionDays:         []int{1, 5},
+		InviteQuotas:          []int{0, 1, 4},
+		InvitationTokenExpiry: "24h",
+		MaxClients:            4,
+		ResourceParams: map[string]internal.SalmonResourceParams{
+			resources.ResourceTypeObfs4: {MaxClients: 20, ProxiesPerUser: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	if params.PromotionDays(0) != 1 || params.PromotionDays(1) != 5 {
+		t.Errorf("ignored configured promotion schedule")
+	}
+	if params.InviteQuota(-1) != 0 || params.InviteQuota(1) != 1 || params.InviteQuota(2) != 4 ||
+		params.InviteQuota(UntouchableTrustLevel) <= 4 {
+		t.Errorf("ignored configured invite quotas")
+	}
+	if params.InvitationTokenExpiry != 24*time.Hour {
+		t.Errorf("expected token expiry of 24h but got %s", params.InvitationTokenExpiry)
+	}
+	if params.MaxClients(resources.ResourceTypeObfs4) != 20 || params.ProxiesPerUser(resources.ResourceTypeObfs4) != 1 {
+		t.Errorf("ignored parameters for obfs4")
+	}
+	if params.MaxClients(resources.ResourceTypeVanilla) != 4 || params.ProxiesPerUser(resources.ResourceTypeVanilla) != DefaultProxiesPerUser {
+		t.Errorf("expected global parameters for vanilla")
+	}
+
+	negative := -1
+	invalid := []internal.SalmonParamsConfig{
+		{MaxReplacements: &negative},
+		{MaxSuspicion: 1.5},
+		{MaxTrustLevel: -1},
+		{MaxTrustLevel: 100},
+		{MaxTrustLevel: 3, PromotionDays: []int{1, 2}},
+		{MaxTrustLevel: 2, PromotionDays: []int{1, 0}},
+		{InvitationTokenExpiry: "a week"},
+		{MaxTrustLevel: 2, InviteQuotas: []int{0, 1}},
+		{MaxTrustLevel: 1, InviteQuotas: []int{0, -1}},
+		{InviteWindow: "-1h"},
+		{MaxInviteDepth: -1},
+		{LimitHitInnocence: 2},
+		{ProxiesPerUser: -1},
+		{ResourceParams: map[string]internal.SalmonResourceParams{"carrier-pigeon": {}}},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewParams(cfg); err == nil {
+			t.Errorf("accepted invalid parameters %+v", cfg)
+		}
+	}
+}
+
+func TestSetParams(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	trusted, _ := salmon.addUser(DefaultMaxTrustLevel, admin)
+	suspicious, _ := salmon.addUser(1, trusted)
+	suspicious.InnocencePs = []float64{0.75}
+
+	if err := salmon.SetParams(internal.SalmonParamsConfig{MaxSuspicion: 1.5}); err == nil {
+		t.Errorf("accepted invalid parameters")
+	}
+
+	// Stricter parameters demote our trusted user and ban our suspicious user.
+	if err := salmon.SetParams(internal.SalmonParamsConfig{MaxTrustLevel: 4, MaxSuspicion: 0.2}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	if trusted.Trust != 4 {
+		t.Errorf("expected user to be demoted to trust level 4 but got %d", trusted.Trust)
+	}
+	if admin.Trust != UntouchableTrustLevel {
+		t.Errorf("demoted admin user")
+	}
+	if !suspicious.Banned {
+		t.Errorf("failed to ban user whose suspicion exceeds new threshold")
+	}
+
+	// Invitees of our admin start at the new maximum trust level.
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	secretId, _ := salmon.RedeemInvite(token)
+	if trust := salmon.Users[secretId].Trust; trust != 4 {
+		t.Errorf("expected invitee at trust level 4 but got %d", trust)
+	}
+
+	// Laxer parameters unban our suspicious user.
+	if err := salmon.SetParams(internal.SalmonParamsConfig{MaxSuspicion: 0.5}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	if suspicious.Banned {
+		t.Errorf("user still banned despite suspicion below new threshold")
+	}
+}
+
+func TestProxiesPerUser(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	salmon.UnassignedProxies = genResourceMap(20)
+	err := salmon.SetParams(internal.SalmonParamsConfig{
+		ResourceParams: map[string]internal.SalmonResourceParams{
+			resources.ResourceTypeObfs4: {MaxClients: 1, ProxiesPerUser: 5},
+		},
+	})
+	if err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	secretId, _ := salmon.RedeemInvite(token)
+	proxies, err := salmon.GetProxies(secretId, resources.ResourceTypeObfs4)
+	if err != nil {
+		t.Fatalf("failed to get proxies: %s", err)
+	}
+	if len(proxies) != 5 {
+		t.Errorf("expected 5 proxies but got %d", len(proxies))
+	}
+	for _, p := range proxies {
+		if !p.(*Proxy).IsDepleted(salmon.Assignments, salmon.params) {
+			t.Errorf("expected proxy with one client to be depleted")
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package salmon
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// salmonState is the on-disk representation of a SalmonDistributor.  Gob
+// cannot round-trip our pointer graph, so we refer to users by their secret ID
+// and to proxies by their unique ID.
+type salmonState struct {
+	TokenCache          map[string]*TokenMetaInfo
+	Users               []*userState
+	AssignedProxies     map[string][]*proxyState
+	UnassignedProxies   map[string][]*proxyState
+	RegistrationProxies map[string][]*proxyState
+	// Assignments maps a user's secret ID to the unique IDs of the user's
+	// assigned proxies.
+	Assignments map[string][]core.Hashkey
+}
+
+// userState is the on-disk representation of a User.
+type userState struct {
+	SecretId      string
+	Banned        bool
+	BannedByAdmin bool
+	InnocencePs   []float64
+	Trust         Trust
+	InvitedBy     string
+	Invited       []string
+	LastPromoted  time.Time
+	Registered    bool
+	// PendingReplacements and ReplacedAt track the replacement of proxies.
+	PendingReplacements map[string]int
+	ReplacedAt          []time.Time
+	Location            string
+	// InvitedAt, LimitHits, and LastLimitHit track the user's invites and
+	// limit hits.
+	InvitedAt    []time.Time
+	LimitHits    int
+	LastLimitHit time.Time
+}
+
+// proxyState is the on-disk representation of a Proxy.  Resources are
+// interfaces, so we store them in the JSON format that the backend uses.
+type proxyState struct {
+	Resource json.RawMessage
+	Trust    Trust
+}
+
+// saveProxies turns the given resource map into its on-disk representation.
+func saveProxies(m core.ResourceMap) (map[string][]*proxyState, error) {
+
+	saved := make(map[string][]*proxyState)
+	for rType, rQueue := range m {
+		for _, r := range rQueue {
+			p := r.(*Proxy)
+			raw, err := json.Marshal(p.Resource)
+			if err != nil {
+				return nil, err
+			}
+			saved[rType] = append(saved[rType], &proxyState{Resource: raw, Trust: p.Trust})
+		}
+	}
+	return saved, nil
+}
+
+// loadProxies turns the given on-disk representation back into a resource map,
+// and adds all proxies to the given map of unique IDs to proxies.
+func loadProxies(saved map[string][]*proxyState, byUid map[core.Hashkey]*Proxy) (core.ResourceMap, error) {
+
+	m := make(core.ResourceMap)
+	for rType, states := range saved {
+		for _, state := range states {
+			rs, err := internal.UnmarshalResources([]json.RawMessage{state.Resource})
+			if err != nil {
+				return nil, err
+			}
+			p := &Proxy{Resource: rs[0], Trust: state.Trust}
+			byUid[p.Uid()] = p
+			m[rType] = append(m[rType], p)
+		}
+	}
+	return m, nil
+}
+
+// GobEncode implements the gob.GobEncoder interface, which lets our
+// persistence mechanism save the distributor's state.
+func (s *SalmonDistributor) GobEncode() ([]byte, error) {
+
+	var err error
+	state := &salmonState{
+		Assignments: make(map[string][]core.Hashkey),
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state.TokenCache = s.TokenCache
+
+	for _, u := range s.Users {
+		us := &userState{
+			SecretId:      u.SecretId,
+			Banned:        u.Banned,
+			BannedByAdmin: u.BannedByAdmin,
+			InnocencePs:   u.InnocencePs,
+			Trust:         u.Trust,
+			LastPromoted:  u.LastPromoted,
+			Registered:    u.Registered,
+
+			PendingReplacements: u.PendingReplacements,
+			ReplacedAt:          u.ReplacedAt,
+			Location:            u.Location,
+
+			InvitedAt:    u.InvitedAt,
+			LimitHits:    u.LimitHits,
+			LastLimitHit: u.LastLimitHit,
+		}
+		if u.InvitedBy != nil {
+			us.InvitedBy = u.InvitedBy.SecretId
+		}
+		for _, invitee := range u.Invited {
+			us.Invited = append(us.Invited, invitee.SecretId)
+		}
+		state.Users = append(state.Users, us)
+
+		for _, p := range s.Assignments.GetAllProxies(u) {
+			state.Assignments[u.SecretId] = append(state.Assignments[u.SecretId], p.Uid())
+		}
+	}
+
+	if state.AssignedProxies, err = saveProxies(s.AssignedProxies); err != nil {
+		return nil, err
+	}
+	if state.UnassignedProxies, err = saveProxies(s.UnassignedProxies); err != nil {
+		return nil, err
+	}
+	if state.RegistrationProxies, err = saveProxies(s.RegistrationProxies); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements the gob.GobDecoder interface, which lets our
+// persistence mechanism load the distributor's state.  The function rebuilds
+// the pointer graph of our users and proxies.
+func (s *SalmonDistributor) GobDecode(data []byte) error {
+
+	var err error
+	state := &salmonState{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(state); err != nil {
+		return err
+	}
+
+	users := make(map[string]*User)
+	for _, us := range state.Users {
+		users[us.SecretId] = &User{
+			SecretId:      us.SecretId,
+			Banned:        us.Banned,
+			BannedByAdmin: us.BannedByAdmin,
+			InnocencePs:   us.InnocencePs,
+			Trust:         us.Trust,
+			LastPromoted:  us.LastPromoted,
+			Registered:    us.Registered,
+
+			PendingReplacements: us.PendingReplacements,
+			ReplacedAt:          us.ReplacedAt,
+			Location:            us.Location,
+
+			InvitedAt:    us.InvitedAt,
+			LimitHits:    us.LimitHits,
+			LastLimitHit: us.LastLimitHit,
+		}
+	}
+	lookup := func(secretId string) (*User, error) {
+		u, exists := users[secretId]
+		if !exists {
+			return nil, fmt.Errorf("state refers to non-existing user %q", secretId)
+		}
+		return u, nil
+	}
+	for _, us := range state.Users {
+		u := users[us.SecretId]
+		if us.InvitedBy != "" {
+			if u.InvitedBy, err = lookup(us.InvitedBy); err != nil {
+				return err
+			}
+		}
+		for _, secretId := range us.Invited {
+			invitee, err := lookup(secretId)
+			if err != nil {
+				return err
+			}
+			u.Invited = append(u.Invited, invitee)
+		}
+	}
+
+	byUid := make(map[core.Hashkey]*Proxy)
+	assigned, err := loadProxies(state.AssignedProxies, byUid)
+	if err != nil {
+		return err
+	}
+	unassigned, err := loadProxies(state.UnassignedProxies, make(map[core.Hashkey]*Proxy))
+	if err != nil {
+		return err
+	}
+	registration, err := loadProxies(state.RegistrationProxies, make(map[core.Hashkey]*Proxy))
+	if err != nil {
+		return err
+	}
+
+	assignments := NewProxyAssignments()
+	for secretId, uids := range state.Assignments {
+		u, err := lookup(secretId)
+		if err != nil {
+			return err
+		}
+		for _, uid := range uids {
+			p, exists := byUid[uid]
+			if !exists {
+				return fmt.Errorf("user %q is assigned non-existing proxy %d", secretId, uid)
+			}
+			assignments.Add(u, p)
+		}
+	}
+
+	if state.TokenCache == nil {
+		state.TokenCache = make(map[string]*TokenMetaInfo)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.TokenCache = state.TokenCache
+	s.Users = users
+	s.AssignedProxies = assigned
+	s.UnassignedProxies = unassigned
+	s.RegistrationProxies = registration
+	s.Assignments = assignments
+	// Our proxies may have changed or disappeared while we were down.
+	s.reconcile = true
+
+	return nil
+}
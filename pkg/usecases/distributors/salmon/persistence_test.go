@@ -0,0 +1,238 @@
+package salmon
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/file"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// proxyStrings returns the sorted string representations of the given user's
+// proxies.
+func proxyStrings(t *testing.T, s *SalmonDistributor, secretId string) []string {
+
+	proxies, err := s.GetProxies(secretId, resources.ResourceTypeObfs4)
+	if err != nil {
+		t.Fatalf("failed to get proxies: %s", err)
+	}
+	strs := []string{}
+	for _, p := range proxies {
+		strs = append(strs, p.String())
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+// saveAndLoad saves the given distributor's state and loads it into a new
+// distributor, which it returns.
+func saveAndLoad(t *testing.T, s *SalmonDistributor) *SalmonDistributor {
+
+	dir, err := ioutil.TempDir("", "salmon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pMech := file.New(DistName, dir)
+	if err := pMech.Save(s); err != nil {
+		t.Fatalf("failed to save state: %s", err)
+	}
+	loaded := NewSalmonDistributor()
+	loaded.cfg = s.cfg
+	if err := pMech.Load(loaded); err != nil {
+		t.Fatalf("failed to load state: %s", err)
+	}
+	return loaded
+}
+
+// snapshot returns the diff that our resource stream relays after a restart:
+// all of the given distributor's proxies, as new resources.
+func snapshot(s *SalmonDistributor) *core.ResourceDiff {
+
+	diff := core.NewResourceDiff()
+	for _, m := range []core.ResourceMap{s.AssignedProxies, s.UnassignedProxies, s.RegistrationProxies} {
+		for rType, rQueue := range m {
+			for _, r := range rQueue {
+				diff.New[rType] = append(diff.New[rType], r.(*Proxy).Resource)
+			}
+		}
+	}
+	return diff
+}
+
+func TestSaveLoadState(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	salmon.UnassignedProxies = genResourceMap(20)
+	salmon.RegistrationProxies = genResourceMap(5)
+
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	friendId, _ := salmon.RedeemInvite(token)
+	friend := salmon.Users[friendId]
+	friend.Trust = DefaultMaxTrustLevel
+	friend.InnocencePs = []float64{0.9}
+	friend.Location = "RU"
+	friend.LimitHits = 2
+	token, _ = salmon.CreateInvite(friendId)
+	inviteeId, _ := salmon.RedeemInvite(token)
+	registered, _ := salmon.addUser(RegisteredTrustLevel, nil)
+	registered.Registered = true
+	banned, _ := salmon.addUser(0, nil)
+	banned.Banned = true
+	banned.BannedByAdmin = true
+	// Leave an invite token unredeemed.
+	pendingToken, _ := salmon.CreateInvite(admin.SecretId)
+
+	want := make(map[string][]string)
+	for _, secretId := range []string{friendId, inviteeId, registered.SecretId} {
+		want[secretId] = proxyStrings(t, salmon, secretId)
+	}
+
+	loaded := saveAndLoad(t, salmon)
+	if loaded.String() != salmon.String() {
+		t.Errorf("expected state %q but got %q", salmon, loaded)
+	}
+	if _, exists := loaded.TokenCache[pendingToken]; !exists {
+		t.Errorf("lost unredeemed invite token")
+	}
+	for secretId, proxies := range want {
+		got := proxyStrings(t, loaded, secretId)
+		if len(got) != len(proxies) {
+			t.Fatalf("expected %d proxies for %q but got %d", len(proxies), secretId, len(got))
+		}
+		for i := range got {
+			if got[i] != proxies[i] {
+				t.Errorf("expected proxy %q for %q but got %q", proxies[i], secretId, got[i])
+			}
+		}
+	}
+
+	// Our invitation tree must survive.
+	invitee := loaded.Users[inviteeId]
+	if invitee.InvitedBy == nil || invitee.InvitedBy != loaded.Users[friendId] {
+		t.Fatalf("invitee lost its inviter")
+	}
+	if invitee.InvitedBy.InvitedBy != loaded.Users[admin.SecretId] {
+		t.Errorf("inviter lost its inviter")
+	}
+	if len(loaded.Users[admin.SecretId].Invited) != 1 || len(loaded.Users[friendId].Invited) != 1 {
+		t.Errorf("inviters lost their invitees")
+	}
+	if f := loaded.Users[friendId]; f.Trust != DefaultMaxTrustLevel || len(f.InnocencePs) != 1 || f.Location != "RU" || f.LimitHits != 2 ||
+		len(f.InvitedAt) != 1 {
+		t.Errorf("user lost trust level, blocking events, or location: %+v", f)
+	}
+	if !loaded.Users[banned.SecretId].BannedByAdmin || !loaded.Users[registered.SecretId].Registered {
+		t.Errorf("users lost their flags")
+	}
+
+	// Users share assigned proxies, which must still be the same objects.
+	for _, p := range loaded.Assignments.GetProxies(loaded.Users[friendId], resources.ResourceTypeObfs4) {
+		users := loaded.Assignments.GetUsers(p.(*Proxy))
+		if len(users) != 2 {
+			t.Errorf("expected proxy to be shared by 2 users but got %d", len(users))
+		}
+	}
+
+	if !loaded.hasAdmin() {
+		t.Errorf("lost admin user")
+	}
+}
+
+func TestReconcileLoadedState(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	salmon.UnassignedProxies = genResourceMap(20)
+	salmon.RegistrationProxies = genResourceMap(5)
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	friendId, _ := salmon.RedeemInvite(token)
+	want := proxyStrings(t, salmon, friendId)
+	wantState := salmon.String()
+
+	// After a restart, the backend's first diff contains all proxies that we
+	// already know, including the ones that we assigned.
+	loaded := saveAndLoad(t, salmon)
+	loaded.processDiff(snapshot(salmon))
+
+	if loaded.String() != wantState {
+		t.Errorf("expected state %q but got %q", wantState, loaded)
+	}
+	got := proxyStrings(t, loaded, friendId)
+	if len(got) != len(want) {
+		t.Fatalf("expected %d proxies but got %d", len(want), len(got))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("expected proxy %q but got %q", want[i], got[i])
+		}
+	}
+	for _, p := range loaded.Assignments.GetProxies(loaded.Users[friendId], resources.ResourceTypeObfs4) {
+		for _, pool := range []core.ResourceMap{loaded.UnassignedProxies, loaded.RegistrationProxies} {
+			q := pool[resources.ResourceTypeObfs4]
+			if _, err := q.Search(p.Uid()); err == nil {
+				t.Errorf("assigned proxy returned to a pool")
+			}
+		}
+	}
+
+	// Later diffs are no snapshots, so we no longer reconcile.
+	if loaded.reconcile {
+		t.Errorf("still reconciling after first diff")
+	}
+}
+
+func TestReconcileVanishedProxies(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	salmon.UnassignedProxies = genResourceMap(20)
+	salmon.RegistrationProxies = genResourceMap(5)
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	friendId, _ := salmon.RedeemInvite(token)
+	rType := resources.ResourceTypeObfs4
+	numProxies := len(proxyStrings(t, salmon, friendId))
+
+	// One assigned, one unassigned, and one registration proxy disappear
+	// while we are down.
+	loaded := saveAndLoad(t, salmon)
+	vanished := map[core.Hashkey]bool{
+		salmon.Assignments.GetProxies(salmon.Users[friendId], rType)[0].Uid(): true,
+		salmon.UnassignedProxies[rType][0].Uid():                              true,
+		salmon.RegistrationProxies[rType][0].Uid():                            true,
+	}
+	diff := snapshot(salmon)
+	var rest core.ResourceQueue
+	for _, r := range diff.New[rType] {
+		if !vanished[r.Uid()] {
+			rest = append(rest, r)
+		}
+	}
+	diff.New[rType] = rest
+	loaded.processDiff(diff)
+
+	for _, m := range []core.ResourceMap{loaded.AssignedProxies, loaded.UnassignedProxies, loaded.RegistrationProxies} {
+		for _, r := range m[rType] {
+			if vanished[r.Uid()] {
+				t.Errorf("kept proxy that disappeared while we were down")
+			}
+		}
+	}
+	// Our user gets a replacement for the vanished proxy.
+	proxies := loaded.Assignments.GetProxies(loaded.Users[friendId], rType)
+	if len(proxies) != numProxies {
+		t.Errorf("expected %d proxies but got %d", numProxies, len(proxies))
+	}
+	for _, p := range proxies {
+		if vanished[p.Uid()] {
+			t.Errorf("user kept proxy that disappeared while we were down")
+		}
+	}
+}
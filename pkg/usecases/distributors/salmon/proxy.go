@@ -6,29 +6,32 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 )
 
-const (
-	// The maximum number of clients per proxy.
-	MaxClients = 10
-)
-
 // Proxy represents a circumvention proxy that's handed out to users.
 type Proxy struct {
 	core.Resource
+	// Trust is the proxy's trust level.  New proxies start at trust level 0,
+	// our lowest tier for proxies, and get promoted along with their users.
 	Trust Trust
 }
 
 // IsDepleted returns true if the proxy reached its capacity and can no longer
 // accommodate new users.
-func (p *Proxy) IsDepleted(assignments *ProxyAssignments) bool {
-	return len(assignments.GetUsers(p)) >= MaxClients
+func (p *Proxy) IsDepleted(assignments *ProxyAssignments, params *Params) bool {
+	return len(assignments.GetUsers(p)) >= params.MaxClients(p.Type())
 }
 
-// UpdateTrust promotes the proxy's trust level depending on its users.
-func (p *Proxy) UpdateTrust(assignments *ProxyAssignments) {
+// UpdateTrust promotes the proxy's trust level depending on its users.  A
+// proxy's trust level is the minimum trust level of its users, but no higher
+// than our maximum trust level.  Proxies without users keep their trust level.
+func (p *Proxy) UpdateTrust(assignments *ProxyAssignments, params *Params) {
 
-	// Determine the minimum trust level of the proxy's users.
-	newTrust := UntouchableTrustLevel
 	users := assignments.GetUsers(p)
+	if len(users) == 0 {
+		return
+	}
+
+	// Determine the minimum trust level of the proxy's users.
+	newTrust := params.MaxTrustLevel
 	for _, user := range users {
 		if user.Trust < newTrust {
 			newTrust = user.Trust
@@ -41,38 +44,49 @@ func (p *Proxy) UpdateTrust(assignments *ProxyAssignments) {
 	}
 
 	// A proxy's trust level should be monotonically increasing because its
-	// users would only lose a trust level if the proxy was blocked.
+	// users would only lose a trust level if the proxy was blocked, and we
+	// never assign a proxy to a user whose trust level is below the proxy's.
 	if newTrust < p.Trust {
 		// TODO: How do we handle server blocking?
 		log.Printf("Bug: proxy was assigned to user with too low a trust level")
 	}
 }
 
-// SetBlocked marks the given proxy as blocked and adjusts the innocence scores
-// of (and potentially blocks) all assigned users.  This function doesn't care
-// *where* a proxy is blocked.
-func (p *Proxy) SetBlocked(assignments *ProxyAssignments) {
+// AssignableTo returns true if we may assign the proxy to the given user, i.e.
+// if the proxy's trust level doesn't exceed the user's, and if the proxy isn't
+// blocked where the user is.  Users at trust level n therefore only learn
+// about proxies at trust level n or below.
+func (p *Proxy) AssignableTo(u *User) bool {
+	return p.Trust <= u.Trust && !p.BlockedFor(u)
+}
+
+// BlockedFor returns true if the proxy may be blocked where the given user is.
+func (p *Proxy) BlockedFor(u *User) bool {
+	return u.InLocations(p.BlockedIn())
+}
+
+// SetBlocked marks the given proxy as blocked in the given locations, adjusts
+// the innocence scores of (and potentially blocks) the assigned users in these
+// locations, and returns these users.  The blocking event doesn't count
+// against users elsewhere because they cannot have caused it by telling the
+// censor about the proxy.
+func (p *Proxy) SetBlocked(assignments *ProxyAssignments, params *Params, locations core.LocationSet) []*User {
 
-	// numUsers := len(p.Users)
-	numUsers := len(assignments.GetUsers(p))
+	users := []*User{}
+	for _, user := range assignments.GetUsers(p) {
+		if user.InLocations(locations) {
+			users = append(users, user)
+		}
+	}
+	numUsers := len(users)
 	if numUsers == 0 {
-		log.Printf("Warning: proxy marked as blocked but has no users.")
-		return
+		log.Printf("Warning: proxy marked as blocked in %s but has no users there.", locations)
+		return users
 	}
 
-	users := assignments.GetUsers(p)
 	for _, user := range users {
 		// Add blocking event and determine user's innocence score.
-		user.InnocencePs = append(user.InnocencePs, (float64(numUsers)-1.0)/float64(numUsers))
-		score := 1.0
-		for _, p := range user.InnocencePs {
-			score *= p
-		}
-
-		// A user's suspicion is the complement of her innocence.
-		if 1-score >= MaxSuspicion {
-			log.Printf("Banning user %q with suspicion %.2f", user.SecretId, 1-score)
-			user.Banned = true
-		}
+		user.addInnocenceP((float64(numUsers)-1.0)/float64(numUsers), params)
 	}
+	return users
 }
@@ -5,7 +5,7 @@ import (
 )
 
 func TestUpdateProxyTrust(t *testing.T) {
-	p := &Proxy{}
+	p := newDummyProxy(1)
 	u1 := &User{}
 	u1.Trust = 1
 	u2 := &User{}
@@ -16,21 +16,38 @@ func TestUpdateProxyTrust(t *testing.T) {
 
 	// Proxy's trust level should be identical to minimum trust level of its
 	// users.
-	p.UpdateTrust(a)
+	p.UpdateTrust(a, DefaultParams())
 	if p.Trust != 1 {
 		t.Errorf("determined incorrect proxy trust level")
 	}
 
 	// When user gets promoted, the proxy's trust level should increase too.
 	u1.Trust++
-	p.UpdateTrust(a)
+	p.UpdateTrust(a, DefaultParams())
 	if p.Trust != 2 {
 		t.Errorf("determined incorrect proxy trust level")
 	}
 
 	u1.Trust++
-	p.UpdateTrust(a)
+	p.UpdateTrust(a, DefaultParams())
 	if p.Trust != 2 {
 		t.Errorf("determined incorrect proxy trust level")
 	}
+
+	// Proxies of admin users don't exceed our maximum trust level.
+	admin := &User{Trust: UntouchableTrustLevel}
+	p = newDummyProxy(2)
+	a.Add(admin, p)
+	p.UpdateTrust(a, DefaultParams())
+	if p.Trust != DefaultMaxTrustLevel {
+		t.Errorf("expected proxy trust level %d but got %d", DefaultMaxTrustLevel, p.Trust)
+	}
+
+	// Proxies without users keep their trust level.
+	p = newDummyProxy(3)
+	p.Trust = 3
+	p.UpdateTrust(a, DefaultParams())
+	if p.Trust != 3 {
+		t.Errorf("changed trust level of proxy without users")
+	}
 }
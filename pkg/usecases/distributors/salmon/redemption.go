@@ -0,0 +1,61 @@
+package salmon
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+// redemptionLimiter limits the number of invite redemptions that each client
+// address, and all clients together, may attempt per minute.  Like the daily
+// quota of our admission control, the limits apply to fixed windows: our
+// counters start over at the beginning of each minute.  We only keep track of
+// the addresses that we let through, so our memory use is bounded by the
+// global limit.
+type redemptionLimiter struct {
+	sync.Mutex
+	perMinute       int
+	globalPerMinute int
+	window          time.Time
+	attempts        map[string]int
+	global          int
+}
+
+// newRedemptionLimiter returns a new limiter for the given configuration,
+// filling in defaults.
+func newRedemptionLimiter(cfg internal.SalmonRedemptionConfig) *redemptionLimiter {
+
+	l := &redemptionLimiter{
+		perMinute:       cfg.AttemptsPerMinute,
+		globalPerMinute: cfg.GlobalAttemptsPerMinute,
+		attempts:        make(map[string]int),
+	}
+	if l.perMinute == 0 {
+		l.perMinute = DefaultRedemptionsPerMinute
+	}
+	if l.globalPerMinute == 0 {
+		l.globalPerMinute = DefaultGlobalRedemptionsPerMinute
+	}
+	return l
+}
+
+// allow returns true if the client with the given address may attempt a
+// redemption at the given time.  If not, it also returns how long the client
+// should wait before trying again.
+func (l *redemptionLimiter) allow(addr string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if window := now.Truncate(time.Minute); !window.Equal(l.window) {
+		l.window = window
+		l.attempts = make(map[string]int)
+		l.global = 0
+	}
+	if l.attempts[addr] >= l.perMinute || l.global >= l.globalPerMinute {
+		return false, l.window.Add(time.Minute).Sub(now)
+	}
+	l.attempts[addr]++
+	l.global++
+	return true, 0
+}
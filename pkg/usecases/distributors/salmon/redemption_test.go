@@ -0,0 +1,45 @@
+package salmon
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func TestRedemptionLimiter(t *testing.T) {
+
+	l := newRedemptionLimiter(internal.SalmonRedemptionConfig{})
+	if l.perMinute != DefaultRedemptionsPerMinute || l.globalPerMinute != DefaultGlobalRedemptionsPerMinute {
+		t.Fatalf("didn't fill in default limits")
+	}
+
+	l = newRedemptionLimiter(internal.SalmonRedemptionConfig{AttemptsPerMinute: 2, GlobalAttemptsPerMinute: 3})
+	now := time.Date(2021, 1, 1, 12, 0, 30, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("1.2.3.4", now); !ok {
+			t.Fatalf("rejected redemption attempt %d", i+1)
+		}
+	}
+	ok, wait := l.allow("1.2.3.4", now)
+	if ok {
+		t.Errorf("allowed redemption attempt beyond per-client limit")
+	}
+	if wait != 30*time.Second {
+		t.Errorf("expected to wait 30s but got %s", wait)
+	}
+
+	// Other clients have their own limit, but share the global one.
+	if ok, _ := l.allow("5.6.7.8", now); !ok {
+		t.Errorf("rejected redemption attempt of another client")
+	}
+	if ok, _ := l.allow("9.9.9.9", now); ok {
+		t.Errorf("allowed redemption attempt beyond global limit")
+	}
+
+	// Our limits start over in the next minute.
+	if ok, _ := l.allow("1.2.3.4", now.Add(30*time.Second)); !ok {
+		t.Errorf("rejected redemption attempt in new window")
+	}
+}
@@ -8,45 +8,61 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 const (
-	DistName = "salmon"
-	// The Salmon paper calls this threshold "T".  Simulation results suggest T
-	// = 1/3: <https://censorbib.nymity.ch/pdf/Douglas2016a.pdf#page=7>
-	MaxSuspicion         = 0.333
+	DistName             = "salmon"
 	SalmonTickerInterval = time.Hour * 24
 	// Number of bytes.
 	InvitationTokenLength = 20
-	InvitationTokenExpiry = time.Hour * 24 * 7
-	NumProxiesPerUser     = 3 // TODO: This should be configurable.
-	TokenCacheFile        = "token-cache.bin"
-	UsersFile             = "users.bin"
+	// By default, each client IP address may attempt three redemptions per
+	// minute, and all clients together sixty.
+	DefaultRedemptionsPerMinute       = 3
+	DefaultGlobalRedemptionsPerMinute = 60
+)
+
+var (
+	ErrInviteQuotaExhausted = errors.New("invite quota exhausted; try again later")
+	ErrInviteDepthExceeded  = errors.New("invitation chain is too long to issue further invites")
 )
 
 // SalmonDistributor contains all the context that the distributor needs to
-// run.
+// run.  HTTP handlers and our housekeeping goroutine access the distributor
+// concurrently, so all exported methods acquire our lock, which protects our
+// token cache, users, proxies, and assignments, including the users' and
+// proxies' fields.  Unexported methods expect the caller to hold the lock,
+// unless documented otherwise.
 type SalmonDistributor struct {
 	ipc      delivery.Mechanism
 	cfg      *internal.Config
 	wg       sync.WaitGroup
 	shutdown chan bool
+	lock     sync.Mutex
 
 	TokenCache        map[string]*TokenMetaInfo
-	tokenCacheMutex   sync.Mutex
 	Users             map[string]*User
 	AssignedProxies   core.ResourceMap
 	UnassignedProxies core.ResourceMap
+	// RegistrationProxies are unassigned proxies that we set aside for users
+	// who registered rather than being invited.
+	RegistrationProxies core.ResourceMap
 	// Assignments keep track of our proxy-to-user mappings.
 	Assignments *ProxyAssignments
+	admission   *admissionControl
+	redemption  *redemptionLimiter
+	params      *Params
+	// reconcile is set if we loaded our proxies from disk and have yet to
+	// reconcile them with the backend's resources.
+	reconcile bool
 }
 
 // Trust represents the level of trust we have for a user or proxy.
@@ -58,6 +74,9 @@ type Trust int
 type TokenMetaInfo struct {
 	SecretInviterId string
 	IssueTime       time.Time
+	// Admin is true if an operator issued the token.  Whoever redeems the
+	// token becomes an admin user at UntouchableTrustLevel.
+	Admin bool
 }
 
 // NewSalmonDistributor allocates and returns a new distributor object.
@@ -67,18 +86,26 @@ func NewSalmonDistributor() *SalmonDistributor {
 	salmon.Users = make(map[string]*User)
 	salmon.AssignedProxies = make(core.ResourceMap)
 	salmon.UnassignedProxies = make(core.ResourceMap)
+	salmon.RegistrationProxies = make(core.ResourceMap)
 	salmon.cfg = &internal.Config{}
 	salmon.Assignments = NewProxyAssignments()
+	salmon.admission = newAdmissionControl(salmon.cfg.Distributors.Salmon.Registration)
+	salmon.redemption = newRedemptionLimiter(salmon.cfg.Distributors.Salmon.Redemption)
+	salmon.params = DefaultParams()
 	return salmon
 }
 
 // String implements the Stringer interface.
 func (s *SalmonDistributor) String() string {
-	return fmt.Sprintf("token cache=%d; users=%d; assigned=%d; unassigned=%d; user2proxy=%d; proxy2user=%d",
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return fmt.Sprintf("token cache=%d; users=%d; assigned=%d; unassigned=%d; registration=%d; user2proxy=%d; proxy2user=%d",
 		len(s.TokenCache),
 		len(s.Users),
 		len(s.AssignedProxies),
 		len(s.UnassignedProxies),
+		len(s.RegistrationProxies),
 		len(s.Assignments.UserToProxy),
 		len(s.Assignments.ProxyToUser))
 }
@@ -93,6 +120,9 @@ func (s *SalmonDistributor) addUser(trust Trust, inviter *User) (*User, error) {
 	}
 	u.InvitedBy = inviter
 	u.Trust = trust
+	if inviter != nil {
+		inviter.Invited = append(inviter.Invited, u)
+	}
 
 	s.Users[u.SecretId] = u
 	log.Printf("Created new user with secret ID %q.", u.SecretId)
@@ -100,6 +130,17 @@ func (s *SalmonDistributor) addUser(trust Trust, inviter *User) (*User, error) {
 	return u, nil
 }
 
+// hasAdmin returns true if one of our users was invited directly by us.
+func (s *SalmonDistributor) hasAdmin() bool {
+
+	for _, u := range s.Users {
+		if u.Trust == UntouchableTrustLevel {
+			return true
+		}
+	}
+	return false
+}
+
 // convertToProxies converts the Resource elements in the given ResourceDiff to
 // Proxy elements, which extend Resources.
 func convertToProxies(diff *core.ResourceDiff) {
@@ -117,51 +158,182 @@ func convertToProxies(diff *core.ResourceDiff) {
 }
 
 // processDiff takes as input a resource diff and feeds it into Salmon's
-// existing set of resources.
-// TODO: How should we handle new proxies that are blocked already?
+// existing set of resources.  New proxies that are blocked already end up in
+// our unassigned proxies like all others, and we only hand them out to users
+// elsewhere.  The function acquires our lock.
 func (s *SalmonDistributor) processDiff(diff *core.ResourceDiff) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	convertToProxies(diff)
+	if s.reconcile {
+		s.reconcileProxies(diff)
+		s.reconcile = false
+	}
 	for rType, rQueue := range diff.Changed {
 		for _, r1 := range rQueue {
-			// Is the given resource blocked in a new place?
 			q, exists := s.AssignedProxies[rType]
 			if !exists {
 				continue
 			}
 			r2, err := q.Search(r1.Uid())
-			if err == nil {
-				if r1.BlockedIn().HasLocationsNotIn(r2.BlockedIn()) {
-					r2.(*Proxy).SetBlocked(s.Assignments)
+			if err != nil {
+				continue
+			}
+			p := r2.(*Proxy)
+			// Is the given resource blocked in new places?
+			newLocations := make(core.LocationSet)
+			for location := range r1.BlockedIn() {
+				if !p.BlockedIn()[location] {
+					newLocations[location] = true
 				}
 			}
+			// We update assigned proxies in place, so our assignments keep
+			// pointing to them.
+			p.Resource = r1.(*Proxy).Resource
+			if len(newLocations) > 0 {
+				users := p.SetBlocked(s.Assignments, s.params, newLocations)
+				s.withdrawProxy(p, rType, users)
+			}
+		}
+	}
+	// Remove proxies that are now gone, and replace them.
+	for rType, rQueue := range diff.Gone {
+		for _, r := range rQueue {
+			q := s.AssignedProxies[rType]
+			if r2, err := q.Search(r.Uid()); err == nil {
+				s.retireProxy(r2.(*Proxy), rType)
+			}
 		}
 	}
-	// Remove proxies that are now gone.
-	for _, rQueue := range diff.Gone {
+
+	// Set aside some of our new proxies for registered users.
+	regDiff := &core.ResourceDiff{
+		New:     make(core.ResourceMap),
+		Changed: diff.Changed,
+		Gone:    diff.Gone,
+	}
+	for rType, rQueue := range diff.New {
+		var rest core.ResourceQueue
 		for _, r := range rQueue {
-			s.Assignments.RemoveProxy(r.(*Proxy))
+			if s.isRegistrationProxy(r) {
+				regDiff.New[rType] = append(regDiff.New[rType], r)
+			} else {
+				rest = append(rest, r)
+			}
 		}
+		diff.New[rType] = rest
 	}
+	s.RegistrationProxies.ApplyDiff(regDiff)
 
+	// We already took care of our assigned proxies above.
 	s.UnassignedProxies.ApplyDiff(diff)
-	// New proxies only belong in UnassignedProxies.
-	diff.New = nil
-	s.AssignedProxies.ApplyDiff(diff)
-	log.Printf("Unassigned proxies: %s; assigned proxies: %s",
-		s.UnassignedProxies, s.AssignedProxies)
+	log.Printf("Unassigned proxies: %s; registration proxies: %s; assigned proxies: %s",
+		s.UnassignedProxies, s.RegistrationProxies, s.AssignedProxies)
+}
+
+// reconcileProxies reconciles the proxies that we loaded from disk with the
+// given diff, which is the first one that we receive after loading our state.
+// Our resource stream starts out empty, so the diff contains all of the
+// backend's resources as new resources.  Loaded proxies that the diff lacks
+// disappeared while we were down, so we remove them, and give their users
+// replacements.  Loaded proxies that we assigned to users must not end up in
+// our pools again, so we turn them into changed resources, which we update in
+// place.  Loaded proxies that are still in one of our pools stay where they
+// are.
+func (s *SalmonDistributor) reconcileProxies(diff *core.ResourceDiff) {
+
+	current := make(map[string]map[core.Hashkey]bool)
+	for rType, rQueue := range diff.New {
+		current[rType] = make(map[core.Hashkey]bool)
+		for _, r := range rQueue {
+			current[rType][r.Uid()] = true
+		}
+	}
+
+	// Remove vanished proxies from our pools first, so we don't hand them
+	// out as replacements.
+	for _, m := range []core.ResourceMap{s.UnassignedProxies, s.RegistrationProxies} {
+		for rType, rQueue := range m {
+			var kept core.ResourceQueue
+			for _, r := range rQueue {
+				if current[rType][r.Uid()] {
+					kept = append(kept, r)
+				}
+			}
+			m[rType] = kept
+		}
+	}
+	for rType, rQueue := range s.AssignedProxies {
+		// Retiring a proxy modifies the queue that we iterate over.
+		for _, r := range append(core.ResourceQueue{}, rQueue...) {
+			if !current[rType][r.Uid()] {
+				log.Printf("Retiring %s proxy that disappeared while we were down.", rType)
+				s.retireProxy(r.(*Proxy), rType)
+			}
+		}
+	}
+
+	if diff.Changed == nil {
+		diff.Changed = make(core.ResourceMap)
+	}
+	for rType, rQueue := range diff.New {
+		var rest core.ResourceQueue
+		assigned := s.AssignedProxies[rType]
+		unassigned := s.UnassignedProxies[rType]
+		registration := s.RegistrationProxies[rType]
+		for _, r := range rQueue {
+			if _, err := assigned.Search(r.Uid()); err == nil {
+				diff.Changed[rType] = append(diff.Changed[rType], r)
+			} else if _, err := unassigned.Search(r.Uid()); err == nil {
+				continue
+			} else if _, err := registration.Search(r.Uid()); err == nil {
+				continue
+			} else {
+				rest = append(rest, r)
+			}
+		}
+		diff.New[rType] = rest
+	}
+}
+
+// isRegistrationProxy returns true if the given new proxy belongs in our pool
+// for registered users.  The decision depends on the proxy's unique ID, so
+// it's stable across restarts.
+func (s *SalmonDistributor) isRegistrationProxy(r core.Resource) bool {
+
+	regCfg := s.cfg.Distributors.Salmon.Registration
+	if regCfg.Admission == "" {
+		return false
+	}
+	return int(r.Uid()%100) < regCfg.PoolShare
 }
 
 // Init initialises the given Salmon distributor.
 func (s *SalmonDistributor) Init(cfg *internal.Config) {
 	log.Printf("Initialising %s distributor.", DistName)
 
-	s.addUser(UntouchableTrustLevel, nil)
+	if err := s.SetParams(cfg.Distributors.Salmon.Params); err != nil {
+		log.Fatalf("Invalid Salmon parameters: %s", err)
+	}
+
+	s.lock.Lock()
+	// We only need a new admin user if we didn't load one from disk.
+	if !s.hasAdmin() {
+		s.addUser(UntouchableTrustLevel, nil)
+	}
 	s.cfg = cfg
+	s.admission = newAdmissionControl(cfg.Distributors.Salmon.Registration)
+	s.redemption = newRedemptionLimiter(cfg.Distributors.Salmon.Redemption)
 	s.shutdown = make(chan bool)
+	s.lock.Unlock()
 
 	log.Printf("Initialising resource stream.")
-	s.ipc = mechanisms.NewHttpsIpc("http://" + cfg.Backend.WebApi.ApiAddress + cfg.Backend.ResourceStreamEndpoint)
+	ipc, err := internal.NewBackendIpc(cfg, cfg.Distributors.Salmon.Ipc, cfg.Distributors.Salmon.Tls)
+	if err != nil {
+		log.Fatalf("Failed to create IPC mechanism: %s", err)
+	}
+	s.ipc = ipc
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
@@ -173,47 +345,77 @@ func (s *SalmonDistributor) Init(cfg *internal.Config) {
 
 	s.wg.Add(1)
 	go s.housekeeping(rStream)
+}
 
-	s.tokenCacheMutex.Lock()
-	defer s.tokenCacheMutex.Unlock()
-	err := internal.Deserialise(cfg.Distributors.Salmon.WorkingDir+TokenCacheFile, &s.TokenCache)
+// SetParams replaces the distributor's parameters with the given ones, which
+// may happen while the distributor is running.  Our users' trust levels and
+// ban states then follow the new parameters: We demote users whose trust level
+// exceeds the new maximum, and ban or unban users depending on the new
+// suspicion threshold.  Users that an operator banned remain banned.
+func (s *SalmonDistributor) SetParams(cfg internal.SalmonParamsConfig) error {
+
+	params, err := NewParams(cfg)
 	if err != nil {
-		log.Printf("Warning: Failed to deserialise token cache: %s", err)
+		return err
 	}
-}
 
-// Shutdown shuts down the given Salmon distributor.
-func (s *SalmonDistributor) Shutdown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.params = params
 
-	// Write our token cache to disk so it can persist across restarts.
-	s.tokenCacheMutex.Lock()
-	defer s.tokenCacheMutex.Unlock()
-	err := internal.Serialise(s.cfg.Distributors.Salmon.WorkingDir+TokenCacheFile, s.TokenCache)
-	if err != nil {
-		log.Printf("Warning: Failed to serialise token cache: %s", err)
+	for _, u := range s.Users {
+		if u.Trust != UntouchableTrustLevel && u.Trust > params.MaxTrustLevel {
+			log.Printf("Demoting user %q from trust level %d to %d.", u.SecretId, u.Trust, params.MaxTrustLevel)
+			u.Trust = params.MaxTrustLevel
+		}
+		banned := u.BannedByAdmin || u.Suspicion() >= params.MaxSuspicion
+		if banned != u.Banned {
+			log.Printf("Changing ban state of user %q with suspicion %.2f to %t.", u.SecretId, u.Suspicion(), banned)
+			u.Banned = banned
+		}
+	}
+	for _, proxies := range s.AssignedProxies {
+		for _, proxy := range proxies {
+			if p := proxy.(*Proxy); p.Trust != UntouchableTrustLevel && p.Trust > params.MaxTrustLevel {
+				p.Trust = params.MaxTrustLevel
+			}
+		}
 	}
 
-	// Signal to housekeeping that it's time to stop.
+	return nil
+}
+
+// Shutdown shuts down the given Salmon distributor.  Our persistence
+// mechanism saves our state, including our token cache, afterwards.
+func (s *SalmonDistributor) Shutdown() {
+
+	// Signal to housekeeping that it's time to stop.  Housekeeping may be
+	// waiting for our lock, so we must not hold it yet.
 	close(s.shutdown)
 	s.wg.Wait()
 }
 
-// Don't call this function directly.  Call findProxies instead.
-func (s *SalmonDistributor) findAssignedProxies(inviter *User) []core.Resource {
+// Don't call this function directly.  Call findProxies instead.  The function
+// returns up to num non-depleted proxies of the given type that are assigned
+// to the given inviter or to the inviter's invitation tree.  We skip proxies
+// that are in the given set, and add the proxies that we return to it.
+func (s *SalmonDistributor) findAssignedProxies(inviter *User, rType string, num int, skip map[*Proxy]bool) []core.Resource {
 
 	var proxies []core.Resource
 
 	// Do the given user's proxies have any free slots?
-	inviterProxies := s.Assignments.GetProxies(inviter)
+	inviterProxies := s.Assignments.GetProxies(inviter, rType)
 	if len(inviterProxies) == 0 {
-		log.Printf("Inviter %q has no assigned proxies.", inviter.SecretId)
+		log.Printf("Inviter %q has no assigned %s proxies.", inviter.SecretId, rType)
 	}
 	for _, proxy := range inviterProxies {
-		if proxy.(*Proxy).IsDepleted(s.Assignments) {
+		p := proxy.(*Proxy)
+		if skip[p] || p.IsDepleted(s.Assignments, s.params) {
 			continue
 		}
+		skip[p] = true
 		proxies = append(proxies, proxy)
-		if len(proxies) >= NumProxiesPerUser {
+		if len(proxies) >= num {
 			return proxies
 		}
 	}
@@ -221,42 +423,72 @@ func (s *SalmonDistributor) findAssignedProxies(inviter *User) []core.Resource {
 	// If we don't have enough proxies yet, we are going to recursively
 	// traverse invitation tree to find already-assigned, non-depleted proxies.
 	for _, invitee := range inviter.Invited {
-		ps := s.findAssignedProxies(invitee)
+		ps := s.findAssignedProxies(invitee, rType, num-len(proxies), skip)
 		proxies = append(proxies, ps...)
-		if len(proxies) >= NumProxiesPerUser {
-			return proxies[:NumProxiesPerUser]
+		if len(proxies) >= num {
+			return proxies
 		}
 	}
 
 	return proxies
 }
 
-func (s *SalmonDistributor) findProxies(invitee *User, rType string) []core.Resource {
+// findProxies finds up to num new proxies of the given type for the given user
+// and assigns them to the user.  We prefer non-depleted proxies that are
+// already assigned to the user's invitation tree, and fall back to unassigned
+// proxies.
+func (s *SalmonDistributor) findProxies(invitee *User, rType string, num int) []core.Resource {
 
-	if invitee == nil {
+	if invitee == nil || num <= 0 {
 		return nil
 	}
 
+	// The user's new proxies must not include the ones that the user already
+	// has, ones that may be blocked where the user is, or ones whose trust
+	// level exceeds the user's.
+	skip := make(map[*Proxy]bool)
+	for _, p := range s.Assignments.GetProxies(invitee, rType) {
+		skip[p.(*Proxy)] = true
+	}
+	for _, p := range s.AssignedProxies[rType] {
+		if !p.(*Proxy).AssignableTo(invitee) {
+			skip[p.(*Proxy)] = true
+		}
+	}
+
 	var proxies []core.Resource
 	// People who registered and admin friends don't have an inviter.
 	if invitee.InvitedBy != nil {
-		proxies := s.findAssignedProxies(invitee.InvitedBy)
-		if len(proxies) == NumProxiesPerUser {
+		proxies = s.findAssignedProxies(invitee.InvitedBy, rType, num, skip)
+		// Remember what proxies we shared with the invitee, so we return the
+		// same proxies next time.
+		for _, p := range proxies {
+			s.Assignments.Add(invitee, p.(*Proxy))
+		}
+		if len(proxies) == num {
 			log.Printf("Returning %d proxies to user.", len(proxies))
 			return proxies
 		}
 	}
 
 	// Take some of our unassigned proxies and allocate them for the given user
-	// graph, T(u).
-	numRemaining := NumProxiesPerUser - len(proxies)
-	if len(s.UnassignedProxies[rType]) < numRemaining {
-		numRemaining = len(s.UnassignedProxies[rType])
+	// graph, T(u).  Users whose invitation tree started with a registration
+	// only get proxies from the pool that we set aside for them.
+	pool := s.UnassignedProxies
+	if invitee.InRegisteredTree() {
+		pool = s.RegistrationProxies
 	}
-	newProxies := s.UnassignedProxies[rType][:numRemaining]
-	s.UnassignedProxies[rType] = s.UnassignedProxies[rType][numRemaining:]
+	var newProxies, rest core.ResourceQueue
+	for _, p := range pool[rType] {
+		if len(proxies)+len(newProxies) < num && p.(*Proxy).AssignableTo(invitee) {
+			newProxies = append(newProxies, p)
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	pool[rType] = rest
 	log.Printf("Not enough assigned proxies; allocated %d unassigned proxies, %d remaining",
-		len(newProxies), len(s.UnassignedProxies))
+		len(newProxies), len(pool[rType]))
 
 	for _, p := range newProxies {
 		s.AssignedProxies[rType] = append(s.AssignedProxies[rType], p)
@@ -267,8 +499,84 @@ func (s *SalmonDistributor) findProxies(invitee *User, rType string) []core.Reso
 	return proxies
 }
 
-// GetProxies attempts to return proxies for the given user.
+// retireProxy removes the given proxy from our assigned proxies and from our
+// assignments, e.g. because it's gone.  Its users get replacements, unless
+// they are banned.
+func (s *SalmonDistributor) retireProxy(p *Proxy, rType string) {
+
+	users := s.Assignments.GetUsers(p)
+	s.Assignments.RemoveProxy(p)
+	q := s.AssignedProxies[rType]
+	q.Delete(p)
+	s.AssignedProxies[rType] = q
+	s.compensate(users, rType)
+}
+
+// withdrawProxy takes the given proxy away from the given users, e.g. because
+// it got blocked where they are, and gives them replacements, unless they are
+// banned.  The proxy's other users keep it.  Once nobody uses the proxy
+// anymore, we return it to its pool, so we can hand it out to users in places
+// where it isn't blocked.
+func (s *SalmonDistributor) withdrawProxy(p *Proxy, rType string, users []*User) {
+
+	for _, u := range users {
+		s.Assignments.Remove(u, p)
+	}
+	if len(s.Assignments.GetUsers(p)) == 0 {
+		q := s.AssignedProxies[rType]
+		q.Delete(p)
+		s.AssignedProxies[rType] = q
+		if s.isRegistrationProxy(p) {
+			s.RegistrationProxies[rType] = append(s.RegistrationProxies[rType], p)
+		} else {
+			s.UnassignedProxies[rType] = append(s.UnassignedProxies[rType], p)
+		}
+	}
+	s.compensate(users, rType)
+}
+
+// compensate gives the given users a replacement for a proxy of the given
+// type that we took away from them, unless they are banned.
+func (s *SalmonDistributor) compensate(users []*User, rType string) {
+
+	now := time.Now().UTC()
+	for _, u := range users {
+		if u.Banned {
+			continue
+		}
+		if u.PendingReplacements == nil {
+			u.PendingReplacements = make(map[string]int)
+		}
+		u.PendingReplacements[rType]++
+		s.replaceProxies(u, rType, now)
+	}
+}
+
+// replaceProxies gives the given user new proxies of the given type for the
+// ones that we took away, as far as the user's replacement budget allows.
+// Replacements that the budget doesn't allow remain pending.
+func (s *SalmonDistributor) replaceProxies(u *User, rType string, now time.Time) {
+
+	num := u.PendingReplacements[rType]
+	if budget := u.ReplacementBudget(now, s.params); budget < num {
+		log.Printf("User %q has %d pending replacements but a budget of only %d.", u.SecretId, num, budget)
+		num = budget
+	}
+	proxies := s.findProxies(u, rType, num)
+	for range proxies {
+		u.ReplacedAt = append(u.ReplacedAt, now)
+	}
+	u.PendingReplacements[rType] -= len(proxies)
+	if u.PendingReplacements[rType] <= 0 {
+		delete(u.PendingReplacements, rType)
+	}
+}
+
+// GetProxies attempts to return proxies of the given type for the given user.
+// Users get proxies of each type independently.
 func (s *SalmonDistributor) GetProxies(secretId string, rType string) ([]core.Resource, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	user, exists := s.Users[secretId]
 	if !exists {
@@ -294,13 +602,16 @@ func (s *SalmonDistributor) GetProxies(secretId string, rType string) ([]core.Re
 		return nil, errors.New("user is blocked and therefore unable to get proxies")
 	}
 
-	// Does the user already have assigned proxies?
-	userProxies := s.Assignments.GetProxies(user)
-	if len(userProxies) > 0 {
-		return userProxies, nil
+	// Replace proxies that we took away from the user.  Users whose proxies
+	// were all taken away must not get around their replacement budget, so
+	// we only hand out a full set of proxies if nothing is pending.
+	if user.PendingReplacements[rType] > 0 {
+		s.replaceProxies(user, rType, time.Now().UTC())
+	} else if len(s.Assignments.GetProxies(user, rType)) == 0 {
+		s.findProxies(user, rType, s.params.ProxiesPerUser(rType))
 	}
 
-	return s.findProxies(user, rType), nil
+	return s.Assignments.GetProxies(user, rType), nil
 }
 
 // housekeeping keeps track of periodic tasks.
@@ -320,33 +631,40 @@ func (s *SalmonDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 			log.Printf("Shutting down housekeeping.")
 			return
 		case <-ticker.C:
-			// Iterate over all users and proxies and update their trust levels if
-			// necessary.
-			log.Printf("Updating trust levels of %d users.", len(s.Users))
-			for _, user := range s.Users {
-				user.UpdateTrust()
-			}
-			log.Printf("Updating trust levels of %d proxies.", len(s.AssignedProxies))
-			for _, proxies := range s.AssignedProxies {
-				for _, proxy := range proxies {
-					proxy.(*Proxy).UpdateTrust(s.Assignments)
-				}
-			}
+			s.updateTrustLevels()
 			log.Printf("Pruning token cache.")
 			s.pruneTokenCache()
 		}
 	}
 }
 
-// pruneTokenCache removes expired tokens from our token cache.
-func (s *SalmonDistributor) pruneTokenCache() {
+// updateTrustLevels iterates over all users and proxies and updates their
+// trust levels if necessary.  The function acquires our lock.
+func (s *SalmonDistributor) updateTrustLevels() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	log.Printf("Updating trust levels of %d users.", len(s.Users))
+	for _, user := range s.Users {
+		user.UpdateTrust(s.params)
+	}
+	log.Printf("Updating trust levels of %d proxies.", len(s.AssignedProxies))
+	for _, proxies := range s.AssignedProxies {
+		for _, proxy := range proxies {
+			proxy.(*Proxy).UpdateTrust(s.Assignments, s.params)
+		}
+	}
+}
 
-	s.tokenCacheMutex.Lock()
-	defer s.tokenCacheMutex.Unlock()
+// pruneTokenCache removes expired tokens from our token cache.  The function
+// acquires our lock.
+func (s *SalmonDistributor) pruneTokenCache() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	prevLen := len(s.TokenCache)
 	for token, metaInfo := range s.TokenCache {
-		if time.Since(metaInfo.IssueTime) > InvitationTokenExpiry {
+		if time.Since(metaInfo.IssueTime) > s.params.InvitationTokenExpiry {
 			// Time to delete the token.
 			log.Printf("Deleting expired token %q issued by user %q.", token, metaInfo.SecretInviterId)
 			delete(s.TokenCache, token)
@@ -355,9 +673,33 @@ func (s *SalmonDistributor) pruneTokenCache() {
 	log.Printf("Pruned token cache from %d to %d entries.", prevLen, len(s.TokenCache))
 }
 
+// addToken creates a new invitation token and adds it to our token cache,
+// where it remains until it's redeemed or until it expires.
+func (s *SalmonDistributor) addToken(metaInfo *TokenMetaInfo) (string, error) {
+
+	for {
+		token, err := internal.GetRandBase32(InvitationTokenLength)
+		if err != nil {
+			return "", err
+		}
+
+		if _, exists := s.TokenCache[token]; !exists {
+			s.TokenCache[token] = metaInfo
+			return token, nil
+		}
+		// In the highly unlikely case of a token collision, we simply try
+		// again.
+		log.Printf("Newly created token already exists.  Trying again.")
+	}
+}
+
 // CreateInvite returns an invitation token if the given user is allowed to
-// issue invites, and an error otherwise.
+// issue invites, and an error otherwise.  Users may only issue as many invites
+// as their trust level's quota allows, and only if their invitees wouldn't
+// exceed our maximum invite depth.
 func (s *SalmonDistributor) CreateInvite(secretId string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	u, exists := s.Users[secretId]
 	if !exists {
@@ -368,73 +710,154 @@ func (s *SalmonDistributor) CreateInvite(secretId string) (string, error) {
 		return "", errors.New("user is blocked and therefore unable to issue invites")
 	}
 
-	if u.Trust < MaxTrustLevel {
+	if s.params.InviteQuota(u.Trust) == 0 {
 		return "", errors.New("user's trust level not high enough to issue invites")
 	}
 
-	s.tokenCacheMutex.Lock()
-	defer s.tokenCacheMutex.Unlock()
+	if u.InviteDepth() >= s.params.MaxInviteDepth {
+		return "", ErrInviteDepthExceeded
+	}
 
-	var token string
-	var err error
-	for {
-		token, err = internal.GetRandBase32(InvitationTokenLength)
-		if err != nil {
-			return "", err
-		}
+	now := time.Now().UTC()
+	if u.InviteBudget(now, s.params) == 0 {
+		u.RecordLimitHit(now, s.params)
+		return "", ErrInviteQuotaExhausted
+	}
 
-		if _, exists := s.TokenCache[token]; !exists {
-			break
-		} else {
-			// In the highly unlikely case of a token collision, we simply try
-			// again.
-			log.Printf("Newly created token already exists.  Trying again.")
-		}
+	token, err := s.addToken(&TokenMetaInfo{SecretInviterId: secretId, IssueTime: now})
+	if err != nil {
+		return "", err
 	}
+	u.InvitedAt = append(u.InvitedAt, now)
 	log.Printf("User %q issued new invite token %q.", u.SecretId, token)
 
-	// Add token to our token cache, where it remains until it's redeemed or
-	// until it expires.
-	s.TokenCache[token] = &TokenMetaInfo{secretId, time.Now().UTC()}
-
 	return token, nil
 }
 
 // RedeemInvite redeems the given token.  If redemption was successful, the
 // function returns the new user's secret ID; otherwise an error.
 func (s *SalmonDistributor) RedeemInvite(token string) (string, error) {
-
-	s.tokenCacheMutex.Lock()
-	defer s.tokenCacheMutex.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	metaInfo, exists := s.TokenCache[token]
 	if !exists {
 		return "", errors.New("invite token does not exist")
 	}
-	// Remove token from our token cache.
-	delete(s.TokenCache, token)
-
 	// Is our token still valid?
-	if time.Since(metaInfo.IssueTime) > InvitationTokenExpiry {
+	if time.Since(metaInfo.IssueTime) > s.params.InvitationTokenExpiry {
+		delete(s.TokenCache, token)
 		return "", errors.New("invite token already expired")
 	}
 
+	// Tokens that an operator issued turn their redeemer into an admin user.
+	if metaInfo.Admin {
+		u, err := s.addUser(UntouchableTrustLevel, nil)
+		if err != nil {
+			return "", err
+		}
+		delete(s.TokenCache, token)
+		log.Printf("User %q redeemed an admin invite.", u.SecretId)
+		return u.SecretId, nil
+	}
+
 	inviter, exists := s.Users[metaInfo.SecretInviterId]
 	if !exists {
 		log.Printf("Bug: could not find valid user for invite token.")
 		return "", errors.New("invite token came from non-existing user (this is a bug)")
 	}
+	// Our maximum invite depth may have changed since the token was issued.
+	// We keep the token, which becomes redeemable again if the operator
+	// raises the maximum invite depth.
+	if inviter.InviteDepth() >= s.params.MaxInviteDepth {
+		return "", ErrInviteDepthExceeded
+	}
 
-	u, err := s.addUser(inviter.Trust-1, inviter)
+	// Users invited by us start at the maximum trust level.
+	trust := inviter.Trust - 1
+	if trust > s.params.MaxTrustLevel {
+		trust = s.params.MaxTrustLevel
+	}
+	u, err := s.addUser(trust, inviter)
 	if err != nil {
 		return "", err
 	}
+	delete(s.TokenCache, token)
 
 	return u.SecretId, nil
 }
 
-// Register lets a user sign up for Salmon.
-func (s *SalmonDistributor) Register() (string, error) {
+// AllowRedemption returns true if the client with the given IP address may
+// attempt to redeem an invite token.  If not, it also returns how long the
+// client should wait before trying again.
+func (s *SalmonDistributor) AllowRedemption(clientAddr string) (bool, time.Duration) {
+	return s.redemption.allow(clientAddr, time.Now().UTC())
+}
+
+// SetLocation sets the location of the given user to the given country code,
+// e.g. "RU".  Users cannot change their location once we know it, so an agent
+// cannot move away from the blocking events that it causes.
+func (s *SalmonDistributor) SetLocation(secretId, countryCode string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, exists := s.Users[secretId]
+	if !exists {
+		return errors.New("user ID does not exists")
+	}
+	if !IsCountryCode(countryCode) {
+		return fmt.Errorf("invalid country code %q", countryCode)
+	}
+	if u.Location != "" {
+		return errors.New("user's location is already known")
+	}
+	u.Location = strings.ToUpper(countryCode)
+	log.Printf("Set location of user %q to %s.", u.SecretId, u.Location)
+
+	return nil
+}
+
+// IsCountryCode returns true if the given string looks like an ISO 3166-1
+// alpha-2 country code.
+func IsCountryCode(countryCode string) bool {
+
+	if len(countryCode) != 2 {
+		return false
+	}
+	for _, c := range countryCode {
+		if !unicode.IsLetter(c) || c > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// NewChallenge returns a challenge that a user has to solve before they can
+// register.
+func (s *SalmonDistributor) NewChallenge() (*Challenge, error) {
+
+	return s.admission.newChallenge(time.Now().UTC())
+}
 
-	return "", errors.New("registration not yet implemented")
+// Register lets a user sign up for Salmon, provided that the given solution
+// solves the given challenge.  If registration was successful, the function
+// returns the new user's secret ID; otherwise an error.  Registered users
+// start at RegisteredTrustLevel and have no inviter.
+func (s *SalmonDistributor) Register(challengeId, solution string) (string, error) {
+
+	if err := s.admission.admit(challengeId, solution, time.Now().UTC()); err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, err := s.addUser(RegisteredTrustLevel, nil)
+	if err != nil {
+		return "", err
+	}
+	u.Registered = true
+	log.Printf("User %q registered.", u.SecretId)
+
+	return u.SecretId, nil
 }
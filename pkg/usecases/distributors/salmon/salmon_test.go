@@ -5,9 +5,11 @@ import (
 	"math/rand"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
@@ -31,7 +33,7 @@ func TestTokenCache(t *testing.T) {
 		t.Errorf("user should not yet be allowed to issue invites")
 	}
 
-	u.Trust = MaxTrustLevel
+	u.Trust = DefaultMaxTrustLevel
 	token, err := salmon.CreateInvite(u.SecretId)
 	if err != nil {
 		t.Errorf("failed to create invite token: %s", err)
@@ -76,7 +78,7 @@ func TestTokenCache(t *testing.T) {
 	}
 	metaInfo, _ := salmon.TokenCache[token]
 	now := time.Now().UTC()
-	metaInfo.IssueTime = now.Add(-InvitationTokenExpiry - time.Minute)
+	metaInfo.IssueTime = now.Add(-DefaultInvitationTokenExpiry - time.Minute)
 
 	// An expired token must not be redeemable.
 	_, err = salmon.RedeemInvite(token)
@@ -87,8 +89,8 @@ func TestTokenCache(t *testing.T) {
 
 func TestPruneTokenCache(t *testing.T) {
 	salmon := NewSalmonDistributor()
-	expiredTime := time.Now().UTC().Add(-InvitationTokenExpiry - time.Minute)
-	salmon.TokenCache["DummyToken"] = &TokenMetaInfo{"foo", expiredTime}
+	expiredTime := time.Now().UTC().Add(-DefaultInvitationTokenExpiry - time.Minute)
+	salmon.TokenCache["DummyToken"] = &TokenMetaInfo{SecretInviterId: "foo", IssueTime: expiredTime}
 	if len(salmon.TokenCache) != 1 {
 		t.Errorf("failed to add expired token to cache")
 	}
@@ -114,9 +116,9 @@ func TestProcessDiff(t *testing.T) {
 
 	diff := core.NewResourceDiff()
 	// Create a new copy of the proxy and mark it as blocked.
-	pNew := &Proxy{Resource: resources.NewTransport()}
-	pNew.SetBlockedIn(core.LocationSet{"no": true})
-	diff.Changed = core.ResourceMap{resources.ResourceTypeObfs4: core.ResourceQueue{pNew}}
+	rNew := resources.NewTransport()
+	rNew.SetBlockedIn(core.LocationSet{"no": true})
+	diff.Changed = core.ResourceMap{resources.ResourceTypeObfs4: core.ResourceQueue{rNew}}
 	salmon.processDiff(diff)
 
 	// User should now have a blocking event.
@@ -130,9 +132,22 @@ func TestProcessDiff(t *testing.T) {
 }
 
 // genResourceMap generates a resource map consisting of the given number of
-// obfs4 bridges.
+// obfs4 proxies.
 func genResourceMap(num int) core.ResourceMap {
 
+	rm := genTransportMap(num)
+	for _, rQueue := range rm {
+		for i, r := range rQueue {
+			rQueue[i] = &Proxy{Resource: r}
+		}
+	}
+	return rm
+}
+
+// genTransportMap generates a resource map consisting of the given number of
+// obfs4 bridges, as they arrive from the backend.
+func genTransportMap(num int) core.ResourceMap {
+
 	rm := make(core.ResourceMap)
 	q := core.ResourceQueue{}
 
@@ -152,7 +167,7 @@ func genResourceMap(num int) core.ResourceMap {
 		r.Parameters["iat-mode"] = "0"
 		// No need to have "real-looking" certificates here.
 		r.Parameters["cert"] = "foo"
-		q.Enqueue(&Proxy{Resource: r})
+		q.Enqueue(r)
 	}
 	rm[resources.ResourceTypeObfs4] = q
 
@@ -188,3 +203,561 @@ func TestUserFlow(t *testing.T) {
 		t.Fatalf("Got no proxies.")
 	}
 }
+
+func TestRegister(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	if _, err := salmon.NewChallenge(); err != ErrRegistrationDisabled {
+		t.Errorf("expected registration to be disabled by default")
+	}
+
+	regCfg := &salmon.cfg.Distributors.Salmon.Registration
+	regCfg.Admission = internal.AdmissionPow
+	regCfg.PowDifficulty = 4
+	regCfg.PerDay = 10
+	regCfg.PoolShare = 50
+	salmon.admission = newAdmissionControl(*regCfg)
+
+	// New proxies are split between our two pools.
+	diff := core.NewResourceDiff()
+	diff.New = genTransportMap(100)
+	salmon.processDiff(diff)
+	numReg := len(salmon.RegistrationProxies[resources.ResourceTypeObfs4])
+	numUnassigned := len(salmon.UnassignedProxies[resources.ResourceTypeObfs4])
+	if numReg == 0 || numUnassigned == 0 || numReg+numUnassigned != 100 {
+		t.Fatalf("expected 100 proxies split between pools but got %d and %d", numReg, numUnassigned)
+	}
+	unassigned := make(map[core.Hashkey]bool)
+	for _, r := range salmon.UnassignedProxies[resources.ResourceTypeObfs4] {
+		unassigned[r.Uid()] = true
+	}
+
+	c, err := salmon.NewChallenge()
+	if err != nil {
+		t.Fatalf("failed to create challenge: %s", err)
+	}
+	wrong := "wrong"
+	for leadingZeroBits(powDigest(c.Id, wrong)) >= c.Difficulty {
+		wrong += "x"
+	}
+	if _, err := salmon.Register(c.Id, wrong); err == nil {
+		t.Errorf("registered user despite wrong solution")
+	}
+	c, _ = salmon.NewChallenge()
+	secretId, err := salmon.Register(c.Id, solvePow(c))
+	if err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	u := salmon.Users[secretId]
+	if u.Trust != RegisteredTrustLevel || !u.Registered {
+		t.Errorf("expected registered user at trust level %d but got %+v", RegisteredTrustLevel, u)
+	}
+
+	// Registered users only get proxies from the registration pool.
+	proxies, err := salmon.GetProxies(secretId, resources.ResourceTypeObfs4)
+	if err != nil {
+		t.Fatalf("failed to get proxies: %s", err)
+	}
+	if len(proxies) != DefaultProxiesPerUser {
+		t.Fatalf("expected %d proxies but got %d", DefaultProxiesPerUser, len(proxies))
+	}
+	for _, p := range proxies {
+		if unassigned[p.Uid()] {
+			t.Errorf("registered user got proxy from pool for invited users")
+		}
+	}
+	if n := len(salmon.UnassignedProxies[resources.ResourceTypeObfs4]); n != numUnassigned {
+		t.Errorf("pool for invited users shrank from %d to %d", numUnassigned, n)
+	}
+
+	// The same holds for users that a registered user invited.
+	u.Trust = DefaultMaxTrustLevel
+	token, _ := salmon.CreateInvite(secretId)
+	inviteeId, _ := salmon.RedeemInvite(token)
+	if !salmon.Users[inviteeId].InRegisteredTree() {
+		t.Errorf("invitee of registered user is not in registered tree")
+	}
+}
+
+// TestConcurrentAccess hammers Salmon with registrations, invites, and proxy
+// requests while we stream resource diffs into it.  Run it with -race.
+func TestConcurrentAccess(t *testing.T) {
+
+	const numWorkers = 8
+	const numRounds = 20
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	regCfg := &salmon.cfg.Distributors.Salmon.Registration
+	regCfg.Admission = internal.AdmissionPow
+	regCfg.PowDifficulty = 1
+	regCfg.PerDay = numWorkers * numRounds
+	regCfg.PoolShare = 20
+	salmon.admission = newAdmissionControl(*regCfg)
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numWorkers*numRounds)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var gone core.ResourceQueue
+		for i := 0; i < numRounds; i++ {
+			// Our resource stream hands us raw resources, which
+			// processDiff turns into proxies.
+			diff := core.NewResourceDiff()
+			diff.New = genTransportMap(10)
+			// Let some of our earlier proxies disappear again.
+			if len(gone) > 0 {
+				diff.Gone = core.ResourceMap{resources.ResourceTypeObfs4: gone}
+			}
+			gone = core.ResourceQueue{diff.New[resources.ResourceTypeObfs4][0]}
+			salmon.processDiff(diff)
+			salmon.updateTrustLevels()
+		}
+	}()
+
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numRounds; j++ {
+				token, err := salmon.CreateInvite(admin.SecretId)
+				if err != nil {
+					errs <- err
+					return
+				}
+				secretId, err := salmon.RedeemInvite(token)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if j%2 == 0 {
+					c, err := salmon.NewChallenge()
+					if err != nil {
+						errs <- err
+						return
+					}
+					if secretId, err = salmon.Register(c.Id, solvePow(c)); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if _, err := salmon.GetProxies(secretId, resources.ResourceTypeObfs4); err != nil {
+					errs <- err
+					return
+				}
+				_ = salmon.String()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent access failed: %s", err)
+	}
+
+	// No proxy may exceed its capacity.
+	salmon.lock.Lock()
+	defer salmon.lock.Unlock()
+	for p, users := range salmon.Assignments.ProxyToUser {
+		if len(users.Set) > DefaultMaxClients {
+			t.Errorf("proxy %q has %d users, exceeding capacity of %d", p, len(users.Set), DefaultMaxClients)
+		}
+	}
+	// Each proxy wraps exactly one of the backend's resources.
+	for _, m := range []core.ResourceMap{salmon.AssignedProxies, salmon.UnassignedProxies, salmon.RegistrationProxies} {
+		for _, r := range m[resources.ResourceTypeObfs4] {
+			if _, ok := r.(*Proxy).Resource.(*resources.Transport); !ok {
+				t.Errorf("expected proxy to wrap a transport but got %T", r.(*Proxy).Resource)
+			}
+		}
+	}
+}
+
+// blockedCopy returns a copy of the given proxy's transport that is blocked in
+// the given locations.
+func blockedCopy(p core.Resource, locations ...string) core.Resource {
+
+	t := *p.(*Proxy).Resource.(*resources.Transport)
+	t.RBlockedIn = make(core.LocationSet)
+	for _, location := range locations {
+		t.RBlockedIn[location] = true
+	}
+	return &t
+}
+
+func TestProxyReplacement(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	salmon.UnassignedProxies = genResourceMap(20)
+	maxReplacements := 1
+	if err := salmon.SetParams(internal.SalmonParamsConfig{
+		MaxSuspicion:    0.5,
+		MaxReplacements: &maxReplacements,
+		InviteQuotas:    []int{0, 0, 0, 0, 0, 0, 4},
+	}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+
+	// Our friend and four invitees share the same three proxies.
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	friendId, _ := salmon.RedeemInvite(token)
+	users := []string{friendId}
+	for i := 0; i < 4; i++ {
+		token, _ := salmon.CreateInvite(friendId)
+		secretId, _ := salmon.RedeemInvite(token)
+		users = append(users, secretId)
+	}
+	for _, secretId := range users {
+		if proxies := proxyStrings(t, salmon, secretId); len(proxies) != DefaultProxiesPerUser {
+			t.Fatalf("expected %d proxies but got %d", DefaultProxiesPerUser, len(proxies))
+		}
+	}
+
+	block := func() core.Resource {
+		blocked := salmon.Assignments.GetProxies(salmon.Users[friendId], resources.ResourceTypeObfs4)[0]
+		diff := core.NewResourceDiff()
+		diff.Changed = core.ResourceMap{resources.ResourceTypeObfs4: core.ResourceQueue{
+			blockedCopy(blocked, "ru"),
+		}}
+		salmon.processDiff(diff)
+		return blocked
+	}
+
+	// Once a proxy is blocked, its users get a replacement.
+	blocked := block()
+	assigned := salmon.AssignedProxies[resources.ResourceTypeObfs4]
+	if _, err := assigned.Search(blocked.Uid()); err == nil {
+		t.Errorf("blocked proxy is still assigned")
+	}
+	for _, secretId := range users {
+		u := salmon.Users[secretId]
+		if u.Banned {
+			t.Fatalf("banned user despite low suspicion %.2f", u.Suspicion())
+		}
+		proxies := proxyStrings(t, salmon, secretId)
+		if len(proxies) != DefaultProxiesPerUser {
+			t.Errorf("expected %d proxies after replacement but got %d", DefaultProxiesPerUser, len(proxies))
+		}
+		for _, p := range proxies {
+			if p == blocked.String() {
+				t.Errorf("user still has blocked proxy")
+			}
+		}
+	}
+
+	// Our users exhausted their replacement budget, so the next blocked proxy
+	// remains unreplaced for now.
+	block()
+	friend := salmon.Users[friendId]
+	if n := len(proxyStrings(t, salmon, friendId)); n != DefaultProxiesPerUser-1 {
+		t.Errorf("expected %d proxies without budget but got %d", DefaultProxiesPerUser-1, n)
+	}
+	if friend.PendingReplacements[resources.ResourceTypeObfs4] != 1 {
+		t.Errorf("expected one pending replacement but got %v", friend.PendingReplacements)
+	}
+
+	// Once the replacement window has passed, we replace the proxy.
+	friend.ReplacedAt[0] = time.Now().UTC().Add(-DefaultReplacementWindow)
+	if n := len(proxyStrings(t, salmon, friendId)); n != DefaultProxiesPerUser {
+		t.Errorf("expected %d proxies after budget refill but got %d", DefaultProxiesPerUser, n)
+	}
+	if len(friend.PendingReplacements) != 0 {
+		t.Errorf("expected no pending replacements but got %v", friend.PendingReplacements)
+	}
+}
+
+func TestPerLocationBlocking(t *testing.T) {
+
+	rType := resources.ResourceTypeObfs4
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{rType}
+	salmon.UnassignedProxies = genResourceMap(20)
+	if err := salmon.SetParams(internal.SalmonParamsConfig{MaxSuspicion: 0.9}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+
+	// Our friend invites users in Russia, in Germany, and in an unknown
+	// location.  All of them share the same three proxies.
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	friendId, _ := salmon.RedeemInvite(token)
+	users := map[string]*User{}
+	for _, location := range []string{"ru", "RU", "DE", ""} {
+		secretId := friendId
+		if location != "ru" {
+			token, _ := salmon.CreateInvite(friendId)
+			secretId, _ = salmon.RedeemInvite(token)
+		}
+		if location != "" {
+			if err := salmon.SetLocation(secretId, location); err != nil {
+				t.Fatalf("failed to set location: %s", err)
+			}
+		}
+		users[location] = salmon.Users[secretId]
+		proxyStrings(t, salmon, secretId)
+	}
+	if users["ru"].Location != "RU" {
+		t.Errorf("expected normalised location but got %q", users["ru"].Location)
+	}
+	if err := salmon.SetLocation(users["DE"].SecretId, "FR"); err == nil {
+		t.Errorf("let user change their location")
+	}
+	if err := salmon.SetLocation(users[""].SecretId, "Russia"); err == nil {
+		t.Errorf("accepted invalid country code")
+	}
+
+	hasProxy := func(u *User, p core.Resource) bool {
+		for _, proxy := range salmon.Assignments.GetProxies(u, rType) {
+			if proxy == p {
+				return true
+			}
+		}
+		return false
+	}
+	block := func(p core.Resource, locations ...string) {
+		diff := core.NewResourceDiff()
+		diff.Changed = core.ResourceMap{rType: core.ResourceQueue{blockedCopy(p, locations...)}}
+		salmon.processDiff(diff)
+	}
+
+	// A block in Russia only counts against our Russian users and the user
+	// whose location we don't know.
+	blocked := salmon.Assignments.GetProxies(users["DE"], rType)[0]
+	block(blocked, "RU (1234)")
+	for location, u := range users {
+		affected := location != "DE"
+		if affected != (len(u.InnocencePs) == 1) {
+			t.Errorf("expected blocking event to count against user in %q: %t", location, affected)
+		}
+		if affected == hasProxy(u, blocked) {
+			t.Errorf("expected user in %q to keep blocked proxy: %t", location, !affected)
+		}
+		if n := len(salmon.Assignments.GetProxies(u, rType)); n != DefaultProxiesPerUser {
+			t.Errorf("expected %d proxies for user in %q but got %d", DefaultProxiesPerUser, location, n)
+		}
+	}
+	if p := users["RU"].InnocencePs[0]; p != 2.0/3.0 {
+		t.Errorf("expected innocence of 2/3 but got %.2f", p)
+	}
+
+	// Once the proxy is blocked in Germany too, nobody uses it anymore, and we
+	// return it to our unassigned proxies.
+	block(blocked, "RU (1234)", "DE")
+	if hasProxy(users["DE"], blocked) {
+		t.Errorf("user in Germany kept proxy that is blocked in Germany")
+	}
+	q := salmon.UnassignedProxies[rType]
+	if _, err := q.Search(blocked.Uid()); err != nil {
+		t.Fatalf("blocked proxy didn't return to unassigned proxies")
+	}
+
+	// We hand out the proxy to users elsewhere, but not in Russia.
+	q.Delete(blocked)
+	salmon.UnassignedProxies[rType] = append(core.ResourceQueue{blocked}, q...)
+	russian, _ := salmon.addUser(0, nil)
+	russian.Location = "RU"
+	if proxyStrings(t, salmon, russian.SecretId); hasProxy(russian, blocked) {
+		t.Errorf("handed out proxy to user where it is blocked")
+	}
+	french, _ := salmon.addUser(0, nil)
+	french.Location = "FR"
+	if proxyStrings(t, salmon, french.SecretId); !hasProxy(french, blocked) {
+		t.Errorf("failed to hand out proxy to user where it isn't blocked")
+	}
+}
+
+func TestProxyTrustTiers(t *testing.T) {
+
+	rType := resources.ResourceTypeObfs4
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{rType}
+	salmon.UnassignedProxies = genResourceMap(20)
+
+	// Our friend's proxies get promoted along with our friend.
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	friendId, _ := salmon.RedeemInvite(token)
+	proxyStrings(t, salmon, friendId)
+	salmon.updateTrustLevels()
+	friendProxies := make(map[core.Resource]bool)
+	for _, p := range salmon.Assignments.GetProxies(salmon.Users[friendId], rType) {
+		if p.(*Proxy).Trust != DefaultMaxTrustLevel {
+			t.Errorf("expected proxy at trust level %d but got %d", DefaultMaxTrustLevel, p.(*Proxy).Trust)
+		}
+		friendProxies[p] = true
+	}
+
+	// Our friend's fresh invitees must not learn about our friend's
+	// high-trust proxies.
+	for i := 0; i < 3; i++ {
+		token, _ := salmon.CreateInvite(friendId)
+		inviteeId, _ := salmon.RedeemInvite(token)
+		invitee := salmon.Users[inviteeId]
+		proxies := proxyStrings(t, salmon, inviteeId)
+		if len(proxies) != DefaultProxiesPerUser {
+			t.Fatalf("expected %d proxies but got %d", DefaultProxiesPerUser, len(proxies))
+		}
+		for _, p := range salmon.Assignments.GetProxies(invitee, rType) {
+			if friendProxies[p] {
+				t.Errorf("exposed high-trust proxy to fresh invitee")
+			}
+			if p.(*Proxy).Trust > invitee.Trust {
+				t.Errorf("assigned proxy at trust level %d to user at trust level %d", p.(*Proxy).Trust, invitee.Trust)
+			}
+		}
+	}
+
+	// Proxies that return to our pool keep their trust level, so we don't hand
+	// them out to users below it.
+	q := salmon.UnassignedProxies[rType]
+	q[0].(*Proxy).Trust = 3
+	newbie, _ := salmon.addUser(0, nil)
+	proxyStrings(t, salmon, newbie.SecretId)
+	for _, p := range salmon.Assignments.GetProxies(newbie, rType) {
+		if p.(*Proxy).Trust != 0 {
+			t.Errorf("assigned proxy at trust level %d to user at trust level 0", p.(*Proxy).Trust)
+		}
+	}
+}
+
+func TestMultipleResourceTypes(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4, resources.ResourceTypeVanilla}
+	salmon.UnassignedProxies = genResourceMap(20)
+	for _, r := range genResourceMap(20)[resources.ResourceTypeObfs4] {
+		r.(*Proxy).SetType(resources.ResourceTypeVanilla)
+		salmon.UnassignedProxies[resources.ResourceTypeVanilla] = append(salmon.UnassignedProxies[resources.ResourceTypeVanilla], r)
+	}
+	err := salmon.SetParams(internal.SalmonParamsConfig{
+		ResourceParams: map[string]internal.SalmonResourceParams{
+			resources.ResourceTypeVanilla: {ProxiesPerUser: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	token, _ := salmon.CreateInvite(admin.SecretId)
+	secretId, _ := salmon.RedeemInvite(token)
+
+	// Users get proxies of each type independently, and only of the type that
+	// they ask for.
+	getProxies := func(rType string, expected int) []core.Resource {
+		proxies, err := salmon.GetProxies(secretId, rType)
+		if err != nil {
+			t.Fatalf("failed to get %s proxies: %s", rType, err)
+		}
+		if len(proxies) != expected {
+			t.Fatalf("expected %d %s proxies but got %d", expected, rType, len(proxies))
+		}
+		for _, p := range proxies {
+			if p.Type() != rType {
+				t.Errorf("expected %s proxy but got %s", rType, p.Type())
+			}
+		}
+		return proxies
+	}
+	obfs4 := getProxies(resources.ResourceTypeObfs4, DefaultProxiesPerUser)
+	getProxies(resources.ResourceTypeVanilla, 1)
+	again := getProxies(resources.ResourceTypeObfs4, DefaultProxiesPerUser)
+	for i := range obfs4 {
+		found := false
+		for j := range again {
+			found = found || obfs4[i] == again[j]
+		}
+		if !found {
+			t.Errorf("user's obfs4 proxies changed after asking for vanilla proxies")
+		}
+	}
+
+	if _, err := salmon.GetProxies(secretId, resources.ResourceTypeSnowflake); err == nil {
+		t.Errorf("handed out proxies of unsupported type")
+	}
+}
+
+func TestInviteQuota(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	u, _ := salmon.addUser(DefaultMaxTrustLevel, admin)
+
+	for i := 0; i < DefaultInviteQuota; i++ {
+		if _, err := salmon.CreateInvite(u.SecretId); err != nil {
+			t.Fatalf("failed to issue invite %d: %s", i+1, err)
+		}
+	}
+	if _, err := salmon.CreateInvite(u.SecretId); err != ErrInviteQuotaExhausted {
+		t.Errorf("expected exhausted invite quota but got %v", err)
+	}
+	if u.LimitHits != 1 || u.Suspicion() == 0 {
+		t.Errorf("didn't record limit hit")
+	}
+
+	// The quota refills once the user's invites are old enough.
+	for i := range u.InvitedAt {
+		u.InvitedAt[i] = u.InvitedAt[i].Add(-salmon.params.InviteWindow)
+	}
+	if _, err := salmon.CreateInvite(u.SecretId); err != nil {
+		t.Errorf("quota didn't refill: %s", err)
+	}
+
+	// Admin users have no quota.
+	for i := 0; i < DefaultInviteQuota+1; i++ {
+		if _, err := salmon.CreateInvite(admin.SecretId); err != nil {
+			t.Fatalf("admin failed to issue invite %d: %s", i+1, err)
+		}
+	}
+	if admin.LimitHits != 0 {
+		t.Errorf("recorded limit hit for admin")
+	}
+}
+
+func TestInviteDepth(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	if err := salmon.SetParams(internal.SalmonParamsConfig{MaxInviteDepth: 2}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	admin, _ := salmon.addUser(UntouchableTrustLevel, nil)
+	u, _ := salmon.addUser(DefaultMaxTrustLevel, admin)
+	invitee, _ := salmon.addUser(DefaultMaxTrustLevel, u)
+	if depth := invitee.InviteDepth(); depth != 2 {
+		t.Fatalf("expected invite depth 2 but got %d", depth)
+	}
+
+	token, err := salmon.CreateInvite(u.SecretId)
+	if err != nil {
+		t.Fatalf("failed to issue invite within maximum depth: %s", err)
+	}
+	if _, err := salmon.CreateInvite(invitee.SecretId); err != ErrInviteDepthExceeded {
+		t.Errorf("expected exceeded invite depth but got %v", err)
+	}
+
+	// Tokens cannot be redeemed if our maximum depth shrank in the meantime.
+	if err := salmon.SetParams(internal.SalmonParamsConfig{MaxInviteDepth: 1}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	if _, err := salmon.RedeemInvite(token); err != ErrInviteDepthExceeded {
+		t.Errorf("expected exceeded invite depth but got %v", err)
+	}
+	if _, exists := salmon.TokenCache[token]; !exists {
+		t.Fatalf("removed token that we didn't redeem")
+	}
+
+	// The token becomes redeemable again once our maximum depth grows.
+	if err := salmon.SetParams(internal.SalmonParamsConfig{MaxInviteDepth: 2}); err != nil {
+		t.Fatalf("rejected valid parameters: %s", err)
+	}
+	if _, err := salmon.RedeemInvite(token); err != nil {
+		t.Errorf("failed to redeem token within maximum depth: %s", err)
+	}
+	if _, exists := salmon.TokenCache[token]; exists {
+		t.Errorf("kept token after redeeming it")
+	}
+}
@@ -6,16 +6,17 @@ import (
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 )
 
 const (
-	// MaxTrustLevel represents the maximum trust level that a user can get
-	// promoted to.  The paper refers to the maximum trust level as "L" and
-	// argues that six is a good compromise:
-	// <https://censorbib.nymity.ch/pdf/Douglas2016a.pdf#page=4>
-	MaxTrustLevel = Trust(6)
 	// A user can get UntouchableTrustLevel by being invited directly by us.
-	UntouchableTrustLevel = Trust(MaxTrustLevel + 1)
+	// The level is above any maximum trust level that we can be configured
+	// with.
+	UntouchableTrustLevel = Trust(math.MaxInt32)
+	// A user who registered rather than being invited starts at
+	// RegisteredTrustLevel and has to earn promotions like everybody else.
+	RegisteredTrustLevel = Trust(0)
 	// Length of ID in bytes.
 	UserSecretIdLength = 20
 )
@@ -24,17 +25,39 @@ const (
 type User struct {
 	SecretId string
 	Banned   bool
+	// BannedByAdmin is true if an operator banned the user.  Unlike bans
+	// that are caused by the user's suspicion, these bans don't go away when
+	// our suspicion threshold changes.
+	BannedByAdmin bool
 	// The probability of the client *not* being an agent is the product of the
 	// probabilities of innocence of each proxy blocking event that the client
 	// was involved in.  The complement of this probability is the client's
-	// suspicion.  We permanently ban client whose suspicion meets or exceeds
-	// our suspicion threshold.
+	// suspicion.  We ban clients whose suspicion meets or exceeds our
+	// suspicion threshold.
 	InnocencePs []float64
 	Trust       Trust
 	InvitedBy   *User `json:"-"` // We have to omit this field to prevent cycles.
 	Invited     []*User
 	// The last time the user got promoted to a higher trust level.
 	LastPromoted time.Time
+	// Registered is true if the user signed up without an invite.
+	Registered bool
+	// PendingReplacements maps a resource type to the number of the user's
+	// proxies that we took away but haven't replaced yet.
+	PendingReplacements map[string]int
+	// ReplacedAt contains the times at which we replaced the user's proxies.
+	ReplacedAt []time.Time
+	// Location is the country code of the country that the user is in, e.g.
+	// "RU".  Users either tell us their location, or we infer it when they
+	// sign up.  An empty location means that we don't know where the user is.
+	Location string
+	// InvitedAt contains the times at which the user issued invites.
+	InvitedAt []time.Time
+	// LimitHits is the number of times that the user exceeded one of our
+	// limits, e.g. their invite quota, and LastLimitHit is when that last
+	// happened.
+	LimitHits    int
+	LastLimitHit time.Time
 }
 
 // NewUser returns a new user.
@@ -53,18 +76,130 @@ func NewUser() (*User, error) {
 	return u, nil
 }
 
+// InRegisteredTree returns true if the root of the user's invitation tree
+// signed up without an invite.  Such users get proxies only from our pool for
+// registered users.
+func (u *User) InRegisteredTree() bool {
+
+	root := u
+	for root.InvitedBy != nil {
+		root = root.InvitedBy
+	}
+	return root.Registered
+}
+
+// InLocations returns true if the user may be in one of the given locations.
+// We don't know where users without a location are, so they may be in any
+// location.
+func (u *User) InLocations(locations core.LocationSet) bool {
+
+	if u.Location == "" {
+		return len(locations) > 0
+	}
+	return locations.HasCountry(u.Location)
+}
+
+// Suspicion returns the user's suspicion, i.e. the complement of the product
+// of the user's probabilities of innocence.
+func (u *User) Suspicion() float64 {
+
+	score := 1.0
+	for _, p := range u.InnocencePs {
+		score *= p
+	}
+	return 1 - score
+}
+
+// InviteDepth returns the number of invites between the user and the root of
+// the user's invitation tree.
+func (u *User) InviteDepth() int {
+
+	depth := 0
+	for inviter := u.InvitedBy; inviter != nil; inviter = inviter.InvitedBy {
+		depth++
+	}
+	return depth
+}
+
+// addInnocenceP adds the given probability of innocence to the user's record,
+// and bans the user if their suspicion reaches our threshold.
+func (u *User) addInnocenceP(innocenceP float64, params *Params) {
+
+	u.InnocencePs = append(u.InnocencePs, innocenceP)
+	if suspicion := u.Suspicion(); suspicion >= params.MaxSuspicion {
+		log.Printf("Banning user %q with suspicion %.2f", u.SecretId, suspicion)
+		u.Banned = true
+	}
+}
+
+// RecordLimitHit records that the user exceeded one of our limits at the given
+// time.  Users who hit our limits may be running a sybil factory, so a limit
+// hit raises the user's suspicion.  Impatient users shouldn't get banned for
+// retrying, though, so limit hits raise the user's suspicion at most once per
+// invite window.
+func (u *User) RecordLimitHit(now time.Time, params *Params) {
+
+	if u.LimitHits == 0 || now.Sub(u.LastLimitHit) >= params.InviteWindow {
+		u.addInnocenceP(params.LimitHitInnocence, params)
+	}
+	u.LimitHits++
+	u.LastLimitHit = now
+	log.Printf("User %q hit one of our limits (%d hits so far).", u.SecretId, u.LimitHits)
+}
+
+// recentTimes returns the times that are less than the given window before the
+// given time.  The function reuses the given slice.
+func recentTimes(times []time.Time, now time.Time, window time.Duration) []time.Time {
+
+	recent := times[:0]
+	for _, t := range times {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// ReplacementBudget returns the number of proxies that we may replace for the
+// user at the given time.  The function forgets about replacements that are
+// older than the given window.
+func (u *User) ReplacementBudget(now time.Time, params *Params) int {
+
+	u.ReplacedAt = recentTimes(u.ReplacedAt, now, params.ReplacementWindow)
+
+	budget := params.MaxReplacements - len(u.ReplacedAt)
+	if budget < 0 {
+		return 0
+	}
+	return budget
+}
+
+// InviteBudget returns the number of invites that the user may issue at the
+// given time.  The user's quota depends on the user's trust level, and
+// refills as the user's invites become older than our invite window.
+func (u *User) InviteBudget(now time.Time, params *Params) int {
+
+	u.InvitedAt = recentTimes(u.InvitedAt, now, params.InviteWindow)
+
+	budget := params.InviteQuota(u.Trust) - len(u.InvitedAt)
+	if budget < 0 {
+		return 0
+	}
+	return budget
+}
+
 // UpdateTrust promotes the user's trust level if the time has come.
-func (u *User) UpdateTrust() {
+func (u *User) UpdateTrust(params *Params) {
 
-	// Users can not be promoted beyond MaxTrustLevel.
-	if u.Trust >= MaxTrustLevel {
+	// Users can not be promoted beyond the maximum trust level.
+	if u.Trust >= params.MaxTrustLevel {
 		return
 	}
 
-	// A promotion from level n to n+1 takes 2^{n+1} days.
-	daysPassed := int64(time.Now().UTC().Sub(u.LastPromoted).Hours() / 24)
-	daysRequired := int64(math.Exp2(math.Abs(float64(u.Trust + 1))))
-	if daysPassed >= daysRequired {
+	now := time.Now().UTC()
+	daysPassed := int64(now.Sub(u.LastPromoted).Hours() / 24)
+	if daysPassed >= int64(params.PromotionDays(u.Trust)) {
 		u.Trust++
+		u.LastPromoted = now
 	}
 }
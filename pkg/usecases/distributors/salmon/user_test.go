@@ -10,50 +10,92 @@ func TestUpdateUserTrust(t *testing.T) {
 	u.Trust = -2
 
 	u.LastPromoted = time.Now().UTC()
-	u.UpdateTrust()
+	u.UpdateTrust(DefaultParams())
 	if u.Trust != -2 {
 		t.Errorf("incorrect user trust level")
 	}
 
 	// Ten seconds before midnight means no promotion.
 	u.LastPromoted = time.Now().UTC().Add(-time.Hour*24*2 + time.Second*10)
-	u.UpdateTrust()
+	u.UpdateTrust(DefaultParams())
 	if u.Trust != -2 {
 		t.Errorf("incorrect user trust level: %d", u.Trust)
 	}
 
 	// After 2^abs(-2 + 1) days, the user should be promoted to trust level -1.
 	u.LastPromoted = time.Now().UTC().Add(-time.Hour*24*2 - time.Second*10)
-	u.UpdateTrust()
+	u.UpdateTrust(DefaultParams())
 	if u.Trust != -1 {
 		t.Errorf("incorrect user trust level")
 	}
 
 	// After 2^abs(-1 + 1) days, the user should be promoted to trust level 0.
 	u.LastPromoted = time.Now().UTC().Add(-time.Hour*24 - time.Second*10)
-	u.UpdateTrust()
+	u.UpdateTrust(DefaultParams())
 	if u.Trust != 0 {
 		t.Errorf("incorrect user trust level")
 	}
 
 	// After 2^abs(0 + 1) days, the user should be promoted to trust level 1.
 	u.LastPromoted = time.Now().UTC().Add(-time.Hour*24*2 - time.Second*10)
-	u.UpdateTrust()
+	u.UpdateTrust(DefaultParams())
 	if u.Trust != 1 {
 		t.Errorf("incorrect user trust level")
 	}
 
 	// Ten seconds before midnight means no promotion.
 	u.LastPromoted = time.Now().UTC().Add(-time.Hour*24*4 + time.Second*10)
-	u.UpdateTrust()
+	u.UpdateTrust(DefaultParams())
 	if u.Trust != 1 {
 		t.Errorf("incorrect user trust level")
 	}
 
 	// After 2^abs(1 + 1) days, the user should be promoted to trust level 2.
 	u.LastPromoted = time.Now().UTC().Add(-time.Hour*24*4 - time.Second*10)
-	u.UpdateTrust()
+	u.UpdateTrust(DefaultParams())
 	if u.Trust != 2 {
 		t.Errorf("incorrect user trust level")
 	}
 }
+
+func TestRecordLimitHit(t *testing.T) {
+
+	params := DefaultParams()
+	u := &User{}
+	now := time.Now().UTC()
+
+	// Retrying right away doesn't raise the user's suspicion any further.
+	u.RecordLimitHit(now, params)
+	u.RecordLimitHit(now.Add(time.Minute), params)
+	if u.LimitHits != 2 || len(u.InnocencePs) != 1 {
+		t.Errorf("expected 2 limit hits and 1 innocence probability but got %d and %d",
+			u.LimitHits, len(u.InnocencePs))
+	}
+
+	// Users who keep hitting our limits eventually get banned.
+	for i := 1; i <= 3; i++ {
+		u.RecordLimitHit(now.Add(time.Minute+time.Duration(i)*params.InviteWindow), params)
+	}
+	if len(u.InnocencePs) != 4 || !u.Banned {
+		t.Errorf("expected user with suspicion %.2f to be banned", u.Suspicion())
+	}
+}
+
+func TestInviteBudget(t *testing.T) {
+
+	params := DefaultParams()
+	u := &User{Trust: DefaultMaxTrustLevel}
+	now := time.Now().UTC()
+
+	if budget := u.InviteBudget(now, params); budget != DefaultInviteQuota {
+		t.Errorf("expected invite budget of %d but got %d", DefaultInviteQuota, budget)
+	}
+	u.InvitedAt = []time.Time{now.Add(-params.InviteWindow), now.Add(-time.Hour)}
+	if budget := u.InviteBudget(now, params); budget != DefaultInviteQuota-1 {
+		t.Errorf("expected invite budget of %d but got %d", DefaultInviteQuota-1, budget)
+	}
+	u.Trust = DefaultMaxTrustLevel - 1
+	if budget := u.InviteBudget(now, params); budget != 0 {
+		t.Errorf("expected no invite budget below maximum trust level but got %d", budget)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
 )
 
 const (
@@ -78,7 +77,11 @@ func (d *StubDistributor) Init(cfg *internal.Config) {
 	// and others may change their state).  We will receive resources at the
 	// rStream channel.
 	log.Printf("Initialising resource stream.")
-	d.ipc = mechanisms.NewHttpsIpc("http://" + cfg.Backend.WebApi.ApiAddress + cfg.Backend.ResourceStreamEndpoint)
+	ipc, err := internal.NewBackendIpc(cfg, cfg.Distributors.Stub.Ipc, cfg.Distributors.Stub.Tls)
+	if err != nil {
+		log.Fatalf("Failed to create IPC mechanism: %s", err)
+	}
+	d.ipc = ipc
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
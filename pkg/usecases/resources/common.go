@@ -2,6 +2,7 @@ package resources
 
 import (
 	"encoding/json"
+	"log"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 )
@@ -35,37 +36,48 @@ var ResourceMap = map[string]func() interface{}{
 }
 
 type TmpResourceDiff struct {
-	New     map[string][]json.RawMessage
-	Changed map[string][]json.RawMessage
-	Gone    map[string][]json.RawMessage
+	New        map[string][]json.RawMessage
+	Changed    map[string][]json.RawMessage
+	Gone       map[string][]json.RawMessage
+	Sequence   uint64 `json:"sequence"`
+	FullUpdate bool   `json:"full_update"`
 }
 
 // UnmarshalTmpResourceDiff unmarshals the raw JSON messages in the given
-// temporary hashring into the respective data structures.
+// temporary hashring into the respective data structures.  New, changed, and
+// gone resources end up in the corresponding fields of the returned
+// ResourceDiff.  Resources whose type we don't know are skipped.
 func UnmarshalTmpResourceDiff(tmp *TmpResourceDiff) (*core.ResourceDiff, error) {
 
 	ret := core.NewResourceDiff()
+	ret.Sequence = tmp.Sequence
+	ret.FullUpdate = tmp.FullUpdate
 
-	process := func(data map[string][]json.RawMessage) error {
+	process := func(data map[string][]json.RawMessage, dst core.ResourceMap) error {
 		for k, vs := range data {
+			rFunc, exists := ResourceMap[k]
+			if !exists {
+				log.Printf("Skipping %d resource(s) of unknown type %q.", len(vs), k)
+				continue
+			}
 			for _, v := range vs {
-				rStruct := ResourceMap[k]()
+				rStruct := rFunc()
 				if err := json.Unmarshal(v, rStruct); err != nil {
 					return err
 				}
-				ret.New[k] = append(ret.New[k], rStruct.(core.Resource))
+				dst[k] = append(dst[k], rStruct.(core.Resource))
 			}
 		}
 		return nil
 	}
 
-	if err := process(tmp.New); err != nil {
+	if err := process(tmp.New, ret.New); err != nil {
 		return nil, err
 	}
-	if err := process(tmp.Changed); err != nil {
+	if err := process(tmp.Changed, ret.Changed); err != nil {
 		return nil, err
 	}
-	if err := process(tmp.Gone); err != nil {
+	if err := process(tmp.Gone, ret.Gone); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,56 @@
+package resources
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUnmarshalTmpResourceDiff(t *testing.T) {
+
+	rawDiff := []byte(`{
+		"new": {"obfs4": [{"type": "obfs4", "address": "1.1.1.1", "port": 1111}]},
+		"changed": {"obfs4": [{"type": "obfs4", "address": "2.2.2.2", "port": 2222}]},
+		"gone": {
+			"obfs4": [{"type": "obfs4", "address": "3.3.3.3", "port": 3333}],
+			"foo": [{"type": "foo"}]
+		}
+	}`)
+	tmp := TmpResourceDiff{}
+	if err := json.Unmarshal(rawDiff, &tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := UnmarshalTmpResourceDiff(&tmp)
+	if err != nil {
+		t.Fatalf("failed to unmarshal resource diff: %s", err)
+	}
+
+	if len(diff.New[ResourceTypeObfs4]) != 1 {
+		t.Fatalf("expected 1 new resource but got %d", len(diff.New[ResourceTypeObfs4]))
+	}
+	if len(diff.Changed[ResourceTypeObfs4]) != 1 {
+		t.Fatalf("expected 1 changed resource but got %d", len(diff.Changed[ResourceTypeObfs4]))
+	}
+	if len(diff.Gone[ResourceTypeObfs4]) != 1 {
+		t.Fatalf("expected 1 gone resource but got %d", len(diff.Gone[ResourceTypeObfs4]))
+	}
+
+	if addr := diff.Changed[ResourceTypeObfs4][0].(*Transport).Address.String(); addr != "2.2.2.2" {
+		t.Errorf("expected changed resource 2.2.2.2 but got %s", addr)
+	}
+	if addr := diff.Gone[ResourceTypeObfs4][0].(*Transport).Address.String(); addr != "3.3.3.3" {
+		t.Errorf("expected gone resource 3.3.3.3 but got %s", addr)
+	}
+
+	// Resources of an unknown type must be skipped rather than cause a panic.
+	if _, exists := diff.Gone["foo"]; exists {
+		t.Errorf("resource of unknown type made it into the diff")
+	}
+
+	tmp = TmpResourceDiff{Gone: map[string][]json.RawMessage{
+		ResourceTypeObfs4: []json.RawMessage{[]byte("not json")},
+	}}
+	if _, err := UnmarshalTmpResourceDiff(&tmp); err == nil {
+		t.Errorf("malformed resource was accepted")
+	}
+}
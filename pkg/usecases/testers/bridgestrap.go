@@ -0,0 +1,145 @@
+package testers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+const (
+	TesterBridgestrap = "bridgestrap"
+	// DefaultBridgestrapTimeout determines how long we wait for bridgestrap
+	// to test a batch of resources.
+	DefaultBridgestrapTimeout = 5 * time.Minute
+)
+
+// BridgestrapRequest represents a request for bridgestrap.  Here's what its
+// API look like: https://gitlab.torproject.org/phw/bridgestrap#input
+type BridgestrapRequest struct {
+	BridgeLines []string `json:"bridge_lines"`
+}
+
+// BridgeTest represents the status of a single bridge in bridgestrap's
+// response.
+type BridgeTest struct {
+	Functional bool      `json:"functional"`
+	LastTested time.Time `json:"last_tested"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// BridgestrapResponse represents bridgestrap's response.
+type BridgestrapResponse struct {
+	Bridges map[string]*BridgeTest `json:"bridge_results"`
+	Time    float64                `json:"time"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// BridgestrapConfig configures a BridgestrapTester.
+type BridgestrapConfig struct {
+	// Endpoint is the URL of bridgestrap's API, e.g.
+	// "http://127.0.0.1:5001/bridge-state".
+	Endpoint string `json:"endpoint"`
+	// Timeout is the time after which we give up on bridgestrap's response,
+	// e.g. "2m".  If empty, it defaults to DefaultBridgestrapTimeout.
+	Timeout string `json:"timeout"`
+}
+
+// BridgestrapTester tests resources by asking a bridgestrap instance about
+// them: https://gitlab.torproject.org/tpo/anti-censorship/bridgestrap
+type BridgestrapTester struct {
+	ipc     *mechanisms.HttpsIpcContext
+	timeout time.Duration
+}
+
+// NewBridgestrapTester returns a new tester that talks to the bridgestrap API
+// at the given endpoint, and gives up on requests that take longer than the
+// given timeout.
+func NewBridgestrapTester(endpoint string, timeout time.Duration) *BridgestrapTester {
+	return &BridgestrapTester{ipc: mechanisms.NewHttpsIpc(endpoint), timeout: timeout}
+}
+
+func newBridgestrapTester(params json.RawMessage) (core.Tester, error) {
+
+	cfg := BridgestrapConfig{}
+	if err := unmarshalParams(params, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Endpoint == "" {
+		return nil, errors.New("bridgestrap tester requires an endpoint")
+	}
+	timeout, err := parseTimeout(cfg.Timeout, DefaultBridgestrapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewBridgestrapTester(cfg.Endpoint, timeout), nil
+}
+
+// Test sends the bridge lines of the given resources to bridgestrap and
+// records bridgestrap's verdict for each resource.  If bridgestrap doesn't
+// respond within our timeout, the test fails, so a hanging bridgestrap
+// instance cannot stall our testing pipeline.
+func (t *BridgestrapTester) Test(rs []core.Resource) error {
+
+	req := BridgestrapRequest{}
+	resp := BridgestrapResponse{}
+	rMap := make(map[string]core.Resource)
+	for _, r := range rs {
+		rMap[r.String()] = r
+		req.BridgeLines = append(req.BridgeLines, r.String())
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	if err := t.ipc.MakeJsonRequestContext(c, req, &resp); err != nil {
+		return fmt.Errorf("bridgestrap request failed: %s", err)
+	}
+	return applyBridgeTests(&resp, rMap)
+}
+
+// applyBridgeTests records the test results in the given bridgestrap response
+// in the given resources, which are keyed by their bridge lines.  If the
+// response lacks some of the resources, we return a *core.PartialTestError.
+func applyBridgeTests(resp *BridgestrapResponse, rMap map[string]core.Resource) error {
+
+	if resp.Error != "" {
+		return fmt.Errorf("bridgestrap test failed: %s", resp.Error)
+	}
+
+	for bridgeLine, bridgeTest := range resp.Bridges {
+		r, exists := rMap[bridgeLine]
+		if !exists {
+			log.Printf("Bug: %q not in our resource test pool.", bridgeLine)
+			continue
+		}
+		if bridgeTest == nil {
+			continue
+		}
+
+		state := core.StateDysfunctional
+		if bridgeTest.Functional {
+			state = core.StateFunctional
+		}
+		r.Test().Record(state, bridgeTest.LastTested, bridgeTest.Error)
+	}
+
+	untested := []core.Resource{}
+	for bridgeLine, r := range rMap {
+		if resp.Bridges[bridgeLine] == nil {
+			untested = append(untested, r)
+		}
+	}
+	if len(untested) > 0 {
+		return &core.PartialTestError{Untested: untested}
+	}
+	return nil
+}
+
+func init() {
+	core.RegisterTester(TesterBridgestrap, newBridgestrapTester)
+}
@@ -0,0 +1,106 @@
+package testers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestBridgestrapTester(t *testing.T) {
+
+	up, down := newTestTransport(t, "1.1.1.1:1111"), newTestTransport(t, "2.2.2.2:2222")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := BridgestrapRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := BridgestrapResponse{Bridges: make(map[string]*BridgeTest)}
+		for _, bridgeLine := range req.BridgeLines {
+			resp.Bridges[bridgeLine] = &BridgeTest{Functional: bridgeLine == up.String()}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	tester := NewBridgestrapTester(srv.URL, DefaultBridgestrapTimeout)
+	if err := tester.Test([]core.Resource{up, down}); err != nil {
+		t.Fatalf("bridgestrap test failed: %s", err)
+	}
+	if up.Test().State != core.StateFunctional {
+		t.Errorf("expected functional resource but got state %d", up.Test().State)
+	}
+	if down.Test().State != core.StateDysfunctional {
+		t.Errorf("expected dysfunctional resource but got state %d", down.Test().State)
+	}
+	if len(up.Test().History) != 1 || up.Test().Score() != 1 {
+		t.Errorf("expected test to be recorded in resource's history")
+	}
+
+	srv.Close()
+	r := newTestTransport(t, "3.3.3.3:3333")
+	if err := tester.Test([]core.Resource{r}); err == nil {
+		t.Errorf("expected error when bridgestrap is unreachable")
+	}
+	if r.Test().State != core.StateUntested {
+		t.Errorf("failed test changed resource state to %d", r.Test().State)
+	}
+}
+
+func TestBridgestrapTimeout(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices that the client went away once it has
+		// consumed the request body.
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	r := newTestTransport(t, "1.1.1.1:1111")
+	tester := NewBridgestrapTester(srv.URL, 50*time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- tester.Test([]core.Resource{r})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected error when bridgestrap hangs")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("test didn't time out while bridgestrap hangs")
+	}
+	if r.Test().State != core.StateUntested {
+		t.Errorf("timed out test changed resource state to %d", r.Test().State)
+	}
+}
+
+func TestApplyBridgeTestsPartial(t *testing.T) {
+
+	up, missing := newTestTransport(t, "1.1.1.1:1111"), newTestTransport(t, "2.2.2.2:2222")
+	rMap := map[string]core.Resource{up.String(): up, missing.String(): missing}
+	resp := &BridgestrapResponse{Bridges: map[string]*BridgeTest{
+		up.String(): &BridgeTest{Functional: true},
+	}}
+
+	err := applyBridgeTests(resp, rMap)
+	partial, ok := err.(*core.PartialTestError)
+	if !ok {
+		t.Fatalf("expected partial test error but got %v", err)
+	}
+	if len(partial.Untested) != 1 || partial.Untested[0] != missing {
+		t.Errorf("expected %q to be untested but got %v", missing, partial.Untested)
+	}
+	if up.Test().State != core.StateFunctional {
+		t.Errorf("expected functional resource but got state %d", up.Test().State)
+	}
+	if missing.Test().State != core.StateUntested {
+		t.Errorf("missing resource changed state to %d", missing.Test().State)
+	}
+}
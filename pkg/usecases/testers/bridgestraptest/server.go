@@ -0,0 +1,180 @@
+// Package bridgestraptest implements a fake bridgestrap instance, which allows
+// tests to exercise rdsys's resource testing without a live bridgestrap.  The
+// fake's verdicts, latency, and errors are programmable.
+package bridgestraptest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/testers"
+)
+
+// EndpointPath is the path of bridgestrap's test API.
+const EndpointPath = "/bridge-state"
+
+// Server is a fake bridgestrap instance.  By default, it considers all bridge
+// lines functional and responds immediately.
+type Server struct {
+	*httptest.Server
+	lock       sync.Mutex
+	verdicts   map[string]*testers.BridgeTest
+	fallback   *testers.BridgeTest
+	latency    time.Duration
+	apiError   string
+	statusCode int
+	requests   [][]string
+}
+
+// NewServer starts and returns a new fake bridgestrap instance.  The caller
+// should call Close when done.
+func NewServer() *Server {
+
+	s := &Server{
+		verdicts:   make(map[string]*testers.BridgeTest),
+		fallback:   &testers.BridgeTest{Functional: true},
+		statusCode: http.StatusOK,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(EndpointPath, s.handleTest)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Endpoint returns the URL of the fake's test API, which is what
+// testers.NewBridgestrapTester expects.
+func (s *Server) Endpoint() string {
+	return s.URL + EndpointPath
+}
+
+// SetVerdict determines the fake's verdict for the given bridge line.  A
+// non-empty error string is passed on to rdsys.
+func (s *Server) SetVerdict(bridgeLine string, functional bool, errStr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.verdicts[bridgeLine] = &testers.BridgeTest{Functional: functional, Error: errStr}
+}
+
+// SetDefaultVerdict determines the fake's verdict for bridge lines that have no
+// verdict of their own.
+func (s *Server) SetDefaultVerdict(functional bool, errStr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fallback = &testers.BridgeTest{Functional: functional, Error: errStr}
+}
+
+// OmitUnknown makes the fake leave bridge lines that have no verdict of their
+// own out of its responses, as if it failed to test them.
+func (s *Server) OmitUnknown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fallback = nil
+}
+
+// SetLatency makes the fake wait for the given duration before responding.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latency = latency
+}
+
+// SetError makes the fake respond with the given error message instead of
+// test results, like bridgestrap does if it cannot test bridges.  An empty
+// message restores normal operation.
+func (s *Server) SetError(errStr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.apiError = errStr
+}
+
+// SetStatusCode makes the fake respond with the given HTTP status code.  Any
+// code other than 200 comes without a response body.
+func (s *Server) SetStatusCode(code int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statusCode = code
+}
+
+// Requests returns the bridge lines of all test requests that the fake
+// received so far, in order.
+func (s *Server) Requests() [][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requests := make([][]string, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+// NumTested returns the number of times that the given bridge line was sent to
+// the fake.
+func (s *Server) NumTested(bridgeLine string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	num := 0
+	for _, bridgeLines := range s.requests {
+		for _, l := range bridgeLines {
+			if l == bridgeLine {
+				num++
+			}
+		}
+	}
+	return num
+}
+
+func (s *Server) handleTest(w http.ResponseWriter, r *http.Request) {
+
+	req := testers.BridgestrapRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	s.requests = append(s.requests, req.BridgeLines)
+	latency, statusCode := s.latency, s.statusCode
+	resp := testers.BridgestrapResponse{Error: s.apiError}
+	if resp.Error == "" {
+		resp.Bridges = make(map[string]*testers.BridgeTest)
+		for _, bridgeLine := range req.BridgeLines {
+			if verdict := s.verdictFor(bridgeLine); verdict != nil {
+				resp.Bridges[bridgeLine] = verdict
+			}
+		}
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-time.After(latency):
+	case <-r.Context().Done():
+		return
+	}
+	resp.Time = latency.Seconds()
+
+	if statusCode != http.StatusOK {
+		w.WriteHeader(statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// verdictFor returns a copy of the verdict for the given bridge line, or nil if
+// the bridge line should be omitted.  The caller must hold our lock.
+func (s *Server) verdictFor(bridgeLine string) *testers.BridgeTest {
+
+	verdict, exists := s.verdicts[bridgeLine]
+	if !exists {
+		verdict = s.fallback
+	}
+	if verdict == nil {
+		return nil
+	}
+	v := *verdict
+	v.LastTested = time.Now().UTC()
+	return &v
+}
@@ -0,0 +1,95 @@
+package bridgestraptest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/testers"
+)
+
+func newTestTransport(num int) *resources.Transport {
+
+	tr := resources.NewTransport()
+	tr.SetType(resources.ResourceTypeObfs4)
+	tr.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP(fmt.Sprintf("1.1.1.%d", num))}}
+	tr.Port = uint16(1000 + num)
+	tr.Fingerprint = fmt.Sprintf("%040X", num)
+	return tr
+}
+
+func TestServerVerdicts(t *testing.T) {
+
+	s := NewServer()
+	defer s.Close()
+	tester := testers.NewBridgestrapTester(s.Endpoint(), testers.DefaultBridgestrapTimeout)
+
+	up, down, unknown := newTestTransport(1), newTestTransport(2), newTestTransport(3)
+	s.SetVerdict(down.String(), false, "timeout")
+	if err := tester.Test([]core.Resource{up, down, unknown}); err != nil {
+		t.Fatalf("test failed: %s", err)
+	}
+	if up.Test().State != core.StateFunctional || unknown.Test().State != core.StateFunctional {
+		t.Errorf("expected resources without verdict to be functional")
+	}
+	if down.Test().State != core.StateDysfunctional || down.Test().Error != "timeout" {
+		t.Errorf("expected dysfunctional resource but got %+v", down.Test())
+	}
+
+	s.SetDefaultVerdict(false, "")
+	unknown.Test().State = core.StateUntested
+	tester.Test([]core.Resource{unknown})
+	if unknown.Test().State != core.StateDysfunctional {
+		t.Errorf("expected default verdict to be dysfunctional")
+	}
+
+	s.SetVerdict(up.String(), true, "")
+	s.OmitUnknown()
+	err := tester.Test([]core.Resource{up, newTestTransport(4)})
+	if partial, ok := err.(*core.PartialTestError); !ok || len(partial.Untested) != 1 {
+		t.Errorf("expected one untested resource but got %v", err)
+	}
+
+	if n := len(s.Requests()); n != 3 {
+		t.Errorf("expected 3 requests but got %d", n)
+	}
+	if n := s.NumTested(up.String()); n != 2 {
+		t.Errorf("expected %q to be tested twice but got %d", up, n)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+
+	s := NewServer()
+	defer s.Close()
+	tester := testers.NewBridgestrapTester(s.Endpoint(), testers.DefaultBridgestrapTimeout)
+	r := newTestTransport(1)
+
+	s.SetError("tor crashed")
+	if err := tester.Test([]core.Resource{r}); err == nil {
+		t.Errorf("expected bridgestrap error")
+	}
+	s.SetError("")
+	s.SetStatusCode(http.StatusInternalServerError)
+	if err := tester.Test([]core.Resource{r}); err == nil {
+		t.Errorf("expected HTTP error")
+	}
+	if r.Test().State != core.StateUntested {
+		t.Errorf("failed tests changed resource state to %d", r.Test().State)
+	}
+	s.SetStatusCode(http.StatusOK)
+
+	latency := 50 * time.Millisecond
+	s.SetLatency(latency)
+	start := time.Now()
+	if err := tester.Test([]core.Resource{r}); err != nil {
+		t.Fatalf("test failed: %s", err)
+	}
+	if time.Since(start) < latency {
+		t.Errorf("fake responded faster than its latency")
+	}
+}
@@ -0,0 +1,97 @@
+package testers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	TesterScript = "script"
+	// DefaultScriptTimeout determines how long the script tester lets its
+	// command run before killing it.
+	DefaultScriptTimeout = 5 * time.Minute
+)
+
+// ScriptConfig configures a ScriptTester.
+type ScriptConfig struct {
+	// Command is the path of the executable to run.
+	Command string `json:"command"`
+	// Args contains the executable's command line arguments.
+	Args []string `json:"args"`
+	// Timeout is the time after which we kill the command, e.g. "1m".  If
+	// empty, it defaults to DefaultScriptTimeout.
+	Timeout string `json:"timeout"`
+}
+
+// ScriptTester tests resources by running a local command.  The command
+// receives the resources' bridge lines on its standard input, one per line,
+// and must write a JSON object to its standard output that looks like
+// bridgestrap's response.  This lets operators plug in whatever testing
+// infrastructure they have.
+type ScriptTester struct {
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+// NewScriptTester returns a new tester that runs the given command with the
+// given arguments, and kills the command after the given timeout.
+func NewScriptTester(command string, args []string, timeout time.Duration) *ScriptTester {
+	return &ScriptTester{command: command, args: args, timeout: timeout}
+}
+
+func newScriptTester(params json.RawMessage) (core.Tester, error) {
+
+	cfg := ScriptConfig{}
+	if err := unmarshalParams(params, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Command == "" {
+		return nil, errors.New("script tester requires a command")
+	}
+	timeout, err := parseTimeout(cfg.Timeout, DefaultScriptTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewScriptTester(cfg.Command, cfg.Args, timeout), nil
+}
+
+// Test runs our command over the given resources and records the command's
+// verdict for each resource.
+func (t *ScriptTester) Test(rs []core.Resource) error {
+
+	var stdin, stdout, stderr bytes.Buffer
+	rMap := make(map[string]core.Resource)
+	for _, r := range rs {
+		rMap[r.String()] = r
+		stdin.WriteString(r.String() + "\n")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.command, t.args...)
+	cmd.Stdin = &stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("test command %q failed: %s (%s)", t.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	resp := BridgestrapResponse{}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return fmt.Errorf("failed to parse output of test command %q: %s", t.command, err)
+	}
+	return applyBridgeTests(&resp, rMap)
+}
+
+func init() {
+	core.RegisterTester(TesterScript, newScriptTester)
+}
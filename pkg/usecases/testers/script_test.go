@@ -0,0 +1,64 @@
+package testers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// testScript considers all bridge lines that contain "1.1.1.1" functional.
+const testScript = `#!/bin/sh
+printf '{"bridge_results": {'
+sep=""
+while read -r line; do
+	functional=false
+	case "$line" in *1.1.1.1*) functional=true ;; esac
+	printf '%s"%s": {"functional": %s}' "$sep" "$line" "$functional"
+	sep=", "
+done
+printf '}}'
+`
+
+func TestScriptTester(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rdsys-testers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "test.sh")
+	if err := ioutil.WriteFile(script, []byte(testScript), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	up, down := newTestTransport(t, "1.1.1.1:1111"), newTestTransport(t, "2.2.2.2:2222")
+	if err := NewScriptTester(script, nil, time.Minute).Test([]core.Resource{up, down}); err != nil {
+		t.Fatalf("script test failed: %s", err)
+	}
+	if up.Test().State != core.StateFunctional {
+		t.Errorf("expected functional resource but got state %d", up.Test().State)
+	}
+	if down.Test().State != core.StateDysfunctional {
+		t.Errorf("expected dysfunctional resource but got state %d", down.Test().State)
+	}
+
+	r := newTestTransport(t, "1.1.1.1:3333")
+	tests := map[string]*ScriptTester{
+		"failing command":     NewScriptTester("/bin/sh", []string{"-c", "exit 1"}, time.Minute),
+		"invalid output":      NewScriptTester("/bin/echo", []string{"foo"}, time.Minute),
+		"command that hangs":  NewScriptTester("/bin/sleep", []string{"10"}, 10*time.Millisecond),
+		"nonexistent command": NewScriptTester(filepath.Join(dir, "nonexistent"), nil, time.Minute),
+	}
+	for desc, tester := range tests {
+		if err := tester.Test([]core.Resource{r}); err == nil {
+			t.Errorf("expected error for %s", desc)
+		}
+	}
+	if r.Test().State != core.StateUntested {
+		t.Errorf("failed test changed resource state to %d", r.Test().State)
+	}
+}
@@ -0,0 +1,112 @@
+package testers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	TesterTCP = "tcp"
+	// DefaultTCPTimeout determines how long the TCP tester waits for a
+	// connection to succeed.
+	DefaultTCPTimeout = 10 * time.Second
+)
+
+// TCPConfig configures a TCPTester.
+type TCPConfig struct {
+	// Timeout is the time after which a connection attempt fails, e.g.
+	// "5s".  If empty, it defaults to DefaultTCPTimeout.
+	Timeout string `json:"timeout"`
+}
+
+// TCPTester tests resources by trying to establish a TCP connection to them.
+// This is a weaker test than bridgestrap's because it doesn't tell us if Tor
+// can bootstrap over a resource, but it works for transports that
+// bridgestrap cannot test.
+type TCPTester struct {
+	timeout time.Duration
+}
+
+// NewTCPTester returns a new tester whose connection attempts time out after
+// the given duration.
+func NewTCPTester(timeout time.Duration) *TCPTester {
+	return &TCPTester{timeout: timeout}
+}
+
+func newTCPTester(params json.RawMessage) (core.Tester, error) {
+
+	cfg := TCPConfig{}
+	if err := unmarshalParams(params, &cfg); err != nil {
+		return nil, err
+	}
+	timeout, err := parseTimeout(cfg.Timeout, DefaultTCPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPTester(timeout), nil
+}
+
+// Test tries to connect to all of the given resources in parallel.  We cannot
+// test resources that don't have an address, so we record them as untested,
+// and return them as untestable in a *core.PartialTestError.
+func (t *TCPTester) Test(rs []core.Resource) error {
+
+	var wg sync.WaitGroup
+	untestable := []core.Resource{}
+	for _, r := range rs {
+		addr, err := resourceAddr(r)
+		if err != nil {
+			r.Test().Record(core.StateUntested, time.Now().UTC(), err.Error())
+			untestable = append(untestable, r)
+			continue
+		}
+		wg.Add(1)
+		go func(r core.Resource, addr string) {
+			defer wg.Done()
+			now := time.Now().UTC()
+			conn, err := net.DialTimeout("tcp", addr, t.timeout)
+			if err != nil {
+				r.Test().Record(core.StateDysfunctional, now, err.Error())
+				return
+			}
+			conn.Close()
+			r.Test().Record(core.StateFunctional, now, "")
+		}(r, addr)
+	}
+	wg.Wait()
+
+	if len(untestable) > 0 {
+		return &core.PartialTestError{Untestable: untestable}
+	}
+	return nil
+}
+
+// resourceAddr returns the "host:port" address of the given resource, or an
+// error if the resource has no address.
+func resourceAddr(r core.Resource) (string, error) {
+
+	var base *resources.BridgeBase
+	switch v := r.(type) {
+	case *resources.Bridge:
+		base = &v.BridgeBase
+	case *resources.Transport:
+		base = &v.BridgeBase
+	default:
+		return "", fmt.Errorf("resource type %q has no address", r.Type())
+	}
+	if base.Address.IP == nil || base.Port == 0 {
+		return "", fmt.Errorf("resource %q has no address", r.String())
+	}
+	return net.JoinHostPort(base.Address.IP.String(), strconv.Itoa(int(base.Port))), nil
+}
+
+func init() {
+	core.RegisterTester(TesterTCP, newTCPTester)
+}
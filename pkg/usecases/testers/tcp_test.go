@@ -0,0 +1,64 @@
+package testers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestTCPTester(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := newTestTransport(t, l.Addr().String())
+	// Nobody listens on the closed listener's port.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := newTestTransport(t, closed.Addr().String())
+	closed.Close()
+	defer l.Close()
+
+	if err := NewTCPTester(time.Second).Test([]core.Resource{up, down}); err != nil {
+		t.Fatalf("TCP test failed: %s", err)
+	}
+	if up.Test().State != core.StateFunctional {
+		t.Errorf("expected functional resource but got state %d (%s)", up.Test().State, up.Test().Error)
+	}
+	if down.Test().State != core.StateDysfunctional || down.Test().Error == "" {
+		t.Errorf("expected dysfunctional resource but got state %d", down.Test().State)
+	}
+}
+
+func TestTCPTesterWithoutAddress(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	up := newTestTransport(t, l.Addr().String())
+	dummy := core.NewDummy(1, 1)
+
+	// Resources without an address must be reported as untestable, so our
+	// test pool doesn't try again.
+	err = NewTCPTester(time.Second).Test([]core.Resource{up, dummy})
+	partial, ok := err.(*core.PartialTestError)
+	if !ok {
+		t.Fatalf("expected partial test error but got %v", err)
+	}
+	if len(partial.Untested) != 0 || len(partial.Untestable) != 1 || partial.Untestable[0] != dummy {
+		t.Errorf("expected resource without address to be untestable but got %v", partial)
+	}
+	if dummy.Test().State != core.StateUntested || dummy.Test().Error == "" {
+		t.Errorf("resource without address wasn't recorded as untested")
+	}
+	if up.Test().State != core.StateFunctional {
+		t.Errorf("expected functional resource but got state %d", up.Test().State)
+	}
+}
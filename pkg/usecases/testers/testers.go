@@ -0,0 +1,40 @@
+// Package testers implements the resource testers that rdsys's backend can
+// use to find out if resources work.  Each tester registers itself with
+// core.RegisterTester, so the backend can look it up by name.
+package testers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// unmarshalParams unmarshals the given tester parameters into the given
+// configuration struct.  Missing parameters leave the struct untouched.
+func unmarshalParams(params json.RawMessage, cfg interface{}) error {
+
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, cfg); err != nil {
+		return fmt.Errorf("invalid tester parameters: %s", err)
+	}
+	return nil
+}
+
+// parseTimeout parses the given duration, e.g. "5s", and returns the given
+// default if the duration is empty.
+func parseTimeout(timeout string, def time.Duration) (time.Duration, error) {
+
+	if timeout == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %s", timeout, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout %q must be positive", timeout)
+	}
+	return d, nil
+}
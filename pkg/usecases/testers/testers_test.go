@@ -0,0 +1,55 @@
+package testers
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// newTestTransport returns an obfs4 transport that listens on the given
+// address.
+func newTestTransport(t *testing.T, addr string) *resources.Transport {
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := resources.NewTransport()
+	tr.SetType(resources.ResourceTypeObfs4)
+	tr.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP(host)}}
+	tr.Port = uint16(p)
+	tr.Fingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+	return tr
+}
+
+func TestRegisteredTesters(t *testing.T) {
+
+	valid := map[string]string{
+		TesterBridgestrap: `{"endpoint": "http://127.0.0.1:5001/bridge-state"}`,
+		TesterTCP:         ``,
+		TesterScript:      `{"command": "/bin/true", "timeout": "1s"}`,
+	}
+	for name, params := range valid {
+		if _, err := core.NewTester(name, json.RawMessage(params)); err != nil {
+			t.Errorf("failed to create %q tester: %s", name, err)
+		}
+	}
+
+	invalid := map[string]string{
+		TesterBridgestrap: `{}`,
+		TesterTCP:         `{"timeout": "-1s"}`,
+		TesterScript:      `{"timeout": "1s"}`,
+	}
+	for name, params := range invalid {
+		if _, err := core.NewTester(name, json.RawMessage(params)); err == nil {
+			t.Errorf("created %q tester with invalid parameters %s", name, params)
+		}
+	}
+}